@@ -1,76 +1,441 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
 
 	"github.com/paul/glienicke/internal/store/sqlite"
+	"github.com/paul/glienicke/pkg/config"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/nips/nip13"
 	"github.com/paul/glienicke/pkg/relay"
+	"github.com/paul/glienicke/pkg/writepolicy"
 )
 
+const usage = `Usage:
+  relay [flags]                 run the relay
+  relay config check [flags]    validate the configuration and exit
+  relay config print [flags]    print the effective configuration as YAML
+
+The configuration is built from defaults, the -config file, GLIENICKE_*
+environment variables and flags, in increasing order of precedence.
+Send SIGHUP to reload it while running.
+
+Flags:
+`
+
 func main() {
-	addr := flag.String("addr", ":8080", "Address to listen on")
-	dbPath := flag.String("db", "relay.db", "Path to SQLite database (will be created if it doesn't exist)")
-	certFile := flag.String("cert", "", "TLS certificate file for secure WebSocket (WSS)")
-	keyFile := flag.String("key", "", "TLS private key file for secure WebSocket (WSS)")
-	nip36Vocab := flag.String("nip36-vocab", "", "Path to NIP-36 vocabulary file (enables NSFW content-warning enforcement)")
-	version := flag.Bool("version", false, "Print version and exit")
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(configCommand(args[1:]))
+	}
 
+	loader := config.NewLoader("")
+	version := loader.Flags().Bool("version", false, "Print version and exit")
+	setUsage(loader.Flags())
+	cfg, err := loader.LoadWithArgs(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal("failed to load config", err)
+	}
 	if *version {
 		fmt.Println(relay.Version)
 		os.Exit(0)
 	}
 
+	if err := logging.Configure(cfg.Logging.Options()); err != nil {
+		fatal("invalid logging configuration", err)
+	}
+	if loader.ConfigFile() != "" {
+		slog.Info("loaded configuration", "config", loader.ConfigFile())
+	}
+
 	// Autoconfigure SQLite storage
-	expandedPath := expandPath(*dbPath)
-	log.Printf("Using SQLite database: %s", expandedPath)
+	expandedPath := expandPath(cfg.Database.Path)
+	slog.Info("using SQLite database", "path", expandedPath)
 
-	store, err := sqlite.New(expandedPath)
+	opts := sqlite.DefaultOptions()
+	opts.MaxOpenConns = cfg.Database.MaxOpenConns
+	opts.MaxIdleConns = cfg.Database.MaxIdleConns
+	opts.ConnMaxLifetime = time.Duration(cfg.Database.ConnMaxLifetime) * time.Second
+	store, err := sqlite.NewWithOptions(expandedPath, opts)
 	if err != nil {
-		log.Fatalf("Failed to initialize SQLite store: %v", err)
+		fatal("failed to initialize SQLite store", err)
 	}
-	defer store.Close()
 
-	// Create relay
+	// Create relay; Shutdown closes the store
 	r := relay.New(store)
-	defer r.Close()
 
-	if *nip36Vocab != "" {
-		r.SetNIP36Policy(*nip36Vocab)
-		log.Printf("NIP-36 enforcement enabled with vocabulary: %s", *nip36Vocab)
+	applyStartup(r, cfg)
+	applyReloadable(r, cfg)
+	if err := applyACLFiles(r, cfg); err != nil {
+		fatal("invalid access-control list", err)
+	}
+	if err := applyWritePolicy(r, cfg); err != nil {
+		fatal("invalid write policy", err)
+	}
+	if cfg.Features.NIP29 {
+		if err := r.EnableGroups(context.Background(), cfg.Relay.SecretKey); err != nil {
+			fatal("failed to enable NIP-29 groups", err)
+		}
 	}
 
-	// Handle shutdown gracefully
+	// Handle shutdown gracefully and reload the configuration on SIGHUP
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
 
 	// Start relay in goroutine
 	go func() {
-		if *certFile != "" && *keyFile != "" {
-			log.Printf("Starting Nostr relay v%s with TLS on %s (WSS)", relay.Version, *addr)
-			log.Printf("Certificate: %s", *certFile)
-			log.Printf("Private key: %s", *keyFile)
-			if err := r.StartTLS(*addr, *certFile, *keyFile); err != nil {
-				log.Fatalf("Relay error: %v", err)
+		net := cfg.Network
+		if net.TLSCert != "" && net.TLSKey != "" {
+			slog.Info("starting Nostr relay with TLS (WSS)", "version", relay.Version, "addr", net.Address)
+			if err := r.StartTLS(net.Address, net.TLSCert, net.TLSKey); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("relay error", err)
 			}
 		} else {
-			log.Printf("Starting Nostr relay v%s on %s (unencrypted WS)", relay.Version, *addr)
-			log.Println("WARNING: Using unencrypted WebSocket connections. Use -cert and -key flags for production.")
-			if err := r.Start(*addr); err != nil {
-				log.Fatalf("Relay error: %v", err)
+			slog.Info("starting Nostr relay (unencrypted WS)", "version", relay.Version, "addr", net.Address)
+			slog.Warn("using unencrypted WebSocket connections; use -cert and -key flags for production")
+			if err := r.Start(net.Address); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("relay error", err)
 			}
 		}
 	}()
 
-	// Wait for shutdown signal
-	<-sigCh
-	log.Println("Shutting down relay...")
+	for {
+		select {
+		case <-hupCh:
+			cfg = reload(r, cfg, args)
+		case <-sigCh:
+			shutdown(r, time.Duration(cfg.Network.ShutdownTimeout)*time.Second)
+			return
+		}
+	}
+}
+
+// shutdown drains the relay's clients for up to timeout (0 = no limit) and
+// closes it; a second signal skips the wait
+func shutdown(r *relay.Relay, timeout time.Duration) {
+	slog.Info("shutting down relay", "timeout", timeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case <-sigCh:
+			slog.Warn("second signal received, disconnecting clients now")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := r.Shutdown(ctx); err != nil {
+		slog.Warn("relay shut down before all clients drained", logging.KeyError, err)
+		return
+	}
+	slog.Info("relay stopped")
+}
+
+// applyStartup applies the settings that only take effect when the relay starts
+func applyStartup(r *relay.Relay, cfg *config.Config) {
+	r.SetFeatures(relay.Features{
+		NIP11: cfg.Features.NIP11,
+		NIP28: cfg.Features.NIP28,
+		NIP42: cfg.Features.NIP42,
+	})
+	r.SetServerTimeouts(
+		time.Duration(cfg.Network.ReadTimeout)*time.Second,
+		time.Duration(cfg.Network.WriteTimeout)*time.Second,
+	)
+	r.SetProxyProtocol(cfg.Network.ProxyProtocol)
+
+	rc := cfg.Relay
+	r.SetRequireAuth(rc.RequireAuth)
+	r.SetRetentionDays(rc.RetentionDays)
+	r.SetGiftWrapRetentionDays(rc.GiftWrapRetentionDays)
+	if rc.Mode == config.ModeInbox {
+		r.SetInboxMode(true)
+		slog.Info("NIP-17 inbox mode: only direct messages for registered users are accepted")
+	}
+	r.SetMaxEventsPerREQ(rc.MaxEventsPerREQ)
+	r.SetCloseAfterEOSE(rc.CloseAfterEOSE)
+	r.SetQueryTimeout(time.Duration(rc.QueryTimeout) * time.Second)
+	if rc.MaxRequestCost > 0 || rc.MaxConnectionCost > 0 {
+		r.SetCostBudget(&event.CostBudget{
+			MaxRequestCost:    rc.MaxRequestCost,
+			MaxConnectionCost: rc.MaxConnectionCost,
+			ClampWindow:       int64(rc.ClampWindow),
+		})
+	}
+	if rc.MinPoW > 0 || len(rc.MinPoWKinds) > 0 {
+		r.SetPoWPolicy(&nip13.Policy{
+			MinDifficulty:       rc.MinPoW,
+			KindDifficulty:      rc.MinPoWKinds,
+			ExemptAuthenticated: rc.PoWExemptAuth,
+			ExemptKnown:         rc.PoWExemptKnown,
+		})
+		slog.Info("NIP-13 proof of work required", "difficulty", rc.MinPoW, "kinds", len(rc.MinPoWKinds),
+			"exempt_authenticated", rc.PoWExemptAuth, "exempt_known", rc.PoWExemptKnown)
+	}
+}
+
+// applyReloadable applies the settings that SIGHUP can change while running
+func applyReloadable(r *relay.Relay, cfg *config.Config) {
+	if err := r.SetTrustedProxies(cfg.Network.TrustedProxies); err != nil {
+		slog.Error("invalid trusted proxies", logging.KeyError, err)
+	}
+	r.SetRateLimits(rateLimits(cfg.RateLimit))
+	r.SetNIP36Policy(cfg.Relay.NIP36Vocab)
+	if cfg.Relay.NIP36Vocab != "" {
+		slog.Info("NIP-36 enforcement enabled", "vocabulary", cfg.Relay.NIP36Vocab)
+	}
+	r.SetAdminPubKeys(cfg.Relay.AdminPubKeys)
+	if len(cfg.Relay.AdminPubKeys) > 0 {
+		slog.Info("NIP-86 management API enabled", "admins", len(cfg.Relay.AdminPubKeys))
+	}
+	mc := cfg.Relay.Moderation
+	r.SetModeration(relay.ModerationPolicy{
+		Moderators:            mc.Moderators,
+		TrustedReporters:      mc.TrustedReporters,
+		HideAfter:             mc.HideAfter,
+		DeleteTypes:           mc.DeleteTypes,
+		TrustedReputation:     mc.TrustedReputation,
+		IgnoreReputation:      mc.IgnoreReputation,
+		MaxReportsPerTarget:   mc.MaxReportsPerTarget,
+		MaxReportsPerReporter: mc.MaxReportsPerReporter,
+		MaxQueuedReports:      mc.MaxQueuedReports,
+	})
+	r.SetInfo(cfg.Info.Document())
+}
+
+// rateLimits converts the rate_limit section; zero values take the relay's defaults
+func rateLimits(rl config.RateLimitConfig) relay.RateLimits {
+	seconds := func(s int) time.Duration { return time.Duration(s) * time.Second }
+	return relay.RateLimits{
+		Enabled:        rl.Enabled,
+		EventsPerSec:   float64(rl.EventsPerSec),
+		ReqPerSec:      float64(rl.ReqPerSec),
+		CountPerSec:    float64(rl.CountPerSec),
+		Burst:          rl.Burst,
+		Authenticated:  relay.MessageRates{Events: rl.Authenticated.EventsPerSec, Reqs: rl.Authenticated.ReqPerSec, Counts: rl.Authenticated.CountPerSec},
+		Trusted:        relay.MessageRates{Events: rl.Trusted.EventsPerSec, Reqs: rl.Trusted.ReqPerSec, Counts: rl.Trusted.CountPerSec},
+		TrustedPubKeys: rl.TrustedPubKeys,
+		KindsPerSec:    rl.Kinds,
+		IPv6Prefix:     rl.IPv6Prefix,
+		Escalation: relay.Escalation{
+			Violations:      rl.Escalation.Violations,
+			Window:          seconds(rl.Escalation.Window),
+			BanDuration:     seconds(rl.Escalation.BanDuration),
+			LongBanAfter:    rl.Escalation.LongBanAfter,
+			LongBanDuration: seconds(rl.Escalation.LongBanDuration),
+		},
+		MaxEventSize:             rl.MaxEventSize,
+		MaxConnections:           rl.MaxConnections,
+		MaxConnectionsPerNetwork: rl.MaxConnectionsPerNetwork,
+		MaxTotalConnections:      rl.MaxTotalConnections,
+		ConnectionsPerSec:        float64(rl.ConnectionsPerSec),
+		MaxTrackedClients:        rl.MaxTrackedClients,
+		IdleTimeout:              seconds(rl.IdleTimeout),
+	}
+}
+
+// applyWritePolicy starts, reconfigures or stops the write-policy plugin
+func applyWritePolicy(r *relay.Relay, cfg *config.Config) error {
+	wp := cfg.Relay.WritePolicy
+	err := r.SetWritePolicy(wp.Command, writepolicy.Options{
+		Timeout:  time.Duration(wp.Timeout) * time.Second,
+		FailOpen: wp.FailOpen,
+	})
+	if err != nil {
+		return err
+	}
+	if wp.Command != "" {
+		slog.Info("write policy plugin enabled", "command", wp.Command, "fail_open", wp.FailOpen)
+	}
+	return nil
+}
+
+// applyACLFiles loads the access-control list files; at startup a bad file is
+// fatal, on reload the previous entries stay in effect
+func applyACLFiles(r *relay.Relay, cfg *config.Config) error {
+	if err := r.SetACLFiles(cfg.Relay.ACLFiles); err != nil {
+		return err
+	}
+	if len(cfg.Relay.ACLFiles) > 0 {
+		slog.Info("access-control lists loaded", "files", len(cfg.Relay.ACLFiles), "entries", len(r.ACLEntries()))
+	}
+	return nil
+}
+
+// reload re-reads the configuration with the original arguments and applies
+// what can change without a restart. On error the running configuration is kept.
+func reload(r *relay.Relay, old *config.Config, args []string) *config.Config {
+	slog.Info("reloading configuration")
+	cfg, err := config.NewLoader("").LoadWithArgs(args)
+	if err != nil {
+		slog.Error("configuration reload failed, keeping current configuration", logging.KeyError, err)
+		return old
+	}
+	if err := logging.Configure(cfg.Logging.Options()); err != nil {
+		slog.Error("configuration reload failed, keeping current configuration", logging.KeyError, err)
+		return old
+	}
+	if cfg.Network.TLSCert != "" && cfg.Network.TLSKey != "" {
+		if err := r.ReloadTLS(cfg.Network.TLSCert, cfg.Network.TLSKey); err != nil {
+			slog.Error("TLS certificate reload failed, keeping current certificate", logging.KeyError, err)
+		}
+	}
+	applyReloadable(r, cfg)
+	if err := applyACLFiles(r, cfg); err != nil {
+		slog.Error("ACL reload failed, keeping current file entries", logging.KeyError, err)
+	}
+	if err := applyWritePolicy(r, cfg); err != nil {
+		slog.Error("write policy reload failed, keeping current plugin", logging.KeyError, err)
+	}
+
+	for _, section := range restartOnly(old, cfg) {
+		slog.Warn("configuration change needs a restart to take effect", "section", section)
+	}
+	slog.Info("configuration reloaded")
+	return cfg
+}
+
+// restartOnly names the changed settings that reload does not apply
+func restartOnly(old, cfg *config.Config) []string {
+	var changed []string
+	oldNet, newNet := old.Network, cfg.Network
+	oldNet.TLSCert, oldNet.TLSKey, newNet.TLSCert, newNet.TLSKey = "", "", "", ""
+	oldNet.ShutdownTimeout, newNet.ShutdownTimeout = 0, 0
+	oldNet.TrustedProxies, newNet.TrustedProxies = nil, nil
+	if !reflect.DeepEqual(oldNet, newNet) || (old.Network.TLSCert == "") != (cfg.Network.TLSCert == "") {
+		changed = append(changed, "network")
+	}
+	if old.Database != cfg.Database {
+		changed = append(changed, "database")
+	}
+	if old.Features != cfg.Features {
+		changed = append(changed, "features")
+	}
+	oldRelay, newRelay := old.Relay, cfg.Relay
+	oldRelay.NIP36Vocab, oldRelay.AdminPubKeys, oldRelay.ACLFiles = "", nil, nil
+	newRelay.NIP36Vocab, newRelay.AdminPubKeys, newRelay.ACLFiles = "", nil, nil
+	oldRelay.WritePolicy, newRelay.WritePolicy = config.WritePolicyConfig{}, config.WritePolicyConfig{}
+	oldRelay.Moderation, newRelay.Moderation = config.ModerationConfig{}, config.ModerationConfig{}
+	if !reflect.DeepEqual(oldRelay, newRelay) {
+		changed = append(changed, "relay")
+	}
+	return changed
+}
+
+// configCommand runs "relay config check" and "relay config print"
+func configCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "print") {
+		fmt.Fprint(os.Stderr, "Usage: relay config check|print [flags]\n")
+		return 2
+	}
+	loader := config.NewLoader("")
+	setUsage(loader.Flags())
+	cfg, err := loader.LoadWithArgs(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if args[0] == "print" {
+		if cfg.Relay.SecretKey != "" {
+			cfg.Relay.SecretKey = "<redacted>"
+		}
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := checkFiles(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	source := loader.ConfigFile()
+	if source == "" {
+		source = "defaults"
+	}
+	fmt.Printf("configuration OK (%s)\n", source)
+	return 0
+}
+
+// checkFiles verifies that the files named by the configuration can be loaded
+func checkFiles(cfg *config.Config) error {
+	if (cfg.Network.TLSCert == "") != (cfg.Network.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if cfg.Network.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.Network.TLSCert, cfg.Network.TLSKey); err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+	}
+	if cfg.Relay.NIP36Vocab != "" {
+		if _, err := os.Stat(cfg.Relay.NIP36Vocab); err != nil {
+			return fmt.Errorf("NIP-36 vocabulary: %w", err)
+		}
+	}
+	for _, path := range cfg.Relay.ACLFiles {
+		if _, err := relay.LoadACLFile(path); err != nil {
+			return fmt.Errorf("access-control list: %w", err)
+		}
+	}
+	if fields := strings.Fields(cfg.Relay.WritePolicy.Command); len(fields) > 0 {
+		if _, err := exec.LookPath(fields[0]); err != nil {
+			return fmt.Errorf("write policy: %w", err)
+		}
+	}
+	return nil
+}
+
+// setUsage prints the command summary before the flag defaults
+func setUsage(f *flag.FlagSet) {
+	f.Usage = func() {
+		fmt.Fprint(f.Output(), usage)
+		f.PrintDefaults()
+	}
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.KeyError, err)
+	os.Exit(1)
 }
 
 // expandPath expands ~ to home directory and makes path absolute
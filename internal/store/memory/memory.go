@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip45"
 	"github.com/paul/glienicke/pkg/storage"
 )
 
@@ -15,19 +18,36 @@ import (
 type Store struct {
 	mu            sync.RWMutex
 	events        map[string]*event.Event
-	deleted       map[string]bool                    // event IDs that have been deleted
-	channelEvents map[string]map[string]*event.Event // channelID -> eventID -> event
+	deleted       map[string]bool                     // event IDs that have been deleted
+	channelEvents map[string]map[string]*event.Event  // channelID -> eventID -> event
+	sketches      map[string]*hyperloglog.HyperLogLog // NIP-45 sketch key -> HyperLogLog
+	lists         map[string][]storage.ListEntry      // management list name -> entries
+	settings      map[string]string
+	bans          map[string]storage.Ban // rate limit key -> ban
+	reports       []storage.Report       // NIP-56 reports, oldest first
+	reputations   map[string]storage.Reputation
 }
 
 // Ensure Store implements storage.Store
 var _ storage.Store = (*Store)(nil)
 
+// Ensure Store implements storage.HLLCounter
+var _ storage.HLLCounter = (*Store)(nil)
+
+// Ensure Store implements storage.ManagementStore
+var _ storage.ManagementStore = (*Store)(nil)
+
 // New creates a new in-memory store
 func New() *Store {
 	return &Store{
 		events:        make(map[string]*event.Event),
 		deleted:       make(map[string]bool),
 		channelEvents: make(map[string]map[string]*event.Event),
+		sketches:      make(map[string]*hyperloglog.HyperLogLog),
+		lists:         make(map[string][]storage.ListEntry),
+		settings:      make(map[string]string),
+		bans:          make(map[string]storage.Ban),
+		reputations:   make(map[string]storage.Reputation),
 	}
 }
 
@@ -60,6 +80,16 @@ func (s *Store) SaveEvent(ctx context.Context, evt *event.Event) error {
 
 	// Store event
 	s.events[evt.ID] = evt
+
+	// NIP-45: Feed the event author into the sketches it contributes to
+	for _, ref := range nip45.EventRefs(evt) {
+		sketch, ok := s.sketches[ref.Key()]
+		if !ok {
+			sketch = nip45.NewSketch(ref)
+			s.sketches[ref.Key()] = sketch
+		}
+		nip45.AddPubKey(sketch, evt.PubKey)
+	}
 	return nil
 }
 
@@ -81,6 +111,9 @@ func (s *Store) QueryEvents(ctx context.Context, filters []*event.Filter) ([]*ev
 
 	// Process each filter (OR'd together)
 	for _, filter := range filters {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		for _, evt := range s.events {
 			// Skip if already included or deleted
 			if seen[evt.ID] || s.deleted[evt.ID] {
@@ -179,6 +212,9 @@ func (s *Store) CountEvents(ctx context.Context, filters []*event.Filter) (int,
 
 	// Process each filter (OR'd together)
 	for _, filter := range filters {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		for _, evt := range s.events {
 			// Skip if already counted or deleted
 			if seen[evt.ID] || s.deleted[evt.ID] {
@@ -196,6 +232,32 @@ func (s *Store) CountEvents(ctx context.Context, filters []*event.Filter) (int,
 	return count, nil
 }
 
+// CountEventsHLL counts events for a NIP-45 HyperLogLog-eligible filter.
+func (s *Store) CountEventsHLL(ctx context.Context, filter *event.Filter, ref nip45.SketchRef) (*nip45.Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if sketch, ok := s.sketches[ref.Key()]; ok {
+		if estimate := sketch.Count(); estimate >= nip45.ExactCountThreshold {
+			registers := make([]byte, 256)
+			copy(registers, sketch.GetRegisters())
+			return &nip45.Result{Count: int(estimate), Registers: registers, Approximate: true}, nil
+		}
+	}
+
+	// Small set: count exactly and compute registers from the matching events
+	exact := nip45.NewSketch(ref)
+	count := 0
+	for id, evt := range s.events {
+		if s.deleted[id] || !evt.Matches(filter) {
+			continue
+		}
+		count++
+		nip45.AddPubKey(exact, evt.PubKey)
+	}
+	return &nip45.Result{Count: count, Registers: exact.GetRegisters()}, nil
+}
+
 // Count returns the number of stored events (for testing)
 func (s *Store) Count() int {
 	s.mu.RLock()
@@ -379,6 +441,170 @@ func (s *Store) DeleteEventsOlderThan(ctx context.Context, before int64, exemptK
 	return count, nil
 }
 
+// DeleteKindsOlderThan deletes events of the given kinds older than the given timestamp.
+func (s *Store) DeleteKindsOlderThan(ctx context.Context, kinds []int, before int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	match := make(map[int]bool, len(kinds))
+	for _, k := range kinds {
+		match[k] = true
+	}
+
+	count := 0
+	for id, evt := range s.events {
+		if s.deleted[id] {
+			continue
+		}
+		if evt.CreatedAt < before && match[evt.Kind] {
+			s.deleted[id] = true
+			count++
+		}
+	}
+	return count, nil
+}
+
+// AddListEntry adds a value to a management list
+func (s *Store) AddListEntry(ctx context.Context, list, value, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, entry := range s.lists[list] {
+		if entry.Value == value {
+			s.lists[list][i].Reason = reason
+			return nil
+		}
+	}
+	s.lists[list] = append(s.lists[list], storage.ListEntry{Value: value, Reason: reason, CreatedAt: time.Now().Unix()})
+	return nil
+}
+
+// RemoveListEntry removes a value from a management list
+func (s *Store) RemoveListEntry(ctx context.Context, list, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.lists[list]
+	for i, entry := range entries {
+		if entry.Value == value {
+			s.lists[list] = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// ListEntries returns the entries of a management list, oldest first
+func (s *Store) ListEntries(ctx context.Context, list string) ([]storage.ListEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]storage.ListEntry(nil), s.lists[list]...), nil
+}
+
+// SetSetting stores a setting
+func (s *Store) SetSetting(ctx context.Context, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[key] = value
+	return nil
+}
+
+// GetSetting returns a setting
+func (s *Store) GetSetting(ctx context.Context, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.settings[key]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return value, nil
+}
+
+// SaveBan stores a rate-limit ban
+func (s *Store) SaveBan(ctx context.Context, ban storage.Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ban.PubKeys = append([]string(nil), ban.PubKeys...)
+	s.bans[ban.Key] = ban
+	return nil
+}
+
+// DeleteBan removes a rate-limit ban
+func (s *Store) DeleteBan(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bans, key)
+	return nil
+}
+
+// ListBans returns the stored rate-limit bans ordered by key
+func (s *Store) ListBans(ctx context.Context) ([]storage.Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bans := make([]storage.Ban, 0, len(s.bans))
+	for _, ban := range s.bans {
+		ban.PubKeys = append([]string(nil), ban.PubKeys...)
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Key < bans[j].Key })
+	return bans, nil
+}
+
+// SaveReport stores a NIP-56 report, replacing the reporter's earlier report of the same target
+func (s *Store) SaveReport(ctx context.Context, report storage.Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.reports {
+		if r.TargetType == report.TargetType && r.Target == report.Target && r.Reporter == report.Reporter {
+			s.reports = append(s.reports[:i:i], s.reports[i+1:]...)
+			break
+		}
+	}
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+// DeleteReports removes every report of a target
+func (s *Store) DeleteReports(ctx context.Context, targetType, target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.reports[:0:0]
+	for _, r := range s.reports {
+		if r.TargetType != targetType || r.Target != target {
+			kept = append(kept, r)
+		}
+	}
+	s.reports = kept
+	return nil
+}
+
+// ListReports returns the stored reports, oldest first
+func (s *Store) ListReports(ctx context.Context) ([]storage.Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]storage.Report(nil), s.reports...), nil
+}
+
+// SaveReputation stores a reporter's reputation
+func (s *Store) SaveReputation(ctx context.Context, rep storage.Reputation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reputations[rep.PubKey] = rep
+	return nil
+}
+
+// ListReputations returns the stored reporter reputations ordered by pubkey
+func (s *Store) ListReputations(ctx context.Context) ([]storage.Reputation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reps := make([]storage.Reputation, 0, len(s.reputations))
+	for _, rep := range s.reputations {
+		reps = append(reps, rep)
+	}
+	sort.Slice(reps, func(i, j int) bool { return reps[i].PubKey < reps[j].PubKey })
+	return reps, nil
+}
+
 func getChannelID(evt *event.Event) string {
 	for _, tag := range evt.Tags {
 		if len(tag) >= 2 && tag[0] == "channel_id" {
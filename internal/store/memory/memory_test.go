@@ -2,11 +2,15 @@ package memory
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/paul/glienicke/internal/testutil"
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip45"
 	"github.com/paul/glienicke/pkg/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -327,6 +331,34 @@ func TestMemoryStore_DeleteEvent_NotFound(t *testing.T) {
 	assert.Equal(t, storage.ErrNotFound, err)
 }
 
+func TestMemoryStore_DeleteKindsOlderThan(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	ctx := context.Background()
+
+	// Test events are created at 1234567890
+	wrap := createTestEvent(t, 1059, "ciphertext", nil)
+	note := createTestEvent(t, 1, "Test content", nil)
+	for _, evt := range []*event.Event{wrap, note} {
+		require.NoError(t, store.SaveEvent(ctx, evt))
+	}
+
+	// Only events before the cutoff are deleted
+	deleted, err := store.DeleteKindsOlderThan(ctx, []int{1059}, 1234567890)
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	deleted, err = store.DeleteKindsOlderThan(ctx, []int{1059}, 1234567891)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	events, err := store.QueryEvents(ctx, []*event.Filter{{}})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, note.ID, events[0].ID)
+}
+
 func TestMemoryStore_CountEvents(t *testing.T) {
 	store := New()
 	defer store.Close()
@@ -553,3 +585,107 @@ func TestMemoryStore_EmptyResults(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 0, count)
 }
+
+func TestMemoryStore_CountEventsHLL(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	ctx := context.Background()
+
+	note := createTestEvent(t, 1, "Note to react to", nil)
+	require.NoError(t, store.SaveEvent(ctx, note))
+
+	filter := &event.Filter{Kinds: []int{7}, Tags: map[string][]string{"e": {note.ID}}}
+	ref, ok := nip45.ParseRef(filter)
+	require.True(t, ok)
+
+	t.Run("small sets are counted exactly", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			require.NoError(t, store.SaveEvent(ctx, createTestEvent(t, 7, "+", [][]string{{"e", note.ID}})))
+		}
+		require.NoError(t, store.SaveEvent(ctx, createTestEvent(t, 7, "+", [][]string{{"e", "other"}})))
+
+		result, err := store.CountEventsHLL(ctx, filter, ref)
+		require.NoError(t, err)
+		assert.Equal(t, 5, result.Count)
+		assert.False(t, result.Approximate)
+		assert.Len(t, result.Registers, 256)
+	})
+
+	t.Run("large sets are estimated from the sketch", func(t *testing.T) {
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, store.SaveEvent(ctx, &event.Event{
+				ID:     fmt.Sprintf("%064x", i),
+				PubKey: randomPubKey(t),
+				Kind:   7,
+				Tags:   [][]string{{"e", note.ID}},
+			}))
+		}
+
+		result, err := store.CountEventsHLL(ctx, filter, ref)
+		require.NoError(t, err)
+		assert.True(t, result.Approximate)
+		assert.InDelta(t, 2005, result.Count, 2005*0.2)
+	})
+}
+
+func randomPubKey(t *testing.T) string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return hex.EncodeToString(b)
+}
+
+func TestMemoryStore_ManagementState(t *testing.T) {
+	store := New()
+	ctx := context.Background()
+
+	require.NoError(t, store.AddListEntry(ctx, "banned_events", "aa", "spam"))
+	require.NoError(t, store.AddListEntry(ctx, "banned_events", "bb", ""))
+	require.NoError(t, store.AddListEntry(ctx, "banned_events", "aa", "illegal"))
+	require.NoError(t, store.RemoveListEntry(ctx, "banned_events", "bb"))
+
+	entries, err := store.ListEntries(ctx, "banned_events")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "aa", entries[0].Value)
+	assert.Equal(t, "illegal", entries[0].Reason)
+
+	_, err = store.GetSetting(ctx, "relay_name")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	require.NoError(t, store.SetSetting(ctx, "relay_name", "renamed"))
+	name, err := store.GetSetting(ctx, "relay_name")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", name)
+
+	require.NoError(t, store.SaveBan(ctx, storage.Ban{Key: "pubkey:cc", Until: 200}))
+	require.NoError(t, store.SaveBan(ctx, storage.Ban{Key: "ip:10.0.0.1", Reason: "flood", Until: 100, PubKeys: []string{"aa"}}))
+	require.NoError(t, store.SaveBan(ctx, storage.Ban{Key: "ip:10.0.0.2", Until: 100}))
+	require.NoError(t, store.DeleteBan(ctx, "ip:10.0.0.2"))
+	bans, err := store.ListBans(ctx)
+	require.NoError(t, err)
+	require.Len(t, bans, 2)
+	assert.Equal(t, "ip:10.0.0.1", bans[0].Key)
+	assert.Equal(t, []string{"aa"}, bans[0].PubKeys)
+	assert.Equal(t, "pubkey:cc", bans[1].Key)
+
+	require.NoError(t, store.SaveReport(ctx, storage.Report{TargetType: "event", Target: "e1", Reporter: "aa", Type: "spam", CreatedAt: 10}))
+	require.NoError(t, store.SaveReport(ctx, storage.Report{TargetType: "pubkey", Target: "cc", Reporter: "aa", CreatedAt: 20}))
+	require.NoError(t, store.SaveReport(ctx, storage.Report{TargetType: "event", Target: "e1", Reporter: "aa", Type: "illegal", CreatedAt: 30}))
+	reports, err := store.ListReports(ctx)
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.Equal(t, "cc", reports[0].Target)
+	assert.Equal(t, "illegal", reports[1].Type)
+	require.NoError(t, store.DeleteReports(ctx, "pubkey", "cc"))
+	reports, err = store.ListReports(ctx)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, "e1", reports[0].Target)
+
+	require.NoError(t, store.SaveReputation(ctx, storage.Reputation{PubKey: "bb", Dismissed: 1}))
+	require.NoError(t, store.SaveReputation(ctx, storage.Reputation{PubKey: "aa", Upheld: 1}))
+	reps, err := store.ListReputations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Reputation{{PubKey: "aa", Upheld: 1}, {PubKey: "bb", Dismissed: 1}}, reps)
+}
@@ -0,0 +1,203 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/paul/glienicke/pkg/storage"
+)
+
+// AddListEntry adds a value to a management list, replacing the reason if it is already present
+func (s *Store) AddListEntry(ctx context.Context, list, value, reason string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO management_lists (list, value, reason, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (list, value) DO UPDATE SET reason = excluded.reason`,
+		list, value, reason, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to add %s entry: %w", list, err)
+	}
+	return nil
+}
+
+// RemoveListEntry removes a value from a management list
+func (s *Store) RemoveListEntry(ctx context.Context, list, value string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM management_lists WHERE list = ? AND value = ?", list, value)
+	if err != nil {
+		return fmt.Errorf("failed to remove %s entry: %w", list, err)
+	}
+	return nil
+}
+
+// ListEntries returns every entry of a management list, oldest first
+func (s *Store) ListEntries(ctx context.Context, list string) ([]storage.ListEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT value, reason, created_at FROM management_lists WHERE list = ? ORDER BY created_at, rowid", list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s entries: %w", list, err)
+	}
+	defer rows.Close()
+
+	var entries []storage.ListEntry
+	for rows.Next() {
+		var entry storage.ListEntry
+		if err := rows.Scan(&entry.Value, &entry.Reason, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan %s entry: %w", list, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// SetSetting stores a setting
+func (s *Store) SetSetting(ctx context.Context, key, value string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to save setting %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetSetting returns a setting, or storage.ErrNotFound if it was never set
+func (s *Store) GetSetting(ctx context.Context, key string) (string, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", storage.ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load setting %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// SaveBan stores a rate-limit ban, replacing any ban with the same key
+func (s *Store) SaveBan(ctx context.Context, ban storage.Ban) error {
+	pubkeys := ban.PubKeys
+	if pubkeys == nil {
+		pubkeys = []string{}
+	}
+	pubkeysJSON, err := json.Marshal(pubkeys)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ban pubkeys: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO bans (key, reason, until, pubkeys, strikes, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET reason = excluded.reason, until = excluded.until,
+			pubkeys = excluded.pubkeys, strikes = excluded.strikes, created_at = excluded.created_at`,
+		ban.Key, ban.Reason, ban.Until, string(pubkeysJSON), ban.Strikes, ban.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save ban %s: %w", ban.Key, err)
+	}
+	return nil
+}
+
+// DeleteBan removes a rate-limit ban
+func (s *Store) DeleteBan(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM bans WHERE key = ?", key)
+	if err != nil {
+		return fmt.Errorf("failed to delete ban %s: %w", key, err)
+	}
+	return nil
+}
+
+// ListBans returns every stored rate-limit ban ordered by key
+func (s *Store) ListBans(ctx context.Context) ([]storage.Ban, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT key, reason, until, pubkeys, strikes, created_at FROM bans ORDER BY key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bans: %w", err)
+	}
+	defer rows.Close()
+
+	var bans []storage.Ban
+	for rows.Next() {
+		var ban storage.Ban
+		var pubkeysJSON string
+		if err := rows.Scan(&ban.Key, &ban.Reason, &ban.Until, &pubkeysJSON, &ban.Strikes, &ban.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan ban: %w", err)
+		}
+		if err := json.Unmarshal([]byte(pubkeysJSON), &ban.PubKeys); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal pubkeys of ban %s: %w", ban.Key, err)
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// SaveReport stores a NIP-56 report, replacing the reporter's earlier report of the same target
+func (s *Store) SaveReport(ctx context.Context, report storage.Report) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO reports (target_type, target, reporter, type, event_id, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (target_type, target, reporter) DO UPDATE SET type = excluded.type,
+			event_id = excluded.event_id, created_at = excluded.created_at`,
+		report.TargetType, report.Target, report.Reporter, report.Type, report.EventID, report.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save report of %s %s: %w", report.TargetType, report.Target, err)
+	}
+	return nil
+}
+
+// DeleteReports removes every report of a target
+func (s *Store) DeleteReports(ctx context.Context, targetType, target string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM reports WHERE target_type = ? AND target = ?", targetType, target)
+	if err != nil {
+		return fmt.Errorf("failed to delete reports of %s %s: %w", targetType, target, err)
+	}
+	return nil
+}
+
+// ListReports returns every stored report, oldest first
+func (s *Store) ListReports(ctx context.Context) ([]storage.Report, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT target_type, target, reporter, type, event_id, created_at FROM reports ORDER BY created_at, rowid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reports: %w", err)
+	}
+	defer rows.Close()
+
+	var reports []storage.Report
+	for rows.Next() {
+		var r storage.Report
+		if err := rows.Scan(&r.TargetType, &r.Target, &r.Reporter, &r.Type, &r.EventID, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan report: %w", err)
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// SaveReputation stores a reporter's reputation, replacing the previous one
+func (s *Store) SaveReputation(ctx context.Context, rep storage.Reputation) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO reporter_reputation (pubkey, upheld, dismissed) VALUES (?, ?, ?)
+		ON CONFLICT (pubkey) DO UPDATE SET upheld = excluded.upheld, dismissed = excluded.dismissed`,
+		rep.PubKey, rep.Upheld, rep.Dismissed)
+	if err != nil {
+		return fmt.Errorf("failed to save reputation of %s: %w", rep.PubKey, err)
+	}
+	return nil
+}
+
+// ListReputations returns the stored reporter reputations ordered by pubkey
+func (s *Store) ListReputations(ctx context.Context) ([]storage.Reputation, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT pubkey, upheld, dismissed FROM reporter_reputation ORDER BY pubkey")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reporter reputations: %w", err)
+	}
+	defer rows.Close()
+
+	var reps []storage.Reputation
+	for rows.Next() {
+		var rep storage.Reputation
+		if err := rows.Scan(&rep.PubKey, &rep.Upheld, &rep.Dismissed); err != nil {
+			return nil, fmt.Errorf("failed to scan reporter reputation: %w", err)
+		}
+		reps = append(reps, rep)
+	}
+	return reps, rows.Err()
+}
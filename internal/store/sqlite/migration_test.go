@@ -22,7 +22,7 @@ func TestMigrationFromFreshDB(t *testing.T) {
 	var count int
 	err = store.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count)
 	assert.NoError(t, err)
-	assert.Equal(t, 3, count, "should have applied 3 migrations")
+	assert.Equal(t, len(migrations), count, "should have applied all migrations")
 
 	// Verify events table exists
 	err = store.db.QueryRow("SELECT COUNT(*) FROM events").Scan(&count)
@@ -47,11 +47,11 @@ func TestMigrationIdempotency(t *testing.T) {
 	require.NoError(t, err)
 	defer store2.Close()
 
-	// Should still have only 3 migrations applied
+	// Should still have each migration applied only once
 	var count int
 	err = store2.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count)
 	assert.NoError(t, err)
-	assert.Equal(t, 3, count, "migrations should not be re-applied")
+	assert.Equal(t, len(migrations), count, "migrations should not be re-applied")
 }
 
 func TestMigrationFromOldDB(t *testing.T) {
@@ -89,7 +89,7 @@ func TestMigrationFromOldDB(t *testing.T) {
 	var count int
 	err = store.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count)
 	assert.NoError(t, err)
-	assert.Equal(t, 3, count, "should have applied missing migrations")
+	assert.Equal(t, len(migrations), count, "should have applied missing migrations")
 
 	// Verify channel_events table was created
 	err = store.db.QueryRow("SELECT COUNT(*) FROM channel_events").Scan(&count)
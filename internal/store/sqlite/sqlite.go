@@ -10,6 +10,7 @@ import (
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip45"
 	"github.com/paul/glienicke/pkg/storage"
 )
 
@@ -62,6 +63,12 @@ type Store struct {
 // Ensure Store implements storage.Store
 var _ storage.Store = (*Store)(nil)
 
+// Ensure Store implements storage.HLLCounter
+var _ storage.HLLCounter = (*Store)(nil)
+
+// Ensure Store implements storage.ManagementStore
+var _ storage.ManagementStore = (*Store)(nil)
+
 // New creates a new SQLite store with autoconfiguration
 func New(dbPath string) (*Store, error) {
 	return NewWithOptions(dbPath, DefaultOptions())
@@ -180,6 +187,7 @@ func (s *Store) initSchema() error {
 type migration struct {
 	version int
 	sql     string
+	after   func(s *Store) error // optional data migration run once after sql is applied
 }
 
 var migrations = []migration{
@@ -230,6 +238,66 @@ var migrations = []migration{
 		CREATE INDEX IF NOT EXISTS idx_channel_events_channel_created ON channel_events(channel_id, created_at);
 		`,
 	},
+	{
+		version: 4,
+		sql: `
+		CREATE TABLE IF NOT EXISTS hll_sketches (
+			kind INTEGER NOT NULL,
+			ref TEXT NOT NULL,
+			registers BLOB NOT NULL,
+			PRIMARY KEY (kind, ref)
+		);
+		`,
+		after: (*Store).rebuildSketches,
+	},
+	{
+		version: 5,
+		sql: `
+		CREATE TABLE IF NOT EXISTS management_lists (
+			list TEXT NOT NULL,
+			value TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (list, value)
+		);
+		CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);
+		`,
+	},
+	{
+		version: 6,
+		sql: `
+		CREATE TABLE IF NOT EXISTS bans (
+			key TEXT PRIMARY KEY,
+			reason TEXT NOT NULL DEFAULT '',
+			until INTEGER NOT NULL,
+			pubkeys TEXT NOT NULL DEFAULT '[]',
+			strikes INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL
+		);
+		`,
+	},
+	{
+		version: 7,
+		sql: `
+		CREATE TABLE IF NOT EXISTS reports (
+			target_type TEXT NOT NULL,
+			target TEXT NOT NULL,
+			reporter TEXT NOT NULL,
+			type TEXT NOT NULL DEFAULT '',
+			event_id TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (target_type, target, reporter)
+		);
+		CREATE TABLE IF NOT EXISTS reporter_reputation (
+			pubkey TEXT PRIMARY KEY,
+			upheld INTEGER NOT NULL DEFAULT 0,
+			dismissed INTEGER NOT NULL DEFAULT 0
+		);
+		`,
+	},
 }
 
 func (s *Store) runMigrations() error {
@@ -250,6 +318,11 @@ func (s *Store) runMigrations() error {
 		if err != nil {
 			return fmt.Errorf("failed to apply migration %d: %w", m.version, err)
 		}
+		if m.after != nil {
+			if err := m.after(s); err != nil {
+				return fmt.Errorf("failed to apply migration %d: %w", m.version, err)
+			}
+		}
 
 		// Record migration
 		_, err = s.db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", m.version, time.Now().Unix())
@@ -322,6 +395,10 @@ func (s *Store) SaveEvent(ctx context.Context, evt *event.Event) error {
 		return fmt.Errorf("failed to save event: %w", err)
 	}
 
+	if err := updateSketches(ctx, s.db, evt); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -377,6 +454,10 @@ func (s *Store) SaveEvents(ctx context.Context, events []*event.Event) error {
 		if _, err := stmt.ExecContext(ctx, evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, tagsJSON, evt.Content, evt.Sig); err != nil {
 			return fmt.Errorf("failed to save event %s: %w", evt.ID, err)
 		}
+
+		if err := updateSketches(ctx, tx, evt); err != nil {
+			return err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -801,6 +882,196 @@ func (s *Store) countFilter(ctx context.Context, filter *event.Filter, seen map[
 	return count, nil
 }
 
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// updateSketches adds the event author to the NIP-45 sketches the event contributes to.
+func updateSketches(ctx context.Context, db sqlExecer, evt *event.Event) error {
+	for _, ref := range nip45.EventRefs(evt) {
+		if err := updateSketch(ctx, db, ref, evt.PubKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateSketch adds a pubkey to a sketch. Registers are only written back when
+// they change, and only over the registers they were merged into, so that
+// concurrent saves cannot overwrite each other's updates; the merge is
+// retried when another save got there first.
+func updateSketch(ctx context.Context, db sqlExecer, ref nip45.SketchRef, pubkey string) error {
+	for {
+		sketch := nip45.NewSketch(ref)
+		var registers []byte
+		err := db.QueryRowContext(ctx, "SELECT registers FROM hll_sketches WHERE kind = ? AND ref = ?",
+			ref.Kind, ref.Ref).Scan(&registers)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to load HLL sketch: %w", err)
+		}
+		if err == nil {
+			if sketch, err = nip45.LoadSketch(ref, registers); err != nil {
+				return fmt.Errorf("failed to load HLL sketch: %w", err)
+			}
+		}
+
+		if !nip45.AddPubKey(sketch, pubkey) {
+			return nil
+		}
+
+		var res sql.Result
+		if registers == nil {
+			res, err = db.ExecContext(ctx, "INSERT INTO hll_sketches (kind, ref, registers) VALUES (?, ?, ?) ON CONFLICT (kind, ref) DO NOTHING",
+				ref.Kind, ref.Ref, sketch.GetRegisters())
+		} else {
+			res, err = db.ExecContext(ctx, "UPDATE hll_sketches SET registers = ? WHERE kind = ? AND ref = ? AND registers = ?",
+				sketch.GetRegisters(), ref.Kind, ref.Ref, registers)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save HLL sketch: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+	}
+}
+
+// rebuildSketches recomputes all NIP-45 sketches from the stored events.
+func (s *Store) rebuildSketches() error {
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM hll_sketches"); err != nil {
+		return fmt.Errorf("failed to clear HLL sketches: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, pubkey, kind, tags FROM events
+		WHERE kind IN (3, 7, 1111) AND id NOT IN (SELECT id FROM deleted_events)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to query events for HLL sketches: %w", err)
+	}
+
+	var events []*event.Event
+	for rows.Next() {
+		evt := &event.Event{}
+		var tagsJSON sql.NullString
+		if err := rows.Scan(&evt.ID, &evt.PubKey, &evt.Kind, &tagsJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		evt.Tags = jsonToTags(tagsJSON.String)
+		events = append(events, evt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating events: %w", err)
+	}
+
+	for _, evt := range events {
+		if err := updateSketches(ctx, tx, evt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// tagCondition builds a WHERE clause matching events carrying a tag with the
+// given name whose value starts with any of the given values. It relies on the
+// deterministic tags serialization used by SaveEvent.
+func tagCondition(name string, values []string) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	for _, v := range values {
+		clauses = append(clauses, "tags GLOB ?")
+		prefix := `["` + strings.ReplaceAll(name, `"`, `\"`) + `","` + strings.ReplaceAll(v, `"`, `\"`)
+		args = append(args, "*"+globEscape(prefix)+"*")
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// globEscape escapes SQLite GLOB metacharacters so the string matches literally.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[':
+			b.WriteRune('[')
+			b.WriteRune(r)
+			b.WriteRune(']')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// CountEventsHLL counts events for a NIP-45 HyperLogLog-eligible filter.
+// Sets whose sketch estimates fewer than nip45.ExactCountThreshold authors are
+// counted exactly; larger sets are answered from the sketch.
+//
+// Sketches only grow: authors of deleted, replaced or expired events stay in
+// them until the sketches are rebuilt, so approximate counts may drift above
+// the number of authors still stored.
+func (s *Store) CountEventsHLL(ctx context.Context, filter *event.Filter, ref nip45.SketchRef) (*nip45.Result, error) {
+	var registers []byte
+	err := s.db.QueryRowContext(ctx, "SELECT registers FROM hll_sketches WHERE kind = ? AND ref = ?",
+		ref.Kind, ref.Ref).Scan(&registers)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load HLL sketch: %w", err)
+	}
+	if err == nil {
+		sketch, err := nip45.LoadSketch(ref, registers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load HLL sketch: %w", err)
+		}
+		if estimate := sketch.Count(); estimate >= nip45.ExactCountThreshold {
+			return &nip45.Result{Count: int(estimate), Registers: sketch.GetRegisters(), Approximate: true}, nil
+		}
+	}
+
+	// Small set: count exactly and compute registers from the matching authors
+	conditions := []string{"kind = ?", "id NOT IN (SELECT id FROM deleted_events)"}
+	args := []interface{}{ref.Kind}
+	for name, values := range filter.Tags {
+		cond, condArgs := tagCondition(name, values)
+		conditions = append(conditions, cond)
+		args = append(args, condArgs...)
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT pubkey FROM events WHERE "+strings.Join(conditions, " AND "), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute count query: %w", err)
+	}
+	defer rows.Close()
+
+	exact := nip45.NewSketch(ref)
+	count := 0
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		count++
+		nip45.AddPubKey(exact, pubkey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating events: %w", err)
+	}
+
+	return &nip45.Result{Count: count, Registers: exact.GetRegisters()}, nil
+}
+
 // DeleteEventsOlderThan deletes all events older than the specified duration,
 // excluding exempt kinds (e.g., profile metadata, relay lists).
 func (s *Store) DeleteEventsOlderThan(ctx context.Context, before int64, exemptKinds []int) (int, error) {
@@ -830,6 +1101,30 @@ func (s *Store) DeleteEventsOlderThan(ctx context.Context, before int64, exemptK
 	return int(n), nil
 }
 
+// DeleteKindsOlderThan deletes events of the given kinds older than the
+// specified timestamp (e.g., expired gift wraps).
+func (s *Store) DeleteKindsOlderThan(ctx context.Context, kinds []int, before int64) (int, error) {
+	if len(kinds) == 0 {
+		return 0, nil
+	}
+
+	placeholders := make([]string, len(kinds))
+	args := []interface{}{before}
+	for i, k := range kinds {
+		placeholders[i] = "?"
+		args = append(args, k)
+	}
+
+	query := fmt.Sprintf("DELETE FROM events WHERE created_at < ? AND kind IN (%s)",
+		strings.Join(placeholders, ","))
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old events: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
 // PruneDeletedEvents removes old entries from the deleted_events table
 // This helps keep the database size manageable
 func (s *Store) PruneDeletedEvents(ctx context.Context, age time.Duration) (int64, error) {
@@ -2,14 +2,19 @@ package sqlite
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/paul/glienicke/internal/testutil"
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip45"
 	"github.com/paul/glienicke/pkg/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -292,6 +297,34 @@ func TestSQLiteStore_DeleteEvent_NotFound(t *testing.T) {
 	assert.Equal(t, storage.ErrNotFound, err)
 }
 
+func TestSQLiteStore_DeleteKindsOlderThan(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+
+	// Test events are created at 1234567890
+	wrap := createTestEvent(t, 1059, "ciphertext", nil)
+	note := createTestEvent(t, 1, "Test content", nil)
+	for _, evt := range []*event.Event{wrap, note} {
+		require.NoError(t, store.SaveEvent(ctx, evt))
+	}
+
+	// Only events before the cutoff are deleted
+	deleted, err := store.DeleteKindsOlderThan(ctx, []int{1059}, 1234567890)
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	deleted, err = store.DeleteKindsOlderThan(ctx, []int{1059}, 1234567891)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	events, err := store.QueryEvents(ctx, []*event.Filter{{}})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, note.ID, events[0].ID)
+}
+
 func TestSQLiteStore_CountEvents(t *testing.T) {
 	store := setupTestDB(t)
 	defer store.Close()
@@ -447,3 +480,219 @@ func TestSQLiteStore_EventWithTags(t *testing.T) {
 		assert.Equal(t, expectedTag, retrieved.Tags[i])
 	}
 }
+
+func TestSQLiteStore_CountEventsHLL(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := New(filepath.Join(tmpDir, "hll.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.Background()
+
+	note := createTestEvent(t, 1, "Note to react to", nil)
+	require.NoError(t, store.SaveEvent(ctx, note))
+
+	filter := &event.Filter{Kinds: []int{7}, Tags: map[string][]string{"e": {note.ID}}}
+	ref, ok := nip45.ParseRef(filter)
+	require.True(t, ok)
+
+	t.Run("small sets are counted exactly", func(t *testing.T) {
+		var reactions []*event.Event
+		for i := 0; i < 5; i++ {
+			reaction := createTestEvent(t, 7, "+", [][]string{{"e", note.ID}})
+			reactions = append(reactions, reaction)
+			require.NoError(t, store.SaveEvent(ctx, reaction))
+		}
+		require.NoError(t, store.SaveEvent(ctx, createTestEvent(t, 7, "+", [][]string{{"e", "other"}})))
+		require.NoError(t, store.DeleteEvent(ctx, reactions[0].ID, reactions[0].PubKey))
+
+		result, err := store.CountEventsHLL(ctx, filter, ref)
+		require.NoError(t, err)
+		assert.Equal(t, 4, result.Count)
+		assert.False(t, result.Approximate)
+		assert.Len(t, result.Registers, 256)
+	})
+
+	t.Run("large sets are estimated from the sketch", func(t *testing.T) {
+		var batch []*event.Event
+		for i := 0; i < 2000; i++ {
+			pubkey := make([]byte, 32)
+			_, err := rand.Read(pubkey)
+			require.NoError(t, err)
+			batch = append(batch, &event.Event{
+				ID:     fmt.Sprintf("%064x", i),
+				PubKey: hex.EncodeToString(pubkey),
+				Kind:   7,
+				Tags:   [][]string{{"e", note.ID}},
+				Sig:    "sig",
+			})
+		}
+		require.NoError(t, store.SaveEvents(ctx, batch))
+
+		result, err := store.CountEventsHLL(ctx, filter, ref)
+		require.NoError(t, err)
+		assert.True(t, result.Approximate)
+		assert.InDelta(t, 2005, result.Count, 2005*0.2)
+	})
+
+	t.Run("sketches are rebuilt from stored events", func(t *testing.T) {
+		_, err = store.db.Exec("DELETE FROM hll_sketches")
+		require.NoError(t, err)
+		require.NoError(t, store.rebuildSketches())
+
+		result, err := store.CountEventsHLL(ctx, filter, ref)
+		require.NoError(t, err)
+		assert.True(t, result.Approximate)
+		assert.InDelta(t, 2004, result.Count, 2004*0.2)
+	})
+
+	t.Run("concurrent saves do not lose sketch updates", func(t *testing.T) {
+		// Interleave the saves even on a single CPU
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+		target := createTestEvent(t, 1, "Popular note", nil)
+		require.NoError(t, store.SaveEvent(ctx, target))
+		reactions := make([]*event.Event, 500)
+		for i := range reactions {
+			reactions[i] = createTestEvent(t, 7, "+", [][]string{{"e", target.ID}})
+		}
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make(chan error, len(reactions))
+		for _, reaction := range reactions {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				errs <- store.SaveEvent(ctx, reaction)
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		load := func() []byte {
+			var registers []byte
+			require.NoError(t, store.db.QueryRow("SELECT registers FROM hll_sketches WHERE kind = 7 AND ref = ?", target.ID).Scan(&registers))
+			return registers
+		}
+		saved := load()
+		require.NoError(t, store.rebuildSketches())
+		assert.Equal(t, load(), saved)
+	})
+}
+
+func TestSQLiteStore_ManagementState(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "management.db")
+	ctx := context.Background()
+
+	store, err := New(dbPath)
+	require.NoError(t, err)
+
+	require.NoError(t, store.AddListEntry(ctx, "banned_pubkeys", "aa", "spam"))
+	require.NoError(t, store.AddListEntry(ctx, "banned_pubkeys", "bb", ""))
+	require.NoError(t, store.AddListEntry(ctx, "banned_pubkeys", "aa", "spam and abuse"))
+	require.NoError(t, store.AddListEntry(ctx, "blocked_ips", "10.0.0.1", ""))
+	require.NoError(t, store.RemoveListEntry(ctx, "banned_pubkeys", "bb"))
+	require.NoError(t, store.RemoveListEntry(ctx, "banned_pubkeys", "missing"))
+	require.NoError(t, store.SetSetting(ctx, "relay_name", "first"))
+	require.NoError(t, store.SetSetting(ctx, "relay_name", "second"))
+	require.NoError(t, store.Close())
+
+	// State survives reopening the database
+	store, err = New(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	entries, err := store.ListEntries(ctx, "banned_pubkeys")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "aa", entries[0].Value)
+	assert.Equal(t, "spam and abuse", entries[0].Reason)
+
+	entries, err = store.ListEntries(ctx, "blocked_ips")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	name, err := store.GetSetting(ctx, "relay_name")
+	require.NoError(t, err)
+	assert.Equal(t, "second", name)
+
+	_, err = store.GetSetting(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestSQLiteStore_Bans(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "bans.db")
+	ctx := context.Background()
+
+	store, err := New(dbPath)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SaveBan(ctx, storage.Ban{Key: "ip:10.0.0.1", Reason: "flood", Until: 100, PubKeys: []string{"aa", "bb"}, Strikes: 1, CreatedAt: 50}))
+	require.NoError(t, store.SaveBan(ctx, storage.Ban{Key: "pubkey:cc", Until: 200, CreatedAt: 60}))
+	require.NoError(t, store.SaveBan(ctx, storage.Ban{Key: "ip:10.0.0.1", Reason: "flood again", Until: 300, Strikes: 2, CreatedAt: 70}))
+	require.NoError(t, store.SaveBan(ctx, storage.Ban{Key: "ip:10.0.0.2", Until: 400}))
+	require.NoError(t, store.DeleteBan(ctx, "ip:10.0.0.2"))
+	require.NoError(t, store.DeleteBan(ctx, "missing"))
+	require.NoError(t, store.Close())
+
+	// Bans survive reopening the database
+	store, err = New(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	bans, err := store.ListBans(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Ban{
+		{Key: "ip:10.0.0.1", Reason: "flood again", Until: 300, PubKeys: []string{}, Strikes: 2, CreatedAt: 70},
+		{Key: "pubkey:cc", Until: 200, PubKeys: []string{}, CreatedAt: 60},
+	}, bans)
+}
+
+func TestSQLiteStore_Reports(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "reports.db")
+	ctx := context.Background()
+
+	store, err := New(dbPath)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SaveReport(ctx, storage.Report{TargetType: "event", Target: "e1", Reporter: "aa", Type: "spam", EventID: "r1", CreatedAt: 10}))
+	require.NoError(t, store.SaveReport(ctx, storage.Report{TargetType: "event", Target: "e1", Reporter: "bb", Type: "spam", EventID: "r2", CreatedAt: 20}))
+	require.NoError(t, store.SaveReport(ctx, storage.Report{TargetType: "pubkey", Target: "cc", Reporter: "aa", EventID: "r3", CreatedAt: 30}))
+	// A reporter's new report of a target replaces the earlier one
+	require.NoError(t, store.SaveReport(ctx, storage.Report{TargetType: "event", Target: "e1", Reporter: "aa", Type: "illegal", EventID: "r4", CreatedAt: 40}))
+	require.NoError(t, store.SaveReputation(ctx, storage.Reputation{PubKey: "bb", Upheld: 1}))
+	require.NoError(t, store.SaveReputation(ctx, storage.Reputation{PubKey: "aa", Upheld: 2, Dismissed: 1}))
+	require.NoError(t, store.SaveReputation(ctx, storage.Reputation{PubKey: "bb", Upheld: 1, Dismissed: 3}))
+	require.NoError(t, store.Close())
+
+	// Reports and reputations survive reopening the database
+	store, err = New(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	reports, err := store.ListReports(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Report{
+		{TargetType: "event", Target: "e1", Reporter: "bb", Type: "spam", EventID: "r2", CreatedAt: 20},
+		{TargetType: "pubkey", Target: "cc", Reporter: "aa", EventID: "r3", CreatedAt: 30},
+		{TargetType: "event", Target: "e1", Reporter: "aa", Type: "illegal", EventID: "r4", CreatedAt: 40},
+	}, reports)
+
+	require.NoError(t, store.DeleteReports(ctx, "event", "e1"))
+	reports, err = store.ListReports(ctx)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, "cc", reports[0].Target)
+
+	reps, err := store.ListReputations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Reputation{
+		{PubKey: "aa", Upheld: 2, Dismissed: 1},
+		{PubKey: "bb", Upheld: 1, Dismissed: 3},
+	}, reps)
+}
@@ -0,0 +1,36 @@
+package testutil
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+)
+
+// NIP98Header builds a NIP-98 "Authorization" header value signed by kp for
+// the given absolute URL and method. A payload tag is added if body is non-nil.
+func NIP98Header(kp *KeyPair, url, method string, body []byte) (string, error) {
+	tags := [][]string{{"u", url}, {"method", method}}
+	if body != nil {
+		sum := sha256.Sum256(body)
+		tags = append(tags, []string{"payload", hex.EncodeToString(sum[:])})
+	}
+
+	evt := &event.Event{
+		Kind:      27235,
+		Tags:      tags,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := kp.SignEvent(evt); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return "", err
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString(data), nil
+}
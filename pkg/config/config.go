@@ -1,12 +1,20 @@
 package config
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/nips/nip11"
+	"github.com/paul/glienicke/pkg/nips/nip56"
 	"gopkg.in/yaml.v3"
 )
 
@@ -15,15 +23,22 @@ type Config struct {
 	Database  DatabaseConfig  `yaml:"database" json:"database"`
 	RateLimit RateLimitConfig `yaml:"rate_limit" json:"rate_limit"`
 	Logging   LoggingConfig   `yaml:"logging" json:"logging"`
-	Features  FeaturesConfig  `yaml:"features"`
+	Features  FeaturesConfig  `yaml:"features" json:"features"`
+	Relay     RelayConfig     `yaml:"relay" json:"relay"`
+	Info      InfoConfig      `yaml:"info" json:"info"`
 }
 
 type NetworkConfig struct {
-	Address      string `yaml:"address" json:"address" env:"GLIENICKE_ADDRESS"`
-	TLSCert      string `yaml:"tls_cert" json:"tls_cert" env:"GLIENICKE_TLS_CERT"`
-	TLSKey       string `yaml:"tls_key" json:"tls_key" env:"GLIENICKE_TLS_KEY"`
-	ReadTimeout  int    `yaml:"read_timeout" json:"read_timeout" env:"GLIENICKE_READ_TIMEOUT"`
-	WriteTimeout int    `yaml:"write_timeout" json:"write_timeout" env:"GLIENICKE_WRITE_TIMEOUT"`
+	Address         string `yaml:"address" json:"address" env:"GLIENICKE_ADDRESS"`
+	TLSCert         string `yaml:"tls_cert" json:"tls_cert" env:"GLIENICKE_TLS_CERT"`
+	TLSKey          string `yaml:"tls_key" json:"tls_key" env:"GLIENICKE_TLS_KEY"`
+	ReadTimeout     int    `yaml:"read_timeout" json:"read_timeout" env:"GLIENICKE_READ_TIMEOUT"`
+	WriteTimeout    int    `yaml:"write_timeout" json:"write_timeout" env:"GLIENICKE_WRITE_TIMEOUT"`
+	ShutdownTimeout int    `yaml:"shutdown_timeout" json:"shutdown_timeout" env:"GLIENICKE_SHUTDOWN_TIMEOUT"`
+	// Reverse proxies (addresses or CIDR networks) whose forwarding headers
+	// and PROXY protocol headers are believed
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies" env:"GLIENICKE_TRUSTED_PROXIES"`
+	ProxyProtocol  bool     `yaml:"proxy_protocol" json:"proxy_protocol" env:"GLIENICKE_PROXY_PROTOCOL"`
 }
 
 type DatabaseConfig struct {
@@ -33,31 +48,213 @@ type DatabaseConfig struct {
 	ConnMaxLifetime int    `yaml:"conn_max_lifetime" json:"conn_max_lifetime" env:"GLIENICKE_DB_CONN_MAX_LIFETIME"`
 }
 
+// RateLimitConfig holds the message rate limits, their escalation to bans and
+// the connection limits. The top-level rates apply per IP to anonymous
+// clients; authenticated and trusted clients are limited per pubkey.
 type RateLimitConfig struct {
-	Enabled        bool `yaml:"enabled" json:"enabled" env:"GLIENICKE_RATE_LIMIT_ENABLED"`
-	EventsPerSec   int  `yaml:"events_per_sec" json:"events_per_sec" env:"GLIENICKE_RATE_LIMIT_EVENTS_PER_SEC"`
-	ReqPerSec      int  `yaml:"req_per_sec" json:"req_per_sec" env:"GLIENICKE_RATE_LIMIT_REQ_PER_SEC"`
-	MaxConnections int  `yaml:"max_connections" json:"max_connections" env:"GLIENICKE_RATE_LIMIT_MAX_CONNECTIONS"`
-	MaxEventSize   int  `yaml:"max_event_size" json:"max_event_size" env:"GLIENICKE_RATE_LIMIT_MAX_EVENT_SIZE"`
+	Enabled        bool             `yaml:"enabled" json:"enabled" env:"GLIENICKE_RATE_LIMIT_ENABLED"`
+	EventsPerSec   int              `yaml:"events_per_sec" json:"events_per_sec" env:"GLIENICKE_RATE_LIMIT_EVENTS_PER_SEC"`
+	ReqPerSec      int              `yaml:"req_per_sec" json:"req_per_sec" env:"GLIENICKE_RATE_LIMIT_REQ_PER_SEC"`
+	CountPerSec    int              `yaml:"count_per_sec" json:"count_per_sec" env:"GLIENICKE_RATE_LIMIT_COUNT_PER_SEC"`
+	Burst          float64          `yaml:"burst" json:"burst"`             // bucket size in seconds of the rate
+	IPv6Prefix     int              `yaml:"ipv6_prefix" json:"ipv6_prefix"` // IPv6 clients share limits per network of this size
+	Authenticated  RateTierConfig   `yaml:"authenticated" json:"authenticated"`
+	Trusted        RateTierConfig   `yaml:"trusted" json:"trusted"`
+	TrustedPubKeys []string         `yaml:"trusted_pubkeys" json:"trusted_pubkeys"`
+	Kinds          map[int]float64  `yaml:"kinds" json:"kinds"` // EVENTs per second per kind and client
+	Escalation     EscalationConfig `yaml:"escalation" json:"escalation"`
+	MaxEventSize   int              `yaml:"max_event_size" json:"max_event_size" env:"GLIENICKE_RATE_LIMIT_MAX_EVENT_SIZE"`
+	// Concurrent WebSocket connections per IP, per IPv6 network of
+	// ipv6_prefix and in total, and new connections per second per network
+	MaxConnections           int `yaml:"max_connections" json:"max_connections" env:"GLIENICKE_RATE_LIMIT_MAX_CONNECTIONS"`
+	MaxConnectionsPerNetwork int `yaml:"max_connections_per_network" json:"max_connections_per_network" env:"GLIENICKE_RATE_LIMIT_MAX_CONNECTIONS_PER_NETWORK"`
+	MaxTotalConnections      int `yaml:"max_total_connections" json:"max_total_connections" env:"GLIENICKE_RATE_LIMIT_MAX_TOTAL_CONNECTIONS"`
+	ConnectionsPerSec        int `yaml:"connections_per_sec" json:"connections_per_sec" env:"GLIENICKE_RATE_LIMIT_CONNECTIONS_PER_SEC"`
+	// Limiter state is dropped for the least recently seen clients beyond
+	// max_tracked_clients and for clients idle for idle_timeout seconds
+	MaxTrackedClients int `yaml:"max_tracked_clients" json:"max_tracked_clients" env:"GLIENICKE_RATE_LIMIT_MAX_TRACKED_CLIENTS"`
+	IdleTimeout       int `yaml:"idle_timeout" json:"idle_timeout"`
+}
+
+// RateTierConfig holds per-pubkey message rates. Zero rates of the
+// authenticated tier are the anonymous per-IP rates; zero rates of the
+// trusted tier are unlimited.
+type RateTierConfig struct {
+	EventsPerSec float64 `yaml:"events_per_sec" json:"events_per_sec"`
+	ReqPerSec    float64 `yaml:"req_per_sec" json:"req_per_sec"`
+	CountPerSec  float64 `yaml:"count_per_sec" json:"count_per_sec"`
+}
+
+// EscalationConfig turns repeated rate limit violations into temporary and
+// long bans. Durations are in seconds.
+type EscalationConfig struct {
+	Violations      int `yaml:"violations" json:"violations"`               // within window, before a temporary ban
+	Window          int `yaml:"window" json:"window"`                       // violations further apart start over
+	BanDuration     int `yaml:"ban_duration" json:"ban_duration"`           // temporary ban
+	LongBanAfter    int `yaml:"long_ban_after" json:"long_ban_after"`       // temporary bans before a long ban
+	LongBanDuration int `yaml:"long_ban_duration" json:"long_ban_duration"` // long ban
 }
 
 type LoggingConfig struct {
-	Level  string `yaml:"level" json:"level" env:"GLIENICKE_LOG_LEVEL"`
-	Format string `yaml:"format" json:"format" env:"GLIENICKE_LOG_FORMAT"`
+	Level      string            `yaml:"level" json:"level" env:"GLIENICKE_LOG_LEVEL"`
+	Format     string            `yaml:"format" json:"format" env:"GLIENICKE_LOG_FORMAT"`
+	Subsystems map[string]string `yaml:"subsystems" json:"subsystems"`
+	Sampling   SamplingConfig    `yaml:"sampling" json:"sampling"`
+}
+
+// SamplingConfig limits repeated log messages below error level: per interval
+// the first Initial identical messages are logged, then every Thereafter-th.
+type SamplingConfig struct {
+	Initial    int `yaml:"initial" json:"initial"`
+	Thereafter int `yaml:"thereafter" json:"thereafter"`
+	Interval   int `yaml:"interval" json:"interval"` // seconds
+}
+
+// Options returns the logging setup described by c
+func (c *LoggingConfig) Options() logging.Config {
+	return logging.Config{
+		Level:      c.Level,
+		Format:     c.Format,
+		Subsystems: c.Subsystems,
+		Sampling: logging.Sampling{
+			Initial:    c.Sampling.Initial,
+			Thereafter: c.Sampling.Thereafter,
+			Interval:   time.Duration(c.Sampling.Interval) * time.Second,
+		},
+	}
+}
+
+// Relay modes
+const (
+	ModePublic = "public" // accept any event the relay's policies allow
+	ModeInbox  = "inbox"  // NIP-17 DM inbox: only direct messages for registered users
+)
+
+// RelayConfig holds the relay's protocol policy: authentication, retention,
+// query limits, access-control lists, the relay mode, NIP-56 moderation and
+// the optional NIP-13, NIP-36 and NIP-86 modules.
+type RelayConfig struct {
+	Mode                  string            `yaml:"mode" json:"mode" env:"GLIENICKE_RELAY_MODE"` // public (default) or inbox (NIP-17 DM inbox)
+	RequireAuth           bool              `yaml:"require_auth" json:"require_auth" env:"GLIENICKE_REQUIRE_AUTH"`
+	RetentionDays         int               `yaml:"retention_days" json:"retention_days" env:"GLIENICKE_RETENTION_DAYS"`
+	GiftWrapRetentionDays int               `yaml:"gift_wrap_retention_days" json:"gift_wrap_retention_days" env:"GLIENICKE_GIFT_WRAP_RETENTION_DAYS"` // 0 = retention_days
+	MaxEventsPerREQ       int               `yaml:"max_events_per_req" json:"max_events_per_req"`
+	CloseAfterEOSE        bool              `yaml:"close_after_eose" json:"close_after_eose"`
+	QueryTimeout          int               `yaml:"query_timeout" json:"query_timeout"` // seconds, 0 = no timeout
+	MaxRequestCost        float64           `yaml:"max_request_cost" json:"max_request_cost"`
+	MaxConnectionCost     float64           `yaml:"max_connection_cost" json:"max_connection_cost"`
+	ClampWindow           int               `yaml:"clamp_window" json:"clamp_window"` // seconds
+	MinPoW                int               `yaml:"min_pow" json:"min_pow"`
+	MinPoWKinds           map[int]int       `yaml:"min_pow_kinds" json:"min_pow_kinds"`                       // per-kind difficulty overriding min_pow
+	PoWExemptAuth         bool              `yaml:"pow_exempt_authenticated" json:"pow_exempt_authenticated"` // no PoW for NIP-42 authenticated authors
+	PoWExemptKnown        bool              `yaml:"pow_exempt_known" json:"pow_exempt_known"`                 // no PoW for authors with stored events
+	NIP36Vocab            string            `yaml:"nip36_vocab" json:"nip36_vocab"`
+	AdminPubKeys          []string          `yaml:"admin_pubkeys" json:"admin_pubkeys" env:"GLIENICKE_ADMIN_PUBKEYS"`
+	ACLFiles              []string          `yaml:"acl_files" json:"acl_files" env:"GLIENICKE_ACL_FILES"`
+	WritePolicy           WritePolicyConfig `yaml:"write_policy" json:"write_policy"`
+	Moderation            ModerationConfig  `yaml:"moderation" json:"moderation"`
+	// SecretKey is the relay's own hex key, which signs NIP-29 group state;
+	// empty = generated on first start and kept in the database
+	SecretKey string `yaml:"secret_key" json:"secret_key" env:"GLIENICKE_RELAY_SECRET_KEY"`
+}
+
+// WritePolicyConfig configures the external write-policy plugin, a process
+// speaking the strfry write-policy protocol on stdin/stdout.
+type WritePolicyConfig struct {
+	Command  string `yaml:"command" json:"command" env:"GLIENICKE_WRITE_POLICY"` // empty = disabled
+	Timeout  int    `yaml:"timeout" json:"timeout"`                              // seconds per event
+	FailOpen bool   `yaml:"fail_open" json:"fail_open"`                          // accept events when the plugin fails
+}
+
+// ModerationConfig configures the automatic actions on NIP-56 reports. Reports
+// are queued for review through the NIP-86 API regardless; admins count as
+// moderators.
+type ModerationConfig struct {
+	Moderators       []string `yaml:"moderators" json:"moderators" env:"GLIENICKE_MODERATOR_PUBKEYS"`
+	TrustedReporters []string `yaml:"trusted_reporters" json:"trusted_reporters"`
+	// Hide an event reported by this many distinct trusted reporters until
+	// it is reviewed (0 = never)
+	HideAfter int `yaml:"hide_after" json:"hide_after"`
+	// Report types with which a moderator's report deletes an event or blob
+	DeleteTypes []string `yaml:"delete_types" json:"delete_types"`
+	// Reporters become trusted once this many more of their reports were
+	// upheld than dismissed, and are ignored once this many more were
+	// dismissed than upheld (0 = never)
+	TrustedReputation int `yaml:"trusted_reputation" json:"trusted_reputation"`
+	IgnoreReputation  int `yaml:"ignore_reputation" json:"ignore_reputation"`
+	// Reports from untrusted reporters are not queued beyond these many per
+	// target, pending per reporter and in the whole queue (0 = unlimited)
+	MaxReportsPerTarget   int `yaml:"max_reports_per_target" json:"max_reports_per_target"`
+	MaxReportsPerReporter int `yaml:"max_reports_per_reporter" json:"max_reports_per_reporter"`
+	MaxQueuedReports      int `yaml:"max_queued_reports" json:"max_queued_reports"`
 }
 
 type FeaturesConfig struct {
 	NIP11 bool `yaml:"nip11" json:"nip11" env:"GLIENICKE_FEATURE_NIP11"`
 	NIP42 bool `yaml:"nip42" json:"nip42" env:"GLIENICKE_FEATURE_NIP42"`
 	NIP28 bool `yaml:"nip28" json:"nip28" env:"GLIENICKE_FEATURE_NIP28"`
+	NIP29 bool `yaml:"nip29" json:"nip29" env:"GLIENICKE_FEATURE_NIP29"` // relay-based groups
+}
+
+// InfoConfig holds the operator-provided fields of the NIP-11 relay
+// information document. Supported NIPs and enforced limits are filled in by
+// the relay itself.
+type InfoConfig struct {
+	Name             string            `yaml:"name" json:"name"`
+	Description      string            `yaml:"description" json:"description"`
+	Banner           string            `yaml:"banner" json:"banner"`
+	Icon             string            `yaml:"icon" json:"icon"`
+	PubKey           string            `yaml:"pubkey" json:"pubkey"`
+	Self             string            `yaml:"self" json:"self"`
+	Contact          string            `yaml:"contact" json:"contact"`
+	TermsOfService   string            `yaml:"terms_of_service" json:"terms_of_service"`
+	PostingPolicy    string            `yaml:"posting_policy" json:"posting_policy"`
+	PaymentsURL      string            `yaml:"payments_url" json:"payments_url"`
+	PaymentRequired  bool              `yaml:"payment_required" json:"payment_required"`
+	RestrictedWrites bool              `yaml:"restricted_writes" json:"restricted_writes"`
+	RelayCountries   []string          `yaml:"relay_countries" json:"relay_countries"`
+	LanguageTags     []string          `yaml:"language_tags" json:"language_tags"`
+	Tags             []string          `yaml:"tags" json:"tags"`
+	Retention        []nip11.Retention `yaml:"retention" json:"retention"`
+	Fees             *nip11.Fees       `yaml:"fees" json:"fees"`
+}
+
+// Document returns the NIP-11 fields configured in c
+func (c *InfoConfig) Document() *nip11.RelayInformationDocument {
+	doc := &nip11.RelayInformationDocument{
+		Name:           c.Name,
+		Description:    c.Description,
+		Banner:         c.Banner,
+		Icon:           c.Icon,
+		Pubkey:         c.PubKey,
+		Self:           c.Self,
+		Contact:        c.Contact,
+		TermsOfService: c.TermsOfService,
+		PostingPolicy:  c.PostingPolicy,
+		PaymentsURL:    c.PaymentsURL,
+		RelayCountries: c.RelayCountries,
+		LanguageTags:   c.LanguageTags,
+		Tags:           c.Tags,
+		Retention:      c.Retention,
+		Fees:           c.Fees,
+	}
+	if c.PaymentRequired || c.RestrictedWrites {
+		doc.Limitation = &nip11.RelayLimitation{
+			PaymentRequired:  c.PaymentRequired,
+			RestrictedWrites: c.RestrictedWrites,
+		}
+	}
+	return doc
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		Network: NetworkConfig{
-			Address:      ":8080",
-			ReadTimeout:  30,
-			WriteTimeout: 30,
+			Address:         ":8080",
+			ReadTimeout:     30,
+			WriteTimeout:    30,
+			ShutdownTimeout: 30,
+			TrustedProxies:  []string{"127.0.0.0/8", "::1/128"},
 		},
 		Database: DatabaseConfig{
 			Path:            "relay.db",
@@ -66,20 +263,58 @@ func DefaultConfig() *Config {
 			ConnMaxLifetime: 300,
 		},
 		RateLimit: RateLimitConfig{
-			Enabled:        true,
-			EventsPerSec:   10,
-			ReqPerSec:      10,
-			MaxConnections: 100,
-			MaxEventSize:   65536,
+			Enabled:      true,
+			EventsPerSec: 10,
+			ReqPerSec:    10,
+			CountPerSec:  10,
+			Burst:        2,
+			IPv6Prefix:   64,
+			Escalation: EscalationConfig{
+				Violations:      10,
+				Window:          60,
+				BanDuration:     600,
+				LongBanAfter:    3,
+				LongBanDuration: 86400,
+			},
+			MaxConnections:           100,
+			MaxConnectionsPerNetwork: 200,
+			ConnectionsPerSec:        5,
+			MaxEventSize:             65536,
+			MaxTrackedClients:        100000,
+			IdleTimeout:              600,
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
 			Format: "text",
+			Sampling: SamplingConfig{
+				Initial:    100,
+				Thereafter: 100,
+				Interval:   1,
+			},
 		},
 		Features: FeaturesConfig{
 			NIP11: true,
 			NIP42: true,
-			NIP28: false,
+			NIP28: true,
+		},
+		Relay: RelayConfig{
+			Mode:              ModePublic,
+			RetentionDays:     30,
+			MaxEventsPerREQ:   100,
+			QueryTimeout:      30,
+			MaxRequestCost:    event.DefaultMaxRequestCost,
+			MaxConnectionCost: event.DefaultMaxConnectionCost,
+			ClampWindow:       event.DefaultClampWindow,
+			WritePolicy:       WritePolicyConfig{Timeout: 5},
+			Moderation: ModerationConfig{
+				HideAfter:             3,
+				DeleteTypes:           []string{nip56.ReportTypeIllegal, nip56.ReportTypeMalware},
+				TrustedReputation:     3,
+				IgnoreReputation:      3,
+				MaxReportsPerTarget:   50,
+				MaxReportsPerReporter: 20,
+				MaxQueuedReports:      10000,
+			},
 		},
 	}
 }
@@ -97,9 +332,136 @@ func (c *Config) Validate() error {
 	if c.Network.TLSKey != "" && c.Network.TLSCert == "" {
 		return fmt.Errorf("TLS cert is required when TLS key is provided")
 	}
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		return err
+	}
+	for subsystem, level := range c.Logging.Subsystems {
+		if _, err := logging.ParseLevel(level); err != nil {
+			return fmt.Errorf("logging subsystem %s: %w", subsystem, err)
+		}
+	}
+	if c.Logging.Format != "" && c.Logging.Format != "text" && c.Logging.Format != "json" {
+		return fmt.Errorf("log format must be text or json")
+	}
+	if c.Relay.RequireAuth && !c.Features.NIP42 {
+		return fmt.Errorf("relay require_auth needs the nip42 feature")
+	}
+	if c.Relay.Mode != "" && c.Relay.Mode != ModePublic && c.Relay.Mode != ModeInbox {
+		return fmt.Errorf("relay mode must be %s or %s", ModePublic, ModeInbox)
+	}
+	if c.Relay.Mode == ModeInbox && !c.Features.NIP42 {
+		return fmt.Errorf("relay mode inbox needs the nip42 feature")
+	}
+	if c.Network.ShutdownTimeout < 0 {
+		return fmt.Errorf("network shutdown_timeout cannot be negative")
+	}
+	for _, proxy := range c.Network.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("network trusted proxy %q must be an IP address or CIDR network", proxy)
+			}
+		}
+	}
+	if c.Relay.RetentionDays < 0 || c.Relay.GiftWrapRetentionDays < 0 || c.Relay.QueryTimeout < 0 || c.Relay.ClampWindow < 0 {
+		return fmt.Errorf("relay retention_days, gift_wrap_retention_days, query_timeout and clamp_window cannot be negative")
+	}
+	if c.Relay.WritePolicy.Timeout < 0 {
+		return fmt.Errorf("relay write_policy timeout cannot be negative")
+	}
+	if c.Relay.MinPoW < 0 || c.Relay.MinPoW > 256 {
+		return fmt.Errorf("relay min_pow must be between 0 and 256")
+	}
+	for kind, difficulty := range c.Relay.MinPoWKinds {
+		if kind < 0 || difficulty < 0 || difficulty > 256 {
+			return fmt.Errorf("relay min_pow_kinds entry %d: %d must be a non-negative kind and a difficulty between 0 and 256", kind, difficulty)
+		}
+	}
+	for _, pk := range c.Relay.AdminPubKeys {
+		if !isHexKey(pk) {
+			return fmt.Errorf("relay admin pubkey %q must be a 64-character hex public key", pk)
+		}
+	}
+	if c.Relay.SecretKey != "" && !isHexKey(c.Relay.SecretKey) {
+		return fmt.Errorf("relay secret_key must be a 64-character hex key")
+	}
+	if err := c.Relay.Moderation.validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if c.Info.PubKey != "" && !isHexKey(c.Info.PubKey) {
+		return fmt.Errorf("info pubkey must be a 64-character hex public key")
+	}
+	if c.Info.Self != "" && !isHexKey(c.Info.Self) {
+		return fmt.Errorf("info self must be a 64-character hex public key")
+	}
 	return nil
 }
 
+func (rl *RateLimitConfig) validate() error {
+	if rl.EventsPerSec < 0 || rl.ReqPerSec < 0 || rl.CountPerSec < 0 || rl.Burst < 0 || rl.MaxConnections < 0 || rl.MaxEventSize < 0 {
+		return fmt.Errorf("rate limits cannot be negative")
+	}
+	if rl.MaxConnectionsPerNetwork < 0 || rl.MaxTotalConnections < 0 || rl.ConnectionsPerSec < 0 {
+		return fmt.Errorf("rate limit connection limits cannot be negative")
+	}
+	if rl.MaxTrackedClients < 0 || rl.IdleTimeout < 0 {
+		return fmt.Errorf("rate limit max_tracked_clients and idle_timeout cannot be negative")
+	}
+	for _, tier := range []RateTierConfig{rl.Authenticated, rl.Trusted} {
+		if tier.EventsPerSec < 0 || tier.ReqPerSec < 0 || tier.CountPerSec < 0 {
+			return fmt.Errorf("rate limits cannot be negative")
+		}
+	}
+	for kind, rate := range rl.Kinds {
+		if kind < 0 || rate < 0 {
+			return fmt.Errorf("rate limit for kind %d is invalid", kind)
+		}
+	}
+	if rl.IPv6Prefix < 0 || rl.IPv6Prefix > 128 {
+		return fmt.Errorf("rate limit ipv6_prefix must be between 0 and 128")
+	}
+	esc := rl.Escalation
+	if esc.Violations < 0 || esc.Window < 0 || esc.BanDuration < 0 || esc.LongBanAfter < 0 || esc.LongBanDuration < 0 {
+		return fmt.Errorf("rate limit escalation settings cannot be negative")
+	}
+	for _, pk := range rl.TrustedPubKeys {
+		if !isHexKey(pk) {
+			return fmt.Errorf("rate limit trusted pubkey %q must be a 64-character hex public key", pk)
+		}
+	}
+	return nil
+}
+
+func (mc *ModerationConfig) validate() error {
+	if mc.HideAfter < 0 || mc.TrustedReputation < 0 || mc.IgnoreReputation < 0 {
+		return fmt.Errorf("relay moderation hide_after, trusted_reputation and ignore_reputation cannot be negative")
+	}
+	if mc.MaxReportsPerTarget < 0 || mc.MaxReportsPerReporter < 0 || mc.MaxQueuedReports < 0 {
+		return fmt.Errorf("relay moderation max_reports_per_target, max_reports_per_reporter and max_queued_reports cannot be negative")
+	}
+	for _, pk := range append(append([]string(nil), mc.Moderators...), mc.TrustedReporters...) {
+		if !isHexKey(pk) {
+			return fmt.Errorf("relay moderation pubkey %q must be a 64-character hex public key", pk)
+		}
+	}
+	for _, t := range mc.DeleteTypes {
+		if !nip56.IsValidReportType(t) {
+			return fmt.Errorf("relay moderation delete type %q is not a NIP-56 report type", t)
+		}
+	}
+	return nil
+}
+
+func isHexKey(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
 func (c *DatabaseConfig) ConnMaxLifetimeDuration() time.Duration {
 	return time.Duration(c.ConnMaxLifetime) * time.Second
 }
@@ -120,17 +482,28 @@ func (l *Loader) Load() (*Config, error) {
 	return l.LoadWithArgs(os.Args[1:])
 }
 
+// LoadWithArgs builds the configuration from defaults, the config file,
+// GLIENICKE_* environment variables and command-line flags, in increasing
+// order of precedence. A -config flag in args names the config file when the
+// loader was created without one.
 func (l *Loader) LoadWithArgs(args []string) (*Config, error) {
 	cfg := DefaultConfig()
 
+	if l.configFile == "" {
+		l.configFile = configFileFromArgs(args)
+	}
 	if l.configFile != "" {
 		if err := l.loadFromFile(cfg, l.configFile); err != nil {
 			return nil, fmt.Errorf("failed to load config from file %s: %w", l.configFile, err)
 		}
 	}
 
-	l.applyEnvironmentVariables(cfg)
-	l.applyFlags(cfg, args)
+	if err := l.applyEnvironmentVariables(cfg); err != nil {
+		return nil, err
+	}
+	if err := l.applyFlags(cfg, args); err != nil {
+		return nil, err
+	}
 
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -139,6 +512,31 @@ func (l *Loader) LoadWithArgs(args []string) (*Config, error) {
 	return cfg, nil
 }
 
+// ConfigFile returns the config file path the loader reads, if any
+func (l *Loader) ConfigFile() string {
+	return l.configFile
+}
+
+// configFileFromArgs returns the value of a -config or --config flag
+func configFileFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if value, ok := strings.CutPrefix(name, "config="); ok {
+			return value
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
 func (l *Loader) loadFromFile(cfg *Config, path string) error {
 	data, err := os.ReadFile(filepath.Clean(path))
 	if err != nil {
@@ -155,32 +553,138 @@ func (l *Loader) loadFromFile(cfg *Config, path string) error {
 	return nil
 }
 
-func (l *Loader) applyEnvironmentVariables(cfg *Config) {
+func (l *Loader) applyEnvironmentVariables(cfg *Config) error {
+	var errs []string
 	applyIfSet := func(envVar string, setter func(string)) {
 		if val := os.Getenv(envVar); val != "" {
 			setter(val)
 		}
 	}
+	applyInt := func(envVar string, target *int) {
+		applyIfSet(envVar, func(v string) {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a number", envVar, v))
+				return
+			}
+			*target = n
+		})
+	}
+	isTrue := func(v string) bool { return v == "true" || v == "1" }
 
 	applyIfSet("GLIENICKE_ADDRESS", func(v string) { cfg.Network.Address = v })
 	applyIfSet("GLIENICKE_TLS_CERT", func(v string) { cfg.Network.TLSCert = v })
 	applyIfSet("GLIENICKE_TLS_KEY", func(v string) { cfg.Network.TLSKey = v })
+	applyInt("GLIENICKE_READ_TIMEOUT", &cfg.Network.ReadTimeout)
+	applyInt("GLIENICKE_WRITE_TIMEOUT", &cfg.Network.WriteTimeout)
+	applyInt("GLIENICKE_SHUTDOWN_TIMEOUT", &cfg.Network.ShutdownTimeout)
+	applyIfSet("GLIENICKE_TRUSTED_PROXIES", func(v string) { cfg.Network.TrustedProxies = splitList(v) })
+	applyIfSet("GLIENICKE_PROXY_PROTOCOL", func(v string) { cfg.Network.ProxyProtocol = isTrue(v) })
 	applyIfSet("GLIENICKE_DB_PATH", func(v string) { cfg.Database.Path = v })
+	applyInt("GLIENICKE_DB_MAX_OPEN_CONNS", &cfg.Database.MaxOpenConns)
+	applyInt("GLIENICKE_DB_MAX_IDLE_CONNS", &cfg.Database.MaxIdleConns)
+	applyInt("GLIENICKE_DB_CONN_MAX_LIFETIME", &cfg.Database.ConnMaxLifetime)
 	applyIfSet("GLIENICKE_LOG_LEVEL", func(v string) { cfg.Logging.Level = v })
 	applyIfSet("GLIENICKE_LOG_FORMAT", func(v string) { cfg.Logging.Format = v })
-	applyIfSet("GLIENICKE_RATE_LIMIT_ENABLED", func(v string) { cfg.RateLimit.Enabled = v == "true" || v == "1" })
-	applyIfSet("GLIENICKE_FEATURE_NIP11", func(v string) { cfg.Features.NIP11 = v == "true" || v == "1" })
-	applyIfSet("GLIENICKE_FEATURE_NIP42", func(v string) { cfg.Features.NIP42 = v == "true" || v == "1" })
-	applyIfSet("GLIENICKE_FEATURE_NIP28", func(v string) { cfg.Features.NIP28 = v == "true" || v == "1" })
+	applyIfSet("GLIENICKE_RATE_LIMIT_ENABLED", func(v string) { cfg.RateLimit.Enabled = isTrue(v) })
+	applyInt("GLIENICKE_RATE_LIMIT_EVENTS_PER_SEC", &cfg.RateLimit.EventsPerSec)
+	applyInt("GLIENICKE_RATE_LIMIT_REQ_PER_SEC", &cfg.RateLimit.ReqPerSec)
+	applyInt("GLIENICKE_RATE_LIMIT_COUNT_PER_SEC", &cfg.RateLimit.CountPerSec)
+	applyInt("GLIENICKE_RATE_LIMIT_MAX_CONNECTIONS", &cfg.RateLimit.MaxConnections)
+	applyInt("GLIENICKE_RATE_LIMIT_MAX_CONNECTIONS_PER_NETWORK", &cfg.RateLimit.MaxConnectionsPerNetwork)
+	applyInt("GLIENICKE_RATE_LIMIT_MAX_TOTAL_CONNECTIONS", &cfg.RateLimit.MaxTotalConnections)
+	applyInt("GLIENICKE_RATE_LIMIT_CONNECTIONS_PER_SEC", &cfg.RateLimit.ConnectionsPerSec)
+	applyInt("GLIENICKE_RATE_LIMIT_MAX_EVENT_SIZE", &cfg.RateLimit.MaxEventSize)
+	applyInt("GLIENICKE_RATE_LIMIT_MAX_TRACKED_CLIENTS", &cfg.RateLimit.MaxTrackedClients)
+	applyIfSet("GLIENICKE_FEATURE_NIP11", func(v string) { cfg.Features.NIP11 = isTrue(v) })
+	applyIfSet("GLIENICKE_FEATURE_NIP42", func(v string) { cfg.Features.NIP42 = isTrue(v) })
+	applyIfSet("GLIENICKE_FEATURE_NIP28", func(v string) { cfg.Features.NIP28 = isTrue(v) })
+	applyIfSet("GLIENICKE_FEATURE_NIP29", func(v string) { cfg.Features.NIP29 = isTrue(v) })
+	applyIfSet("GLIENICKE_REQUIRE_AUTH", func(v string) { cfg.Relay.RequireAuth = isTrue(v) })
+	applyInt("GLIENICKE_RETENTION_DAYS", &cfg.Relay.RetentionDays)
+	applyInt("GLIENICKE_GIFT_WRAP_RETENTION_DAYS", &cfg.Relay.GiftWrapRetentionDays)
+	applyIfSet("GLIENICKE_RELAY_MODE", func(v string) { cfg.Relay.Mode = v })
+	applyIfSet("GLIENICKE_ADMIN_PUBKEYS", func(v string) { cfg.Relay.AdminPubKeys = splitList(v) })
+	applyIfSet("GLIENICKE_MODERATOR_PUBKEYS", func(v string) { cfg.Relay.Moderation.Moderators = splitList(v) })
+	applyIfSet("GLIENICKE_ACL_FILES", func(v string) { cfg.Relay.ACLFiles = splitList(v) })
+	applyIfSet("GLIENICKE_WRITE_POLICY", func(v string) { cfg.Relay.WritePolicy.Command = v })
+	applyIfSet("GLIENICKE_RELAY_SECRET_KEY", func(v string) { cfg.Relay.SecretKey = v })
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (l *Loader) applyFlags(cfg *Config, args []string) error {
+	f := l.flags
+	f.String("config", l.configFile, "Path to a YAML config file")
+	f.StringVar(&cfg.Network.Address, "addr", cfg.Network.Address, "Address to listen on")
+	f.StringVar(&cfg.Database.Path, "db", cfg.Database.Path, "Path to SQLite database")
+	f.StringVar(&cfg.Network.TLSCert, "cert", cfg.Network.TLSCert, "TLS certificate file for WSS")
+	f.StringVar(&cfg.Network.TLSKey, "key", cfg.Network.TLSKey, "TLS private key file for WSS")
+	f.Func("trusted-proxies", "Comma-separated addresses or CIDR networks of reverse proxies whose forwarding headers are believed", func(v string) error {
+		cfg.Network.TrustedProxies = splitList(v)
+		return nil
+	})
+	f.BoolVar(&cfg.Network.ProxyProtocol, "proxy-protocol", cfg.Network.ProxyProtocol, "Read PROXY protocol v1/v2 headers from trusted proxies")
+	f.StringVar(&cfg.Relay.NIP36Vocab, "nip36-vocab", cfg.Relay.NIP36Vocab, "Path to NIP-36 vocabulary file (enables NSFW content-warning enforcement)")
+	f.IntVar(&cfg.Relay.MinPoW, "min-pow", cfg.Relay.MinPoW, "Minimum NIP-13 proof-of-work difficulty required for events (0 = disabled)")
+	f.IntVar(&cfg.Relay.RetentionDays, "retention-days", cfg.Relay.RetentionDays, "Delete events older than this many days (0 = keep forever)")
+	f.IntVar(&cfg.Relay.GiftWrapRetentionDays, "gift-wrap-retention-days", cfg.Relay.GiftWrapRetentionDays, "Delete gift wraps this many days after they were sent (0 = -retention-days)")
+	f.StringVar(&cfg.Relay.Mode, "mode", cfg.Relay.Mode, "Relay mode: public, or inbox to only accept direct messages for registered users")
+	f.BoolVar(&cfg.Relay.RequireAuth, "require-auth", cfg.Relay.RequireAuth, "Require NIP-42 authentication before REQ/EVENT")
+	secondsFlag(f, &cfg.Network.ShutdownTimeout, "shutdown-timeout", "Time clients get to drain on SIGINT/SIGTERM before they are disconnected (0 = no limit)")
+	secondsFlag(f, &cfg.Relay.QueryTimeout, "query-timeout", "Maximum time a REQ/COUNT may spend on stored events (0 = no timeout)")
+	f.Float64Var(&cfg.Relay.MaxRequestCost, "max-request-cost", cfg.Relay.MaxRequestCost, "Filter cost budget per REQ/COUNT; full scan = 1000 (0 = unlimited)")
+	f.Float64Var(&cfg.Relay.MaxConnectionCost, "max-connection-cost", cfg.Relay.MaxConnectionCost, "Filter cost budget for the queries running on one connection (0 = unlimited)")
+	secondsFlag(f, &cfg.Relay.ClampWindow, "clamp-window", "Time range unbounded filters are clamped to when over the request budget")
+	f.Func("admin-pubkeys", "Comma-separated hex pubkeys allowed to use the NIP-86 management API", func(v string) error {
+		cfg.Relay.AdminPubKeys = splitList(v)
+		return nil
+	})
+	f.Func("moderator-pubkeys", "Comma-separated hex pubkeys whose NIP-56 reports are trusted and may delete content", func(v string) error {
+		cfg.Relay.Moderation.Moderators = splitList(v)
+		return nil
+	})
+	f.StringVar(&cfg.Relay.WritePolicy.Command, "write-policy", cfg.Relay.WritePolicy.Command, "Write-policy plugin command (strfry-compatible JSONL on stdin/stdout)")
+	secondsFlag(f, &cfg.Relay.WritePolicy.Timeout, "write-policy-timeout", "Time the write-policy plugin gets to answer for an event")
+	f.BoolVar(&cfg.Relay.WritePolicy.FailOpen, "write-policy-fail-open", cfg.Relay.WritePolicy.FailOpen, "Accept events when the write-policy plugin fails or times out")
+	f.Func("acl-files", "Comma-separated access-control list files", func(v string) error {
+		cfg.Relay.ACLFiles = splitList(v)
+		return nil
+	})
+	f.StringVar(&cfg.Logging.Level, "log-level", cfg.Logging.Level, "Log level: debug, info, warn or error")
+	f.StringVar(&cfg.Logging.Format, "log-format", cfg.Logging.Format, "Log format: text or json")
+	f.BoolFunc("debug", "Enable debug logging (same as -log-level debug)", func(string) error {
+		cfg.Logging.Level = "debug"
+		return nil
+	})
+
+	return f.Parse(args)
 }
 
-func (l *Loader) applyFlags(cfg *Config, args []string) {
-	l.flags.StringVar(&cfg.Network.Address, "addr", cfg.Network.Address, "Address to listen on")
-	l.flags.StringVar(&cfg.Database.Path, "db", cfg.Database.Path, "Path to SQLite database")
-	l.flags.StringVar(&cfg.Network.TLSCert, "cert", cfg.Network.TLSCert, "TLS certificate file for WSS")
-	l.flags.StringVar(&cfg.Network.TLSKey, "key", cfg.Network.TLSKey, "TLS private key file for WSS")
+// secondsFlag binds a duration flag (e.g. 30s, 2h) to a config value in seconds
+func secondsFlag(f *flag.FlagSet, target *int, name, usage string) {
+	f.Func(name, fmt.Sprintf("%s (default %v)", usage, time.Duration(*target)*time.Second), func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*target = int(d / time.Second)
+		return nil
+	})
+}
 
-	l.flags.Parse(args)
+// splitList splits a comma-separated list, dropping empty items
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func (l *Loader) Flags() *flag.FlagSet {
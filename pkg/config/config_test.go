@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -69,6 +71,22 @@ func TestConfigValidation(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "trusted proxies",
+			cfg: &Config{
+				Network:  NetworkConfig{Address: ":8080", TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}},
+				Database: DatabaseConfig{Path: "test.db"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid trusted proxy",
+			cfg: &Config{
+				Network:  NetworkConfig{Address: ":8080", TrustedProxies: []string{"proxy.example.com"}},
+				Database: DatabaseConfig{Path: "test.db"},
+			},
+			wantErr: true,
+		},
 		{
 			name: "valid tls config",
 			cfg: &Config{
@@ -157,6 +175,10 @@ func TestEnvironmentVariables(t *testing.T) {
 	os.Setenv("GLIENICKE_LOG_LEVEL", "warn")
 	os.Setenv("GLIENICKE_RATE_LIMIT_ENABLED", "false")
 	os.Setenv("GLIENICKE_FEATURE_NIP28", "true")
+	os.Setenv("GLIENICKE_RATE_LIMIT_MAX_CONNECTIONS_PER_NETWORK", "50")
+	os.Setenv("GLIENICKE_RELAY_MODE", "inbox")
+	os.Setenv("GLIENICKE_GIFT_WRAP_RETENTION_DAYS", "7")
+	os.Setenv("GLIENICKE_MODERATOR_PUBKEYS", strings.Repeat("ab", 32))
 	defer func() {
 		os.Unsetenv("GLIENICKE_ADDRESS")
 		os.Unsetenv("GLIENICKE_TLS_CERT")
@@ -165,6 +187,10 @@ func TestEnvironmentVariables(t *testing.T) {
 		os.Unsetenv("GLIENICKE_LOG_LEVEL")
 		os.Unsetenv("GLIENICKE_RATE_LIMIT_ENABLED")
 		os.Unsetenv("GLIENICKE_FEATURE_NIP28")
+		os.Unsetenv("GLIENICKE_RATE_LIMIT_MAX_CONNECTIONS_PER_NETWORK")
+		os.Unsetenv("GLIENICKE_RELAY_MODE")
+		os.Unsetenv("GLIENICKE_GIFT_WRAP_RETENTION_DAYS")
+		os.Unsetenv("GLIENICKE_MODERATOR_PUBKEYS")
 	}()
 
 	loader := NewLoader("")
@@ -194,6 +220,15 @@ func TestEnvironmentVariables(t *testing.T) {
 	if !cfg.Features.NIP28 {
 		t.Error("expected NIP28 enabled from env")
 	}
+	if cfg.RateLimit.MaxConnectionsPerNetwork != 50 {
+		t.Errorf("expected 50 connections per network from env, got %d", cfg.RateLimit.MaxConnectionsPerNetwork)
+	}
+	if cfg.Relay.Mode != ModeInbox || cfg.Relay.GiftWrapRetentionDays != 7 {
+		t.Errorf("expected inbox mode with 7-day gift wrap retention from env, got %s, %d", cfg.Relay.Mode, cfg.Relay.GiftWrapRetentionDays)
+	}
+	if len(cfg.Relay.Moderation.Moderators) != 1 || cfg.Relay.Moderation.HideAfter != 3 {
+		t.Errorf("expected one moderator from env and default hide_after, got %v, %d", cfg.Relay.Moderation.Moderators, cfg.Relay.Moderation.HideAfter)
+	}
 }
 
 func TestConnMaxLifetimeDuration(t *testing.T) {
@@ -206,3 +241,303 @@ func TestConnMaxLifetimeDuration(t *testing.T) {
 		t.Errorf("expected 300 seconds, got %v", duration)
 	}
 }
+
+func TestLoadInfoFromFile(t *testing.T) {
+	yamlContent := `
+info:
+  name: "Test Relay"
+  description: "A relay for tests"
+  pubkey: "0000000000000000000000000000000000000000000000000000000000000001"
+  terms_of_service: "https://relay.example.com/tos"
+  relay_countries: ["DE", "US"]
+  language_tags: ["en", "de"]
+  payment_required: true
+  retention:
+    - kinds: [0, 1, [5, 7]]
+      time: 3600
+    - count: 1000
+  fees:
+    admission:
+      - amount: 1000000
+        unit: msats
+`
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "test.yaml")
+	if err := os.WriteFile(configPath, []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg, err := NewLoader(configPath).LoadWithArgs(nil)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	doc := cfg.Info.Document()
+	if doc.Name != "Test Relay" {
+		t.Errorf("expected name Test Relay, got %s", doc.Name)
+	}
+	if doc.TermsOfService != "https://relay.example.com/tos" {
+		t.Errorf("expected terms_of_service, got %s", doc.TermsOfService)
+	}
+	if len(doc.RelayCountries) != 2 || len(doc.LanguageTags) != 2 {
+		t.Errorf("expected 2 countries and 2 language tags, got %v and %v", doc.RelayCountries, doc.LanguageTags)
+	}
+	if doc.Limitation == nil || !doc.Limitation.PaymentRequired {
+		t.Error("expected payment_required in limitation")
+	}
+	if len(doc.Retention) != 2 || *doc.Retention[0].Time != 3600 || len(doc.Retention[0].Kinds) != 3 || *doc.Retention[1].Count != 1000 {
+		t.Errorf("unexpected retention: %+v", doc.Retention)
+	}
+	if doc.Fees == nil || len(doc.Fees.Admission) != 1 || doc.Fees.Admission[0].Amount != 1000000 {
+		t.Errorf("unexpected fees: %+v", doc.Fees)
+	}
+}
+
+func TestInfoPubKeyValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Info.PubKey = "npub1notahexkey"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for non-hex info pubkey")
+	}
+}
+
+func TestLoadLoggingFromFile(t *testing.T) {
+	yamlContent := `
+logging:
+  level: "warn"
+  format: "json"
+  subsystems:
+    relay: "debug"
+    ratelimit: "error"
+  sampling:
+    initial: 5
+    thereafter: 50
+    interval: 10
+`
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "test.yaml")
+	if err := os.WriteFile(configPath, []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg, err := NewLoader(configPath).LoadWithArgs(nil)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	opts := cfg.Logging.Options()
+	if opts.Level != "warn" || opts.Format != "json" {
+		t.Errorf("expected warn/json, got %s/%s", opts.Level, opts.Format)
+	}
+	if opts.Subsystems["relay"] != "debug" || opts.Subsystems["ratelimit"] != "error" {
+		t.Errorf("unexpected subsystem levels: %v", opts.Subsystems)
+	}
+	if opts.Sampling.Initial != 5 || opts.Sampling.Thereafter != 50 || opts.Sampling.Interval != 10*time.Second {
+		t.Errorf("unexpected sampling: %+v", opts.Sampling)
+	}
+}
+
+func TestLoggingValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Logging.Level = "verbose"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown log level")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Logging.Format = "xml"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown log format")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Logging.Subsystems = map[string]string{"relay": "loud"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown subsystem level")
+	}
+}
+
+func TestLoadRelayFromFlags(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "relay.yaml")
+	content := `
+network:
+  proxy_protocol: true
+  trusted_proxies:
+    - 192.0.2.10
+relay:
+  retention_days: 7
+  min_pow: 8
+  min_pow_kinds:
+    7: 16
+  pow_exempt_known: true
+  admin_pubkeys:
+    - "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+  write_policy:
+    command: /usr/local/bin/spam-filter --strict
+    fail_open: true
+rate_limit:
+  enabled: true
+  authenticated:
+    events_per_sec: 50
+  kinds:
+    7: 0.5
+  escalation:
+    ban_duration: 300
+  max_tracked_clients: 5000
+  max_total_connections: 20000
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	loader := NewLoader("")
+	cfg, err := loader.LoadWithArgs([]string{
+		"-config", configPath,
+		"-min-pow", "12",
+		"-query-timeout", "2m",
+		"-debug",
+		"-acl-files", "/etc/glienicke/deny.acl, /etc/glienicke/allow.acl",
+		"-trusted-proxies", "10.0.0.0/8, fd00::/8",
+	})
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	if loader.ConfigFile() != configPath {
+		t.Errorf("expected config file %s, got %s", configPath, loader.ConfigFile())
+	}
+	if cfg.Relay.RetentionDays != 7 {
+		t.Errorf("expected retention 7 from file, got %d", cfg.Relay.RetentionDays)
+	}
+	if cfg.Relay.MinPoW != 12 {
+		t.Errorf("expected flag to override min_pow, got %d", cfg.Relay.MinPoW)
+	}
+	if cfg.Relay.MinPoWKinds[7] != 16 || !cfg.Relay.PoWExemptKnown || cfg.Relay.PoWExemptAuth {
+		t.Errorf("expected PoW kinds and exemptions from file, got %v known=%v auth=%v", cfg.Relay.MinPoWKinds, cfg.Relay.PoWExemptKnown, cfg.Relay.PoWExemptAuth)
+	}
+	if cfg.Relay.QueryTimeout != 120 {
+		t.Errorf("expected query timeout 120s, got %d", cfg.Relay.QueryTimeout)
+	}
+	if len(cfg.Relay.AdminPubKeys) != 1 {
+		t.Errorf("expected 1 admin pubkey, got %d", len(cfg.Relay.AdminPubKeys))
+	}
+	if cfg.Relay.WritePolicy.Command != "/usr/local/bin/spam-filter --strict" || !cfg.Relay.WritePolicy.FailOpen {
+		t.Errorf("expected write policy from file, got %+v", cfg.Relay.WritePolicy)
+	}
+	if cfg.Relay.WritePolicy.Timeout != 5 {
+		t.Errorf("expected default write policy timeout 5s, got %d", cfg.Relay.WritePolicy.Timeout)
+	}
+	if cfg.RateLimit.Authenticated.EventsPerSec != 50 || cfg.RateLimit.Kinds[7] != 0.5 {
+		t.Errorf("expected tier and kind rates from file, got %+v", cfg.RateLimit)
+	}
+	if cfg.RateLimit.Escalation.BanDuration != 300 || cfg.RateLimit.Escalation.LongBanDuration != 86400 {
+		t.Errorf("expected escalation from file over defaults, got %+v", cfg.RateLimit.Escalation)
+	}
+	if cfg.RateLimit.MaxTrackedClients != 5000 || cfg.RateLimit.IdleTimeout != 600 {
+		t.Errorf("expected limiter bounds from file over defaults, got %d clients, %ds idle", cfg.RateLimit.MaxTrackedClients, cfg.RateLimit.IdleTimeout)
+	}
+	if cfg.RateLimit.MaxTotalConnections != 20000 || cfg.RateLimit.MaxConnectionsPerNetwork != 200 || cfg.RateLimit.ConnectionsPerSec != 5 {
+		t.Errorf("expected connection limits from file over defaults, got %+v", cfg.RateLimit)
+	}
+	if len(cfg.Relay.ACLFiles) != 2 || cfg.Relay.ACLFiles[1] != "/etc/glienicke/allow.acl" {
+		t.Errorf("expected 2 ACL files from flag, got %v", cfg.Relay.ACLFiles)
+	}
+	if !cfg.Network.ProxyProtocol {
+		t.Error("expected proxy_protocol from file")
+	}
+	if len(cfg.Network.TrustedProxies) != 2 || cfg.Network.TrustedProxies[1] != "fd00::/8" {
+		t.Errorf("expected 2 trusted proxies from flag, got %v", cfg.Network.TrustedProxies)
+	}
+	if cfg.Logging.Level != "debug" {
+		t.Errorf("expected -debug to set log level debug, got %s", cfg.Logging.Level)
+	}
+}
+
+func TestInvalidFlagsAndEnvironment(t *testing.T) {
+	if _, err := NewLoader("").LoadWithArgs([]string{"-no-such-flag"}); err == nil {
+		t.Error("expected error for unknown flag")
+	}
+
+	os.Setenv("GLIENICKE_RATE_LIMIT_EVENTS_PER_SEC", "fast")
+	defer os.Unsetenv("GLIENICKE_RATE_LIMIT_EVENTS_PER_SEC")
+	if _, err := NewLoader("").LoadWithArgs(nil); err == nil {
+		t.Error("expected error for non-numeric environment variable")
+	}
+}
+
+func TestRelayValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Relay.AdminPubKeys = []string{"npub1notahexkey"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for non-hex admin pubkey")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.RequireAuth = true
+	cfg.Features.NIP42 = false
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for require_auth without nip42")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.MinPoW = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for negative min_pow")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.MinPoWKinds = map[int]int{1: 300}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for min_pow_kinds difficulty above 256")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.SecretKey = "nsec1notahexkey"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for non-hex secret key")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.Mode = "private"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown relay mode")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.Mode = ModeInbox
+	cfg.Features.NIP42 = false
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for inbox mode without nip42")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.GiftWrapRetentionDays = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for negative gift_wrap_retention_days")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.Moderation.HideAfter = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for negative moderation hide_after")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.Moderation.MaxQueuedReports = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for negative moderation max_queued_reports")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.Moderation.Moderators = []string{"npub1notahexkey"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for non-hex moderator pubkey")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Relay.Moderation.DeleteTypes = []string{"rude"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown moderation delete type")
+	}
+}
@@ -0,0 +1,177 @@
+package event
+
+import (
+	"fmt"
+	"math"
+)
+
+// Filter cost scores are abstract units in which FullScanCost is the cost of
+// reading every stored event. A filter is scored by its most selective indexed
+// field, discounted by the time range it covers and by its limit.
+const (
+	FullScanCost = 1000.0
+
+	idCost     = 1.0   // exact event ID lookup
+	authorCost = 5.0   // events of one author
+	tagCost    = 10.0  // events referencing one tag value
+	kindCost   = 100.0 // events of one kind
+
+	// Time ranges of costReferenceWindow seconds or more get no discount
+	costReferenceWindow = 30 * 24 * 60 * 60
+	minTimeFactor       = 0.05
+
+	// Limits of costReferenceLimit or more get no discount
+	costReferenceLimit = 500
+	minLimitFactor     = 0.02
+)
+
+// FilterCost is the estimated cost of running a filter against the store.
+type FilterCost struct {
+	Score  float64
+	Index  string // field driving the query: "ids", "authors", "#<tag>", "kinds" or "scan"
+	Window int64  // seconds covered by the time range, 0 if unbounded
+}
+
+func (c FilterCost) String() string {
+	window := "unbounded"
+	if c.Window > 0 {
+		window = fmt.Sprintf("%ds", c.Window)
+	}
+	return fmt.Sprintf("score=%.1f index=%s window=%s", c.Score, c.Index, window)
+}
+
+// EstimateCost scores a filter at time now (unix seconds).
+func EstimateCost(f *Filter, now int64) FilterCost {
+	cost := FilterCost{Score: FullScanCost, Index: "scan"}
+
+	consider := func(index string, score float64) {
+		if score < cost.Score {
+			cost.Score = score
+			cost.Index = index
+		}
+	}
+	if len(f.IDs) > 0 {
+		consider("ids", prefixedCost(f.IDs, idCost))
+	}
+	if len(f.Authors) > 0 {
+		consider("authors", prefixedCost(f.Authors, authorCost))
+	}
+	for name, values := range f.Tags {
+		if len(values) > 0 {
+			consider("#"+name, float64(len(values))*tagCost)
+		}
+	}
+	if len(f.Kinds) > 0 {
+		consider("kinds", float64(len(f.Kinds))*kindCost)
+	}
+
+	if f.Limit != nil {
+		// limit 0 only asks for new events
+		if *f.Limit <= 0 {
+			cost.Score = 0
+			return cost
+		}
+		cost.Score *= clampFactor(float64(*f.Limit)/costReferenceLimit, minLimitFactor)
+	}
+
+	if f.Since != nil {
+		until := now
+		if f.Until != nil {
+			until = *f.Until
+		}
+		cost.Window = until - *f.Since
+		if cost.Window < 1 {
+			cost.Window = 1
+		}
+		cost.Score *= clampFactor(float64(cost.Window)/costReferenceWindow, minTimeFactor)
+	}
+
+	return cost
+}
+
+// ClampTimeRange bounds a filter without a since to at most window seconds
+// before its until (or now). It reports whether the filter was changed.
+func ClampTimeRange(f *Filter, window, now int64) bool {
+	if f.Since != nil || window <= 0 {
+		return false
+	}
+	until := now
+	if f.Until != nil {
+		until = *f.Until
+	}
+	since := until - window
+	f.Since = &since
+	return true
+}
+
+// prefixedCost scores IDs or pubkeys, which NIP-01 allows as hex prefixes.
+// Each halving of the prefix length doubles the cost, so one-character
+// prefixes cost as much as a full scan.
+func prefixedCost(values []string, exact float64) float64 {
+	total := 0.0
+	for _, v := range values {
+		if len(v) == 0 {
+			return FullScanCost
+		}
+		total += math.Max(exact, FullScanCost/math.Pow(2, float64(len(v)-1)))
+	}
+	return math.Min(total, FullScanCost)
+}
+
+func clampFactor(f, min float64) float64 {
+	return math.Max(min, math.Min(1, f))
+}
+
+// Default budgets, see CostBudget.
+const (
+	DefaultMaxRequestCost    = 500
+	DefaultMaxConnectionCost = 2000
+	DefaultClampWindow       = 7 * 24 * 60 * 60
+)
+
+// CostBudget limits how expensive the queries of a REQ/COUNT and of a
+// connection may be. Zero budgets are unlimited.
+type CostBudget struct {
+	// MaxRequestCost is the budget for the sum of the filter scores of one REQ/COUNT.
+	MaxRequestCost float64
+
+	// MaxConnectionCost is the budget for the sum of the scores of all queries
+	// running concurrently on one connection.
+	MaxConnectionCost float64
+
+	// ClampWindow is the time range, in seconds, that filters without a since
+	// are clamped to when a REQ/COUNT is over budget.
+	ClampWindow int64
+}
+
+// Apply scores the filters of one REQ/COUNT against the per-request budget.
+// If they are over budget, filters with an unbounded time range are clamped to
+// ClampWindow in place and rescored. It returns the score of every filter and
+// the total, and ok=false if the filters are still over budget.
+func (b *CostBudget) Apply(filters []*Filter, now int64) (costs []FilterCost, total float64, ok bool) {
+	costs, total = scoreFilters(filters, now)
+	if b.MaxRequestCost <= 0 || total <= b.MaxRequestCost {
+		return costs, total, true
+	}
+
+	clamped := false
+	for _, f := range filters {
+		if ClampTimeRange(f, b.ClampWindow, now) {
+			clamped = true
+		}
+	}
+	if clamped {
+		costs, total = scoreFilters(filters, now)
+	}
+	return costs, total, total <= b.MaxRequestCost
+}
+
+func scoreFilters(filters []*Filter, now int64) ([]FilterCost, float64) {
+	costs := make([]FilterCost, len(filters))
+	total := 0.0
+	for i, f := range filters {
+		costs[i] = EstimateCost(f, now)
+		total += costs[i].Score
+	}
+	return costs, total
+}
@@ -0,0 +1,102 @@
+package event
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func intPtr(i int) *int       { return &i }
+func int64Ptr(i int64) *int64 { return &i }
+
+func TestEstimateCost(t *testing.T) {
+	const now = 1700000000
+	pubkey := strings.Repeat("a", 64)
+
+	tests := []struct {
+		name  string
+		f     *Filter
+		score float64
+		index string
+	}{
+		{"empty filter is a full scan", &Filter{}, FullScanCost, "scan"},
+		{"one character author prefix is a full scan", &Filter{Authors: []string{"a"}}, FullScanCost, "scan"},
+		{"exact author", &Filter{Authors: []string{pubkey}}, authorCost, "authors"},
+		{"exact id", &Filter{IDs: []string{strings.Repeat("b", 64)}}, idCost, "ids"},
+		{"most selective field wins", &Filter{Authors: []string{pubkey}, Kinds: []int{1}}, authorCost, "authors"},
+		{"tag values", &Filter{Tags: map[string][]string{"e": {"x", "y"}}}, 2 * tagCost, "#e"},
+		{"kinds", &Filter{Kinds: []int{1, 7}}, 2 * kindCost, "kinds"},
+		{"limit discounts", &Filter{Limit: intPtr(50)}, FullScanCost * 0.1, "scan"},
+		{"limit 0 only asks for new events", &Filter{Limit: intPtr(0)}, 0, "scan"},
+		{"bounded time range discounts", &Filter{Since: int64Ptr(now - 3*24*60*60)}, FullScanCost * 0.1, "scan"},
+		{"time discount has a floor", &Filter{Since: int64Ptr(now - 60)}, FullScanCost * minTimeFactor, "scan"},
+		{"since with until", &Filter{Since: int64Ptr(0), Until: int64Ptr(costReferenceWindow * 2)}, FullScanCost, "scan"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cost := EstimateCost(tt.f, now)
+			assert.InDelta(t, tt.score, cost.Score, 0.001)
+			assert.Equal(t, tt.index, cost.Index)
+		})
+	}
+}
+
+func TestEstimateCost_PrefixLength(t *testing.T) {
+	short := EstimateCost(&Filter{Authors: []string{"abcd"}}, 0)
+	long := EstimateCost(&Filter{Authors: []string{"abcdef01"}}, 0)
+	assert.Greater(t, short.Score, long.Score)
+	assert.Less(t, short.Score, FullScanCost)
+}
+
+func TestCostBudget_Apply(t *testing.T) {
+	const now = 1700000000
+	budget := &CostBudget{MaxRequestCost: 500, ClampWindow: 7 * 24 * 60 * 60}
+
+	t.Run("within budget is untouched", func(t *testing.T) {
+		f := &Filter{Kinds: []int{1}}
+		_, total, ok := budget.Apply([]*Filter{f}, now)
+		assert.True(t, ok)
+		assert.Equal(t, 100.0, total)
+		assert.Nil(t, f.Since)
+	})
+
+	t.Run("unbounded filter is clamped", func(t *testing.T) {
+		f := &Filter{}
+		costs, _, ok := budget.Apply([]*Filter{f}, now)
+		assert.True(t, ok)
+		if assert.NotNil(t, f.Since) {
+			assert.Equal(t, int64(now-7*24*60*60), *f.Since)
+		}
+		assert.Equal(t, int64(7*24*60*60), costs[0].Window)
+	})
+
+	t.Run("clamp is relative to until", func(t *testing.T) {
+		f := &Filter{Until: int64Ptr(now - 1000)}
+		budget.Apply([]*Filter{f}, now)
+		if assert.NotNil(t, f.Since) {
+			assert.Equal(t, int64(now-1000-7*24*60*60), *f.Since)
+		}
+	})
+
+	t.Run("bounded broad filters are rejected", func(t *testing.T) {
+		f := &Filter{Authors: []string{"a"}, Since: int64Ptr(0)}
+		_, total, ok := budget.Apply([]*Filter{f}, now)
+		assert.False(t, ok)
+		assert.Equal(t, FullScanCost, total)
+	})
+
+	t.Run("many filters still over budget after clamping", func(t *testing.T) {
+		filters := []*Filter{{}, {}, {}}
+		_, _, ok := budget.Apply(filters, now)
+		assert.False(t, ok)
+	})
+
+	t.Run("zero budget is unlimited", func(t *testing.T) {
+		f := &Filter{}
+		_, _, ok := (&CostBudget{}).Apply([]*Filter{f}, now)
+		assert.True(t, ok)
+		assert.Nil(t, f.Since)
+	})
+}
@@ -0,0 +1,248 @@
+// Package logging provides the relay's structured, leveled loggers. Every
+// subsystem gets its own *slog.Logger from For; level, output format,
+// per-subsystem overrides and sampling are set process-wide with Configure
+// and take effect immediately, also for loggers created before.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Field keys shared by all subsystems
+const (
+	KeySubsystem = "subsystem"
+	KeyClientIP  = "client_ip"
+	KeyPubKey    = "pubkey"
+	KeySubID     = "sub_id"
+	KeyEventID   = "event_id"
+	KeyKind      = "kind"
+	KeyError     = "error"
+)
+
+// Config controls the process-wide logging setup.
+type Config struct {
+	Level      string            // debug, info, warn or error (default info)
+	Format     string            // text or json (default text)
+	Subsystems map[string]string // level overrides by subsystem name
+	Sampling   Sampling
+	Output     io.Writer // default os.Stderr
+}
+
+// Sampling limits repeated messages below error level. Within each Interval
+// the first Initial records with the same subsystem, level and message are
+// logged, then every Thereafter-th. Initial 0 disables sampling.
+type Sampling struct {
+	Initial    int
+	Thereafter int
+	Interval   time.Duration
+}
+
+// state is the configured handler and levels, swapped atomically by Configure
+type state struct {
+	base    slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+	sampler *sampler // nil = no sampling
+}
+
+func (s *state) levelFor(subsystem string) slog.Level {
+	if level, ok := s.levels[subsystem]; ok {
+		return level
+	}
+	return s.level
+}
+
+var current atomic.Pointer[state]
+
+func init() {
+	current.Store(&state{
+		base:  slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level: slog.LevelInfo,
+	})
+}
+
+// Configure applies cfg to every logger returned by For and makes the relay
+// logger the slog and log package default.
+func Configure(cfg Config) error {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	levels := make(map[string]slog.Level, len(cfg.Subsystems))
+	for subsystem, s := range cfg.Subsystems {
+		l, err := ParseLevel(s)
+		if err != nil {
+			return fmt.Errorf("subsystem %s: %w", subsystem, err)
+		}
+		levels[subsystem] = l
+	}
+
+	out := cfg.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	// Levels are checked per subsystem by our handler; the base handler logs everything it gets
+	opts := &slog.HandlerOptions{Level: slog.Level(-8)}
+	var base slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		base = slog.NewTextHandler(out, opts)
+	case "json":
+		base = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", cfg.Format)
+	}
+
+	st := &state{base: base, level: level, levels: levels}
+	if cfg.Sampling.Initial > 0 {
+		st.sampler = newSampler(cfg.Sampling)
+	}
+	current.Store(st)
+	slog.SetDefault(For("main"))
+	return nil
+}
+
+// ParseLevel parses debug, info, warn (or warning) and error, case-insensitively.
+// The empty string is info.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// For returns the logger of a subsystem. Its records carry the subsystem name
+// and are filtered by the subsystem's level.
+func For(subsystem string) *slog.Logger {
+	return slog.New(&handler{subsystem: subsystem})
+}
+
+// WithClient adds the client IP and, once authenticated, its pubkey.
+func WithClient(l *slog.Logger, clientIP, pubkey string) *slog.Logger {
+	if pubkey == "" {
+		return l.With(KeyClientIP, clientIP)
+	}
+	return l.With(KeyClientIP, clientIP, KeyPubKey, pubkey)
+}
+
+// handler resolves the configured base handler on every record, so
+// Configure affects loggers that already exist
+type handler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler // WithAttrs/WithGroup calls to replay on the base
+	cache     atomic.Pointer[resolved]
+}
+
+// resolved is the base handler of one state with the subsystem attribute and ops applied
+type resolved struct {
+	st *state
+	h  slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= current.Load().levelFor(h.subsystem)
+}
+
+func (h *handler) Handle(ctx context.Context, rec slog.Record) error {
+	st := current.Load()
+	if rec.Level < st.levelFor(h.subsystem) {
+		return nil
+	}
+	if st.sampler != nil && rec.Level < slog.LevelError && !st.sampler.allow(h.subsystem, rec) {
+		return nil
+	}
+	return h.resolve(st).Handle(ctx, rec)
+}
+
+func (h *handler) resolve(st *state) slog.Handler {
+	if r := h.cache.Load(); r != nil && r.st == st {
+		return r.h
+	}
+	base := st.base.WithAttrs([]slog.Attr{slog.String(KeySubsystem, h.subsystem)})
+	for _, op := range h.ops {
+		base = op(base)
+	}
+	h.cache.Store(&resolved{st: st, h: base})
+	return base
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{subsystem: h.subsystem, ops: append(ops, op)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithGroup(name) })
+}
+
+// sampler counts records per subsystem, level and message within an interval
+type sampler struct {
+	cfg    Sampling
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+type sampleKey struct {
+	subsystem string
+	level     slog.Level
+	msg       string
+}
+
+type sampleCount struct {
+	start time.Time
+	n     int
+}
+
+func newSampler(cfg Sampling) *sampler {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	return &sampler{cfg: cfg, counts: make(map[sampleKey]*sampleCount)}
+}
+
+func (s *sampler) allow(subsystem string, rec slog.Record) bool {
+	key := sampleKey{subsystem: subsystem, level: rec.Level, msg: rec.Message}
+	now := rec.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counts[key]
+	if !ok || now.Sub(c.start) >= s.cfg.Interval {
+		c = &sampleCount{start: now}
+		s.counts[key] = c
+	}
+	c.n++
+	if c.n <= s.cfg.Initial {
+		return true
+	}
+	return s.cfg.Thereafter > 0 && (c.n-s.cfg.Initial)%s.cfg.Thereafter == 0
+}
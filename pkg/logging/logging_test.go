@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigure_SubsystemLevels(t *testing.T) {
+	var buf bytes.Buffer
+	relayLog := For("relay") // created before Configure; picks up the new setup
+	require.NoError(t, Configure(Config{
+		Level:      "warn",
+		Format:     "json",
+		Subsystems: map[string]string{"relay": "debug"},
+		Output:     &buf,
+	}))
+	defer Configure(Config{})
+
+	relayLog.Debug("query cost", KeySubID, "sub1")
+	For("protocol").Info("dropped")
+	For("protocol").Warn("kept")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var rec map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &rec))
+	assert.Equal(t, "query cost", rec["msg"])
+	assert.Equal(t, "relay", rec[KeySubsystem])
+	assert.Equal(t, "sub1", rec[KeySubID])
+	assert.Contains(t, lines[1], `"msg":"kept"`)
+}
+
+func TestConfigure_Sampling(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Configure(Config{
+		Sampling: Sampling{Initial: 2, Thereafter: 5, Interval: time.Hour},
+		Output:   &buf,
+	}))
+	defer Configure(Config{})
+
+	l := WithClient(For("ratelimit"), "10.0.0.1", "")
+	for i := 0; i < 12; i++ {
+		l.Warn("rate limited")
+	}
+	l.Error("rate limiter failed") // errors are never sampled
+
+	// 2 initial, then the 5th and 10th of the remaining 10, plus the error
+	assert.Equal(t, 5, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), "client_ip=10.0.0.1")
+}
+
+func TestConfigure_Invalid(t *testing.T) {
+	assert.Error(t, Configure(Config{Level: "verbose"}))
+	assert.Error(t, Configure(Config{Format: "xml"}))
+	assert.Error(t, Configure(Config{Subsystems: map[string]string{"relay": "loud"}}))
+}
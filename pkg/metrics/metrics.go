@@ -0,0 +1,410 @@
+// Package metrics provides the counters, gauges and histograms the relay is
+// instrumented with, and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ContentType is the media type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are histogram buckets in seconds suited to request latencies
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric family that can write itself in the text format
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds metric families and writes them in the Prometheus text format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// register adds a metric family; registering a name twice is a programming error
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[c.name()]; ok {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.collectors[c.name()] = c
+}
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(&counterFamily{desc: desc{name, help}, vec: singleVec(c)})
+	return c
+}
+
+// NewCounterVec registers a counter partitioned by the given labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec: newVec(labels, func() interface{} { return &Counter{} })}
+	r.register(&counterFamily{desc: desc{name, help}, vec: v.vec})
+	return v
+}
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(&gaugeFamily{desc: desc{name, help}, vec: singleVec(g)})
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn on every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFamily{desc: desc{name, help}, vec: singleVec(gaugeFunc(fn))})
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(&histogramFamily{desc: desc{name, help}, vec: singleVec(h)})
+	return h
+}
+
+// NewHistogramVec registers a histogram partitioned by the given labels.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{vec: newVec(labels, func() interface{} { return newHistogram(buckets) })}
+	r.register(&histogramFamily{desc: desc{name, help}, vec: v.vec})
+	return v
+}
+
+// Write writes every metric family in the Prometheus text format, sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := make([]collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		collectors = append(collectors, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.Write(w)
+	})
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	bits uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	vec *vec
+}
+
+// With returns the counter for the given label values, in label order.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.vec.with(values).(*Counter)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the gauge.
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	addFloat(&g.bits, 1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	addFloat(&g.bits, -1)
+}
+
+// Add adds v to the gauge.
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// gaugeFunc is a gauge computed when the registry is scraped
+type gaugeFunc func() float64
+
+// Value calls the function.
+func (f gaugeFunc) Value() float64 {
+	return f()
+}
+
+// Histogram counts observations in buckets and tracks their sum.
+type Histogram struct {
+	upper  []float64
+	counts []uint64 // per bucket, the last one is +Inf
+	count  uint64
+	sum    uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	upper := append([]float64(nil), buckets...)
+	sort.Float64s(upper)
+	return &Histogram{upper: upper, counts: make([]uint64, len(upper)+1)}
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	addFloat(&h.sum, v)
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	vec *vec
+}
+
+// With returns the histogram for the given label values, in label order.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.vec.with(values).(*Histogram)
+}
+
+// addFloat atomically adds v to the float64 stored in bits
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(bits, old, updated) {
+			return
+		}
+	}
+}
+
+// vec holds the children of a metric family keyed by their label values
+type vec struct {
+	labels   []string
+	newChild func() interface{}
+	mu       sync.RWMutex
+	children map[string]*child
+}
+
+type child struct {
+	values []string
+	metric interface{}
+}
+
+func newVec(labels []string, newChild func() interface{}) *vec {
+	return &vec{labels: labels, newChild: newChild, children: make(map[string]*child)}
+}
+
+// singleVec wraps an unlabelled metric
+func singleVec(metric interface{}) *vec {
+	return &vec{children: map[string]*child{"": {metric: metric}}}
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.children[key]; ok {
+		return c.metric
+	}
+	c = &child{values: append([]string(nil), values...), metric: v.newChild()}
+	v.children[key] = c
+	return c.metric
+}
+
+// sorted returns the children ordered by label values for stable output
+func (v *vec) sorted() []*child {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	children := make([]*child, 0, len(keys))
+	sort.Strings(keys)
+	for _, key := range keys {
+		children = append(children, v.children[key])
+	}
+	v.mu.RUnlock()
+	return children
+}
+
+// labelString formats label pairs, with extra pairs (such as le) appended
+func (v *vec) labelString(values []string, extra ...string) string {
+	if len(v.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range v.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writeLabel(&b, label, values[i])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		writeLabel(&b, extra[i], extra[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabel(b *strings.Builder, name, value string) {
+	b.WriteString(name)
+	b.WriteString(`="`)
+	labelEscaper.WriteString(b, value)
+	b.WriteByte('"')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// desc is the name and help text of a metric family
+type desc struct {
+	metricName string
+	help       string
+}
+
+func (d desc) name() string {
+	return d.metricName
+}
+
+func (d desc) writeHeader(w *bufio.Writer, typ string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, help, d.metricName, typ)
+}
+
+type counterFamily struct {
+	desc
+	vec *vec
+}
+
+func (f *counterFamily) write(w *bufio.Writer) {
+	f.writeHeader(w, "counter")
+	for _, c := range f.vec.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", f.metricName, f.vec.labelString(c.values), formatFloat(c.metric.(*Counter).Value()))
+	}
+}
+
+type gaugeFamily struct {
+	desc
+	vec *vec
+}
+
+func (f *gaugeFamily) write(w *bufio.Writer) {
+	f.writeHeader(w, "gauge")
+	for _, c := range f.vec.sorted() {
+		value := c.metric.(interface{ Value() float64 }).Value()
+		fmt.Fprintf(w, "%s%s %s\n", f.metricName, f.vec.labelString(c.values), formatFloat(value))
+	}
+}
+
+type histogramFamily struct {
+	desc
+	vec *vec
+}
+
+func (f *histogramFamily) write(w *bufio.Writer) {
+	f.writeHeader(w, "histogram")
+	for _, c := range f.vec.sorted() {
+		h := c.metric.(*Histogram)
+		var cumulative uint64
+		for i, upper := range h.upper {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.metricName, f.vec.labelString(c.values, "le", formatFloat(upper)), cumulative)
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(h.upper)])
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.metricName, f.vec.labelString(c.values, "le", "+Inf"), cumulative)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.metricName, f.vec.labelString(c.values), formatFloat(h.Sum()))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.metricName, f.vec.labelString(c.values), cumulative)
+	}
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exposition(t *testing.T, reg *Registry) string {
+	t.Helper()
+	var b strings.Builder
+	require.NoError(t, reg.Write(&b))
+	return b.String()
+}
+
+func TestRegistry_TextFormat(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.NewCounter("test_requests_total", "Requests.")
+	v := reg.NewCounterVec("test_events_total", "Events.", "result", "kind")
+	h := reg.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	reg.NewGaugeFunc("test_active", "Active.", func() float64 { return 3 })
+
+	c.Inc()
+	c.Add(2)
+	v.With("accepted", "1").Inc()
+	v.With("rejected", `quo"te`).Inc()
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	out := exposition(t, reg)
+	assert.Contains(t, out, "# TYPE test_requests_total counter\ntest_requests_total 3\n")
+	assert.Contains(t, out, `test_events_total{result="accepted",kind="1"} 1`)
+	assert.Contains(t, out, `test_events_total{result="rejected",kind="quo\"te"} 1`)
+	assert.Contains(t, out, "test_active 3\n")
+	assert.Contains(t, out, `test_latency_seconds_bucket{le="0.1"} 1`)
+	assert.Contains(t, out, `test_latency_seconds_bucket{le="1"} 2`)
+	assert.Contains(t, out, `test_latency_seconds_bucket{le="+Inf"} 3`)
+	assert.Contains(t, out, "test_latency_seconds_sum 5.55\n")
+	assert.Contains(t, out, "test_latency_seconds_count 3\n")
+
+	// Families are sorted by name for stable output
+	assert.Less(t, strings.Index(out, "test_active"), strings.Index(out, "test_requests_total"))
+}
+
+func TestRegistry_DuplicateName(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("dup_total", "")
+	assert.Panics(t, func() { reg.NewGauge("dup_total", "") })
+}
+
+func TestInstrumentStore(t *testing.T) {
+	reg := NewRegistry()
+	inner := memory.New()
+	store := InstrumentStore(inner, NewStoreMetrics(reg, "test"))
+
+	// Optional interfaces of the wrapped store stay visible
+	_, ok := store.(storage.HLLCounter)
+	assert.Equal(t, implementsHLL(inner), ok)
+	_, ok = store.(storage.ManagementStore)
+	assert.True(t, ok)
+	_, ok = store.(channelStore)
+	assert.True(t, ok)
+
+	ctx := context.Background()
+	evt := &event.Event{ID: strings.Repeat("a", 64), PubKey: strings.Repeat("b", 64), Kind: 1, CreatedAt: 1}
+	require.NoError(t, store.SaveEvent(ctx, evt))
+	_, err := store.QueryEvents(ctx, []*event.Filter{{}})
+	require.NoError(t, err)
+	_, err = store.GetEvent(ctx, strings.Repeat("c", 64))
+	assert.True(t, errors.Is(err, storage.ErrNotFound))
+
+	out := exposition(t, reg)
+	assert.Contains(t, out, `test_store_operation_duration_seconds_count{op="save_event"} 1`)
+	assert.Contains(t, out, `test_store_operation_duration_seconds_count{op="query_events"} 1`)
+	assert.Contains(t, out, `test_store_operation_duration_seconds_count{op="get_event"} 1`)
+	assert.NotContains(t, out, `test_store_errors_total{op="get_event"}`, "not found is not an error")
+}
+
+func implementsHLL(s storage.Store) bool {
+	_, ok := s.(storage.HLLCounter)
+	return ok
+}
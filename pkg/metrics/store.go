@@ -0,0 +1,307 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip45"
+	"github.com/paul/glienicke/pkg/storage"
+)
+
+// StoreMetrics are the series recorded by an instrumented store.
+type StoreMetrics struct {
+	Duration *HistogramVec // operation latency by op
+	Errors   *CounterVec   // failed operations by op (ErrNotFound is not a failure)
+}
+
+// NewStoreMetrics registers the store series.
+func NewStoreMetrics(reg *Registry, namespace string) *StoreMetrics {
+	return &StoreMetrics{
+		Duration: reg.NewHistogramVec(namespace+"_store_operation_duration_seconds",
+			"Latency of storage operations.", DefBuckets, "op"),
+		Errors: reg.NewCounterVec(namespace+"_store_errors_total",
+			"Storage operations that returned an error.", "op"),
+	}
+}
+
+func (m *StoreMetrics) observe(op string, start time.Time, err error) {
+	m.Duration.With(op).ObserveSince(start)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		m.Errors.With(op).Inc()
+	}
+}
+
+// channelStore mirrors the NIP-28 channel methods a store may provide
+type channelStore interface {
+	SaveChannelEvent(ctx context.Context, evt *event.Event) error
+	QueryChannelEvents(ctx context.Context, channelID string, since, until *int64, limit *int) ([]*event.Event, error)
+}
+
+// InstrumentStore wraps a store so that every operation is timed. The
+// returned store implements the same optional interfaces as inner
+// (storage.HLLCounter, storage.ManagementStore, NIP-28 channel methods), so
+// type assertions against it keep working.
+func InstrumentStore(inner storage.Store, m *StoreMetrics) storage.Store {
+	base := &instrumentedStore{inner: inner, m: m}
+	hll, hasHLL := inner.(storage.HLLCounter)
+	mgmt, hasMgmt := inner.(storage.ManagementStore)
+	channels, hasChannels := inner.(channelStore)
+	h := &instrumentedHLL{inner: hll, m: m}
+	g := &instrumentedManagement{inner: mgmt, m: m}
+	c := &instrumentedChannels{inner: channels, m: m}
+
+	switch {
+	case hasHLL && hasMgmt && hasChannels:
+		return struct {
+			*instrumentedStore
+			*instrumentedHLL
+			*instrumentedManagement
+			*instrumentedChannels
+		}{base, h, g, c}
+	case hasHLL && hasMgmt:
+		return struct {
+			*instrumentedStore
+			*instrumentedHLL
+			*instrumentedManagement
+		}{base, h, g}
+	case hasHLL && hasChannels:
+		return struct {
+			*instrumentedStore
+			*instrumentedHLL
+			*instrumentedChannels
+		}{base, h, c}
+	case hasMgmt && hasChannels:
+		return struct {
+			*instrumentedStore
+			*instrumentedManagement
+			*instrumentedChannels
+		}{base, g, c}
+	case hasHLL:
+		return struct {
+			*instrumentedStore
+			*instrumentedHLL
+		}{base, h}
+	case hasMgmt:
+		return struct {
+			*instrumentedStore
+			*instrumentedManagement
+		}{base, g}
+	case hasChannels:
+		return struct {
+			*instrumentedStore
+			*instrumentedChannels
+		}{base, c}
+	default:
+		return base
+	}
+}
+
+// instrumentedStore times the core storage.Store methods
+type instrumentedStore struct {
+	inner storage.Store
+	m     *StoreMetrics
+}
+
+// Unwrap returns the instrumented store.
+func (s *instrumentedStore) Unwrap() storage.Store {
+	return s.inner
+}
+
+func (s *instrumentedStore) SaveEvent(ctx context.Context, evt *event.Event) error {
+	start := time.Now()
+	err := s.inner.SaveEvent(ctx, evt)
+	s.m.observe("save_event", start, err)
+	return err
+}
+
+func (s *instrumentedStore) QueryEvents(ctx context.Context, filters []*event.Filter) ([]*event.Event, error) {
+	start := time.Now()
+	events, err := s.inner.QueryEvents(ctx, filters)
+	s.m.observe("query_events", start, err)
+	return events, err
+}
+
+func (s *instrumentedStore) DeleteEvent(ctx context.Context, eventID string, deleterPubKey string) error {
+	start := time.Now()
+	err := s.inner.DeleteEvent(ctx, eventID, deleterPubKey)
+	s.m.observe("delete_event", start, err)
+	return err
+}
+
+func (s *instrumentedStore) DeleteAllEventsByPubKey(ctx context.Context, pubkey string) error {
+	start := time.Now()
+	err := s.inner.DeleteAllEventsByPubKey(ctx, pubkey)
+	s.m.observe("delete_events_by_pubkey", start, err)
+	return err
+}
+
+func (s *instrumentedStore) GetEvent(ctx context.Context, eventID string) (*event.Event, error) {
+	start := time.Now()
+	evt, err := s.inner.GetEvent(ctx, eventID)
+	s.m.observe("get_event", start, err)
+	return evt, err
+}
+
+func (s *instrumentedStore) Close() error {
+	return s.inner.Close()
+}
+
+func (s *instrumentedStore) CountEvents(ctx context.Context, filters []*event.Filter) (int, error) {
+	start := time.Now()
+	count, err := s.inner.CountEvents(ctx, filters)
+	s.m.observe("count_events", start, err)
+	return count, err
+}
+
+func (s *instrumentedStore) DeleteChannelEvents(ctx context.Context, channelID string) (int, error) {
+	start := time.Now()
+	deleted, err := s.inner.DeleteChannelEvents(ctx, channelID)
+	s.m.observe("delete_channel_events", start, err)
+	return deleted, err
+}
+
+func (s *instrumentedStore) DeleteEventsOlderThan(ctx context.Context, before int64, exemptKinds []int) (int, error) {
+	start := time.Now()
+	deleted, err := s.inner.DeleteEventsOlderThan(ctx, before, exemptKinds)
+	s.m.observe("delete_events_older_than", start, err)
+	return deleted, err
+}
+
+func (s *instrumentedStore) DeleteKindsOlderThan(ctx context.Context, kinds []int, before int64) (int, error) {
+	start := time.Now()
+	deleted, err := s.inner.DeleteKindsOlderThan(ctx, kinds, before)
+	s.m.observe("delete_kinds_older_than", start, err)
+	return deleted, err
+}
+
+// instrumentedHLL times storage.HLLCounter
+type instrumentedHLL struct {
+	inner storage.HLLCounter
+	m     *StoreMetrics
+}
+
+func (s *instrumentedHLL) CountEventsHLL(ctx context.Context, filter *event.Filter, ref nip45.SketchRef) (*nip45.Result, error) {
+	start := time.Now()
+	result, err := s.inner.CountEventsHLL(ctx, filter, ref)
+	s.m.observe("count_events_hll", start, err)
+	return result, err
+}
+
+// instrumentedManagement times storage.ManagementStore
+type instrumentedManagement struct {
+	inner storage.ManagementStore
+	m     *StoreMetrics
+}
+
+func (s *instrumentedManagement) AddListEntry(ctx context.Context, list, value, reason string) error {
+	start := time.Now()
+	err := s.inner.AddListEntry(ctx, list, value, reason)
+	s.m.observe("add_list_entry", start, err)
+	return err
+}
+
+func (s *instrumentedManagement) RemoveListEntry(ctx context.Context, list, value string) error {
+	start := time.Now()
+	err := s.inner.RemoveListEntry(ctx, list, value)
+	s.m.observe("remove_list_entry", start, err)
+	return err
+}
+
+func (s *instrumentedManagement) ListEntries(ctx context.Context, list string) ([]storage.ListEntry, error) {
+	start := time.Now()
+	entries, err := s.inner.ListEntries(ctx, list)
+	s.m.observe("list_entries", start, err)
+	return entries, err
+}
+
+func (s *instrumentedManagement) SetSetting(ctx context.Context, key, value string) error {
+	start := time.Now()
+	err := s.inner.SetSetting(ctx, key, value)
+	s.m.observe("set_setting", start, err)
+	return err
+}
+
+func (s *instrumentedManagement) GetSetting(ctx context.Context, key string) (string, error) {
+	start := time.Now()
+	value, err := s.inner.GetSetting(ctx, key)
+	s.m.observe("get_setting", start, err)
+	return value, err
+}
+
+func (s *instrumentedManagement) SaveBan(ctx context.Context, ban storage.Ban) error {
+	start := time.Now()
+	err := s.inner.SaveBan(ctx, ban)
+	s.m.observe("save_ban", start, err)
+	return err
+}
+
+func (s *instrumentedManagement) DeleteBan(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.inner.DeleteBan(ctx, key)
+	s.m.observe("delete_ban", start, err)
+	return err
+}
+
+func (s *instrumentedManagement) ListBans(ctx context.Context) ([]storage.Ban, error) {
+	start := time.Now()
+	bans, err := s.inner.ListBans(ctx)
+	s.m.observe("list_bans", start, err)
+	return bans, err
+}
+
+func (s *instrumentedManagement) SaveReport(ctx context.Context, report storage.Report) error {
+	start := time.Now()
+	err := s.inner.SaveReport(ctx, report)
+	s.m.observe("save_report", start, err)
+	return err
+}
+
+func (s *instrumentedManagement) DeleteReports(ctx context.Context, targetType, target string) error {
+	start := time.Now()
+	err := s.inner.DeleteReports(ctx, targetType, target)
+	s.m.observe("delete_reports", start, err)
+	return err
+}
+
+func (s *instrumentedManagement) ListReports(ctx context.Context) ([]storage.Report, error) {
+	start := time.Now()
+	reports, err := s.inner.ListReports(ctx)
+	s.m.observe("list_reports", start, err)
+	return reports, err
+}
+
+func (s *instrumentedManagement) SaveReputation(ctx context.Context, rep storage.Reputation) error {
+	start := time.Now()
+	err := s.inner.SaveReputation(ctx, rep)
+	s.m.observe("save_reputation", start, err)
+	return err
+}
+
+func (s *instrumentedManagement) ListReputations(ctx context.Context) ([]storage.Reputation, error) {
+	start := time.Now()
+	reps, err := s.inner.ListReputations(ctx)
+	s.m.observe("list_reputations", start, err)
+	return reps, err
+}
+
+// instrumentedChannels times the NIP-28 channel methods
+type instrumentedChannels struct {
+	inner channelStore
+	m     *StoreMetrics
+}
+
+func (s *instrumentedChannels) SaveChannelEvent(ctx context.Context, evt *event.Event) error {
+	start := time.Now()
+	err := s.inner.SaveChannelEvent(ctx, evt)
+	s.m.observe("save_channel_event", start, err)
+	return err
+}
+
+func (s *instrumentedChannels) QueryChannelEvents(ctx context.Context, channelID string, since, until *int64, limit *int) ([]*event.Event, error) {
+	start := time.Now()
+	events, err := s.inner.QueryChannelEvents(ctx, channelID, since, until, limit)
+	s.m.observe("query_channel_events", start, err)
+	return events, err
+}
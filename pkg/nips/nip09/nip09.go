@@ -2,9 +2,9 @@ package nip09
 
 import (
 	"context"
-	"log"
 
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
 	"github.com/paul/glienicke/pkg/storage"
 )
 
@@ -13,6 +13,8 @@ const (
 	KindChannelMetadata = 41
 )
 
+var logger = logging.For("nip09")
+
 // HandleDeletion handles a NIP-09 event deletion request.
 func HandleDeletion(ctx context.Context, store storage.Store, evt *event.Event) error {
 	if evt.Kind != 5 {
@@ -34,9 +36,9 @@ func HandleDeletion(ctx context.Context, store storage.Store, evt *event.Event)
 						// Delete all channel events for this channel
 						deletedCount, err := store.DeleteChannelEvents(ctx, channelID)
 						if err != nil {
-							log.Printf("Failed to delete channel events for channel %s: %v", channelID, err)
+							logger.Error("failed to delete channel events", "channel_id", channelID, logging.KeyError, err)
 						} else if deletedCount > 0 {
-							log.Printf("Deleted %d channel events for channel %s", deletedCount, channelID)
+							logger.Debug("deleted channel events", "channel_id", channelID, "deleted", deletedCount)
 						}
 					}
 				}
@@ -44,7 +46,7 @@ func HandleDeletion(ctx context.Context, store storage.Store, evt *event.Event)
 
 			// Now delete the event from the main events table
 			if err := store.DeleteEvent(ctx, eventID, evt.PubKey); err != nil {
-				log.Printf("Failed to delete event %s: %v", eventID, err)
+				logger.Debug("failed to delete event", logging.KeyEventID, eventID, logging.KeyPubKey, evt.PubKey, logging.KeyError, err)
 			}
 		}
 	}
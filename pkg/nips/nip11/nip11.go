@@ -1,20 +1,95 @@
 package nip11
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+)
+
+// MediaType is the media type of the relay information document
+const MediaType = "application/nostr+json"
 
 // RelayInformationDocument represents the NIP-11 relay information document.
 type RelayInformationDocument struct {
-	Name          string `json:"name,omitempty"`
-	Description   string `json:"description,omitempty"`
-	Pubkey        string `json:"pubkey,omitempty"`
-	Contact       string `json:"contact,omitempty"`
-	SupportedNIPs []int  `json:"supported_nips,omitempty"`
-	Software      string `json:"software,omitempty"`
-	Version       string `json:"version,omitempty"`
-	Icon          string `json:"icon,omitempty"`
+	Name           string           `json:"name,omitempty"`
+	Description    string           `json:"description,omitempty"`
+	Banner         string           `json:"banner,omitempty"`
+	Icon           string           `json:"icon,omitempty"`
+	Pubkey         string           `json:"pubkey,omitempty"`
+	Self           string           `json:"self,omitempty"`
+	Contact        string           `json:"contact,omitempty"`
+	SupportedNIPs  []int            `json:"supported_nips,omitempty"`
+	Software       string           `json:"software,omitempty"`
+	Version        string           `json:"version,omitempty"`
+	TermsOfService string           `json:"terms_of_service,omitempty"`
+	Limitation     *RelayLimitation `json:"limitation,omitempty"`
+	Retention      []Retention      `json:"retention,omitempty"`
+	RelayCountries []string         `json:"relay_countries,omitempty"`
+	LanguageTags   []string         `json:"language_tags,omitempty"`
+	Tags           []string         `json:"tags,omitempty"`
+	PostingPolicy  string           `json:"posting_policy,omitempty"`
+	PaymentsURL    string           `json:"payments_url,omitempty"`
+	Fees           *Fees            `json:"fees,omitempty"`
+}
+
+// RelayLimitation describes the limits a relay enforces on clients.
+type RelayLimitation struct {
+	MaxMessageLength    int   `json:"max_message_length,omitempty"`
+	MaxSubscriptions    int   `json:"max_subscriptions,omitempty"`
+	MaxLimit            int   `json:"max_limit,omitempty"`
+	MaxSubIDLength      int   `json:"max_subid_length,omitempty"`
+	MaxEventTags        int   `json:"max_event_tags,omitempty"`
+	MaxContentLength    int   `json:"max_content_length,omitempty"`
+	MinPowDifficulty    int   `json:"min_pow_difficulty,omitempty"`
+	AuthRequired        bool  `json:"auth_required"`
+	PaymentRequired     bool  `json:"payment_required"`
+	RestrictedWrites    bool  `json:"restricted_writes"`
+	CreatedAtLowerLimit int64 `json:"created_at_lower_limit,omitempty"`
+	CreatedAtUpperLimit int64 `json:"created_at_upper_limit,omitempty"`
+	DefaultLimit        int   `json:"default_limit,omitempty"`
+}
+
+// Retention describes how long events of some kinds are kept. Kinds holds
+// single kinds and [start, end] ranges; no kinds means all other kinds. A nil
+// Time means events are kept indefinitely (unless Count applies).
+type Retention struct {
+	Kinds []interface{} `json:"kinds,omitempty" yaml:"kinds"`
+	Time  *int64        `json:"time" yaml:"time"`
+	Count *int          `json:"count,omitempty" yaml:"count"`
+}
+
+// Fees lists what the relay charges for admission, subscription and publication.
+type Fees struct {
+	Admission    []Fee `json:"admission,omitempty" yaml:"admission"`
+	Subscription []Fee `json:"subscription,omitempty" yaml:"subscription"`
+	Publication  []Fee `json:"publication,omitempty" yaml:"publication"`
+}
+
+// Fee is a single fee; Period is in seconds for subscriptions.
+type Fee struct {
+	Amount int    `json:"amount" yaml:"amount"`
+	Unit   string `json:"unit" yaml:"unit"`
+	Period int    `json:"period,omitempty" yaml:"period"`
+	Kinds  []int  `json:"kinds,omitempty" yaml:"kinds"`
 }
 
 // ToJSON returns the JSON encoding of the document.
 func (d *RelayInformationDocument) ToJSON() ([]byte, error) {
 	return json.Marshal(d)
 }
+
+// Accepts reports whether an Accept header asks for the relay information
+// document, also when it lists other media types next to it.
+func Accepts(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || !strings.EqualFold(mediaType, MediaType) {
+			continue
+		}
+		if q, ok := params["q"]; ok && strings.Trim(q, "0.") == "" {
+			continue // q=0 explicitly refuses it
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+// Package nip13 implements NIP-13 proof of work.
+//
+// The difficulty of an event is the number of leading zero bits of its ID.
+// Miners commit to a target difficulty in the third element of the "nonce"
+// tag so that a relay can reject events that only reached the required
+// difficulty by luck.
+package nip13
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"github.com/paul/glienicke/pkg/event"
+)
+
+// Difficulty returns the number of leading zero bits of a hex-encoded event ID.
+func Difficulty(id string) (int, error) {
+	idBytes, err := hex.DecodeString(id)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID hex: %w", err)
+	}
+
+	count := 0
+	for _, b := range idBytes {
+		if b == 0 {
+			count += 8
+			continue
+		}
+		count += bits.LeadingZeros8(b)
+		break
+	}
+	return count, nil
+}
+
+// CommittedTarget returns the target difficulty committed in the event's
+// nonce tag. The second return value is false if the event has no nonce tag
+// or the tag carries no parseable target.
+func CommittedTarget(evt *event.Event) (int, bool) {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 3 && tag[0] == "nonce" {
+			target, err := strconv.Atoi(tag[2])
+			if err != nil {
+				return 0, false
+			}
+			return target, true
+		}
+	}
+	return 0, false
+}
+
+// Check verifies that the event meets the given minimum difficulty. If the
+// event commits to a target difficulty, the target must also meet the
+// minimum. A minimum of 0 or less always passes.
+func Check(evt *event.Event, minDifficulty int) error {
+	if minDifficulty <= 0 {
+		return nil
+	}
+
+	difficulty, err := Difficulty(evt.ID)
+	if err != nil {
+		return err
+	}
+	if difficulty < minDifficulty {
+		return fmt.Errorf("difficulty %d is less than %d", difficulty, minDifficulty)
+	}
+
+	if target, ok := CommittedTarget(evt); ok && target < minDifficulty {
+		return fmt.Errorf("committed target difficulty %d is less than %d", target, minDifficulty)
+	}
+
+	return nil
+}
+
+// Policy describes the proof of work a relay demands from incoming events.
+type Policy struct {
+	// MinDifficulty is the difficulty required for every kind not listed in KindDifficulty.
+	MinDifficulty int
+
+	// KindDifficulty overrides MinDifficulty for specific event kinds.
+	KindDifficulty map[int]int
+
+	// ExemptAuthenticated skips the check for events published by a
+	// connection that is NIP-42 authenticated as the event's author.
+	ExemptAuthenticated bool
+
+	// ExemptKnown skips the check for authors the relay already stores events from.
+	ExemptKnown bool
+}
+
+// RequiredDifficulty returns the difficulty required for the given event kind.
+func (p *Policy) RequiredDifficulty(kind int) int {
+	if d, ok := p.KindDifficulty[kind]; ok {
+		return d
+	}
+	return p.MinDifficulty
+}
+
+// MaxDifficulty returns the highest difficulty the policy can demand, used
+// to advertise min_pow_difficulty in NIP-11.
+func (p *Policy) MaxDifficulty() int {
+	max := p.MinDifficulty
+	for _, d := range p.KindDifficulty {
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// ShouldReject returns a non-empty "pow:" reason if the event does not carry
+// the proof of work required by the policy. authPubKey is the pubkey the
+// publishing connection authenticated as (empty if unauthenticated) and known
+// reports whether the relay already stores events from the author; it is
+// only consulted when ExemptKnown is set and the event lacks the required
+// proof of work, since it may cost a store lookup.
+func (p *Policy) ShouldReject(evt *event.Event, authPubKey string, known func(pubkey string) bool) string {
+	required := p.RequiredDifficulty(evt.Kind)
+	if required <= 0 {
+		return ""
+	}
+	err := Check(evt, required)
+	if err == nil {
+		return ""
+	}
+	if p.ExemptAuthenticated && authPubKey != "" && authPubKey == evt.PubKey {
+		return ""
+	}
+	if p.ExemptKnown && known != nil && known(evt.PubKey) {
+		return ""
+	}
+	return fmt.Sprintf("pow: %v", err)
+}
@@ -0,0 +1,135 @@
+package nip13
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mine searches for a nonce giving the event at least the target difficulty
+// and signs the result.
+func mine(t *testing.T, kp *testutil.KeyPair, kind int, target int, committed int) *event.Event {
+	t.Helper()
+	evt := &event.Event{Kind: kind, Content: "pow", CreatedAt: 1234567890, PubKey: kp.PubKeyHex}
+	for nonce := 0; ; nonce++ {
+		evt.Tags = [][]string{{"nonce", strconv.Itoa(nonce), strconv.Itoa(committed)}}
+		id, err := evt.ComputeID()
+		require.NoError(t, err)
+		if d, _ := Difficulty(id); d >= target {
+			break
+		}
+	}
+	require.NoError(t, kp.SignEvent(evt))
+	return evt
+}
+
+func TestDifficulty(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected int
+	}{
+		{"ffff", 0},
+		{"7fff", 1},
+		{"0fff", 4},
+		{"00ff", 8},
+		{"000000000e9d97a1ab09fc381030b346cdd7a142ad57e6df0b46dc9bef6c7e2d", 36},
+		{"0000", 16},
+	}
+	for _, tc := range tests {
+		t.Run(tc.id, func(t *testing.T) {
+			d, err := Difficulty(tc.id)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, d)
+		})
+	}
+
+	_, err := Difficulty("not-hex")
+	assert.Error(t, err)
+}
+
+func TestCommittedTarget(t *testing.T) {
+	target, ok := CommittedTarget(&event.Event{Tags: [][]string{{"nonce", "776797", "20"}}})
+	assert.True(t, ok)
+	assert.Equal(t, 20, target)
+
+	_, ok = CommittedTarget(&event.Event{Tags: [][]string{{"nonce", "776797"}}})
+	assert.False(t, ok)
+
+	_, ok = CommittedTarget(&event.Event{Tags: [][]string{{"nonce", "1", "abc"}}})
+	assert.False(t, ok)
+}
+
+func TestCheck(t *testing.T) {
+	kp := testutil.MustGenerateKeyPair()
+
+	evt := mine(t, kp, 1, 8, 8)
+	assert.NoError(t, Check(evt, 8))
+	assert.NoError(t, Check(evt, 0))
+
+	// Lucky event: enough zero bits but committed to a lower target
+	lucky := mine(t, kp, 1, 8, 4)
+	err := Check(lucky, 8)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "committed target")
+
+	// No nonce tag at all and no work
+	plain, _ := testutil.MustNewTestEvent(1, "no work", nil)
+	for d, _ := Difficulty(plain.ID); d >= 16; d, _ = Difficulty(plain.ID) {
+		plain, _ = testutil.MustNewTestEvent(1, "no work", nil)
+	}
+	assert.Error(t, Check(plain, 16))
+}
+
+func TestPolicy_ShouldReject(t *testing.T) {
+	kp := testutil.MustGenerateKeyPair()
+	weak := mine(t, kp, 1, 0, 0)
+	for d, _ := Difficulty(weak.ID); d >= 8; d, _ = Difficulty(weak.ID) {
+		weak.Content += "."
+		require.NoError(t, kp.SignEvent(weak))
+	}
+	strong := mine(t, kp, 1, 8, 8)
+
+	t.Run("global minimum", func(t *testing.T) {
+		p := &Policy{MinDifficulty: 8}
+		assert.Contains(t, p.ShouldReject(weak, "", nil), "pow:")
+		assert.Empty(t, p.ShouldReject(strong, "", nil))
+	})
+
+	t.Run("per kind", func(t *testing.T) {
+		p := &Policy{KindDifficulty: map[int]int{7: 8}}
+		assert.Empty(t, p.ShouldReject(weak, "", nil))
+		reaction := mine(t, kp, 7, 0, 0)
+		for d, _ := Difficulty(reaction.ID); d >= 8; d, _ = Difficulty(reaction.ID) {
+			reaction.Content += "."
+			require.NoError(t, kp.SignEvent(reaction))
+		}
+		assert.Contains(t, p.ShouldReject(reaction, "", nil), "pow:")
+		assert.Equal(t, 8, p.MaxDifficulty())
+	})
+
+	t.Run("exempt authenticated author", func(t *testing.T) {
+		p := &Policy{MinDifficulty: 8, ExemptAuthenticated: true}
+		assert.Empty(t, p.ShouldReject(weak, kp.PubKeyHex, nil))
+		assert.NotEmpty(t, p.ShouldReject(weak, "someoneelse", nil))
+	})
+
+	t.Run("exempt known pubkeys", func(t *testing.T) {
+		p := &Policy{MinDifficulty: 8, ExemptKnown: true}
+		known := func(pk string) bool { return pk == kp.PubKeyHex }
+		unknown := func(string) bool { return false }
+		assert.Empty(t, p.ShouldReject(weak, "", known))
+		assert.NotEmpty(t, p.ShouldReject(weak, "", unknown))
+	})
+
+	t.Run("known lookup skipped when pow suffices", func(t *testing.T) {
+		p := &Policy{MinDifficulty: 8, ExemptKnown: true}
+		calls := 0
+		known := func(string) bool { calls++; return false }
+		assert.Empty(t, p.ShouldReject(strong, "", known))
+		assert.Equal(t, 0, calls)
+	})
+}
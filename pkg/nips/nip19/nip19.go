@@ -0,0 +1,137 @@
+// Package nip19 implements the bech32-encoded keys of NIP-19.
+//
+// Only the bare key prefixes (npub, nsec, note) are supported; the TLV
+// entities (nprofile, nevent, naddr) are not needed by the relay.
+package nip19
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var generator = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+// DecodeNpub returns the hex public key encoded by an npub string
+func DecodeNpub(npub string) (string, error) {
+	prefix, data, err := Decode(npub)
+	if err != nil {
+		return "", err
+	}
+	if prefix != "npub" {
+		return "", fmt.Errorf("unexpected prefix %q (want npub)", prefix)
+	}
+	if len(data) != 32 {
+		return "", fmt.Errorf("invalid npub length %d", len(data))
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// EncodeNpub returns the npub string for a hex public key
+func EncodeNpub(pubkey string) (string, error) {
+	data, err := hex.DecodeString(pubkey)
+	if err != nil || len(data) != 32 {
+		return "", fmt.Errorf("invalid pubkey %q", pubkey)
+	}
+	return Encode("npub", data)
+}
+
+// Decode returns the prefix and payload of a bech32 string
+func Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case bech32 string")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, errors.New("invalid bech32 separator position")
+	}
+	prefix := s[:sep]
+	values := make([]byte, 0, len(s)-sep-1)
+	for i := sep + 1; i < len(s); i++ {
+		v := strings.IndexByte(charset, s[i])
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", s[i])
+		}
+		values = append(values, byte(v))
+	}
+	if polymod(append(expandPrefix(prefix), values...)) != 1 {
+		return "", nil, errors.New("invalid bech32 checksum")
+	}
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return prefix, data, nil
+}
+
+// Encode returns the bech32 string for a prefix and payload
+func Encode(prefix string, data []byte) (string, error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	mod := polymod(append(append(expandPrefix(prefix), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(mod>>uint(5*(5-i)))&31)
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteByte('1')
+	for _, v := range values {
+		b.WriteByte(charset[v])
+	}
+	return b.String(), nil
+}
+
+func polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func expandPrefix(prefix string) []byte {
+	out := make([]byte, 0, len(prefix)*2+1)
+	for i := 0; i < len(prefix); i++ {
+		out = append(out, prefix[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(prefix); i++ {
+		out = append(out, prefix[i]&31)
+	}
+	return out
+}
+
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc, bits uint
+	maxv := uint(1)<<to - 1
+	var out []byte
+	for _, b := range data {
+		acc = acc<<from | uint(b)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("invalid bech32 padding")
+	}
+	return out, nil
+}
@@ -0,0 +1,40 @@
+package nip19
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Example from the NIP-19 specification
+const (
+	specNpub   = "npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg"
+	specPubKey = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+)
+
+func TestDecodeNpub(t *testing.T) {
+	pubkey, err := DecodeNpub(specNpub)
+	require.NoError(t, err)
+	assert.Equal(t, specPubKey, pubkey)
+}
+
+func TestEncodeNpub(t *testing.T) {
+	npub, err := EncodeNpub(specPubKey)
+	require.NoError(t, err)
+	assert.Equal(t, specNpub, npub)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"npub1",
+		specNpub[:len(specNpub)-1] + "h", // bad checksum
+		"nPub" + specNpub[4:],            // mixed case
+		"npub1" + "b" + specNpub[6:],     // invalid character
+		"nsec" + specNpub[4:],            // checksum covers the prefix
+	} {
+		_, err := DecodeNpub(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,504 @@
+// Package nip29 implements the state of NIP-29 relay-based groups.
+//
+// A group is identified by the "h" tag of the events posted to it. Its
+// metadata and members are changed by moderation events (kinds 9000-9020)
+// from members whose roles permit them, and by join and leave requests
+// (kinds 9021 and 9022). The relay publishes the resulting state as events
+// signed by its own key (kinds 39000-39003).
+//
+// Groups applies these events in order, so the state of every group can be
+// rebuilt by replaying the stored ones. Check authorizes an event against
+// the current state before it is accepted; Apply assumes that it was.
+package nip29
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/paul/glienicke/pkg/event"
+)
+
+// Moderation events, join and leave requests
+const (
+	KindPutUser      = 9000
+	KindRemoveUser   = 9001
+	KindEditMetadata = 9002
+	KindDeleteEvent  = 9005
+	KindCreateGroup  = 9007
+	KindDeleteGroup  = 9008
+	KindCreateInvite = 9009
+	KindJoinRequest  = 9021
+	KindLeaveRequest = 9022
+)
+
+// Group state published by the relay, addressed by a "d" tag of the group ID
+const (
+	KindGroupMetadata = 39000
+	KindGroupAdmins   = 39001
+	KindGroupMembers  = 39002
+	KindGroupRoles    = 39003
+)
+
+// RelayKinds are the group state kinds the relay publishes
+var RelayKinds = []int{KindGroupMetadata, KindGroupAdmins, KindGroupMembers, KindGroupRoles}
+
+// StateKinds are the kinds group state is built from; they must be kept for
+// it to be rebuilt
+var StateKinds = []int{
+	KindPutUser, KindRemoveUser, KindEditMetadata, KindDeleteEvent, KindCreateGroup,
+	KindDeleteGroup, KindCreateInvite, KindJoinRequest, KindLeaveRequest,
+}
+
+// TimelineSize is the number of recent events per group that "previous" tags
+// may refer to
+const TimelineSize = 200
+
+// LatePublication bounds how far the created_at of an event changing group
+// state may be from the relay's clock, in seconds, so that moderation events
+// cannot be backdated to reorder the history
+const LatePublication = 10 * 60
+
+// Roles assigned by the relay
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// Roles describes the roles in the kind 39003 event
+var Roles = map[string]string{
+	RoleAdmin:     "Edits and deletes the group, manages members and their roles",
+	RoleModerator: "Adds and removes members without roles, deletes events, creates invites",
+}
+
+// permissions are the moderation kinds each role may publish
+var permissions = map[string]map[int]bool{
+	RoleAdmin: {
+		KindPutUser: true, KindRemoveUser: true, KindEditMetadata: true, KindDeleteEvent: true,
+		KindDeleteGroup: true, KindCreateInvite: true,
+	},
+	RoleModerator: {
+		KindPutUser: true, KindRemoveUser: true, KindDeleteEvent: true, KindCreateInvite: true,
+	},
+}
+
+// validGroupID matches the group IDs NIP-29 allows
+var validGroupID = regexp.MustCompile(`^[a-z0-9_-]{1,128}$`)
+
+// GroupID returns the group an event belongs to: its "h" tag, or "" if none
+func GroupID(evt *event.Event) string {
+	return tagValue(evt, "h")
+}
+
+// IsModerationEvent reports whether an event is a moderation event (kinds 9000-9020)
+func IsModerationEvent(evt *event.Event) bool {
+	return evt.Kind >= 9000 && evt.Kind <= 9020
+}
+
+// ChangesState reports whether an event is a moderation event or a join or
+// leave request
+func ChangesState(evt *event.Event) bool {
+	return IsModerationEvent(evt) || evt.Kind == KindJoinRequest || evt.Kind == KindLeaveRequest
+}
+
+// IsRelayEvent reports whether an event is of a kind only the relay
+// publishes (39000-39009)
+func IsRelayEvent(evt *event.Event) bool {
+	return evt.Kind >= 39000 && evt.Kind <= 39009
+}
+
+// Group is the state of one group.
+type Group struct {
+	ID        string
+	Name      string
+	Picture   string
+	About     string
+	Private   bool                // only members can read
+	Closed    bool                // joining takes an invite code or a moderator
+	Members   map[string][]string // member pubkeys and their roles
+	Invites   map[string]bool     // invite codes
+	CreatedAt int64
+}
+
+// IsMember reports whether pubkey is a member
+func (g *Group) IsMember(pubkey string) bool {
+	_, ok := g.Members[pubkey]
+	return ok
+}
+
+// HasRole reports whether pubkey is a member with the role
+func (g *Group) HasRole(pubkey, role string) bool {
+	for _, r := range g.Members[pubkey] {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether pubkey holds a role that may publish a moderation kind
+func (g *Group) Can(pubkey string, kind int) bool {
+	for _, role := range g.Members[pubkey] {
+		if permissions[role][kind] {
+			return true
+		}
+	}
+	return false
+}
+
+// editMetadata applies the metadata tags of a create-group or edit-metadata event
+func (g *Group) editMetadata(evt *event.Event) {
+	for _, tag := range evt.Tags {
+		switch {
+		case len(tag) >= 2 && tag[0] == "name":
+			g.Name = tag[1]
+		case len(tag) >= 2 && tag[0] == "picture":
+			g.Picture = tag[1]
+		case len(tag) >= 2 && tag[0] == "about":
+			g.About = tag[1]
+		case len(tag) >= 1 && tag[0] == "private":
+			g.Private = true
+		case len(tag) >= 1 && tag[0] == "public":
+			g.Private = false
+		case len(tag) >= 1 && tag[0] == "closed":
+			g.Closed = true
+		case len(tag) >= 1 && tag[0] == "open":
+			g.Closed = false
+		}
+	}
+}
+
+// Groups is the state of all groups on a relay. It is not safe for
+// concurrent use.
+type Groups struct {
+	groups    map[string]*Group
+	deleted   map[string]bool     // IDs of deleted groups, which cannot be reused
+	timelines map[string][]string // recent event IDs per group, oldest first
+}
+
+// NewGroups returns an empty state.
+func NewGroups() *Groups {
+	return &Groups{
+		groups:    make(map[string]*Group),
+		deleted:   make(map[string]bool),
+		timelines: make(map[string][]string),
+	}
+}
+
+// Get returns a group, or nil if there is no such group
+func (s *Groups) Get(id string) *Group {
+	return s.groups[id]
+}
+
+// IDs returns the IDs of all groups, sorted
+func (s *Groups) IDs() []string {
+	ids := make([]string, 0, len(s.groups))
+	for id := range s.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Check returns an OK reason if an event must be rejected: events for
+// unknown groups, events from non-members, moderation events the author's
+// roles do not permit, and "previous" tags referring to events not in the
+// group's recent timeline. Events outside of any group pass. now is the
+// relay's clock in Unix seconds.
+func (s *Groups) Check(evt *event.Event, now int64) string {
+	if IsRelayEvent(evt) {
+		return "restricted: group state is published by the relay"
+	}
+	id := GroupID(evt)
+	if id == "" {
+		if ChangesState(evt) {
+			return "invalid: missing group h tag"
+		}
+		return ""
+	}
+	if ChangesState(evt) && (evt.CreatedAt < now-LatePublication || evt.CreatedAt > now+LatePublication) {
+		return "invalid: created_at too far from the relay's time"
+	}
+
+	if evt.Kind == KindCreateGroup {
+		switch {
+		case !validGroupID.MatchString(id):
+			return "invalid: group IDs are made of a-z, 0-9, - and _"
+		case s.groups[id] != nil:
+			return "duplicate: group already exists"
+		case s.deleted[id]:
+			return "blocked: group was deleted"
+		}
+		return ""
+	}
+
+	g := s.groups[id]
+	if g == nil {
+		return "invalid: unknown group"
+	}
+	switch evt.Kind {
+	case KindJoinRequest:
+		if g.IsMember(evt.PubKey) {
+			return "duplicate: already a member"
+		}
+		return ""
+	case KindLeaveRequest:
+		if !g.IsMember(evt.PubKey) {
+			return "invalid: not a member"
+		}
+		return ""
+	}
+	if !g.IsMember(evt.PubKey) {
+		return "restricted: not a member of this group"
+	}
+	if IsModerationEvent(evt) {
+		return g.checkModeration(evt)
+	}
+	return s.checkPrevious(id, evt)
+}
+
+// checkModeration authorizes a moderation event by a member
+func (g *Group) checkModeration(evt *event.Event) string {
+	switch evt.Kind {
+	case KindPutUser, KindRemoveUser, KindEditMetadata, KindDeleteEvent, KindDeleteGroup, KindCreateInvite:
+	default:
+		return fmt.Sprintf("invalid: unsupported moderation kind %d", evt.Kind)
+	}
+	if !g.Can(evt.PubKey, evt.Kind) {
+		return fmt.Sprintf("restricted: your roles do not allow kind %d in this group", evt.Kind)
+	}
+	admin := g.HasRole(evt.PubKey, RoleAdmin)
+
+	switch evt.Kind {
+	case KindPutUser, KindRemoveUser:
+		targets := 0
+		for _, tag := range evt.Tags {
+			if len(tag) < 2 || tag[0] != "p" {
+				continue
+			}
+			if !isHexKey(tag[1]) {
+				return "invalid: p tag must be a hex pubkey"
+			}
+			targets++
+			if evt.Kind == KindPutUser {
+				for _, role := range tag[2:] {
+					if _, ok := Roles[role]; !ok {
+						return fmt.Sprintf("invalid: unknown role %q", role)
+					}
+				}
+				if len(tag) > 2 && !admin {
+					return "restricted: only admins can assign roles"
+				}
+			}
+			if len(g.Members[tag[1]]) > 0 && !admin {
+				return "restricted: only admins can change members with roles"
+			}
+		}
+		if targets == 0 {
+			return "invalid: missing p tag"
+		}
+	case KindDeleteEvent:
+		if tagValue(evt, "e") == "" {
+			return "invalid: missing e tag"
+		}
+	case KindCreateInvite:
+		if tagValue(evt, "code") == "" {
+			return "invalid: missing code tag"
+		}
+	}
+	return ""
+}
+
+// checkPrevious rejects "previous" tags that match no recent event of the group
+func (s *Groups) checkPrevious(id string, evt *event.Event) string {
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || tag[0] != "previous" {
+			continue
+		}
+		if len(tag[1]) < 8 {
+			return "invalid: previous tags carry at least 8 characters of an event ID"
+		}
+		found := false
+		for _, recent := range s.timelines[id] {
+			if strings.HasPrefix(recent, tag[1]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("invalid: previous event %s is not in the group timeline", tag[1])
+		}
+	}
+	return ""
+}
+
+// Apply applies an accepted moderation event, join or leave request and
+// returns the relay event kinds whose content changed. Events that do not
+// change state are ignored.
+func (s *Groups) Apply(evt *event.Event) []int {
+	id := GroupID(evt)
+	if evt.Kind == KindCreateGroup {
+		if id == "" || s.groups[id] != nil || s.deleted[id] {
+			return nil
+		}
+		g := &Group{
+			ID:        id,
+			Members:   map[string][]string{evt.PubKey: {RoleAdmin}},
+			Invites:   make(map[string]bool),
+			CreatedAt: evt.CreatedAt,
+		}
+		g.editMetadata(evt)
+		s.groups[id] = g
+		return RelayKinds
+	}
+
+	g := s.groups[id]
+	if g == nil {
+		return nil
+	}
+	switch evt.Kind {
+	case KindPutUser:
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				g.Members[tag[1]] = append([]string(nil), tag[2:]...)
+			}
+		}
+		return []int{KindGroupAdmins, KindGroupMembers}
+	case KindRemoveUser:
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				delete(g.Members, tag[1])
+			}
+		}
+		return []int{KindGroupAdmins, KindGroupMembers}
+	case KindEditMetadata:
+		g.editMetadata(evt)
+		return []int{KindGroupMetadata}
+	case KindCreateInvite:
+		g.Invites[tagValue(evt, "code")] = true
+	case KindDeleteGroup:
+		delete(s.groups, id)
+		delete(s.timelines, id)
+		s.deleted[id] = true
+	case KindJoinRequest:
+		// Open groups admit anyone; closed groups need a valid invite code,
+		// or else the request waits for a moderator's put-user
+		if g.IsMember(evt.PubKey) || (g.Closed && !g.Invites[tagValue(evt, "code")]) {
+			return nil
+		}
+		g.Members[evt.PubKey] = nil
+		return []int{KindGroupMembers}
+	case KindLeaveRequest:
+		if !g.IsMember(evt.PubKey) {
+			return nil
+		}
+		delete(g.Members, evt.PubKey)
+		return []int{KindGroupAdmins, KindGroupMembers}
+	}
+	return nil
+}
+
+// Observe adds an accepted event to its group's timeline
+func (s *Groups) Observe(evt *event.Event) {
+	id := GroupID(evt)
+	if s.groups[id] == nil {
+		return
+	}
+	timeline := append(s.timelines[id], evt.ID)
+	if len(timeline) > TimelineSize {
+		timeline = timeline[len(timeline)-TimelineSize:]
+	}
+	s.timelines[id] = timeline
+}
+
+// CanRead reports whether a client authenticated as pubkey ("" if not) may
+// read an event: events of private groups are only served to members
+func (s *Groups) CanRead(pubkey string, evt *event.Event) bool {
+	g := s.groups[GroupID(evt)]
+	return g == nil || !g.Private || g.IsMember(pubkey)
+}
+
+// CheckRead returns a CLOSED reason if a client authenticated as pubkey (""
+// if not) may not read a group
+func (s *Groups) CheckRead(pubkey, id string) string {
+	g := s.groups[id]
+	switch {
+	case g == nil || !g.Private || g.IsMember(pubkey):
+		return ""
+	case pubkey == "":
+		return "auth-required: this group is private"
+	default:
+		return "restricted: not a member of this group"
+	}
+}
+
+// RelayEvent builds the unsigned relay event of a kind (see RelayKinds) that
+// publishes a group's state.
+func RelayEvent(g *Group, kind int, createdAt int64) *event.Event {
+	evt := &event.Event{Kind: kind, CreatedAt: createdAt, Tags: [][]string{{"d", g.ID}}}
+	switch kind {
+	case KindGroupMetadata:
+		for _, field := range [][2]string{{"name", g.Name}, {"picture", g.Picture}, {"about", g.About}} {
+			if field[1] != "" {
+				evt.Tags = append(evt.Tags, []string{field[0], field[1]})
+			}
+		}
+		if g.Private {
+			evt.Tags = append(evt.Tags, []string{"private"})
+		} else {
+			evt.Tags = append(evt.Tags, []string{"public"})
+		}
+		if g.Closed {
+			evt.Tags = append(evt.Tags, []string{"closed"})
+		} else {
+			evt.Tags = append(evt.Tags, []string{"open"})
+		}
+	case KindGroupAdmins:
+		for _, pk := range sortedKeys(g.Members) {
+			if roles := g.Members[pk]; len(roles) > 0 {
+				evt.Tags = append(evt.Tags, append([]string{"p", pk}, roles...))
+			}
+		}
+	case KindGroupMembers:
+		for _, pk := range sortedKeys(g.Members) {
+			evt.Tags = append(evt.Tags, []string{"p", pk})
+		}
+	case KindGroupRoles:
+		for _, role := range sortedKeys(Roles) {
+			evt.Tags = append(evt.Tags, []string{"role", role, Roles[role]})
+		}
+	}
+	return evt
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tagValue returns the value of the first tag with the given name
+func tagValue(evt *event.Event, name string) string {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+func isHexKey(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package nip29
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const now = 1700000000
+
+var (
+	alice = strings.Repeat("a", 64)
+	bob   = strings.Repeat("b", 64)
+	carol = strings.Repeat("c", 64)
+)
+
+// accept checks and applies an event, failing the test if it is rejected
+func accept(t *testing.T, s *Groups, evt *event.Event) []int {
+	t.Helper()
+	require.Empty(t, s.Check(evt, now))
+	changed := s.Apply(evt)
+	s.Observe(evt)
+	return changed
+}
+
+func groupEvent(id, pubkey string, kind int, tags ...[]string) *event.Event {
+	evt := &event.Event{
+		PubKey:    pubkey,
+		Kind:      kind,
+		CreatedAt: now,
+		Tags:      append([][]string{{"h", id}}, tags...),
+	}
+	evt.ID, _ = evt.ComputeID()
+	return evt
+}
+
+func TestGroups_Lifecycle(t *testing.T) {
+	s := NewGroups()
+
+	changed := accept(t, s, groupEvent("dev", alice, KindCreateGroup, []string{"name", "Developers"}, []string{"closed"}))
+	assert.Equal(t, RelayKinds, changed)
+	g := s.Get("dev")
+	require.NotNil(t, g)
+	assert.True(t, g.HasRole(alice, RoleAdmin))
+	assert.True(t, g.Closed)
+	assert.Equal(t, "duplicate: group already exists", s.Check(groupEvent("dev", bob, KindCreateGroup), now))
+
+	// Closed groups need an invite code
+	join := groupEvent("dev", bob, KindJoinRequest)
+	accept(t, s, join)
+	assert.False(t, g.IsMember(bob))
+	accept(t, s, groupEvent("dev", alice, KindCreateInvite, []string{"code", "s3cret"}))
+	accept(t, s, groupEvent("dev", bob, KindJoinRequest, []string{"code", "s3cret"}))
+	assert.True(t, g.IsMember(bob))
+
+	// Members without roles cannot moderate
+	assert.Contains(t, s.Check(groupEvent("dev", bob, KindPutUser, []string{"p", carol}), now), "restricted:")
+
+	// Moderators add members but cannot assign roles or remove admins
+	accept(t, s, groupEvent("dev", alice, KindPutUser, []string{"p", bob, RoleModerator}))
+	accept(t, s, groupEvent("dev", bob, KindPutUser, []string{"p", carol}))
+	assert.True(t, g.IsMember(carol))
+	assert.Contains(t, s.Check(groupEvent("dev", bob, KindPutUser, []string{"p", carol, RoleAdmin}), now), "only admins")
+	assert.Contains(t, s.Check(groupEvent("dev", bob, KindRemoveUser, []string{"p", alice}), now), "only admins")
+	assert.Contains(t, s.Check(groupEvent("dev", alice, KindPutUser, []string{"p", carol, "owner"}), now), "unknown role")
+
+	assert.Equal(t, []int{KindGroupMetadata}, accept(t, s, groupEvent("dev", alice, KindEditMetadata, []string{"about", "Go"}, []string{"private"})))
+	assert.Equal(t, "Go", g.About)
+	assert.True(t, g.Private)
+
+	accept(t, s, groupEvent("dev", carol, KindLeaveRequest))
+	assert.False(t, g.IsMember(carol))
+	assert.Equal(t, "restricted: not a member of this group", s.Check(groupEvent("dev", carol, 9), now))
+
+	accept(t, s, groupEvent("dev", alice, KindDeleteGroup))
+	assert.Nil(t, s.Get("dev"))
+	assert.Equal(t, "blocked: group was deleted", s.Check(groupEvent("dev", alice, KindCreateGroup), now))
+}
+
+func TestGroups_Check(t *testing.T) {
+	s := NewGroups()
+	accept(t, s, groupEvent("chat", alice, KindCreateGroup))
+
+	tests := []struct {
+		name string
+		evt  *event.Event
+		want string
+	}{
+		{name: "outside any group", evt: &event.Event{Kind: 1, PubKey: carol}},
+		{name: "member message", evt: groupEvent("chat", alice, 9)},
+		{name: "non-member message", evt: groupEvent("chat", carol, 9), want: "restricted: not a member of this group"},
+		{name: "unknown group", evt: groupEvent("nope", alice, 9), want: "invalid: unknown group"},
+		{name: "relay event", evt: &event.Event{Kind: KindGroupMetadata, PubKey: alice}, want: "restricted: group state is published by the relay"},
+		{name: "moderation without h", evt: &event.Event{Kind: KindPutUser, PubKey: alice, CreatedAt: now}, want: "invalid: missing group h tag"},
+		{name: "invalid group ID", evt: groupEvent("Big Group", alice, KindCreateGroup), want: "invalid: group IDs are made of a-z, 0-9, - and _"},
+		{name: "join as member", evt: groupEvent("chat", alice, KindJoinRequest), want: "duplicate: already a member"},
+		{name: "put-user without p", evt: groupEvent("chat", alice, KindPutUser), want: "invalid: missing p tag"},
+		{name: "unsupported moderation kind", evt: groupEvent("chat", alice, 9003), want: "invalid: unsupported moderation kind 9003"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, s.Check(tt.evt, now))
+		})
+	}
+
+	late := groupEvent("chat", alice, KindPutUser, []string{"p", bob})
+	late.CreatedAt = now - 2*LatePublication
+	assert.Contains(t, s.Check(late, now), "created_at")
+}
+
+func TestGroups_Previous(t *testing.T) {
+	s := NewGroups()
+	create := groupEvent("chat", alice, KindCreateGroup)
+	accept(t, s, create)
+
+	msg := groupEvent("chat", alice, 9, []string{"previous", create.ID[:8]})
+	assert.Empty(t, s.Check(msg, now))
+
+	msg = groupEvent("chat", alice, 9, []string{"previous", "deadbeef"})
+	assert.Contains(t, s.Check(msg, now), "not in the group timeline")
+
+	msg = groupEvent("chat", alice, 9, []string{"previous", "dead"})
+	assert.Contains(t, s.Check(msg, now), "at least 8 characters")
+}
+
+func TestGroups_Read(t *testing.T) {
+	s := NewGroups()
+	accept(t, s, groupEvent("secret", alice, KindCreateGroup, []string{"private"}))
+	msg := groupEvent("secret", alice, 9)
+
+	assert.True(t, s.CanRead(alice, msg))
+	assert.False(t, s.CanRead(bob, msg))
+	assert.False(t, s.CanRead("", msg))
+	assert.True(t, s.CanRead("", &event.Event{Kind: 1}))
+
+	assert.Empty(t, s.CheckRead(alice, "secret"))
+	assert.Equal(t, "auth-required: this group is private", s.CheckRead("", "secret"))
+	assert.Equal(t, "restricted: not a member of this group", s.CheckRead(bob, "secret"))
+}
+
+func TestRelayEvent(t *testing.T) {
+	g := &Group{
+		ID:      "dev",
+		Name:    "Developers",
+		Private: true,
+		Members: map[string][]string{bob: nil, alice: {RoleAdmin}},
+	}
+
+	assert.Equal(t, [][]string{{"d", "dev"}, {"name", "Developers"}, {"private"}, {"open"}},
+		RelayEvent(g, KindGroupMetadata, now).Tags)
+	assert.Equal(t, [][]string{{"d", "dev"}, {"p", alice, RoleAdmin}},
+		RelayEvent(g, KindGroupAdmins, now).Tags)
+	assert.Equal(t, [][]string{{"d", "dev"}, {"p", alice}, {"p", bob}},
+		RelayEvent(g, KindGroupMembers, now).Tags)
+	assert.Len(t, RelayEvent(g, KindGroupRoles, now).Tags, 1+len(Roles))
+}
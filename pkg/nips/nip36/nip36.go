@@ -8,7 +8,6 @@ package nip36
 
 import (
 	"bufio"
-	"log"
 	"os"
 	"strings"
 	"sync"
@@ -16,8 +15,11 @@ import (
 	"time"
 
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
 )
 
+var logger = logging.For("nip36")
+
 // Policy enforces NIP-36 content-warning requirements based on a configurable
 // vocabulary loaded from disk and reloaded automatically on file change.
 type Policy struct {
@@ -64,6 +66,17 @@ func (p *Policy) Close() {
 	close(p.stopReload)
 }
 
+// Path returns the vocabulary file the policy is backed by.
+func (p *Policy) Path() string {
+	return p.path
+}
+
+// Reload re-reads the vocabulary file now, even if its mtime is unchanged.
+func (p *Policy) Reload() {
+	p.mtime.Store(-1)
+	p.reload()
+}
+
 // reload reads the vocabulary file if its mtime has changed.
 func (p *Policy) reload() {
 	p.mu.Lock()
@@ -80,7 +93,7 @@ func (p *Policy) reload() {
 			empty := []string{}
 			p.terms.Store(&empty)
 			p.mtime.Store(0)
-			log.Printf("NIP-36: vocabulary file %s missing, policy disabled", p.path)
+			logger.Warn("vocabulary file missing, policy disabled", "path", p.path)
 		}
 		return
 	}
@@ -92,13 +105,13 @@ func (p *Policy) reload() {
 
 	terms, err := loadFile(p.path)
 	if err != nil {
-		log.Printf("NIP-36: failed to read vocabulary file %s: %v", p.path, err)
+		logger.Error("failed to read vocabulary file", "path", p.path, logging.KeyError, err)
 		return
 	}
 
 	p.terms.Store(&terms)
 	p.mtime.Store(mtime)
-	log.Printf("NIP-36: loaded %d trigger terms from %s", len(terms), p.path)
+	logger.Info("loaded vocabulary", "terms", len(terms), "path", p.path)
 }
 
 // loadFile parses the vocabulary file. Format: one term per line, blank lines
@@ -119,6 +119,10 @@ func (m *mockStore) DeleteEventsOlderThan(ctx context.Context, before int64, exe
 	return 0, nil
 }
 
+func (m *mockStore) DeleteKindsOlderThan(ctx context.Context, kinds []int, before int64) (int, error) {
+	return 0, nil
+}
+
 func (m *mockStore) Close() error {
 	return nil
 }
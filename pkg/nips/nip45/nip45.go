@@ -0,0 +1,144 @@
+// Package nip45 implements the HyperLogLog extension of NIP-45 event counts.
+//
+// For a few well-known aggregates (followers of a pubkey, reactions to an
+// event, comments on an event) a relay returns, next to the count, the 256
+// HyperLogLog registers computed over the pubkeys of the counted events.
+// Clients merge registers from several relays to estimate the number of
+// distinct authors without double counting. The register arithmetic and the
+// choice of eligible filters come from github.com/nbd-wtf/go-nostr/nip45.
+package nip45
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	gonip45 "github.com/nbd-wtf/go-nostr/nip45"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+	"github.com/paul/glienicke/pkg/event"
+)
+
+// ExactCountThreshold is the estimated cardinality below which stores count
+// matching events exactly instead of answering from the sketch.
+const ExactCountThreshold = 1000
+
+// SketchRef identifies a maintained sketch: the events of one kind that
+// reference a given event ID or pubkey.
+type SketchRef struct {
+	Kind   int
+	Ref    string
+	Offset int
+}
+
+// Key returns a string usable as a map key for the sketch.
+func (s SketchRef) Key() string {
+	return fmt.Sprintf("%d:%s", s.Kind, s.Ref)
+}
+
+// ParseRef returns the sketch a filter can be answered from. The second
+// return value is false if the filter is not eligible for HyperLogLog counting.
+func ParseRef(f *event.Filter) (SketchRef, bool) {
+	offset := gonip45.HyperLogLogEventPubkeyOffsetForFilter(toNostrFilter(f))
+	if offset < 0 {
+		return SketchRef{}, false
+	}
+	for _, values := range f.Tags {
+		return SketchRef{Kind: f.Kinds[0], Ref: values[0], Offset: offset}, true
+	}
+	return SketchRef{}, false
+}
+
+// EventRefs returns the sketches the event contributes its pubkey to.
+func EventRefs(evt *event.Event) []SketchRef {
+	var refs []SketchRef
+	for ref, offset := range gonip45.HyperLogLogEventPubkeyOffsetsAndReferencesForEvent(toNostrEvent(evt)) {
+		refs = append(refs, SketchRef{Kind: evt.Kind, Ref: ref, Offset: offset})
+	}
+	return refs
+}
+
+// NewSketch returns an empty sketch for the given reference.
+func NewSketch(ref SketchRef) *hyperloglog.HyperLogLog {
+	return hyperloglog.New(ref.Offset)
+}
+
+// LoadSketch restores a sketch from its registers.
+func LoadSketch(ref SketchRef, registers []byte) (*hyperloglog.HyperLogLog, error) {
+	if len(registers) != 256 {
+		return nil, fmt.Errorf("invalid number of registers %d", len(registers))
+	}
+	regs := make([]byte, 256)
+	copy(regs, registers)
+	return hyperloglog.NewWithRegisters(regs, ref.Offset), nil
+}
+
+// EncodeRegisters returns the hex encoding of the registers as sent in the
+// "hll" field of a COUNT response.
+func EncodeRegisters(registers []byte) string {
+	return hex.EncodeToString(registers)
+}
+
+// Result is the answer to an HyperLogLog-eligible COUNT.
+type Result struct {
+	Count       int
+	Registers   []byte
+	Approximate bool
+}
+
+func toNostrFilter(f *event.Filter) nostr.Filter {
+	nf := nostr.Filter{
+		IDs:     f.IDs,
+		Authors: f.Authors,
+		Kinds:   f.Kinds,
+		Search:  f.Search,
+	}
+	if len(f.Tags) > 0 {
+		nf.Tags = make(nostr.TagMap, len(f.Tags))
+		for k, v := range f.Tags {
+			nf.Tags[k] = v
+		}
+	}
+	if f.Since != nil {
+		since := nostr.Timestamp(*f.Since)
+		nf.Since = &since
+	}
+	if f.Until != nil {
+		until := nostr.Timestamp(*f.Until)
+		nf.Until = &until
+	}
+	return nf
+}
+
+func toNostrEvent(evt *event.Event) *nostr.Event {
+	tags := make(nostr.Tags, len(evt.Tags))
+	for i, tag := range evt.Tags {
+		tags[i] = nostr.Tag(tag)
+	}
+	return &nostr.Event{
+		ID:        evt.ID,
+		PubKey:    evt.PubKey,
+		CreatedAt: nostr.Timestamp(evt.CreatedAt),
+		Kind:      evt.Kind,
+		Tags:      tags,
+		Content:   evt.Content,
+		Sig:       evt.Sig,
+	}
+}
+
+// AddPubKey adds an event author to the sketch and reports whether any
+// register changed. Pubkeys that are not 32-byte hex are ignored.
+func AddPubKey(sketch *hyperloglog.HyperLogLog, pubkey string) bool {
+	if !nostr.IsValid32ByteHex(pubkey) {
+		return false
+	}
+	regs := sketch.GetRegisters()
+	before := make([]byte, len(regs))
+	copy(before, regs)
+	sketch.Add(pubkey)
+	for i := range regs {
+		if regs[i] != before[i] {
+			return true
+		}
+	}
+	return false
+}
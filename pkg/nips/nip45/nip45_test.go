@@ -0,0 +1,89 @@
+package nip45
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomHex(t *testing.T) string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return hex.EncodeToString(b)
+}
+
+func TestParseRef(t *testing.T) {
+	target := randomHex(t)
+
+	tests := []struct {
+		name     string
+		filter   *event.Filter
+		eligible bool
+		kind     int
+	}{
+		{"followers", &event.Filter{Kinds: []int{3}, Tags: map[string][]string{"p": {target}}}, true, 3},
+		{"reactions", &event.Filter{Kinds: []int{7}, Tags: map[string][]string{"e": {target}}}, true, 7},
+		{"comments", &event.Filter{Kinds: []int{1111}, Tags: map[string][]string{"E": {target}}}, true, 1111},
+		{"two kinds", &event.Filter{Kinds: []int{6, 7}, Tags: map[string][]string{"e": {target}}}, false, 0},
+		{"with author", &event.Filter{Kinds: []int{7}, Authors: []string{target}, Tags: map[string][]string{"e": {target}}}, false, 0},
+		{"prefix value", &event.Filter{Kinds: []int{7}, Tags: map[string][]string{"e": {target[:10]}}}, false, 0},
+		{"plain kind", &event.Filter{Kinds: []int{1}}, false, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, ok := ParseRef(tc.filter)
+			assert.Equal(t, tc.eligible, ok)
+			if tc.eligible {
+				assert.Equal(t, tc.kind, ref.Kind)
+				assert.Equal(t, target, ref.Ref)
+				assert.GreaterOrEqual(t, ref.Offset, 8)
+				assert.LessOrEqual(t, ref.Offset, 23)
+			}
+		})
+	}
+}
+
+func TestEventRefs_MatchFilterRefs(t *testing.T) {
+	target := randomHex(t)
+	reaction := &event.Event{Kind: 7, PubKey: randomHex(t), Tags: [][]string{{"e", target}}}
+
+	refs := EventRefs(reaction)
+	require.Len(t, refs, 1)
+
+	filterRef, ok := ParseRef(&event.Filter{Kinds: []int{7}, Tags: map[string][]string{"e": {target}}})
+	require.True(t, ok)
+	assert.Equal(t, filterRef, refs[0])
+	assert.Equal(t, filterRef.Key(), refs[0].Key())
+
+	assert.Empty(t, EventRefs(&event.Event{Kind: 1, Tags: [][]string{{"e", target}}}))
+}
+
+func TestSketch_Estimate(t *testing.T) {
+	ref := SketchRef{Kind: 3, Ref: randomHex(t), Offset: 8}
+	sketch := NewSketch(ref)
+
+	assert.False(t, AddPubKey(sketch, "not-a-pubkey"))
+
+	pubkey := randomHex(t)
+	AddPubKey(sketch, pubkey)
+	assert.False(t, AddPubKey(sketch, pubkey), "adding the same pubkey twice must not change registers")
+
+	for i := 0; i < 4999; i++ {
+		AddPubKey(sketch, randomHex(t))
+	}
+	estimate := float64(sketch.Count())
+	assert.InDelta(t, 5000, estimate, 5000*0.2)
+
+	restored, err := LoadSketch(ref, sketch.GetRegisters())
+	require.NoError(t, err)
+	assert.Equal(t, sketch.Count(), restored.Count())
+	assert.Len(t, EncodeRegisters(restored.GetRegisters()), 512)
+
+	_, err = LoadSketch(ref, []byte{1, 2, 3})
+	assert.Error(t, err)
+}
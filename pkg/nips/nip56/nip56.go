@@ -176,6 +176,68 @@ func GetReportedBlobs(evt *event.Event) []BlobReport {
 	return blobs
 }
 
+// Target types of a report
+const (
+	TargetPubKey = "pubkey"
+	TargetEvent  = "event"
+	TargetBlob   = "blob"
+)
+
+// Target is what a report is about
+type Target struct {
+	Type       string // TargetPubKey, TargetEvent or TargetBlob
+	Value      string // pubkey, event ID or blob hash
+	ReportType string // empty if the report does not give one
+}
+
+// GetReportTargets returns what a report is about: its blobs if it reports
+// any, else its events, else the reported pubkey. The p tag of a note or blob
+// report only names the author, so it is not a target of its own. A target
+// without a report type of its own takes the one of the p tag.
+func GetReportTargets(evt *event.Event) []Target {
+	if !IsReportEvent(evt) {
+		return nil
+	}
+
+	pubkeyType := ""
+	for _, tag := range evt.Tags {
+		if len(tag) >= 3 && tag[0] == "p" {
+			pubkeyType = tag[2]
+			break
+		}
+	}
+	withType := func(t Target) Target {
+		if t.ReportType == "" {
+			t.ReportType = pubkeyType
+		}
+		return t
+	}
+
+	var targets []Target
+	for _, blob := range GetReportedBlobs(evt) {
+		targets = append(targets, withType(Target{Type: TargetBlob, Value: blob.Hash, ReportType: blob.Type}))
+	}
+	if len(targets) > 0 {
+		return targets
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			t := Target{Type: TargetEvent, Value: tag[1]}
+			if len(tag) >= 3 {
+				t.ReportType = tag[2]
+			}
+			targets = append(targets, withType(t))
+		}
+	}
+	if len(targets) > 0 {
+		return targets
+	}
+	if pubkey := GetReportedPubKey(evt); pubkey != "" {
+		targets = append(targets, Target{Type: TargetPubKey, Value: pubkey, ReportType: pubkeyType})
+	}
+	return targets
+}
+
 // IsValidReportType checks if a report type is valid according to NIP-56
 func IsValidReportType(reportType string) bool {
 	return validReportTypes[reportType]
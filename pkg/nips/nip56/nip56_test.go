@@ -344,6 +344,49 @@ func TestGetReportedBlobs(t *testing.T) {
 	})
 }
 
+func TestGetReportTargets(t *testing.T) {
+	t.Run("Profile report targets the pubkey", func(t *testing.T) {
+		evt := &event.Event{
+			Kind: 1984,
+			Tags: [][]string{{"p", "pubkey1", "impersonation"}},
+		}
+		require.Equal(t, []Target{{Type: TargetPubKey, Value: "pubkey1", ReportType: "impersonation"}}, GetReportTargets(evt))
+	})
+
+	t.Run("Note report targets the events", func(t *testing.T) {
+		evt := &event.Event{
+			Kind: 1984,
+			Tags: [][]string{
+				{"e", "event1", "spam"},
+				{"e", "event2"},
+				{"p", "pubkey1", "illegal"},
+			},
+		}
+		require.Equal(t, []Target{
+			{Type: TargetEvent, Value: "event1", ReportType: "spam"},
+			{Type: TargetEvent, Value: "event2", ReportType: "illegal"},
+		}, GetReportTargets(evt))
+	})
+
+	t.Run("Blob report targets the blob", func(t *testing.T) {
+		evt := &event.Event{
+			Kind: 1984,
+			Tags: [][]string{
+				{"x", "hash1", "malware"},
+				{"e", "event1", "malware"},
+				{"server", "https://blossom.example.com"},
+				{"p", "pubkey1"},
+			},
+		}
+		require.Equal(t, []Target{{Type: TargetBlob, Value: "hash1", ReportType: "malware"}}, GetReportTargets(evt))
+	})
+
+	t.Run("Returns nil if not a report event", func(t *testing.T) {
+		evt := &event.Event{Kind: 1, Tags: [][]string{{"p", "pubkey1"}}}
+		require.Nil(t, GetReportTargets(evt))
+	})
+}
+
 func TestIsValidReportType(t *testing.T) {
 	testCases := []struct {
 		reportType string
@@ -0,0 +1,33 @@
+// Package nip70 implements NIP-70 protected events.
+//
+// An event carrying the ["-"] tag may only be published by its author, so
+// that it cannot be rebroadcast to other relays by whoever received it. The
+// relay proves authorship through NIP-42 authentication.
+package nip70
+
+import "github.com/paul/glienicke/pkg/event"
+
+// IsProtected reports whether the event carries the ["-"] tag
+func IsProtected(evt *event.Event) bool {
+	for _, tag := range evt.Tags {
+		if len(tag) > 0 && tag[0] == "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the reason a protected event is rejected for a client
+// authenticated as authPubKey ("" if not authenticated), or "" if it may be
+// published. Events without the ["-"] tag always pass.
+func Check(evt *event.Event, authPubKey string) string {
+	switch {
+	case !IsProtected(evt):
+		return ""
+	case authPubKey == "":
+		return "auth-required: this event may only be published by its author"
+	case authPubKey != evt.PubKey:
+		return "restricted: this event may only be published by its author"
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package nip70
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	author := strings.Repeat("a", 64)
+	other := strings.Repeat("b", 64)
+	protected := &event.Event{PubKey: author, Kind: 1, Tags: [][]string{{"t", "nostr"}, {"-"}}}
+	public := &event.Event{PubKey: author, Kind: 1, Tags: [][]string{{"t", "-"}}}
+
+	assert.True(t, IsProtected(protected))
+	assert.False(t, IsProtected(public))
+
+	tests := []struct {
+		name   string
+		evt    *event.Event
+		authed string
+		want   string
+	}{
+		{name: "unprotected anonymous", evt: public},
+		{name: "unprotected other author", evt: public, authed: other},
+		{name: "protected author", evt: protected, authed: author},
+		{name: "protected anonymous", evt: protected, want: "auth-required: this event may only be published by its author"},
+		{name: "protected other author", evt: protected, authed: other, want: "restricted: this event may only be published by its author"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Check(tt.evt, tt.authed))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package nip98
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultMaxBodySize is the largest request body the middleware reads to
+// verify the payload hash
+const DefaultMaxBodySize = 1 << 20
+
+// ErrNoAuth is returned when a request carries no Authorization header
+var ErrNoAuth = errors.New("missing Authorization header")
+
+// ErrBodyTooLarge is returned when a request body exceeds MaxBodySize
+var ErrBodyTooLarge = errors.New("request body too large")
+
+type contextKey struct{}
+
+// ContextWithPubKey returns a copy of ctx carrying an authenticated pubkey
+func ContextWithPubKey(ctx context.Context, pubkey string) context.Context {
+	return context.WithValue(ctx, contextKey{}, pubkey)
+}
+
+// PubKeyFromContext returns the pubkey authenticated by the middleware
+func PubKeyFromContext(ctx context.Context) (string, bool) {
+	pubkey, ok := ctx.Value(contextKey{}).(string)
+	return pubkey, ok && pubkey != ""
+}
+
+// Authenticator verifies NIP-98 Authorization headers on HTTP requests.
+// The zero value requires authentication with the default time window and
+// body size limit.
+type Authenticator struct {
+	// Window is how far created_at may be from the server clock
+	// (DefaultTimeWindow if zero)
+	Window time.Duration
+
+	// MaxBodySize limits how much of the body is read to check the payload
+	// hash (DefaultMaxBodySize if zero)
+	MaxBodySize int64
+
+	// Optional passes requests without an Authorization header through
+	// unauthenticated; requests with an invalid header are still rejected
+	Optional bool
+
+	// OnError writes the response for a rejected request. It defaults to a
+	// plain-text error with a "WWW-Authenticate: Nostr" header.
+	OnError func(w http.ResponseWriter, req *http.Request, status int, err error)
+
+	// Now returns the current time (time.Now if nil)
+	Now func() time.Time
+
+	// TrustedProxy reports whether a peer is a reverse proxy whose
+	// X-Forwarded-Proto header is believed when reconstructing the signed
+	// request URL (nil = the header is ignored)
+	TrustedProxy func(net.IP) bool
+}
+
+// Authenticate verifies the Authorization header of req and returns the
+// authenticated pubkey. The body is read to check the payload hash and
+// replaced so handlers can read it again.
+func (a *Authenticator) Authenticate(req *http.Request) (string, error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return "", ErrNoAuth
+	}
+
+	evt, err := ParseHeader(header)
+	if err != nil {
+		return "", err
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		limit := a.MaxBodySize
+		if limit <= 0 {
+			limit = DefaultMaxBodySize
+		}
+		body, err = io.ReadAll(io.LimitReader(req.Body, limit+1))
+		req.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read request body: %w", err)
+		}
+		if int64(len(body)) > limit {
+			return "", ErrBodyTooLarge
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if len(body) == 0 {
+			body = nil
+		}
+	}
+
+	window := a.Window
+	if window <= 0 {
+		window = DefaultTimeWindow
+	}
+	now := time.Now
+	if a.Now != nil {
+		now = a.Now
+	}
+
+	if err := Validate(evt, RequestURL(req, a.TrustedProxy), req.Method, body, now(), window); err != nil {
+		return "", err
+	}
+	return evt.PubKey, nil
+}
+
+// Middleware wraps next so that it only sees authenticated requests, with
+// the pubkey available through PubKeyFromContext.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pubkey, err := a.Authenticate(req)
+		switch {
+		case err == nil:
+			req = req.WithContext(ContextWithPubKey(req.Context(), pubkey))
+		case errors.Is(err, ErrNoAuth) && a.Optional:
+		case errors.Is(err, ErrBodyTooLarge):
+			a.reject(w, req, http.StatusRequestEntityTooLarge, err)
+			return
+		default:
+			a.reject(w, req, http.StatusUnauthorized, err)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (a *Authenticator) reject(w http.ResponseWriter, req *http.Request, status int, err error) {
+	if a.OnError != nil {
+		a.OnError(w, req, status, err)
+		return
+	}
+	if status != http.StatusUnauthorized {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", authScheme)
+	http.Error(w, fmt.Sprintf("unauthorized: %v", err), status)
+}
+
+// Middleware wraps next with an Authenticator using the default settings
+func Middleware(next http.Handler) http.Handler {
+	return (&Authenticator{}).Middleware(next)
+}
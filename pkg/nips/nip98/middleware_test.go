@@ -0,0 +1,129 @@
+package nip98
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoHandler responds with the authenticated pubkey and the request body
+func echoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pubkey, _ := PubKeyFromContext(req.Context())
+		body, _ := io.ReadAll(req.Body)
+		w.Write([]byte(pubkey + "|" + string(body)))
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	kp := testutil.MustGenerateKeyPair()
+	srv := httptest.NewServer(Middleware(echoHandler()))
+	defer srv.Close()
+	url := srv.URL + "/export"
+
+	do := func(method string, body []byte, auth string) (*http.Response, string) {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	t.Run("injects pubkey and preserves body", func(t *testing.T) {
+		body := []byte(`{"hello":"world"}`)
+		auth, err := testutil.NIP98Header(kp, url, "POST", body)
+		require.NoError(t, err)
+		resp, data := do("POST", body, auth)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, kp.PubKeyHex+"|"+string(body), data)
+	})
+
+	t.Run("GET without payload", func(t *testing.T) {
+		auth, err := testutil.NIP98Header(kp, url, "GET", nil)
+		require.NoError(t, err)
+		resp, data := do("GET", nil, auth)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, kp.PubKeyHex+"|", data)
+	})
+
+	t.Run("missing header", func(t *testing.T) {
+		resp, _ := do("GET", nil, "")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, "Nostr", resp.Header.Get("WWW-Authenticate"))
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		auth, err := testutil.NIP98Header(kp, url, "POST", []byte("original"))
+		require.NoError(t, err)
+		resp, _ := do("POST", []byte("tampered"), auth)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestAuthenticator_TrustedProxy(t *testing.T) {
+	kp := testutil.MustGenerateKeyPair()
+	header, err := testutil.NIP98Header(kp, "https://relay.example.com/export", "GET", nil)
+	require.NoError(t, err)
+
+	// A client signs the https URL a TLS-terminating proxy forwarded as http
+	serve := func(auth *Authenticator, remoteAddr string) int {
+		req := httptest.NewRequest("GET", "http://relay.example.com/export", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", header)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rec := httptest.NewRecorder()
+		auth.Middleware(echoHandler()).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	proxy := func(ip net.IP) bool { return ip.IsLoopback() }
+	assert.Equal(t, http.StatusOK, serve(&Authenticator{TrustedProxy: proxy}, "127.0.0.1:4321"))
+	assert.Equal(t, http.StatusUnauthorized, serve(&Authenticator{TrustedProxy: proxy}, "203.0.113.5:4321"))
+	assert.Equal(t, http.StatusUnauthorized, serve(&Authenticator{}, "127.0.0.1:4321"))
+}
+
+func TestAuthenticator_Optional(t *testing.T) {
+	auth := &Authenticator{Optional: true}
+	handler := auth.Middleware(echoHandler())
+
+	req := httptest.NewRequest("GET", "http://relay.example.com/", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "|", rec.Body.String())
+
+	// An invalid header is still rejected
+	req = httptest.NewRequest("GET", "http://relay.example.com/", nil)
+	req.Header.Set("Authorization", "Nostr invalid")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAuthenticator_MaxBodySize(t *testing.T) {
+	kp := testutil.MustGenerateKeyPair()
+	auth := &Authenticator{MaxBodySize: 8}
+	body := []byte(strings.Repeat("x", 16))
+
+	header, err := testutil.NIP98Header(kp, "http://relay.example.com/upload", "POST", body)
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "http://relay.example.com/upload", bytes.NewReader(body))
+	req.Header.Set("Authorization", header)
+
+	rec := httptest.NewRecorder()
+	auth.Middleware(echoHandler()).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
@@ -0,0 +1,117 @@
+// Package nip98 implements NIP-98 HTTP authentication.
+//
+// A client authenticates an HTTP request by signing a kind 27235 event that
+// names the absolute request URL ("u" tag) and method ("method" tag) and,
+// for requests with a body, the SHA-256 of the body ("payload" tag). The
+// event is sent base64-encoded in an "Authorization: Nostr <base64>" header.
+package nip98
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+)
+
+const (
+	// KindHTTPAuth is the kind of NIP-98 HTTP auth events
+	KindHTTPAuth = 27235
+
+	// DefaultTimeWindow is how far created_at may be from the server clock
+	DefaultTimeWindow = 60 * time.Second
+
+	authScheme = "Nostr"
+)
+
+// ParseHeader decodes the event carried in an "Authorization: Nostr <base64>" header value.
+func ParseHeader(header string) (*event.Event, error) {
+	scheme, token, found := strings.Cut(strings.TrimSpace(header), " ")
+	if !found || !strings.EqualFold(scheme, authScheme) {
+		return nil, fmt.Errorf("authorization scheme must be %s", authScheme)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+
+	var evt event.Event
+	if err := json.Unmarshal(data, &evt); err != nil {
+		return nil, fmt.Errorf("invalid event: %w", err)
+	}
+	return &evt, nil
+}
+
+// Validate checks an HTTP auth event against the request it authenticates.
+// If body is non-nil, the event must carry a matching "payload" tag;
+// otherwise a "payload" tag is not required.
+func Validate(evt *event.Event, url, method string, body []byte, now time.Time, window time.Duration) error {
+	if evt.Kind != KindHTTPAuth {
+		return fmt.Errorf("event kind %d is not HTTP auth (%d)", evt.Kind, KindHTTPAuth)
+	}
+
+	if err := evt.Validate(); err != nil {
+		return fmt.Errorf("invalid event: %w", err)
+	}
+
+	if d := now.Sub(time.Unix(evt.CreatedAt, 0)); d > window || d < -window {
+		return fmt.Errorf("created_at is outside the %v time window", window)
+	}
+
+	if u := tagValue(evt, "u"); u != url {
+		return fmt.Errorf("u tag %q does not match request URL %q", u, url)
+	}
+
+	if m := tagValue(evt, "method"); !strings.EqualFold(m, method) {
+		return fmt.Errorf("method tag %q does not match request method %q", m, method)
+	}
+
+	if body != nil {
+		sum := sha256.Sum256(body)
+		if p := tagValue(evt, "payload"); !strings.EqualFold(p, hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("payload tag does not match the request body")
+		}
+	}
+
+	return nil
+}
+
+// RequestURL reconstructs the absolute URL a client used for the request,
+// honoring TLS and the X-Forwarded-Proto header set by reverse proxies. The
+// header is only believed if trusted reports that the peer is such a proxy;
+// with a nil trusted it is ignored, since any client can send it.
+func RequestURL(req *http.Request, trusted func(net.IP) bool) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" && trusted != nil && trusted(peerIP(req)) {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	return scheme + "://" + req.Host + req.URL.RequestURI()
+}
+
+// peerIP returns the address of the peer that sent req, or nil
+func peerIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func tagValue(evt *event.Event, name string) string {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package nip98
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testURL = "https://relay.example.com/api"
+
+func authEvent(t *testing.T, kp *testutil.KeyPair, url, method string, body []byte) *event.Event {
+	t.Helper()
+	header, err := testutil.NIP98Header(kp, url, method, body)
+	require.NoError(t, err)
+	evt, err := ParseHeader(header)
+	require.NoError(t, err)
+	return evt
+}
+
+func TestParseHeader(t *testing.T) {
+	kp := testutil.MustGenerateKeyPair()
+	header, err := testutil.NIP98Header(kp, testURL, "GET", nil)
+	require.NoError(t, err)
+
+	evt, err := ParseHeader(header)
+	require.NoError(t, err)
+	assert.Equal(t, KindHTTPAuth, evt.Kind)
+	assert.Equal(t, kp.PubKeyHex, evt.PubKey)
+
+	for _, bad := range []string{
+		"",
+		"Bearer abc",
+		"Nostr",
+		"Nostr !!!not-base64!!!",
+		"Nostr " + base64.StdEncoding.EncodeToString([]byte("not json")),
+	} {
+		_, err := ParseHeader(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	kp := testutil.MustGenerateKeyPair()
+	body := []byte(`{"method":"supportedmethods","params":[]}`)
+	now := time.Now()
+
+	t.Run("valid with payload", func(t *testing.T) {
+		evt := authEvent(t, kp, testURL, "POST", body)
+		assert.NoError(t, Validate(evt, testURL, "POST", body, now, DefaultTimeWindow))
+	})
+
+	t.Run("payload not required without body", func(t *testing.T) {
+		evt := authEvent(t, kp, testURL, "GET", nil)
+		assert.NoError(t, Validate(evt, testURL, "GET", nil, now, DefaultTimeWindow))
+	})
+
+	t.Run("payload mismatch", func(t *testing.T) {
+		evt := authEvent(t, kp, testURL, "POST", body)
+		assert.Error(t, Validate(evt, testURL, "POST", []byte("other"), now, DefaultTimeWindow))
+	})
+
+	t.Run("missing payload for body", func(t *testing.T) {
+		evt := authEvent(t, kp, testURL, "POST", nil)
+		assert.Error(t, Validate(evt, testURL, "POST", body, now, DefaultTimeWindow))
+	})
+
+	t.Run("url mismatch", func(t *testing.T) {
+		evt := authEvent(t, kp, testURL, "GET", nil)
+		assert.Error(t, Validate(evt, testURL+"/other", "GET", nil, now, DefaultTimeWindow))
+	})
+
+	t.Run("method mismatch", func(t *testing.T) {
+		evt := authEvent(t, kp, testURL, "GET", nil)
+		assert.Error(t, Validate(evt, testURL, "DELETE", nil, now, DefaultTimeWindow))
+	})
+
+	t.Run("outside time window", func(t *testing.T) {
+		evt := authEvent(t, kp, testURL, "GET", nil)
+		assert.Error(t, Validate(evt, testURL, "GET", nil, now.Add(2*time.Minute), DefaultTimeWindow))
+		assert.Error(t, Validate(evt, testURL, "GET", nil, now.Add(-2*time.Minute), DefaultTimeWindow))
+	})
+
+	t.Run("wrong kind", func(t *testing.T) {
+		evt, err := testutil.NewTestEventWithKey(kp, 1, "", [][]string{{"u", testURL}, {"method", "GET"}})
+		require.NoError(t, err)
+		assert.Error(t, Validate(evt, testURL, "GET", nil, now, DefaultTimeWindow))
+	})
+
+	t.Run("tampered event", func(t *testing.T) {
+		evt := authEvent(t, kp, testURL, "GET", nil)
+		evt.Tags[0][1] = "https://evil.example.com/api"
+		assert.Error(t, Validate(evt, "https://evil.example.com/api", "GET", nil, now, DefaultTimeWindow))
+	})
+}
+
+func TestRequestURL(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://relay.example.com/api?x=1", nil)
+	assert.Equal(t, "http://relay.example.com/api?x=1", RequestURL(req, nil))
+
+	req.TLS = &tls.ConnectionState{}
+	assert.Equal(t, "https://relay.example.com/api?x=1", RequestURL(req, nil))
+
+	// X-Forwarded-Proto is only believed from trusted proxies
+	req.TLS = nil
+	req.RemoteAddr = "192.0.2.1:4321"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	assert.Equal(t, "http://relay.example.com/api?x=1", RequestURL(req, nil))
+	proxy := func(ip net.IP) bool { return ip.Equal(net.ParseIP("192.0.2.1")) }
+	assert.Equal(t, "https://relay.example.com/api?x=1", RequestURL(req, proxy))
+
+	req.RemoteAddr = "198.51.100.9:4321"
+	assert.Equal(t, "http://relay.example.com/api?x=1", RequestURL(req, proxy))
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+)
+
+const (
+	// MaxPendingDeliveries is the number of broadcast events that may wait in a
+	// client's delivery queue. A client that falls further behind is disconnected.
+	MaxPendingDeliveries = 1024
+)
+
+// delivery is one broadcast event queued for a client, pre-encoded once for
+// all recipients and sent on every matching subscription.
+type delivery struct {
+	subIDs  []string
+	encoded []byte
+}
+
+// EncodeEvent serializes an event once so it can be delivered to many
+// subscriptions with Deliver.
+func EncodeEvent(evt *event.Event) ([]byte, error) {
+	return json.Marshal(evt)
+}
+
+// eventEnvelope wraps a pre-encoded event in an ["EVENT", <subID>, <event>] message.
+func eventEnvelope(subID string, encoded []byte) ([]byte, error) {
+	id, err := quoteSubID(subID)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, len(`["EVENT",,]`)+len(id)+len(encoded))
+	data = append(data, `["EVENT",`...)
+	data = append(data, id...)
+	data = append(data, ',')
+	data = append(data, encoded...)
+	data = append(data, ']')
+	return data, nil
+}
+
+// quoteSubID JSON-encodes a subscription ID. IDs made of printable ASCII that
+// encoding/json would not escape are quoted directly without allocating an encoder.
+func quoteSubID(subID string) ([]byte, error) {
+	for i := 0; i < len(subID); i++ {
+		switch b := subID[i]; {
+		case b < 0x20, b >= 0x80, b == '"', b == '\\', b == '<', b == '>', b == '&':
+			return json.Marshal(subID)
+		}
+	}
+	id := make([]byte, 0, len(subID)+2)
+	id = append(id, '"')
+	id = append(id, subID...)
+	return append(id, '"'), nil
+}
+
+// Deliver queues a pre-encoded event for the given subscriptions. It never
+// blocks: events are written by the client's delivery pump in the order they
+// were queued. If the queue is full the client is too slow to keep up and is
+// closed.
+func (c *Client) Deliver(subIDs []string, encoded []byte) error {
+	c.deliverMu.Lock()
+	select {
+	case <-c.closeCh:
+		c.deliverMu.Unlock()
+		return fmt.Errorf("client closed")
+	default:
+	}
+	if c.draining.Load() {
+		c.deliverMu.Unlock()
+		return errShuttingDown
+	}
+	if len(c.deliverQueue) >= MaxPendingDeliveries {
+		c.deliverMu.Unlock()
+		c.log().Warn("delivery queue full, disconnecting", "pending", len(c.deliverQueue))
+		c.Close()
+		return fmt.Errorf("delivery queue full")
+	}
+	c.deliverQueue = append(c.deliverQueue, delivery{subIDs: subIDs, encoded: encoded})
+	c.deliverMu.Unlock()
+
+	// Wake the pump; a pending signal already covers this delivery
+	select {
+	case c.deliverSignal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// PendingDeliveries returns the number of broadcast events waiting in the delivery queue.
+func (c *Client) PendingDeliveries() int {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+	return len(c.deliverQueue)
+}
+
+// deliverPump moves queued broadcast events to the write pump, preserving queue order.
+func (c *Client) deliverPump(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.closeCh:
+			return
+		case <-c.deliverSignal:
+		}
+
+		c.deliverMu.Lock()
+		batch := c.deliverQueue
+		c.deliverQueue = nil
+		c.delivering.Store(len(batch) > 0)
+		c.deliverMu.Unlock()
+
+		for _, d := range batch {
+			for _, subID := range d.subIDs {
+				data, err := eventEnvelope(subID, d.encoded)
+				if err != nil {
+					c.log().Error("failed to encode event", logging.KeySubID, subID, logging.KeyError, err)
+					continue
+				}
+				select {
+				case c.sendCh <- data:
+				case <-ctx.Done():
+					return
+				case <-c.closeCh:
+					return
+				}
+			}
+		}
+		c.delivering.Store(false)
+	}
+}
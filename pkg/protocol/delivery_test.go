@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvent(i int) *event.Event {
+	return &event.Event{
+		ID:        fmt.Sprintf("%064x", i),
+		PubKey:    fmt.Sprintf("%064x", 1),
+		CreatedAt: 1700000000 + int64(i),
+		Kind:      1,
+		Tags:      [][]string{{"t", "nostr"}, {"p", fmt.Sprintf("%064x", 2)}},
+		Content:   "hello <world> & friends",
+		Sig:       fmt.Sprintf("%0128x", i),
+	}
+}
+
+func TestEventEnvelope_MatchesPerRecipientMarshal(t *testing.T) {
+	evt := testEvent(1)
+	encoded, err := EncodeEvent(evt)
+	require.NoError(t, err)
+
+	for _, subID := range []string{"sub", `quo"ted`, `back\\slash`, "<tag>", "ünïcode", "tab\t"} {
+		want, err := json.Marshal([]interface{}{MessageTypeEvent, subID, evt})
+		require.NoError(t, err)
+
+		got, err := eventEnvelope(subID, encoded)
+		require.NoError(t, err)
+		assert.Equal(t, string(want), string(got))
+	}
+}
+
+func TestDeliver_PreservesOrder(t *testing.T) {
+	c := NewClient(nil, nil, "10.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		encoded, err := EncodeEvent(testEvent(i))
+		require.NoError(t, err)
+		require.NoError(t, c.Deliver([]string{"a", "b"}, encoded))
+	}
+	go c.deliverPump(ctx)
+
+	for i := 0; i < n; i++ {
+		for _, subID := range []string{"a", "b"} {
+			select {
+			case data := <-c.sendCh:
+				var msg []json.RawMessage
+				require.NoError(t, json.Unmarshal(data, &msg))
+				var gotSub string
+				var got event.Event
+				require.NoError(t, json.Unmarshal(msg[1], &gotSub))
+				require.NoError(t, json.Unmarshal(msg[2], &got))
+				assert.Equal(t, subID, gotSub)
+				assert.Equal(t, testEvent(i).ID, got.ID)
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for event %d", i)
+			}
+		}
+	}
+	assert.Zero(t, c.PendingDeliveries())
+}
+
+// fanOut is the number of recipients per broadcast in the benchmarks below.
+const fanOut = 1000
+
+// BenchmarkFanOut_MarshalPerRecipient is the previous behavior: each
+// recipient marshals the whole ["EVENT", subID, event] message.
+func BenchmarkFanOut_MarshalPerRecipient(b *testing.B) {
+	evt := testEvent(1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < fanOut; j++ {
+			if _, err := json.Marshal([]interface{}{MessageTypeEvent, "sub", evt}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkFanOut_EncodeOnce encodes the event once per broadcast and only
+// builds the envelope per recipient.
+func BenchmarkFanOut_EncodeOnce(b *testing.B) {
+	evt := testEvent(1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encoded, err := EncodeEvent(evt)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < fanOut; j++ {
+			if _, err := eventEnvelope("sub", encoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
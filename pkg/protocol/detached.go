@@ -0,0 +1,43 @@
+package protocol
+
+import "context"
+
+// NewDetachedClient creates a client that is not backed by a WebSocket
+// connection. Other transports, such as the HTTP API, feed it protocol
+// messages with HandleMessage and read the replies from Messages, so they go
+// through the same validation, auth, rate limiting and query handling as
+// WebSocket clients. Run must be called to receive broadcast events.
+func NewDetachedClient(handler Handler, realIP string) *Client {
+	return NewClient(nil, handler, realIP)
+}
+
+// HandleMessage processes a single protocol message as if it had been
+// received on the connection.
+func (c *Client) HandleMessage(ctx context.Context, message []byte) error {
+	return c.handleMessage(ctx, message)
+}
+
+// Messages returns the encoded protocol messages sent to a detached client.
+// The caller must drain it; handlers block while it is full.
+func (c *Client) Messages() <-chan []byte {
+	return c.sendCh
+}
+
+// Done returns a channel that is closed when the client is closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.closeCh
+}
+
+// Run moves broadcast events of a detached client to Messages until ctx is
+// done or the client is closed, then waits for running queries to return.
+// It takes the place of Start.
+func (c *Client) Run(ctx context.Context) {
+	c.deliverPump(ctx)
+	c.Close()
+	c.Wait()
+}
+
+// Wait blocks until the queries running for the client have returned.
+func (c *Client) Wait() {
+	c.queryWG.Wait()
+}
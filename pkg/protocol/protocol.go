@@ -6,12 +6,15 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
 )
 
 const (
@@ -34,6 +37,9 @@ const (
 	MessageTypeClosed MessageType = "CLOSED" // NIP-45 count rejection
 )
 
+// logger is the protocol subsystem logger
+var logger = logging.For("protocol")
+
 // Handler processes Nostr protocol messages
 type Handler interface {
 	HandleEvent(ctx context.Context, c *Client, evt *event.Event) error
@@ -43,7 +49,7 @@ type Handler interface {
 }
 
 // RateLimitFunc is called before processing a message; returns an error message if rejected, empty string if allowed
-type RateLimitFunc func(clientIP string, pubkey string) string
+type RateLimitFunc func(clientIP string, pubkey string, msgType MessageType) string
 
 // Client represents a WebSocket client connection
 type Client struct {
@@ -54,10 +60,30 @@ type Client struct {
 	sendCh        chan []byte
 	closeCh       chan struct{}
 	closeOnce     sync.Once
-	realIP        string        // Real client IP from X-Forwarded-For
+	realIP        string        // Client IP, resolved through trusted proxies
 	rateLimit     RateLimitFunc // External rate limit check
+	observe       func(MessageType) // Called for every parsed message (metrics)
+	maxEventSize  atomic.Int64      // Maximum raw event size in bytes (0 = unlimited)
+
+	// Ordered delivery of broadcast events (see delivery.go)
+	deliverMu     sync.Mutex
+	deliverQueue  []delivery
+	deliverSignal chan struct{}
+
+	// Concurrent REQ/COUNT execution (see query.go)
+	queryMu      sync.Mutex
+	queries      map[string]*runningQuery // sub/count ID -> running query
+	querySem     chan struct{}
+	queryWG      sync.WaitGroup
+	queryTimeout time.Duration
+
+	// Graceful shutdown (see shutdown.go)
+	handleMu   sync.Mutex  // held while a received message is handled
+	draining   atomic.Bool // set by Shutdown; new messages and deliveries are refused
+	delivering atomic.Bool // the delivery pump is moving a batch to sendCh
 
 	// NIP-42 auth
+	authMu        sync.RWMutex
 	requireAuth   bool
 	authenticated bool
 	authChallenge string
@@ -72,6 +98,10 @@ func NewClient(conn *websocket.Conn, handler Handler, realIP string) *Client {
 		subscriptions: make(map[string][]*event.Filter),
 		sendCh:        make(chan []byte, 256),
 		closeCh:       make(chan struct{}),
+		deliverSignal: make(chan struct{}, 1),
+		queries:       make(map[string]*runningQuery),
+		querySem:      make(chan struct{}, MaxConcurrentQueriesPerClient),
+		queryTimeout:  DefaultQueryTimeout,
 		realIP:        realIP,
 	}
 }
@@ -81,18 +111,54 @@ func (c *Client) SetRateLimit(fn RateLimitFunc) {
 	c.rateLimit = fn
 }
 
+// log returns the protocol logger with the client's IP and authenticated pubkey
+func (c *Client) log() *slog.Logger {
+	return logging.WithClient(logger, c.RemoteAddr(), c.AuthPubKey())
+}
+
+// SetMessageObserver sets a function called with the type of every message received
+func (c *Client) SetMessageObserver(fn func(MessageType)) {
+	c.observe = fn
+}
+
+// SetMaxEventSize sets the maximum size of an event in bytes (0 = unlimited)
+func (c *Client) SetMaxEventSize(n int) {
+	c.maxEventSize.Store(int64(n))
+}
+
 // SetRequireAuth enables NIP-42 authentication requirement for this client
 func (c *Client) SetRequireAuth() {
 	c.requireAuth = true
-	// Generate a random challenge
+	c.newAuthChallenge()
+}
+
+// newAuthChallenge generates a random challenge unless the client already
+// has one, and reports whether it did. Concurrent queries may race to
+// request auth; only the first creates the challenge.
+func (c *Client) newAuthChallenge() bool {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.authChallenge != "" {
+		return false
+	}
 	b := make([]byte, 16)
 	rand.Read(b)
 	c.authChallenge = hex.EncodeToString(b)
+	return true
+}
+
+// RequestAuth sends an AUTH challenge to a client that was not sent one on
+// connect, when the relay needs it to authenticate for a single action
+func (c *Client) RequestAuth() error {
+	if !c.newAuthChallenge() {
+		return nil
+	}
+	return c.SendAuth()
 }
 
 // SendAuth sends an AUTH challenge to the client
 func (c *Client) SendAuth() error {
-	msg := []interface{}{MessageTypeAuth, c.authChallenge}
+	msg := []interface{}{MessageTypeAuth, c.AuthChallenge()}
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -107,22 +173,30 @@ func (c *Client) SendAuth() error {
 
 // Authenticate marks the client as authenticated with the given pubkey
 func (c *Client) Authenticate(pubkey string) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
 	c.authenticated = true
 	c.authPubKey = pubkey
 }
 
 // IsAuthenticated returns whether the client has completed NIP-42 auth
 func (c *Client) IsAuthenticated() bool {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
 	return c.authenticated
 }
 
 // AuthChallenge returns the challenge string sent to this client
 func (c *Client) AuthChallenge() string {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
 	return c.authChallenge
 }
 
 // AuthPubKey returns the authenticated client's pubkey
 func (c *Client) AuthPubKey() string {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
 	return c.authPubKey
 }
 
@@ -130,7 +204,7 @@ func (c *Client) AuthPubKey() string {
 // This method blocks until the connection is closed
 func (c *Client) Start(ctx context.Context) {
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(3)
 
 	go func() {
 		defer wg.Done()
@@ -142,7 +216,15 @@ func (c *Client) Start(ctx context.Context) {
 		c.writePump(ctx)
 	}()
 
+	go func() {
+		defer wg.Done()
+		c.deliverPump(ctx)
+	}()
+
 	wg.Wait()
+
+	// Let cancelled queries return before the connection is torn down
+	c.queryWG.Wait()
 }
 
 // readPump reads messages from the WebSocket connection
@@ -163,14 +245,14 @@ func (c *Client) readPump(ctx context.Context) {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				// Don't log close 1005 (no status) as an error - it's a normal condition
 				if !strings.Contains(err.Error(), "close 1005") {
-					log.Printf("WebSocket read error: %v", err)
+					c.log().Warn("websocket read error", logging.KeyError, err)
 				}
 			}
 			return
 		}
 
 		if err := c.handleMessage(ctx, message); err != nil {
-			log.Printf("Error handling message: %v", err)
+			c.log().Debug("error handling message", logging.KeyError, err)
 			c.SendNotice(fmt.Sprintf("error: %v", err))
 		}
 	}
@@ -187,8 +269,13 @@ func (c *Client) writePump(ctx context.Context) {
 		case <-c.closeCh:
 			return
 		case message := <-c.sendCh:
+			if message == nil {
+				// Queued by Shutdown after its last message
+				c.writeCloseFrame()
+				return
+			}
 			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("WebSocket write error: %v", err)
+				c.log().Debug("websocket write error", logging.KeyError, err)
 				return
 			}
 		}
@@ -197,6 +284,12 @@ func (c *Client) writePump(ctx context.Context) {
 
 // handleMessage processes a single protocol message
 func (c *Client) handleMessage(ctx context.Context, message []byte) error {
+	c.handleMu.Lock()
+	defer c.handleMu.Unlock()
+	if c.draining.Load() {
+		return errShuttingDown
+	}
+
 	// Parse as JSON array
 	var raw []json.RawMessage
 	if err := json.Unmarshal(message, &raw); err != nil {
@@ -212,9 +305,12 @@ func (c *Client) handleMessage(ctx context.Context, message []byte) error {
 	if err := json.Unmarshal(raw[0], &msgType); err != nil {
 		return fmt.Errorf("invalid message type: %w", err)
 	}
+	if c.observe != nil {
+		c.observe(MessageType(msgType))
+	}
 
 	// NIP-42: Require authentication for all messages except CLOSE and AUTH events
-	if c.requireAuth && !c.authenticated && MessageType(msgType) != MessageTypeClose {
+	if c.requireAuth && !c.IsAuthenticated() && MessageType(msgType) != MessageTypeClose {
 		// Allow AUTH events (kind 22242) through for the handshake
 		if MessageType(msgType) == MessageTypeEvent && len(raw) >= 2 {
 			var partial struct{ Kind int `json:"kind"` }
@@ -244,7 +340,7 @@ authenticated:
 
 	// Rate limit all messages except CLOSE (always allow clients to clean up subscriptions)
 	if MessageType(msgType) != MessageTypeClose && c.rateLimit != nil {
-		if reason := c.rateLimit(c.realIP, c.authPubKey); reason != "" {
+		if reason := c.rateLimit(c.realIP, c.AuthPubKey(), MessageType(msgType)); reason != "" {
 			// For REQ/COUNT, send CLOSED with the subscription/count ID per Nostr protocol
 			if (MessageType(msgType) == MessageTypeReq || MessageType(msgType) == MessageTypeCount) && len(raw) >= 2 {
 				var subID string
@@ -283,6 +379,11 @@ func (c *Client) handleEventMessage(ctx context.Context, raw []json.RawMessage)
 		return fmt.Errorf("invalid event: %w", err)
 	}
 
+	if max := c.maxEventSize.Load(); max > 0 && int64(len(raw[1])) > max {
+		c.SendOK(evt.ID, false, fmt.Sprintf("invalid: event too large (max %d bytes)", max))
+		return nil
+	}
+
 	// Validate event
 	if err := evt.Validate(); err != nil {
 		c.SendOK(evt.ID, false, fmt.Sprintf("invalid: %v", err))
@@ -317,7 +418,7 @@ func (c *Client) handleReqMessage(ctx context.Context, raw []json.RawMessage) er
 	c.subMu.RUnlock()
 
 	if !isReplacement && subCount >= MaxSubscriptionsPerClient {
-		log.Printf("Max subscriptions reached for client %s (subscription %s, count %d)", c.RemoteAddr(), subID, subCount)
+		c.log().Info("max subscriptions reached", logging.KeySubID, subID, "subscriptions", subCount)
 		c.SendClosed(subID, "rate-limited: too many concurrent subscriptions")
 		return nil
 	}
@@ -332,13 +433,24 @@ func (c *Client) handleReqMessage(ctx context.Context, raw []json.RawMessage) er
 		filters = append(filters, &filter)
 	}
 
+	// A replaced subscription's query must finish before the new one starts
+	c.stopQuery(subID)
+
 	// Store subscription
 	c.subMu.Lock()
 	c.subscriptions[subID] = filters
 	c.subMu.Unlock()
 
-	// Handle subscription
-	return c.handler.HandleReq(ctx, c, subID, filters)
+	// Handle subscription concurrently; on timeout the subscription is closed
+	started := c.startQuery(ctx, subID, func(ctx context.Context) error {
+		return c.handler.HandleReq(ctx, c, subID, filters)
+	}, func() {
+		c.handler.HandleClose(context.Background(), c, subID)
+	})
+	if !started {
+		c.RemoveSubscription(subID)
+	}
+	return nil
 }
 
 // handleCloseMessage processes a CLOSE message
@@ -352,7 +464,8 @@ func (c *Client) handleCloseMessage(ctx context.Context, raw []json.RawMessage)
 		return fmt.Errorf("invalid subscription ID: %w", err)
 	}
 
-	// Handle close
+	// Cancel a query still running for the subscription, then close it
+	c.stopQuery(subID)
 	return c.handler.HandleClose(ctx, c, subID)
 }
 
@@ -377,8 +490,12 @@ func (c *Client) handleCountMessage(ctx context.Context, raw []json.RawMessage)
 		filters = append(filters, &filter)
 	}
 
-	// Handle count
-	return c.handler.HandleCount(ctx, c, countID, filters)
+	// Handle count concurrently, replacing a count still running under the same ID
+	c.stopQuery(countID)
+	c.startQuery(ctx, countID, func(ctx context.Context) error {
+		return c.handler.HandleCount(ctx, c, countID, filters)
+	}, nil)
+	return nil
 }
 
 // RemoveSubscription removes a subscription from the client
@@ -456,7 +573,10 @@ func (c *Client) SendNotice(message string) error {
 func (c *Client) Close() {
 	c.closeOnce.Do(func() {
 		close(c.closeCh)
-		c.conn.Close()
+		c.cancelQueries()
+		if c.conn != nil {
+			c.conn.Close()
+		}
 	})
 }
 
@@ -494,20 +614,24 @@ func (c *Client) HasSubscriptionToPubKey(pubKey string) bool {
 
 // RemoteAddr returns the real client IP if available, otherwise the connection's remote address
 func (c *Client) RemoteAddr() string {
-	if c.realIP != "" {
+	if c.realIP != "" || c.conn == nil {
 		return c.realIP
 	}
 	return c.conn.RemoteAddr().String()
 }
 
-// SendCount sends a COUNT response to the client
-func (c *Client) SendCount(countID string, count int, approximate bool) error {
+// SendCount sends a COUNT response to the client.
+// hll carries the hex-encoded NIP-45 HyperLogLog registers and is omitted when empty.
+func (c *Client) SendCount(countID string, count int, approximate bool, hll string) error {
 	response := map[string]interface{}{
 		"count": count,
 	}
 	if approximate {
 		response["approximate"] = true
 	}
+	if hll != "" {
+		response["hll"] = hll
+	}
 
 	msg := []interface{}{MessageTypeCount, countID, response}
 	data, err := json.Marshal(msg)
@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/paul/glienicke/pkg/logging"
+)
+
+const (
+	// MaxConcurrentQueriesPerClient is the maximum number of REQ/COUNT queries
+	// a single connection may have running at the same time
+	MaxConcurrentQueriesPerClient = 4
+
+	// DefaultQueryTimeout bounds how long a REQ/COUNT may spend on stored events
+	DefaultQueryTimeout = 30 * time.Second
+)
+
+// runningQuery is a REQ or COUNT executing in its own goroutine.
+type runningQuery struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// SetQueryTimeout sets the per-query timeout for REQ/COUNT (0 = no timeout)
+func (c *Client) SetQueryTimeout(d time.Duration) {
+	c.queryTimeout = d
+}
+
+// startQuery runs a REQ/COUNT handler concurrently with the rest of the
+// connection, in a context that is cancelled on CLOSE, on replacement of the
+// subscription, on disconnect, or when the query timeout expires. onTimeout is
+// called after the handler returned because the timeout expired. It returns
+// false if the query was not started.
+func (c *Client) startQuery(ctx context.Context, id string, run func(ctx context.Context) error, onTimeout func()) bool {
+	select {
+	case c.querySem <- struct{}{}:
+	default:
+		c.SendClosed(id, "rate-limited: too many concurrent requests")
+		return false
+	}
+
+	var qctx context.Context
+	var cancel context.CancelFunc
+	if c.queryTimeout > 0 {
+		qctx, cancel = context.WithTimeout(ctx, c.queryTimeout)
+	} else {
+		qctx, cancel = context.WithCancel(ctx)
+	}
+	q := &runningQuery{cancel: cancel, done: make(chan struct{})}
+
+	c.queryMu.Lock()
+	select {
+	case <-c.closeCh:
+		c.queryMu.Unlock()
+		cancel()
+		<-c.querySem
+		return false
+	default:
+	}
+	c.queries[id] = q
+	c.queryWG.Add(1)
+	c.queryMu.Unlock()
+
+	go func() {
+		defer c.queryWG.Done()
+		defer func() { <-c.querySem }()
+		defer close(q.done)
+		defer cancel()
+
+		err := run(qctx)
+
+		// Clean up while the query is still registered: a REQ reusing id
+		// waits for it in stopQuery rather than being closed by onTimeout
+		switch {
+		case err != nil && errors.Is(qctx.Err(), context.DeadlineExceeded):
+			c.SendClosed(id, "error: timeout")
+			if onTimeout != nil {
+				onTimeout()
+			}
+		case qctx.Err() != nil:
+			// Cancelled by CLOSE, replacement or disconnect
+		case err != nil:
+			c.log().Debug("error handling message", logging.KeySubID, id, logging.KeyError, err)
+			c.SendNotice("error: " + err.Error())
+		}
+
+		c.queryMu.Lock()
+		if c.queries[id] == q {
+			delete(c.queries, id)
+		}
+		c.queryMu.Unlock()
+	}()
+	return true
+}
+
+// stopQuery cancels the query running under id, if any, and waits for its
+// handler to return so that cleanup for id cannot race with it.
+func (c *Client) stopQuery(id string) {
+	c.queryMu.Lock()
+	q, ok := c.queries[id]
+	delete(c.queries, id)
+	c.queryMu.Unlock()
+
+	if ok {
+		q.cancel()
+		<-q.done
+	}
+}
+
+// cancelQueries cancels every running query without waiting for them.
+func (c *Client) cancelQueries() {
+	c.queryMu.Lock()
+	defer c.queryMu.Unlock()
+	for _, q := range c.queries {
+		q.cancel()
+	}
+}
@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingHandler blocks every REQ/COUNT until its context is cancelled and
+// records what happened to it.
+type blockingHandler struct {
+	started   chan string
+	cancelled chan string
+	closed    chan string
+	events    chan string
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{
+		started:   make(chan string, 16),
+		cancelled: make(chan string, 16),
+		closed:    make(chan string, 16),
+		events:    make(chan string, 16),
+	}
+}
+
+func (h *blockingHandler) HandleEvent(ctx context.Context, c *Client, evt *event.Event) error {
+	h.events <- evt.ID
+	return nil
+}
+
+func (h *blockingHandler) HandleReq(ctx context.Context, c *Client, subID string, filters []*event.Filter) error {
+	h.started <- subID
+	<-ctx.Done()
+	h.cancelled <- subID
+	return ctx.Err()
+}
+
+func (h *blockingHandler) HandleClose(ctx context.Context, c *Client, subID string) error {
+	c.RemoveSubscription(subID)
+	h.closed <- subID
+	return nil
+}
+
+func (h *blockingHandler) HandleCount(ctx context.Context, c *Client, countID string, filters []*event.Filter) error {
+	return h.HandleReq(ctx, c, countID, filters)
+}
+
+func receive(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out")
+		return ""
+	}
+}
+
+func readSent(t *testing.T, c *Client) []interface{} {
+	t.Helper()
+	select {
+	case data := <-c.sendCh:
+		var msg []interface{}
+		require.NoError(t, json.Unmarshal(data, &msg))
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return nil
+	}
+}
+
+func sendReq(t *testing.T, c *Client, subID string) {
+	t.Helper()
+	require.NoError(t, c.handleMessage(context.Background(), []byte(fmt.Sprintf(`["REQ",%q,{"kinds":[1]}]`, subID))))
+}
+
+func TestQuery_DoesNotBlockConnection(t *testing.T) {
+	h := newBlockingHandler()
+	c := NewClient(nil, h, "10.0.0.1")
+
+	sendReq(t, c, "slow")
+	assert.Equal(t, "slow", receive(t, h.started))
+
+	// An EVENT is handled while the REQ is still running
+	id := fmt.Sprintf("%064x", 1)
+	require.NoError(t, c.handleMessage(context.Background(), []byte(fmt.Sprintf(
+		`["EVENT",{"id":%q,"pubkey":%q,"created_at":1,"kind":1,"tags":[],"content":"","sig":%q}]`,
+		id, id, fmt.Sprintf("%0128x", 1)))))
+	assert.Equal(t, "OK", readSent(t, c)[0])
+
+	c.cancelQueries()
+	assert.Equal(t, "slow", receive(t, h.cancelled))
+	c.queryWG.Wait()
+}
+
+func TestQuery_CloseCancelsRunningQuery(t *testing.T) {
+	h := newBlockingHandler()
+	c := NewClient(nil, h, "10.0.0.1")
+
+	sendReq(t, c, "sub")
+	receive(t, h.started)
+
+	require.NoError(t, c.handleMessage(context.Background(), []byte(`["CLOSE","sub"]`)))
+
+	// The query has returned by the time the subscription is closed
+	select {
+	case <-h.cancelled:
+	default:
+		t.Fatal("query still running when CLOSE was handled")
+	}
+	assert.Equal(t, "sub", receive(t, h.closed))
+	assert.Empty(t, c.GetSubscriptions())
+}
+
+func TestQuery_ReplacementCancelsPreviousQuery(t *testing.T) {
+	h := newBlockingHandler()
+	c := NewClient(nil, h, "10.0.0.1")
+
+	sendReq(t, c, "sub")
+	receive(t, h.started)
+	sendReq(t, c, "sub")
+
+	assert.Equal(t, "sub", receive(t, h.cancelled))
+	assert.Equal(t, "sub", receive(t, h.started))
+
+	c.cancelQueries()
+	c.queryWG.Wait()
+}
+
+func TestQuery_Timeout(t *testing.T) {
+	h := newBlockingHandler()
+	c := NewClient(nil, h, "10.0.0.1")
+	c.SetQueryTimeout(50 * time.Millisecond)
+
+	sendReq(t, c, "sub")
+	receive(t, h.started)
+
+	assert.Equal(t, []interface{}{"CLOSED", "sub", "error: timeout"}, readSent(t, c))
+	assert.Equal(t, "sub", receive(t, h.closed))
+	assert.Empty(t, c.GetSubscriptions())
+}
+
+// gatedCloseHandler holds the first HandleClose until gate is closed
+type gatedCloseHandler struct {
+	*blockingHandler
+	closing chan string
+	gate    chan struct{}
+}
+
+func (h *gatedCloseHandler) HandleClose(ctx context.Context, c *Client, subID string) error {
+	select {
+	case h.closing <- subID:
+		<-h.gate
+	default:
+	}
+	return h.blockingHandler.HandleClose(ctx, c, subID)
+}
+
+func TestQuery_TimeoutDoesNotCloseReplacement(t *testing.T) {
+	h := &gatedCloseHandler{blockingHandler: newBlockingHandler(), closing: make(chan string, 1), gate: make(chan struct{})}
+	c := NewClient(nil, h, "10.0.0.1")
+	c.SetQueryTimeout(50 * time.Millisecond)
+
+	sendReq(t, c, "sub")
+	receive(t, h.started)
+	assert.Equal(t, "sub", receive(t, h.closing))
+
+	// A REQ reusing the ID while the timed-out query is being closed
+	c.SetQueryTimeout(0)
+	replaced := make(chan struct{})
+	go func() {
+		defer close(replaced)
+		sendReq(t, c, "sub")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(h.gate)
+	<-replaced
+	assert.Equal(t, "sub", receive(t, h.closed))
+	assert.Equal(t, "sub", receive(t, h.started))
+	assert.Contains(t, c.GetSubscriptions(), "sub")
+
+	c.cancelQueries()
+	c.queryWG.Wait()
+}
+
+func TestQuery_ConcurrencyLimit(t *testing.T) {
+	h := newBlockingHandler()
+	c := NewClient(nil, h, "10.0.0.1")
+
+	for i := 0; i < MaxConcurrentQueriesPerClient; i++ {
+		sendReq(t, c, fmt.Sprintf("sub-%d", i))
+		receive(t, h.started)
+	}
+
+	sendReq(t, c, "one-too-many")
+	assert.Equal(t, []interface{}{"CLOSED", "one-too-many", "rate-limited: too many concurrent requests"}, readSent(t, c))
+	assert.NotContains(t, c.GetSubscriptions(), "one-too-many")
+
+	c.cancelQueries()
+	c.queryWG.Wait()
+}
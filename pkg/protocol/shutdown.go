@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ShutdownNotice is sent to clients when the relay shuts down
+const ShutdownNotice = "relay is shutting down"
+
+// shutdownPollInterval is how often Shutdown checks whether queued events
+// have been handed to the writer
+const shutdownPollInterval = 10 * time.Millisecond
+
+// errShuttingDown is returned for messages received while the client drains
+var errShuttingDown = errors.New(ShutdownNotice)
+
+// Shutdown ends the session gracefully. It stops handling new messages, waits
+// for the message being handled (e.g. an EVENT being saved) and cancels the
+// running queries, flushes queued broadcast events, then sends CLOSED for every
+// open subscription and a NOTICE, and closes the connection once they have been
+// written. The client is closed when Shutdown returns; if ctx ends first,
+// messages not yet written are dropped and ctx's error is returned.
+func (c *Client) Shutdown(ctx context.Context) error {
+	defer c.Close()
+	c.draining.Store(true)
+
+	// The message being handled finishes; later ones are refused
+	if err := waitCtx(ctx, func() {
+		c.handleMu.Lock()
+		c.handleMu.Unlock()
+	}); err != nil {
+		return err
+	}
+
+	ids := c.openIDs()
+	c.cancelQueries()
+	if err := waitCtx(ctx, c.queryWG.Wait); err != nil {
+		return err
+	}
+
+	// Deliver refuses new events now, so the queue only shrinks
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for c.PendingDeliveries() > 0 || c.delivering.Load() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closeCh:
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	for _, id := range ids {
+		if err := c.sendCtx(ctx, []interface{}{MessageTypeClosed, id, "error: " + ShutdownNotice}); err != nil {
+			return err
+		}
+	}
+	if err := c.sendCtx(ctx, []interface{}{MessageTypeNotice, ShutdownNotice}); err != nil {
+		return err
+	}
+
+	if c.conn != nil {
+		// A nil message makes the write pump send a close frame and stop
+		select {
+		case c.sendCh <- nil:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closeCh:
+			return nil
+		}
+	}
+	// Detached clients are closed by their transport once it has read the messages
+	select {
+	case <-c.closeCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// openIDs returns the IDs of open subscriptions and running COUNTs
+func (c *Client) openIDs() []string {
+	seen := make(map[string]bool)
+	var ids []string
+	c.subMu.RLock()
+	for id := range c.subscriptions {
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	c.subMu.RUnlock()
+
+	c.queryMu.Lock()
+	for id := range c.queries {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	c.queryMu.Unlock()
+	return ids
+}
+
+// sendCtx queues a message like the Send methods, giving up when ctx ends
+func (c *Client) sendCtx(ctx context.Context, msg []interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.sendCh <- data:
+		return nil
+	case <-c.closeCh:
+		return errors.New("client closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeCloseFrame tells the peer the connection is going away
+func (c *Client) writeCloseFrame() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, ShutdownNotice)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// waitCtx runs wait and returns when it does or when ctx ends
+func waitCtx(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wait()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
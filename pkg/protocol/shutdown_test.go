@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown_FlushesDeliveriesBeforeClosed(t *testing.T) {
+	h := newBlockingHandler()
+	c := NewDetachedClient(h, "10.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, c.HandleMessage(ctx, []byte(`["REQ","live",{"kinds":[1]}]`)))
+	assert.Equal(t, "live", receive(t, h.started))
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		encoded, err := EncodeEvent(testEvent(i))
+		require.NoError(t, err)
+		require.NoError(t, c.Deliver([]string{"live"}, encoded))
+	}
+
+	// Read like a transport would, closing the client after the NOTICE
+	var types []MessageType
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for data := range c.Messages() {
+			var msg []json.RawMessage
+			var typ MessageType
+			if !assert.NoError(t, json.Unmarshal(data, &msg)) || !assert.NoError(t, json.Unmarshal(msg[0], &typ)) {
+				return
+			}
+			types = append(types, typ)
+			if typ == MessageTypeNotice {
+				c.Close()
+				return
+			}
+		}
+	}()
+	go c.Run(ctx)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelShutdown()
+	require.NoError(t, c.Shutdown(shutdownCtx))
+	<-readDone
+
+	// The running query was cancelled without a reply of its own
+	assert.Equal(t, "live", receive(t, h.cancelled))
+	require.Len(t, types, n+2)
+	for _, typ := range types[:n] {
+		assert.Equal(t, MessageTypeEvent, typ)
+	}
+	assert.Equal(t, MessageTypeClosed, types[n])
+	assert.Equal(t, MessageTypeNotice, types[n+1])
+
+	// Draining clients refuse new messages and deliveries
+	assert.ErrorIs(t, c.HandleMessage(ctx, []byte(`["REQ","late",{}]`)), errShuttingDown)
+	encoded, err := EncodeEvent(testEvent(n))
+	require.NoError(t, err)
+	assert.Error(t, c.Deliver([]string{"live"}, encoded))
+}
+
+func TestShutdown_DeadlineClosesClient(t *testing.T) {
+	c := NewDetachedClient(newBlockingHandler(), "10.0.0.1")
+
+	// Nobody reads the messages, so the transport never closes the client
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("client not closed after the shutdown deadline")
+	}
+}
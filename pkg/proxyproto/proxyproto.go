@@ -0,0 +1,224 @@
+// Package proxyproto accepts the HAProxy PROXY protocol (versions 1 and 2)
+// on a listener, so that connections relayed by a TCP load balancer report
+// the original client address.
+//
+// Headers are only read from trusted peers; connections from other peers are
+// passed through untouched, so they cannot spoof their address. A trusted
+// peer may omit the header, in which case its own address is used. The
+// header is read on the first Read or RemoteAddr call rather than in Accept,
+// so a slow peer does not hold up other connections.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeaderTimeout bounds how long a trusted peer may take to send the header
+const DefaultHeaderTimeout = 5 * time.Second
+
+// Header signatures
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	v1MaxLength = 107 // including CRLF
+	v2HeaderLen = 16  // signature, version/command, family, length
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamilyInet  = 0x1
+	v2FamilyInet6 = 0x2
+)
+
+// ErrInvalidHeader is returned by Read on a connection whose PROXY header is malformed
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Listener wraps a net.Listener and reads PROXY protocol headers from
+// connections of trusted peers.
+type Listener struct {
+	net.Listener
+
+	// Trusted reports whether a peer may send a PROXY header; nil trusts no one
+	Trusted func(ip net.IP) bool
+
+	// HeaderTimeout bounds the time to read the header (0 = DefaultHeaderTimeout)
+	HeaderTimeout time.Duration
+}
+
+// Accept waits for the next connection and wraps it.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	trusted := false
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && l.Trusted != nil {
+		trusted = l.Trusted(addr.IP)
+	}
+	return &Conn{Conn: conn, trusted: trusted, timeout: timeout}, nil
+}
+
+// Conn is a connection whose remote address is taken from its PROXY header.
+type Conn struct {
+	net.Conn
+	trusted bool
+	timeout time.Duration
+
+	once   sync.Once
+	reader io.Reader // buffered reader positioned after the header
+	remote net.Addr
+	err    error
+}
+
+// Read reads from the connection after the PROXY header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the
+// peer's address if there is none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remote
+}
+
+func (c *Conn) readHeader() {
+	c.remote = c.Conn.RemoteAddr()
+	if !c.trusted {
+		c.reader = c.Conn
+		return
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(c.Conn)
+	c.reader = br
+	addr, err := ReadHeader(br)
+	if err != nil {
+		c.err = err
+		return
+	}
+	if addr != nil {
+		c.remote = addr
+	}
+}
+
+// ReadHeader reads a version 1 or 2 PROXY header from r and returns the
+// source address it carries. It returns a nil address without consuming
+// anything if r does not start with a header, and for headers that carry no
+// address (v1 UNKNOWN, v2 LOCAL or non-IP families).
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	// Look at the first byte only, so that short non-PROXY payloads are not
+	// waited on
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		if prefix, err := r.Peek(len(v1Prefix)); err == nil && bytes.Equal(prefix, v1Prefix) {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		if sig, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(sig, v2Signature) {
+			return readV2(r)
+		}
+	}
+	return nil, nil
+}
+
+// readV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n"
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long or not terminated", ErrInvalidHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 parses the binary header: signature, version and command, address
+// family and protocol, address length, addresses and TLVs
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]>>4
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+
+	switch command {
+	case v2CmdLocal:
+		return nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, command)
+	}
+	switch family {
+	case v2FamilyInet:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case v2FamilyInet6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Unix sockets and unspecified families carry no usable address
+	return nil, nil
+}
@@ -0,0 +1,106 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(command, family byte, addrs []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x1f, 0x90, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 4711)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string // source address, "" for none
+		rest    string
+		wantErr bool
+	}{
+		{name: "v1 TCP4", input: "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nGET /", want: "203.0.113.7:56324", rest: "GET /"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\nGET /", want: "[2001:db8::1]:4711", rest: "GET /"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\nGET /", rest: "GET /"},
+		{name: "v1 family mismatch", input: "PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n", wantErr: true},
+		{name: "v1 unterminated", input: "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443" + strings.Repeat(" ", 100), wantErr: true},
+		{name: "v2 IPv4", input: string(v2Header(v2CmdProxy, v2FamilyInet, ipv4)) + "GET /", want: "203.0.113.7:8080", rest: "GET /"},
+		{name: "v2 IPv6 with TLV", input: string(v2Header(v2CmdProxy, v2FamilyInet6, append(ipv6, 0x04, 0, 1, 'x'))) + "GET /", want: "[2001:db8::1]:4711", rest: "GET /"},
+		{name: "v2 LOCAL", input: string(v2Header(v2CmdLocal, 0, nil)) + "GET /", rest: "GET /"},
+		{name: "v2 short", input: string(v2Header(v2CmdProxy, v2FamilyInet, ipv4[:4])), wantErr: true},
+		{name: "no header", input: "GET / HTTP/1.1\r\n", rest: "GET / HTTP/1.1\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			addr, err := ReadHeader(r)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidHeader)
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, addr)
+			} else {
+				require.NotNil(t, addr)
+				assert.Equal(t, tt.want, addr.String())
+			}
+			rest, _ := io.ReadAll(r)
+			assert.Equal(t, tt.rest, string(rest))
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	trusted := true
+	ln := &Listener{Listener: inner, Trusted: func(net.IP) bool { return trusted }, HeaderTimeout: time.Second}
+	defer ln.Close()
+
+	accept := func(send string) (net.Addr, string) {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		_, err = client.Write([]byte(send))
+		require.NoError(t, err)
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		return conn.RemoteAddr(), string(buf)
+	}
+
+	addr, data := accept("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nhello")
+	assert.Equal(t, "203.0.113.7:56324", addr.String())
+	assert.Equal(t, "hello", data)
+
+	// Without a header the peer's address is used
+	addr, data = accept("hello")
+	assert.Equal(t, "127.0.0.1", addr.(*net.TCPAddr).IP.String())
+	assert.Equal(t, "hello", data)
+
+	// Untrusted peers cannot spoof their address
+	trusted = false
+	addr, data = accept("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n")
+	assert.Equal(t, "127.0.0.1", addr.(*net.TCPAddr).IP.String())
+	assert.Equal(t, "PROXY", data)
+}
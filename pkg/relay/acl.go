@@ -0,0 +1,591 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip19"
+	"github.com/paul/glienicke/pkg/storage"
+)
+
+// ACLDirection is the access an ACL entry controls
+type ACLDirection string
+
+const (
+	ACLRead  ACLDirection = "read"  // REQ, COUNT and live events
+	ACLWrite ACLDirection = "write" // EVENT
+)
+
+// ACLAction is what an ACL entry does with matching requests
+type ACLAction string
+
+const (
+	// ACLAllow entries form an allowlist: once a direction has one for a
+	// type, values not on it are rejected with "restricted:"
+	ACLAllow ACLAction = "allow"
+	// ACLDeny entries are rejected with "blocked:"; they take precedence over allow entries
+	ACLDeny ACLAction = "deny"
+)
+
+// ACLType is what an ACL entry matches
+type ACLType string
+
+const (
+	ACLPubKey ACLType = "pubkey" // event author (write) or NIP-42 authenticated pubkey (read); hex or npub
+	ACLIP     ACLType = "ip"     // client IP address or CIDR range
+	ACLKind   ACLType = "kind"   // event kind or range, e.g. 4 or 30000-39999
+)
+
+// ACLEntry is an access-control rule.
+type ACLEntry struct {
+	Direction ACLDirection `json:"direction"`
+	Action    ACLAction    `json:"action"`
+	Type      ACLType      `json:"type"`
+	Value     string       `json:"value"`
+	Reason    string       `json:"reason,omitempty"`
+	Source    string       `json:"source,omitempty"` // file the entry was loaded from; empty for runtime entries
+}
+
+// aclListName is the storage.ManagementStore list holding runtime entries
+func aclListName(dir ACLDirection, action ACLAction, typ ACLType) string {
+	return fmt.Sprintf("acl_%s_%s_%s", dir, action, typ)
+}
+
+// Normalize validates an entry and puts its value in canonical form: npub
+// pubkeys become hex, IPs and CIDR ranges are canonicalised and kind ranges
+// are written as "min-max".
+func (e ACLEntry) Normalize() (ACLEntry, error) {
+	switch e.Direction {
+	case ACLRead, ACLWrite:
+	default:
+		return e, fmt.Errorf("invalid ACL direction %q (want read or write)", e.Direction)
+	}
+	switch e.Action {
+	case ACLAllow, ACLDeny:
+	default:
+		return e, fmt.Errorf("invalid ACL action %q (want allow or deny)", e.Action)
+	}
+
+	value := strings.TrimSpace(e.Value)
+	switch e.Type {
+	case ACLPubKey:
+		pubkey, err := parseACLPubKey(value)
+		if err != nil {
+			return e, err
+		}
+		e.Value = pubkey
+	case ACLIP:
+		ipNet, err := parseACLNet(value)
+		if err != nil {
+			return e, err
+		}
+		if ones, bits := ipNet.Mask.Size(); ones == bits {
+			e.Value = ipNet.IP.String()
+		} else {
+			e.Value = ipNet.String()
+		}
+	case ACLKind:
+		min, max, err := parseACLKinds(value)
+		if err != nil {
+			return e, err
+		}
+		e.Value = strconv.Itoa(min)
+		if max != min {
+			e.Value += "-" + strconv.Itoa(max)
+		}
+	default:
+		return e, fmt.Errorf("invalid ACL type %q (want pubkey, ip or kind)", e.Type)
+	}
+	return e, nil
+}
+
+func parseACLPubKey(value string) (string, error) {
+	if strings.HasPrefix(value, "npub1") {
+		decoded, err := nip19.DecodeNpub(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid npub %q: %w", value, err)
+		}
+		value = decoded
+	}
+	value = strings.ToLower(value)
+	if len(value) != 64 || strings.Trim(value, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid pubkey %q (want 64-character hex or npub)", value)
+	}
+	return value, nil
+}
+
+func parseACLNet(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", value)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", value)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func parseACLKinds(value string) (min, max int, err error) {
+	lo, hi, isRange := strings.Cut(value, "-")
+	if min, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil || min < 0 {
+		return 0, 0, fmt.Errorf("invalid kind %q", value)
+	}
+	max = min
+	if isRange {
+		if max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil || max < min {
+			return 0, 0, fmt.Errorf("invalid kind range %q", value)
+		}
+	}
+	return min, max, nil
+}
+
+// aclMatcher matches values of all types against the entries of one direction and action
+type aclMatcher struct {
+	pubkeys map[string]*ACLEntry
+	nets    []aclNet
+	kinds   []aclKinds
+}
+
+type aclNet struct {
+	ipNet *net.IPNet
+	entry *ACLEntry
+}
+
+type aclKinds struct {
+	min, max int
+	entry    *ACLEntry
+}
+
+func (m *aclMatcher) add(e *ACLEntry) {
+	switch e.Type {
+	case ACLPubKey:
+		if m.pubkeys == nil {
+			m.pubkeys = make(map[string]*ACLEntry)
+		}
+		m.pubkeys[e.Value] = e
+	case ACLIP:
+		ipNet, _ := parseACLNet(e.Value)
+		m.nets = append(m.nets, aclNet{ipNet: ipNet, entry: e})
+	case ACLKind:
+		min, max, _ := parseACLKinds(e.Value)
+		m.kinds = append(m.kinds, aclKinds{min: min, max: max, entry: e})
+	}
+}
+
+// has reports whether the matcher holds entries of a type
+func (m *aclMatcher) has(typ ACLType) bool {
+	switch typ {
+	case ACLPubKey:
+		return len(m.pubkeys) > 0
+	case ACLIP:
+		return len(m.nets) > 0
+	default:
+		return len(m.kinds) > 0
+	}
+}
+
+func (m *aclMatcher) matchPubKey(pubkey string) *ACLEntry {
+	return m.pubkeys[pubkey]
+}
+
+func (m *aclMatcher) matchIP(ip net.IP) *ACLEntry {
+	if ip == nil {
+		return nil
+	}
+	for _, n := range m.nets {
+		if n.ipNet.Contains(ip) {
+			return n.entry
+		}
+	}
+	return nil
+}
+
+func (m *aclMatcher) matchKind(kind int) *ACLEntry {
+	for _, k := range m.kinds {
+		if kind >= k.min && kind <= k.max {
+			return k.entry
+		}
+	}
+	return nil
+}
+
+// aclRules are the compiled allow and deny entries of one direction
+type aclRules struct {
+	allow, deny aclMatcher
+}
+
+// acl holds the access-control lists. Runtime entries are cached in memory
+// and written through to the store like the NIP-86 lists; file entries are
+// replaced as a whole when the files are reloaded.
+type acl struct {
+	mu      sync.RWMutex
+	store   storage.ManagementStore // nil if the store cannot persist entries
+	runtime []ACLEntry
+	files   []ACLEntry
+	rules   map[ACLDirection]*aclRules
+}
+
+func newACL(store storage.Store) *acl {
+	a := &acl{}
+	if ms, ok := store.(storage.ManagementStore); ok {
+		a.store = ms
+	}
+	a.compile()
+	return a
+}
+
+// load reads the persisted runtime entries into memory
+func (a *acl) load(ctx context.Context) error {
+	if a.store == nil {
+		return nil
+	}
+	var entries []ACLEntry
+	for _, dir := range []ACLDirection{ACLRead, ACLWrite} {
+		for _, action := range []ACLAction{ACLAllow, ACLDeny} {
+			for _, typ := range []ACLType{ACLPubKey, ACLIP, ACLKind} {
+				stored, err := a.store.ListEntries(ctx, aclListName(dir, action, typ))
+				if err != nil {
+					return err
+				}
+				for _, s := range stored {
+					e, err := ACLEntry{Direction: dir, Action: action, Type: typ, Value: s.Value, Reason: s.Reason}.Normalize()
+					if err != nil {
+						logger.Warn("skipping invalid stored ACL entry", "list", aclListName(dir, action, typ), "value", s.Value)
+						continue
+					}
+					entries = append(entries, e)
+				}
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.runtime = entries
+	a.compile()
+	return nil
+}
+
+// compile rebuilds the matchers from the entries; callers hold mu
+func (a *acl) compile() {
+	rules := map[ACLDirection]*aclRules{ACLRead: {}, ACLWrite: {}}
+	for _, list := range [][]ACLEntry{a.files, a.runtime} {
+		for i := range list {
+			e := &list[i]
+			r := rules[e.Direction]
+			if e.Action == ACLAllow {
+				r.allow.add(e)
+			} else {
+				r.deny.add(e)
+			}
+		}
+	}
+	a.rules = rules
+}
+
+// add stores a runtime entry, replacing the reason of an existing one
+func (a *acl) add(ctx context.Context, e ACLEntry) error {
+	if a.store != nil {
+		if err := a.store.AddListEntry(ctx, aclListName(e.Direction, e.Action, e.Type), e.Value, e.Reason); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.runtime = append(removeACLEntry(a.runtime, e), e)
+	a.compile()
+	return nil
+}
+
+// remove deletes a runtime entry; removing a missing entry is not an error
+func (a *acl) remove(ctx context.Context, e ACLEntry) error {
+	if a.store != nil {
+		if err := a.store.RemoveListEntry(ctx, aclListName(e.Direction, e.Action, e.Type), e.Value); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.runtime = removeACLEntry(a.runtime, e)
+	a.compile()
+	return nil
+}
+
+func removeACLEntry(entries []ACLEntry, e ACLEntry) []ACLEntry {
+	kept := make([]ACLEntry, 0, len(entries))
+	for _, x := range entries {
+		if x.Direction != e.Direction || x.Action != e.Action || x.Type != e.Type || x.Value != e.Value {
+			kept = append(kept, x)
+		}
+	}
+	return kept
+}
+
+// setFiles replaces the file entries
+func (a *acl) setFiles(entries []ACLEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.files = entries
+	a.compile()
+}
+
+// entries returns the file entries followed by the runtime entries
+func (a *acl) entries() []ACLEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	all := make([]ACLEntry, 0, len(a.files)+len(a.runtime))
+	all = append(all, a.files...)
+	return append(all, a.runtime...)
+}
+
+// restrictsWrites reports whether any write entries exist (NIP-11 restricted_writes)
+func (a *acl) restrictsWrites() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	w := a.rules[ACLWrite]
+	for _, typ := range []ACLType{ACLPubKey, ACLIP, ACLKind} {
+		if w.allow.has(typ) || w.deny.has(typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// verbs describe the access in rejection reasons
+var aclVerbs = map[ACLDirection]string{
+	ACLRead:  "read from",
+	ACLWrite: "write to",
+}
+
+// checkValue applies the rules of one direction and type. match finds the
+// entry for the value in a matcher; subject names the value in the reason.
+func (r *aclRules) checkValue(dir ACLDirection, typ ACLType, subject string, match func(*aclMatcher) *ACLEntry) string {
+	if e := match(&r.deny); e != nil {
+		reason := fmt.Sprintf("blocked: %s may not %s this relay", subject, aclVerbs[dir])
+		if e.Reason != "" {
+			reason += " (" + e.Reason + ")"
+		}
+		return reason
+	}
+	if r.allow.has(typ) && match(&r.allow) == nil {
+		return fmt.Sprintf("restricted: %s is not allowed to %s this relay", subject, aclVerbs[dir])
+	}
+	return ""
+}
+
+func (r *aclRules) checkIP(dir ACLDirection, ip string) string {
+	parsed := net.ParseIP(ip)
+	return r.checkValue(dir, ACLIP, "IP address", func(m *aclMatcher) *ACLEntry { return m.matchIP(parsed) })
+}
+
+func (r *aclRules) checkPubKey(dir ACLDirection, pubkey string) string {
+	return r.checkValue(dir, ACLPubKey, "pubkey", func(m *aclMatcher) *ACLEntry { return m.matchPubKey(pubkey) })
+}
+
+func (r *aclRules) checkKind(dir ACLDirection, kind int) string {
+	return r.checkValue(dir, ACLKind, fmt.Sprintf("kind %d", kind), func(m *aclMatcher) *ACLEntry { return m.matchKind(kind) })
+}
+
+// checkConnection returns a reason if an IP may neither read nor write
+func (a *acl) checkConnection(ip string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	reason := a.rules[ACLRead].checkIP(ACLRead, ip)
+	if reason == "" || a.rules[ACLWrite].checkIP(ACLWrite, ip) == "" {
+		return ""
+	}
+	return reason
+}
+
+// checkWrite returns an OK reason if a client at ip may not publish evt
+func (a *acl) checkWrite(ip string, evt *event.Event) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	w := a.rules[ACLWrite]
+	if reason := w.checkIP(ACLWrite, ip); reason != "" {
+		return reason
+	}
+	if reason := w.checkPubKey(ACLWrite, evt.PubKey); reason != "" {
+		return reason
+	}
+	return w.checkKind(ACLWrite, evt.Kind)
+}
+
+// checkRead returns a CLOSED reason if a client at ip, authenticated as
+// pubkey (empty if not), may not query the relay
+func (a *acl) checkRead(ip, pubkey string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	rd := a.rules[ACLRead]
+	if reason := rd.checkIP(ACLRead, ip); reason != "" {
+		return reason
+	}
+	if pubkey == "" {
+		if rd.allow.has(ACLPubKey) {
+			return "auth-required: this relay only serves authorized pubkeys"
+		}
+		return ""
+	}
+	return rd.checkPubKey(ACLRead, pubkey)
+}
+
+// checkCountKinds returns a CLOSED reason if kind rules restrict reads and a
+// COUNT filter could include kinds that may not be read
+func (a *acl) checkCountKinds(filters []*event.Filter) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	rd := a.rules[ACLRead]
+	if !rd.allow.has(ACLKind) && !rd.deny.has(ACLKind) {
+		return ""
+	}
+	for _, f := range filters {
+		if len(f.Kinds) == 0 {
+			return "restricted: COUNT filters must list readable kinds"
+		}
+		for _, kind := range f.Kinds {
+			if reason := rd.checkKind(ACLRead, kind); reason != "" {
+				return reason
+			}
+		}
+	}
+	return ""
+}
+
+// readableKind reports whether events of a kind may be served
+func (a *acl) readableKind(kind int) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.rules[ACLRead].checkKind(ACLRead, kind) == ""
+}
+
+// mayReceive reports whether a live event may be delivered to a client
+func (a *acl) mayReceive(ip, pubkey string, kind int) bool {
+	return a.checkRead(ip, pubkey) == "" && a.readableKind(kind)
+}
+
+// LoadACLFile reads ACL entries from a file. Each line holds
+//
+//	<read|write|both> <allow|deny> <pubkey|ip|kind> <value> [reason]
+//
+// Blank lines and lines starting with # are ignored.
+func LoadACLFile(path string) ([]ACLEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ACLEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%s:%d: want <direction> <action> <type> <value> [reason]", path, line)
+		}
+		dirs := []ACLDirection{ACLDirection(fields[0])}
+		if fields[0] == "both" {
+			dirs = []ACLDirection{ACLRead, ACLWrite}
+		}
+		for _, dir := range dirs {
+			e, err := ACLEntry{
+				Direction: dir,
+				Action:    ACLAction(fields[1]),
+				Type:      ACLType(fields[2]),
+				Value:     fields[3],
+				Reason:    strings.Join(fields[4:], " "),
+				Source:    path,
+			}.Normalize()
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SetACLFiles loads the ACL entries of the given files, replacing the entries
+// loaded from files before. Runtime entries are kept. If a file cannot be
+// loaded the previous file entries stay in effect.
+func (r *Relay) SetACLFiles(paths []string) error {
+	var entries []ACLEntry
+	for _, path := range paths {
+		loaded, err := LoadACLFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to load ACL file: %w", err)
+		}
+		entries = append(entries, loaded...)
+	}
+	r.acl.setFiles(entries)
+	return nil
+}
+
+// AddACLEntry adds a runtime ACL entry and persists it in the store.
+func (r *Relay) AddACLEntry(ctx context.Context, entry ACLEntry) error {
+	e, err := entry.Normalize()
+	if err != nil {
+		return err
+	}
+	e.Source = ""
+	if err := r.acl.add(ctx, e); err != nil {
+		return fmt.Errorf("failed to add ACL entry: %w", err)
+	}
+	return nil
+}
+
+// RemoveACLEntry removes a runtime ACL entry. Entries loaded from files are
+// removed by editing the file and reloading.
+func (r *Relay) RemoveACLEntry(ctx context.Context, entry ACLEntry) error {
+	e, err := entry.Normalize()
+	if err != nil {
+		return err
+	}
+	if err := r.acl.remove(ctx, e); err != nil {
+		return fmt.Errorf("failed to remove ACL entry: %w", err)
+	}
+	return nil
+}
+
+// ACLEntries returns the ACL entries in effect, sorted by direction, action,
+// type and value.
+func (r *Relay) ACLEntries() []ACLEntry {
+	entries := r.acl.entries()
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.Action != b.Action {
+			return a.Action < b.Action
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Value < b.Value
+	})
+	return entries
+}
@@ -0,0 +1,346 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/storage"
+)
+
+// banReason is the NOTICE/OK reason sent to banned clients
+const banReason = "banned: too many rate limit violations"
+
+// banRecord is the ban state of a rate limit key. Records outlive their ban
+// so that repeated bans escalate; they are pruned once the escalation
+// history has lapsed.
+type banRecord struct {
+	reason    string
+	until     time.Time
+	pubkeys   []string // authenticated pubkeys seen from a banned IP network
+	strikes   int      // temporary bans since the last long ban
+	createdAt time.Time
+}
+
+func (rec *banRecord) active(now time.Time) bool {
+	return now.Before(rec.until)
+}
+
+// Ban is a rate-limit ban of an IP network or pubkey. It is also the entry
+// format of blocklists written by ExportBans and read by ImportBans.
+type Ban struct {
+	Target    string    `json:"target"` // IP address, IPv6 network (CIDR) or hex pubkey
+	Reason    string    `json:"reason,omitempty"`
+	Until     time.Time `json:"until"`
+	PubKeys   []string  `json:"pubkeys,omitempty"` // authenticated pubkeys seen from a banned IP network
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// banned reports whether a rate limit key is banned. Callers hold limiterMu.
+func (r *Relay) banned(key string, now time.Time) bool {
+	rec, ok := r.bans[key]
+	return ok && rec.active(now)
+}
+
+// ban bans a key after repeated violations: temporarily, or for the long ban
+// duration after LongBanAfter temporary bans. Callers hold limiterMu.
+func (r *Relay) ban(key string, now time.Time, pubkeys []string) {
+	esc := r.rateLimits.Escalation
+	rec, ok := r.bans[key]
+	if !ok {
+		rec = &banRecord{}
+		r.bans[key] = rec
+	}
+
+	// Ban history is forgotten once a long ban's worth of time has passed
+	if rec.strikes > 0 && now.Sub(rec.until) > esc.LongBanDuration {
+		rec.strikes = 0
+	}
+	rec.strikes++
+	duration := esc.BanDuration
+	rec.reason = fmt.Sprintf("%d rate limit violations within %s", esc.Violations, esc.Window)
+	if rec.strikes > esc.LongBanAfter {
+		duration = esc.LongBanDuration
+		rec.reason = fmt.Sprintf("%d rate limit bans", rec.strikes)
+		rec.strikes = 0
+	}
+	rec.until = now.Add(duration)
+	rec.pubkeys = pubkeys
+	rec.createdAt = now
+	r.obs.bans.Inc()
+
+	rateLogger.Warn("banned", "key", key, "duration", duration, "pubkeys", pubkeys)
+	r.persistBan(key)
+}
+
+// pruneBans drops the records of expired bans whose escalation history has
+// lapsed. Callers hold limiterMu.
+func (r *Relay) pruneBans(now time.Time) {
+	for key, rec := range r.bans {
+		if rec.active(now) || (rec.strikes > 0 && now.Sub(rec.until) <= r.rateLimits.Escalation.LongBanDuration) {
+			continue
+		}
+		delete(r.bans, key)
+		r.persistBan(key)
+	}
+}
+
+// pruneExpiredBans drops lapsed ban records. It runs with the retention loop
+// so that they do not pile up between calls to Bans.
+func (r *Relay) pruneExpiredBans() {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+	r.pruneBans(time.Now())
+}
+
+// persistBan writes the ban state of a key to the store in the background.
+// Callers hold limiterMu.
+func (r *Relay) persistBan(key string) {
+	if r.mgmt.store == nil {
+		return
+	}
+	r.banWrites.Add(1)
+	go func() {
+		defer r.banWrites.Done()
+		if err := r.syncBan(context.Background(), key); err != nil {
+			rateLogger.Error("failed to persist ban", "key", key, logging.KeyError, err)
+		}
+	}()
+}
+
+// syncBan writes the current ban state of a key to the store: the ban, or
+// its deletion if there is none. Writes are serialized so that the store
+// ends up with the latest state.
+func (r *Relay) syncBan(ctx context.Context, key string) error {
+	store := r.mgmt.store
+	if store == nil {
+		return nil
+	}
+	r.banStoreMu.Lock()
+	defer r.banStoreMu.Unlock()
+
+	r.limiterMu.Lock()
+	rec, ok := r.bans[key]
+	var ban storage.Ban
+	if ok {
+		ban = storage.Ban{
+			Key:       key,
+			Reason:    rec.reason,
+			Until:     rec.until.Unix(),
+			PubKeys:   rec.pubkeys,
+			Strikes:   rec.strikes,
+			CreatedAt: rec.createdAt.Unix(),
+		}
+	}
+	r.limiterMu.Unlock()
+
+	if !ok {
+		return store.DeleteBan(ctx, key)
+	}
+	return store.SaveBan(ctx, ban)
+}
+
+// loadBans restores the persisted bans, so that a restart does not lift them
+func (r *Relay) loadBans(ctx context.Context) error {
+	store := r.mgmt.store
+	if store == nil {
+		return nil
+	}
+	bans, err := store.ListBans(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+	for _, ban := range bans {
+		r.bans[ban.Key] = &banRecord{
+			reason:    ban.Reason,
+			until:     time.Unix(ban.Until, 0),
+			pubkeys:   ban.PubKeys,
+			strikes:   ban.Strikes,
+			createdAt: time.Unix(ban.CreatedAt, 0),
+		}
+	}
+	r.pruneBans(time.Now())
+	return nil
+}
+
+// banKey returns the rate limit key of a ban target: a hex pubkey, an IP
+// address or an IPv6 network. Addresses and networks are aggregated like
+// client addresses; an IPv6 network wider than ipv6Prefix is rejected, since
+// no client key could match it.
+func banKey(target string, ipv6Prefix int) (string, error) {
+	target = strings.ToLower(strings.TrimSpace(target))
+	if len(target) == 64 && strings.Trim(target, "0123456789abcdef") == "" {
+		return rateKeyPubKey + target, nil
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		return ipRateKey(ip.String(), ipv6Prefix), nil
+	}
+	if _, network, err := net.ParseCIDR(target); err == nil {
+		ones, bits := network.Mask.Size()
+		if ones == bits {
+			return rateKeyIP + network.IP.String(), nil
+		}
+		if network.IP.To4() == nil {
+			if ones < ipv6Prefix {
+				return "", fmt.Errorf("invalid ban target %q: IPv6 networks cannot be wider than the /%d clients are limited per", target, ipv6Prefix)
+			}
+			return ipRateKey(network.IP.String(), ipv6Prefix), nil
+		}
+	}
+	return "", fmt.Errorf("invalid ban target %q: want a hex pubkey, an IP address or an IPv6 network", target)
+}
+
+// banTarget is the inverse of banKey
+func banTarget(key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, rateKeyIP), rateKeyPubKey)
+}
+
+// Bans returns the rate-limit bans in effect, ordered by target.
+func (r *Relay) Bans() []Ban {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+	now := time.Now()
+	r.pruneBans(now)
+
+	bans := make([]Ban, 0, len(r.bans))
+	for key, rec := range r.bans {
+		if !rec.active(now) {
+			continue
+		}
+		bans = append(bans, Ban{
+			Target:    banTarget(key),
+			Reason:    rec.reason,
+			Until:     rec.until,
+			PubKeys:   append([]string(nil), rec.pubkeys...),
+			CreatedAt: rec.createdAt,
+		})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Target < bans[j].Target })
+	return bans
+}
+
+// LiftBan lifts the ban of a target (see Ban) together with its escalation
+// history. Lifting a target that is not banned is not an error.
+func (r *Relay) LiftBan(ctx context.Context, target string) error {
+	r.limiterMu.Lock()
+	key, err := banKey(target, r.rateLimits.IPv6Prefix)
+	if err != nil {
+		r.limiterMu.Unlock()
+		return err
+	}
+	_, wasBanned := r.bans[key]
+	delete(r.bans, key)
+	if lim, ok := r.limiters[key]; ok {
+		lim.violations = 0
+	}
+	r.limiterMu.Unlock()
+
+	if wasBanned {
+		rateLogger.Info("ban lifted", "key", key)
+	}
+	if err := r.syncBan(ctx, key); err != nil {
+		return fmt.Errorf("failed to lift ban: %w", err)
+	}
+	return nil
+}
+
+// AddBans adds bans, for example from another relay's blocklist. Expired
+// bans are skipped, and a ban in effect is only replaced by one that lasts
+// longer. It returns the number of bans added.
+func (r *Relay) AddBans(ctx context.Context, bans []Ban) (int, error) {
+	r.limiterMu.Lock()
+	keys := make([]string, len(bans))
+	for i, ban := range bans {
+		key, err := banKey(ban.Target, r.rateLimits.IPv6Prefix)
+		if err != nil {
+			r.limiterMu.Unlock()
+			return 0, err
+		}
+		keys[i] = key
+	}
+
+	now := time.Now()
+	var added []string
+	for i, ban := range bans {
+		if !now.Before(ban.Until) {
+			continue
+		}
+		rec, ok := r.bans[keys[i]]
+		if ok && rec.active(now) && !ban.Until.After(rec.until) {
+			continue
+		}
+		if !ok {
+			rec = &banRecord{}
+			r.bans[keys[i]] = rec
+		}
+		rec.reason = ban.Reason
+		rec.until = ban.Until
+		rec.pubkeys = append([]string(nil), ban.PubKeys...)
+		rec.createdAt = ban.CreatedAt
+		if rec.createdAt.IsZero() {
+			rec.createdAt = now
+		}
+		added = append(added, keys[i])
+	}
+	r.limiterMu.Unlock()
+
+	for _, key := range added {
+		if err := r.syncBan(ctx, key); err != nil {
+			return len(added), fmt.Errorf("failed to persist ban: %w", err)
+		}
+	}
+	return len(added), nil
+}
+
+// ExportBans writes the bans in effect to w as a JSON blocklist.
+func (r *Relay) ExportBans(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Bans())
+}
+
+// ImportBans reads a JSON blocklist written by ExportBans and adds its bans
+// (see AddBans).
+func (r *Relay) ImportBans(ctx context.Context, blocklist io.Reader) (int, error) {
+	var bans []Ban
+	if err := json.NewDecoder(blocklist).Decode(&bans); err != nil {
+		return 0, fmt.Errorf("invalid blocklist: %w", err)
+	}
+	return r.AddBans(ctx, bans)
+}
+
+// isIPBanned checks if an IP's network is currently banned. Must be called with limiterMu held.
+func (r *Relay) isIPBanned(ip string) bool {
+	return r.banned(ipRateKey(ip, r.rateLimits.IPv6Prefix), time.Now())
+}
+
+// IsIPBanned checks if an IP is currently banned (thread-safe, for use in ServeHTTP).
+// Bans are not enforced while rate limiting is disabled.
+func (r *Relay) IsIPBanned(ip string) bool {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+	return r.rateLimits.Enabled && r.isIPBanned(ip)
+}
+
+// bannedIPCount returns the number of IP networks whose rate limit ban is in effect
+func (r *Relay) bannedIPCount() int {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+	now := time.Now()
+	count := 0
+	for key, rec := range r.bans {
+		if strings.HasPrefix(key, rateKeyIP) && rec.active(now) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"sort"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/protocol"
+)
+
+// dmKinds are the kinds of direct messages: NIP-04 DMs, NIP-17 seals and chat
+// messages, and NIP-59 gift wraps. They are only served to their recipients.
+var dmKinds = map[int]bool{4: true, 13: true, 14: true, 1059: true}
+
+// dmAuthRequired is the CLOSED reason sent, with an AUTH challenge, to
+// unauthenticated clients asking for direct messages
+const dmAuthRequired = "auth-required: direct messages are only served to their recipients"
+
+// dmReadable reports whether a client authenticated as pubkey (empty if not)
+// may receive an event: direct messages go to their p-tagged recipients and,
+// for kind 4, to their author
+func dmReadable(pubkey string, evt *event.Event) bool {
+	if !dmKinds[evt.Kind] {
+		return true
+	}
+	if pubkey == "" {
+		return false
+	}
+	if evt.Kind == 4 && evt.PubKey == pubkey {
+		return true
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && tag[1] == pubkey {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDMRead returns a CLOSED reason if filters ask for direct messages and
+// the client is not authenticated. Authenticated clients only get the direct
+// messages dmReadable lets through.
+func checkDMRead(c *protocol.Client, filters []*event.Filter) string {
+	if c.IsAuthenticated() || !requestsDMs(filters) {
+		return ""
+	}
+	return dmAuthRequired
+}
+
+// checkDMCount returns a CLOSED reason if COUNT filters ask for direct
+// messages other than the client's own. Counts cannot be filtered event by
+// event, so each filter listing a DM kind must be limited to the client's
+// pubkey in #p or, for kind 4 alone, in authors.
+func checkDMCount(c *protocol.Client, filters []*event.Filter) string {
+	if reason := checkDMRead(c, filters); reason != "" {
+		return reason
+	}
+	pubkey := c.AuthPubKey()
+	for _, f := range filters {
+		if !requestsDMs([]*event.Filter{f}) {
+			continue
+		}
+		if onlyValue(f.Tags["p"], pubkey) {
+			continue
+		}
+		if onlyValue(f.Kinds, 4) && onlyValue(f.Authors, pubkey) {
+			continue
+		}
+		return "restricted: direct messages can only be counted by their recipients"
+	}
+	return ""
+}
+
+// dmCountExclusions returns the direct messages that COUNT filters without
+// kinds match but may not count: each such filter narrowed to the DM kinds,
+// unless it is limited to the client's pubkey in #p. Their count is
+// subtracted, so that kindless counts do not reveal other people's messages.
+func dmCountExclusions(pubkey string, filters []*event.Filter) []*event.Filter {
+	var exclusions []*event.Filter
+	for _, f := range filters {
+		if len(f.Kinds) > 0 || (pubkey != "" && onlyValue(f.Tags["p"], pubkey)) {
+			continue
+		}
+		dms := *f
+		dms.Kinds = make([]int, 0, len(dmKinds))
+		for kind := range dmKinds {
+			dms.Kinds = append(dms.Kinds, kind)
+		}
+		sort.Ints(dms.Kinds)
+		exclusions = append(exclusions, &dms)
+	}
+	return exclusions
+}
+
+// requestsDMs reports whether any filter explicitly lists a direct message kind
+func requestsDMs(filters []*event.Filter) bool {
+	for _, f := range filters {
+		for _, kind := range f.Kinds {
+			if dmKinds[kind] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onlyValue reports whether values is not empty and holds nothing but v
+func onlyValue[T comparable](values []T, v T) bool {
+	for _, value := range values {
+		if value != v {
+			return false
+		}
+	}
+	return len(values) > 0
+}
@@ -0,0 +1,408 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/nips/nip29"
+	"github.com/paul/glienicke/pkg/protocol"
+	"github.com/paul/glienicke/pkg/storage"
+)
+
+// groupsKeySetting is the management setting holding the generated relay key
+const groupsKeySetting = "groups_secret_key"
+
+var groupsLogger = logging.For("nip29")
+
+// groupState hosts NIP-29 relay-based groups
+type groupState struct {
+	mu        sync.RWMutex
+	groups    *nip29.Groups
+	secretKey string
+	pubKey    string
+	published map[string]publishedEvent // relay events in effect by relayEventKey
+}
+
+// publishedEvent is a relay event in effect, replaced by the next of its kind
+type publishedEvent struct {
+	id        string
+	group     string
+	createdAt int64 // later relay events of the kind get a later created_at
+}
+
+// relayEventKey identifies a relay event by kind and group
+func relayEventKey(kind int, group string) string {
+	return fmt.Sprintf("%d:%s", kind, group)
+}
+
+// EnableGroups hosts NIP-29 relay-based groups, publishing their state as
+// events signed by secretKey (hex). Without a key, one is generated and kept
+// in the store's management settings, so that the relay's identity survives
+// restarts. Group state is rebuilt from the stored moderation events. Call
+// it before the relay starts serving.
+func (r *Relay) EnableGroups(ctx context.Context, secretKey string) error {
+	if secretKey == "" {
+		var err error
+		if secretKey, err = r.groupsKey(ctx); err != nil {
+			return err
+		}
+	}
+	if !nostr.IsValid32ByteHex(secretKey) {
+		return fmt.Errorf("relay secret key must be 64 hex characters")
+	}
+	pubKey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return fmt.Errorf("invalid relay secret key: %w", err)
+	}
+
+	g := &groupState{
+		groups:    nip29.NewGroups(),
+		secretKey: secretKey,
+		pubKey:    pubKey,
+		published: make(map[string]publishedEvent),
+	}
+	if err := r.loadGroups(ctx, g); err != nil {
+		return err
+	}
+	r.groups = g
+	groupsLogger.Info("NIP-29 groups enabled", "relay_pubkey", pubKey, "groups", len(g.groups.IDs()))
+	return nil
+}
+
+// GroupsPubKey returns the pubkey signing group state, or "" if groups are disabled.
+func (r *Relay) GroupsPubKey() string {
+	if r.groups == nil {
+		return ""
+	}
+	return r.groups.pubKey
+}
+
+// groupsKey returns the relay key kept in the store, generating it on first use
+func (r *Relay) groupsKey(ctx context.Context) (string, error) {
+	ms, ok := r.store.(storage.ManagementStore)
+	if !ok {
+		groupsLogger.Warn("store cannot keep the relay key; group state is signed with a new key on every start")
+		return nostr.GeneratePrivateKey(), nil
+	}
+	key, err := ms.GetSetting(ctx, groupsKeySetting)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return "", fmt.Errorf("failed to load relay key: %w", err)
+	}
+	key = nostr.GeneratePrivateKey()
+	if err := ms.SetSetting(ctx, groupsKeySetting, key); err != nil {
+		return "", fmt.Errorf("failed to save relay key: %w", err)
+	}
+	return key, nil
+}
+
+// loadGroups replays the stored moderation events, join and leave requests,
+// fills in the recent timelines and republishes the state of every group
+func (r *Relay) loadGroups(ctx context.Context, g *groupState) error {
+	events, err := r.store.QueryEvents(ctx, []*event.Filter{{Kinds: nip29.StateKinds}})
+	if err != nil {
+		return fmt.Errorf("failed to load group events: %w", err)
+	}
+	// Replay oldest first; a group's creation goes before anything else of
+	// the same second
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt < b.CreatedAt
+		}
+		if (a.Kind == nip29.KindCreateGroup) != (b.Kind == nip29.KindCreateGroup) {
+			return a.Kind == nip29.KindCreateGroup
+		}
+		return a.ID < b.ID
+	})
+	for _, evt := range events {
+		if nip29.GroupID(evt) != "" {
+			g.groups.Apply(evt)
+		}
+	}
+
+	limit := nip29.TimelineSize
+	for _, id := range g.groups.IDs() {
+		recent, err := r.store.QueryEvents(ctx, []*event.Filter{{Tags: map[string][]string{"h": {id}}, Limit: &limit}})
+		if err != nil {
+			return fmt.Errorf("failed to load timeline of group %s: %w", id, err)
+		}
+		for i := len(recent) - 1; i >= 0; i-- {
+			g.groups.Observe(recent[i])
+		}
+	}
+
+	// Relay events of earlier runs may be signed by another key or describe
+	// deleted groups: keep the newest of each kind and group to be replaced
+	// below, and delete the rest
+	old, err := r.store.QueryEvents(ctx, []*event.Filter{{Kinds: nip29.RelayKinds}})
+	if err != nil {
+		return fmt.Errorf("failed to load group relay events: %w", err)
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i].CreatedAt < old[j].CreatedAt })
+	var stale []string
+	for _, evt := range old {
+		group := tagValue(evt, "d")
+		key := relayEventKey(evt.Kind, group)
+		if prev, ok := g.published[key]; ok {
+			stale = append(stale, prev.id)
+		}
+		g.published[key] = publishedEvent{id: evt.ID, group: group, createdAt: evt.CreatedAt}
+	}
+	for key, p := range g.published {
+		if g.groups.Get(p.group) == nil {
+			stale = append(stale, p.id)
+			delete(g.published, key)
+		}
+	}
+	for _, id := range stale {
+		r.deleteGroupRelayEvent(ctx, id)
+	}
+
+	// Republish the state of every group with the current key
+	for _, id := range g.groups.IDs() {
+		for _, evt := range r.groupRelayEvents(g, id, nip29.RelayKinds) {
+			r.saveGroupRelayEvent(ctx, g, evt)
+		}
+	}
+	return nil
+}
+
+// handleGroupEvent enforces group membership on events with an "h" tag and
+// handles moderation events, join and leave requests completely. It reports
+// whether the event was handled; other events continue through HandleEvent
+// and are added to their group's timeline by observeGroupEvent once stored.
+func (r *Relay) handleGroupEvent(ctx context.Context, c *protocol.Client, evt *event.Event) bool {
+	g := r.groups
+	if nip29.GroupID(evt) == "" && !nip29.ChangesState(evt) && !nip29.IsRelayEvent(evt) {
+		return false
+	}
+
+	if !nip29.ChangesState(evt) {
+		g.mu.RLock()
+		reason := g.groups.Check(evt, time.Now().Unix())
+		g.mu.RUnlock()
+		if reason != "" {
+			r.sendOK(c, evt, false, reason)
+			return true
+		}
+		return false
+	}
+
+	// State changes are checked, stored and applied in one step so that
+	// concurrent moderation events see each other's effects
+	g.mu.Lock()
+	if reason := g.groups.Check(evt, time.Now().Unix()); reason != "" {
+		g.mu.Unlock()
+		r.sendOK(c, evt, false, reason)
+		return true
+	}
+	if existing, err := r.store.GetEvent(ctx, evt.ID); err == nil && existing != nil {
+		g.mu.Unlock()
+		r.sendOK(c, evt, true, "duplicate: event already exists")
+		return true
+	}
+	if err := r.store.SaveEvent(ctx, evt); err != nil {
+		g.mu.Unlock()
+		r.sendOK(c, evt, false, fmt.Sprintf("error: failed to save event: %v", err))
+		return true
+	}
+	id := nip29.GroupID(evt)
+	changed := g.groups.Apply(evt)
+	g.groups.Observe(evt)
+	relayEvents := r.groupRelayEvents(g, id, changed)
+	g.mu.Unlock()
+
+	r.sendOK(c, evt, true, "")
+	r.broadcastEvent(evt)
+	clientLog(c).Info("group state changed", "group", id, logging.KeyKind, evt.Kind, logging.KeyEventID, evt.ID)
+
+	switch evt.Kind {
+	case nip29.KindDeleteEvent:
+		r.deleteGroupEvents(ctx, evt, tagValues(evt, "e"))
+	case nip29.KindDeleteGroup:
+		r.deleteGroup(ctx, g, evt, id)
+	}
+	for _, relayEvt := range relayEvents {
+		r.saveGroupRelayEvent(ctx, g, relayEvt)
+		r.broadcastEvent(relayEvt)
+	}
+	return true
+}
+
+// observeGroupEvent adds a stored event to its group's timeline
+func (r *Relay) observeGroupEvent(evt *event.Event) {
+	if g := r.groups; g != nil && nip29.GroupID(evt) != "" {
+		g.mu.Lock()
+		g.groups.Observe(evt)
+		g.mu.Unlock()
+	}
+}
+
+// groupReadable reports whether a client may receive an event; events of
+// private groups are only served to authenticated members
+func (r *Relay) groupReadable(c *protocol.Client, evt *event.Event) bool {
+	g := r.groups
+	if g == nil || nip29.GroupID(evt) == "" {
+		return true
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.groups.CanRead(c.AuthPubKey(), evt)
+}
+
+// checkGroupRead returns a CLOSED reason if filters ask for a private group
+// the client is not an authenticated member of
+func (r *Relay) checkGroupRead(c *protocol.Client, filters []*event.Filter) string {
+	g := r.groups
+	if g == nil {
+		return ""
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, f := range filters {
+		for _, id := range f.Tags["h"] {
+			if reason := g.groups.CheckRead(c.AuthPubKey(), id); reason != "" {
+				return reason
+			}
+		}
+	}
+	return ""
+}
+
+// groupRelayEvents builds and signs the relay events of a group. Callers hold g.mu.
+func (r *Relay) groupRelayEvents(g *groupState, id string, kinds []int) []*event.Event {
+	group := g.groups.Get(id)
+	if group == nil {
+		return nil
+	}
+	now := time.Now().Unix()
+	var events []*event.Event
+	for _, kind := range kinds {
+		// Each relay event must be newer than the one it replaces
+		key := relayEventKey(kind, id)
+		p := g.published[key]
+		p.group, p.createdAt = id, max(now, p.createdAt+1)
+		g.published[key] = p
+
+		evt := nip29.RelayEvent(group, kind, p.createdAt)
+		ne := convertLocalEventToNostrEvent(evt)
+		if err := ne.Sign(g.secretKey); err != nil {
+			groupsLogger.Error("failed to sign group relay event", "group", id, logging.KeyKind, kind, logging.KeyError, err)
+			continue
+		}
+		evt.ID, evt.PubKey, evt.Sig = ne.ID, ne.PubKey, ne.Sig
+		events = append(events, evt)
+	}
+	return events
+}
+
+// saveGroupRelayEvent stores a relay event, deleting the one it replaces.
+// Neither store replaces addressable events by itself.
+func (r *Relay) saveGroupRelayEvent(ctx context.Context, g *groupState, evt *event.Event) {
+	if err := r.store.SaveEvent(ctx, evt); err != nil {
+		groupsLogger.Error("failed to save group relay event", logging.KeyEventID, evt.ID, logging.KeyKind, evt.Kind, logging.KeyError, err)
+		return
+	}
+	key := relayEventKey(evt.Kind, tagValue(evt, "d"))
+	g.mu.Lock()
+	p := g.published[key]
+	previous := p.id
+	if evt.CreatedAt >= p.createdAt {
+		p.id, p.createdAt = evt.ID, evt.CreatedAt
+		g.published[key] = p
+	}
+	g.mu.Unlock()
+	if previous != "" && previous != evt.ID {
+		r.deleteGroupRelayEvent(ctx, previous)
+	}
+}
+
+// deleteGroupRelayEvent deletes a stored relay event, whichever key signed it
+func (r *Relay) deleteGroupRelayEvent(ctx context.Context, id string) {
+	evt, err := r.store.GetEvent(ctx, id)
+	if err != nil || evt == nil {
+		return
+	}
+	if err := r.store.DeleteEvent(ctx, id, evt.PubKey); err != nil {
+		groupsLogger.Warn("failed to delete group relay event", logging.KeyEventID, id, logging.KeyError, err)
+	}
+}
+
+// deleteGroupEvents deletes the events a delete-event names from the
+// moderator's group
+func (r *Relay) deleteGroupEvents(ctx context.Context, moderation *event.Event, ids []string) {
+	id := nip29.GroupID(moderation)
+	for _, eventID := range ids {
+		target, err := r.store.GetEvent(ctx, eventID)
+		if err != nil || target == nil || nip29.GroupID(target) != id {
+			continue
+		}
+		if err := r.store.DeleteEvent(ctx, target.ID, target.PubKey); err != nil {
+			groupsLogger.Warn("failed to delete group event", "group", id, logging.KeyEventID, eventID, logging.KeyError, err)
+		}
+	}
+}
+
+// deleteGroup deletes the events and relay events of a deleted group. The
+// moderation events are kept, so that the deletion survives a restart.
+func (r *Relay) deleteGroup(ctx context.Context, g *groupState, moderation *event.Event, id string) {
+	events, err := r.store.QueryEvents(ctx, []*event.Filter{{Tags: map[string][]string{"h": {id}}}})
+	if err != nil {
+		groupsLogger.Error("failed to query events of deleted group", "group", id, logging.KeyError, err)
+	}
+	for _, evt := range events {
+		if nip29.ChangesState(evt) {
+			continue
+		}
+		if err := r.store.DeleteEvent(ctx, evt.ID, evt.PubKey); err != nil {
+			groupsLogger.Warn("failed to delete group event", "group", id, logging.KeyEventID, evt.ID, logging.KeyError, err)
+		}
+	}
+
+	g.mu.Lock()
+	var relayEvents []string
+	for _, kind := range nip29.RelayKinds {
+		key := relayEventKey(kind, id)
+		if p := g.published[key]; p.id != "" {
+			relayEvents = append(relayEvents, p.id)
+		}
+		delete(g.published, key)
+	}
+	g.mu.Unlock()
+	for _, eventID := range relayEvents {
+		r.deleteGroupRelayEvent(ctx, eventID)
+	}
+	groupsLogger.Info("group deleted", "group", id, "by", moderation.PubKey, "events", len(events))
+}
+
+// tagValue returns the value of the first tag with the given name
+func tagValue(evt *event.Event, name string) string {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// tagValues returns the values of all tags with the given name
+func tagValues(evt *event.Event, name string) []string {
+	var values []string
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			values = append(values, tag[1])
+		}
+	}
+	return values
+}
@@ -0,0 +1,539 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paul/glienicke/pkg/nips/nip98"
+	"github.com/paul/glienicke/pkg/protocol"
+)
+
+// The HTTP API lets clients that cannot speak WebSocket publish, query, count
+// and stream events. Every request is run as protocol messages on a detached
+// client, so it goes through the same validation, auth, rate limiting, cost
+// budgets and broadcast path as a WebSocket connection.
+
+const (
+	// maxAPIBodySize limits the body of HTTP API requests
+	maxAPIBodySize = 512 * 1024
+
+	// apiSubID is the subscription ID used for HTTP API queries
+	apiSubID = "http"
+
+	// sseKeepAlive is how often an idle event stream sends a comment line
+	sseKeepAlive = 30 * time.Second
+)
+
+// apiAuth returns the authenticator of HTTP API requests: NIP-98 if an
+// Authorization header is present; whether a pubkey is required is decided
+// per request
+func (r *Relay) apiAuth() *nip98.Authenticator {
+	return &nip98.Authenticator{
+		Optional:     true,
+		MaxBodySize:  maxAPIBodySize,
+		TrustedProxy: r.isTrustedProxy,
+		OnError: func(w http.ResponseWriter, req *http.Request, status int, err error) {
+			writeAPIError(w, status, fmt.Sprintf("auth-required: %v", err))
+		},
+	}
+}
+
+// apiOKResponse is the HTTP form of an OK message
+type apiOKResponse struct {
+	ID       string `json:"id"`
+	Accepted bool   `json:"accepted"`
+	Message  string `json:"message"`
+}
+
+// handleAPIEvent publishes an event: POST /api/event with the event as body
+func (r *Relay) handleAPIEvent(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid: method not allowed")
+		return
+	}
+	body, ok := readAPIBody(w, req)
+	if !ok {
+		return
+	}
+	if !json.Valid(body) {
+		writeAPIError(w, http.StatusBadRequest, "invalid: malformed event")
+		return
+	}
+
+	c, ok := r.newAPIClient(w, req)
+	if !ok {
+		return
+	}
+	defer r.closeAPIClient(c)
+
+	msg, _ := json.Marshal([]interface{}{protocol.MessageTypeEvent, json.RawMessage(body)})
+	if err := c.HandleMessage(req.Context(), msg); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid: %v", err))
+		return
+	}
+
+	// EVENT is handled synchronously; the first reply answers it
+	select {
+	case data := <-c.Messages():
+		typ, raw := decodeAPIMessage(data)
+		switch typ {
+		case protocol.MessageTypeOK:
+			var resp apiOKResponse
+			if len(raw) >= 4 {
+				json.Unmarshal(raw[1], &resp.ID)
+				json.Unmarshal(raw[2], &resp.Accepted)
+				json.Unmarshal(raw[3], &resp.Message)
+			}
+			status := http.StatusOK
+			if !resp.Accepted {
+				status = apiStatus(resp.Message)
+			}
+			writeAPIJSON(w, status, resp)
+		default:
+			reason := apiReason(raw)
+			writeAPIError(w, apiStatus(reason), reason)
+		}
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "error: no response for event")
+	}
+}
+
+// handleAPIQuery returns stored events matching the filters in the body, as a
+// JSON array or, with "Accept: application/x-ndjson" or ?format=ndjson, as
+// newline-delimited JSON streamed while the query runs
+func (r *Relay) handleAPIQuery(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid: method not allowed")
+		return
+	}
+	body, ok := readAPIBody(w, req)
+	if !ok {
+		return
+	}
+	filters, err := parseAPIFilters(body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid: %v", err))
+		return
+	}
+
+	c, ok := r.newAPIClient(w, req)
+	if !ok {
+		return
+	}
+	defer r.closeAPIClient(c)
+
+	msg, _ := json.Marshal(append([]interface{}{protocol.MessageTypeReq, apiSubID}, filters...))
+	if err := c.HandleMessage(req.Context(), msg); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid: %v", err))
+		return
+	}
+
+	ndjson := wantsNDJSON(req)
+	flusher, _ := w.(http.Flusher)
+	started := false
+	start := func() {
+		started = true
+		if ndjson {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("["))
+	}
+
+	written := 0
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case data := <-c.Messages():
+			typ, raw := decodeAPIMessage(data)
+			switch typ {
+			case protocol.MessageTypeEvent:
+				if len(raw) < 3 {
+					continue
+				}
+				if !started {
+					start()
+				}
+				if ndjson {
+					w.Write(raw[2])
+					w.Write([]byte("\n"))
+					if flusher != nil {
+						flusher.Flush()
+					}
+				} else {
+					if written > 0 {
+						w.Write([]byte(","))
+					}
+					w.Write(raw[2])
+				}
+				written++
+
+			case protocol.MessageTypeEOSE:
+				if !started {
+					start()
+				}
+				if !ndjson {
+					w.Write([]byte("]\n"))
+				}
+				return
+
+			case protocol.MessageTypeClosed, protocol.MessageTypeNotice:
+				reason := apiReason(raw)
+				if !started {
+					writeAPIError(w, apiStatus(reason), reason)
+					return
+				}
+				// Headers are already sent; end the partial result
+				clientLog(c).Warn("HTTP API query ended early", "reason", reason)
+				if !ndjson {
+					w.Write([]byte("]\n"))
+				}
+				return
+			}
+		}
+	}
+}
+
+// handleAPICount counts events matching the filters in the body (NIP-45)
+func (r *Relay) handleAPICount(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid: method not allowed")
+		return
+	}
+	body, ok := readAPIBody(w, req)
+	if !ok {
+		return
+	}
+	filters, err := parseAPIFilters(body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid: %v", err))
+		return
+	}
+
+	c, ok := r.newAPIClient(w, req)
+	if !ok {
+		return
+	}
+	defer r.closeAPIClient(c)
+
+	msg, _ := json.Marshal(append([]interface{}{protocol.MessageTypeCount, apiSubID}, filters...))
+	if err := c.HandleMessage(req.Context(), msg); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid: %v", err))
+		return
+	}
+
+	select {
+	case <-req.Context().Done():
+	case data := <-c.Messages():
+		typ, raw := decodeAPIMessage(data)
+		if typ == protocol.MessageTypeCount && len(raw) >= 3 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(raw[2])
+			w.Write([]byte("\n"))
+			return
+		}
+		reason := apiReason(raw)
+		writeAPIError(w, apiStatus(reason), reason)
+	}
+}
+
+// handleAPIStream streams events matching the filters given in one or more
+// "filter" query parameters as Server-Sent Events: stored events, an "eose"
+// event, then live events delivered through the broadcast path
+func (r *Relay) handleAPIStream(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid: method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "error: streaming not supported")
+		return
+	}
+
+	var filters []interface{}
+	for _, param := range req.URL.Query()["filter"] {
+		parsed, err := parseAPIFilters([]byte(param))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid: %v", err))
+			return
+		}
+		filters = append(filters, parsed...)
+	}
+	if len(filters) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid: missing filter parameter")
+		return
+	}
+
+	c, ok := r.newAPIClient(w, req)
+	if !ok {
+		return
+	}
+
+	// Streams are long-lived like WebSocket connections and count towards the same limits
+	release, reason, retryAfter := r.acquireConnection(c.RemoteAddr())
+	if release == nil {
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		writeAPIError(w, http.StatusTooManyRequests, reason)
+		return
+	}
+	defer release()
+
+	// Streams stay open beyond the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// Register like a WebSocket client so the stream is counted and closed with the relay
+	if !r.addClient(c) {
+		writeAPIError(w, http.StatusServiceUnavailable, "error: "+protocol.ShutdownNotice)
+		return
+	}
+	defer r.removeClient(c)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-runDone
+		r.subs.RemoveClient(c)
+	}()
+
+	msg, _ := json.Marshal(append([]interface{}{protocol.MessageTypeReq, apiSubID}, filters...))
+	if err := c.HandleMessage(ctx, msg); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid: %v", err))
+		return
+	}
+
+	started := false
+	start := func() {
+		started = true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.Done():
+			// Closed by the relay, e.g. on shutdown or as a slow consumer
+			if started {
+				fmt.Fprint(w, "event: closed\ndata: \"error: connection closed\"\n\n")
+				flusher.Flush()
+			}
+			return
+		case <-keepAlive.C:
+			if started {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+		case data := <-c.Messages():
+			typ, raw := decodeAPIMessage(data)
+			switch typ {
+			case protocol.MessageTypeEvent:
+				if len(raw) < 3 {
+					continue
+				}
+				if !started {
+					start()
+				}
+				var id struct {
+					ID string `json:"id"`
+				}
+				json.Unmarshal(raw[2], &id)
+				fmt.Fprintf(w, "id: %s\ndata: %s\n\n", id.ID, raw[2])
+				flusher.Flush()
+
+			case protocol.MessageTypeEOSE:
+				if !started {
+					start()
+				}
+				fmt.Fprint(w, "event: eose\ndata: {}\n\n")
+				flusher.Flush()
+				// Without a live subscription there is nothing more to stream
+				if r.closeAfterEOSE {
+					return
+				}
+
+			case protocol.MessageTypeClosed, protocol.MessageTypeNotice:
+				reason := apiReason(raw)
+				if !started {
+					writeAPIError(w, apiStatus(reason), reason)
+					return
+				}
+				quoted, _ := json.Marshal(reason)
+				fmt.Fprintf(w, "event: closed\ndata: %s\n\n", quoted)
+				flusher.Flush()
+				return
+			}
+		}
+	}
+}
+
+// newAPIClient applies the connection policy to an HTTP API request and
+// returns a detached client to run it on. If the request is rejected the
+// response has been written and ok is false.
+func (r *Relay) newAPIClient(w http.ResponseWriter, req *http.Request) (c *protocol.Client, ok bool) {
+	ip := r.requestIP(req)
+
+	// NIP-86: Reject blocked IPs
+	if r.mgmt.isIPBlocked(ip) {
+		writeAPIError(w, http.StatusForbidden, "blocked: IP address is blocked")
+		return nil, false
+	}
+	if reason := r.acl.checkConnection(ip); reason != "" {
+		writeAPIError(w, http.StatusForbidden, reason)
+		return nil, false
+	}
+	if r.IsIPBanned(ip) {
+		writeAPIError(w, http.StatusForbidden, "banned: too many rate limit violations")
+		return nil, false
+	}
+
+	// NIP-98 takes the place of NIP-42 for HTTP clients
+	pubkey, _ := nip98.PubKeyFromContext(req.Context())
+	if r.requireAuth && pubkey == "" {
+		w.Header().Set("WWW-Authenticate", "Nostr")
+		writeAPIError(w, http.StatusUnauthorized, "auth-required: this relay requires NIP-98 authentication")
+		return nil, false
+	}
+
+	c = protocol.NewDetachedClient(r, ip)
+	c.SetMessageObserver(r.observeMessage)
+	c.SetRateLimit(r.checkRate)
+	c.SetMaxEventSize(r.maxEventSize())
+	c.SetQueryTimeout(r.queryTimeout)
+	if pubkey != "" {
+		c.Authenticate(pubkey)
+	}
+	return c, true
+}
+
+// closeAPIClient closes a detached client once its request is done
+func (r *Relay) closeAPIClient(c *protocol.Client) {
+	c.Close()
+	c.Wait()
+	r.subs.RemoveClient(c)
+}
+
+// readAPIBody reads a size-limited request body, writing an error response on failure
+func readAPIBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxAPIBodySize+1))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid: failed to read request body")
+		return nil, false
+	}
+	if len(body) > maxAPIBodySize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "invalid: request body too large")
+		return nil, false
+	}
+	return body, true
+}
+
+// parseAPIFilters accepts a single filter object or an array of filters
+func parseAPIFilters(data []byte) ([]interface{}, error) {
+	data = bytes.TrimSpace(data)
+	var raw []json.RawMessage
+	switch {
+	case len(data) > 0 && data[0] == '{':
+		raw = []json.RawMessage{data}
+	case len(data) > 0 && data[0] == '[':
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("malformed filters: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("expected a filter object or an array of filters")
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no filters provided")
+	}
+
+	filters := make([]interface{}, 0, len(raw))
+	for _, f := range raw {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(f, &obj); err != nil {
+			return nil, fmt.Errorf("malformed filter: %w", err)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// wantsNDJSON reports whether a query asked for newline-delimited JSON
+func wantsNDJSON(req *http.Request) bool {
+	if req.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	return strings.Contains(req.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// decodeAPIMessage splits an encoded protocol message into its type and elements
+func decodeAPIMessage(data []byte) (protocol.MessageType, []json.RawMessage) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil || len(raw) == 0 {
+		return "", nil
+	}
+	var typ string
+	json.Unmarshal(raw[0], &typ)
+	return protocol.MessageType(typ), raw
+}
+
+// apiReason returns the human-readable reason of a CLOSED or NOTICE message
+func apiReason(raw []json.RawMessage) string {
+	if len(raw) == 0 {
+		return "error: unexpected response"
+	}
+	var reason string
+	json.Unmarshal(raw[len(raw)-1], &reason)
+	return reason
+}
+
+// apiStatus maps the machine-readable prefix of a rejection to an HTTP status
+func apiStatus(reason string) int {
+	if reason == "error: timeout" {
+		return http.StatusGatewayTimeout
+	}
+	prefix, _, _ := strings.Cut(reason, ":")
+	switch prefix {
+	case "auth-required":
+		return http.StatusUnauthorized
+	case "blocked", "restricted", "banned":
+		return http.StatusForbidden
+	case "rate-limited":
+		return http.StatusTooManyRequests
+	case "error":
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"context"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/nips/nip59"
+	"github.com/paul/glienicke/pkg/protocol"
+)
+
+// kindDMRelayList is the NIP-17 list of relays a user receives direct messages on
+const kindDMRelayList = 10050
+
+// giftWrapTimestampSlack is how far NIP-59 lets gift wraps backdate their
+// created_at to hide when they were sent
+const giftWrapTimestampSlack = 2 * 24 * 60 * 60
+
+// inboxAuthRequired is the OK reason sent, with an AUTH challenge, to
+// unauthenticated clients publishing metadata of a pubkey that is not a user
+const inboxAuthRequired = "auth-required: authenticate as the author to register with this relay"
+
+// inboxMetadataKinds are accepted in inbox mode besides gift wraps: what
+// senders look up to reach a user (profile, relay lists, DM relay list)
+var inboxMetadataKinds = map[int]bool{0: true, 10002: true, kindDMRelayList: true}
+
+// retentionSweepExemptKinds are kept by the retention sweep: retentionExemptKinds
+// and gift wraps, which expireGiftWraps deletes
+var retentionSweepExemptKinds = append(append([]int(nil), retentionExemptKinds...), nip59.GiftWrapKind)
+
+// SetInboxMode makes the relay a NIP-17 DM inbox. It then only accepts gift
+// wraps addressed to its users, and their profile, relay list and DM relay
+// list. Users register by publishing a kind 10050 DM relay list while
+// authenticated; authenticated connections also count as users. Call it
+// before the relay starts serving.
+func (r *Relay) SetInboxMode(enabled bool) {
+	r.inboxMode = enabled
+}
+
+// SetGiftWrapRetentionDays sets how many days gift wraps are kept after they
+// were sent. 0 uses the retention period of other events.
+func (r *Relay) SetGiftWrapRetentionDays(days int) {
+	r.giftWrapRetentionDays.Store(int64(days))
+}
+
+// giftWrapRetention returns the retention period of gift wraps in days (0 = keep forever)
+func (r *Relay) giftWrapRetention() int {
+	if days := r.giftWrapRetentionDays.Load(); days > 0 {
+		return int(days)
+	}
+	return int(r.retentionDays.Load())
+}
+
+// checkInboxWrite returns the reason an event is rejected in inbox mode, or
+// "" if it is accepted
+func (r *Relay) checkInboxWrite(ctx context.Context, c *protocol.Client, evt *event.Event) string {
+	if !r.inboxMode {
+		return ""
+	}
+	switch {
+	case evt.Kind == nip59.GiftWrapKind:
+		recipients := tagValues(evt, "p")
+		if len(recipients) == 0 {
+			return "invalid: gift wraps must be addressed with a p tag"
+		}
+		for _, pubkey := range recipients {
+			if r.isInboxUser(ctx, pubkey) {
+				return ""
+			}
+		}
+		return "restricted: recipient is not a user of this relay"
+	case inboxMetadataKinds[evt.Kind]:
+		if c.AuthPubKey() == evt.PubKey || r.isInboxUser(ctx, evt.PubKey) {
+			return ""
+		}
+		if !c.IsAuthenticated() {
+			return inboxAuthRequired
+		}
+		return "restricted: only users of this relay may publish their metadata"
+	}
+	return "blocked: this relay only accepts direct messages for its users"
+}
+
+// isInboxUser reports whether pubkey has registered with a DM relay list or
+// is authenticated on a connection
+func (r *Relay) isInboxUser(ctx context.Context, pubkey string) bool {
+	limit := 1
+	events, err := r.store.QueryEvents(ctx, []*event.Filter{{
+		Authors: []string{pubkey},
+		Kinds:   []int{kindDMRelayList},
+		Limit:   &limit,
+	}})
+	if err != nil {
+		logger.Error("inbox: failed to look up DM relay list", logging.KeyPubKey, pubkey, logging.KeyError, err)
+	}
+	if len(events) > 0 {
+		return true
+	}
+
+	r.clientsMu.RLock()
+	defer r.clientsMu.RUnlock()
+	for c := range r.clients {
+		if c.AuthPubKey() == pubkey {
+			return true
+		}
+	}
+	return false
+}
+
+// expireGiftWraps deletes the gift wraps sent more than the gift wrap
+// retention period ago. Their created_at may be up to two days earlier than
+// when they were sent, so only wraps older than that are deleted.
+func (r *Relay) expireGiftWraps(ctx context.Context) (int, error) {
+	days := r.giftWrapRetention()
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Unix() - int64(days*86400) - giftWrapTimestampSlack
+	return r.store.DeleteKindsOlderThan(ctx, []int{nip59.GiftWrapKind}, cutoff)
+}
@@ -0,0 +1,54 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGiftWrapRetention(t *testing.T) {
+	store := memory.New()
+	r := New(store)
+	t.Cleanup(func() { r.Close() })
+	r.SetRetentionDays(30)
+	r.SetGiftWrapRetentionDays(7)
+
+	ctx := context.Background()
+	kp := testutil.MustGenerateKeyPair()
+	day := int64(24 * 60 * 60)
+	now := time.Now().Unix()
+	save := func(kind int, age int64) *event.Event {
+		evt := &event.Event{Kind: kind, CreatedAt: now - age, Tags: [][]string{{"p", kp.PubKeyHex}}}
+		require.NoError(t, kp.SignEvent(evt))
+		require.NoError(t, store.SaveEvent(ctx, evt))
+		return evt
+	}
+
+	// A wrap backdated within NIP-59's two days may have been sent just now
+	recent := save(1059, 8*day)
+	expired := save(1059, 10*day)
+	note := save(1, 10*day)
+	old := save(1, 31*day)
+
+	r.runRetention()
+
+	events, err := store.QueryEvents(ctx, []*event.Filter{{}})
+	require.NoError(t, err)
+	var ids []string
+	for _, evt := range events {
+		ids = append(ids, evt.ID)
+	}
+	assert.ElementsMatch(t, []string{recent.ID, note.ID}, ids)
+	assert.NotContains(t, ids, expired.ID)
+	assert.NotContains(t, ids, old.ID)
+
+	// Without their own period, wraps follow the general retention
+	r.SetGiftWrapRetentionDays(0)
+	assert.Equal(t, 30, r.giftWrapRetention())
+}
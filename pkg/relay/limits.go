@@ -0,0 +1,252 @@
+package relay
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Features toggles optional protocol modules; all are enabled by default.
+type Features struct {
+	NIP11 bool // serve the relay information document
+	NIP28 bool // public chat channels
+	NIP42 bool // AUTH; required by SetRequireAuth
+}
+
+// SetFeatures enables or disables optional protocol modules. Call it before
+// the relay starts serving.
+func (r *Relay) SetFeatures(features Features) {
+	r.features = features
+}
+
+// RateLimits configures rate limiting and connection limits. Anonymous
+// clients are limited per IP, with IPv6 addresses aggregated to a network;
+// NIP-42/NIP-98 authenticated clients are limited per pubkey at the
+// Authenticated or Trusted rates. Zero values take the defaults noted.
+type RateLimits struct {
+	Enabled        bool            // enforce message rates and bans
+	EventsPerSec   float64         // sustained EVENT/AUTH rate per IP (0 = 10)
+	ReqPerSec      float64         // sustained REQ rate per IP (0 = 10)
+	CountPerSec    float64         // sustained COUNT rate per IP (0 = ReqPerSec)
+	Burst          float64         // bucket size in seconds of the sustained rate (0 = 2)
+	Authenticated  MessageRates    // rates per authenticated pubkey; zero rates are the per-IP rates
+	Trusted        MessageRates    // rates per TrustedPubKeys pubkey; zero rates are unlimited
+	TrustedPubKeys []string        // hex pubkeys of the trusted tier
+	KindsPerSec    map[int]float64 // sustained EVENT rate per kind and client; trusted pubkeys are exempt
+	IPv6Prefix     int             // prefix length IPv6 clients are aggregated to (0 = 64)
+	Escalation     Escalation      // what repeated violations lead to
+	MaxEventSize   int             // maximum size of an event in bytes (0 = unlimited)
+
+	// Connection limits are checked before the WebSocket upgrade and
+	// answered with HTTP 429 and Retry-After. The caps apply whether or not
+	// rate limiting is enabled; ConnectionsPerSec only when it is.
+	MaxConnections           int     // concurrent WebSocket connections per IP (0 = unlimited)
+	MaxConnectionsPerNetwork int     // concurrent WebSocket connections per IPv4 address or IPv6 network (0 = unlimited)
+	MaxTotalConnections      int     // concurrent WebSocket connections in total (0 = unlimited)
+	ConnectionsPerSec        float64 // sustained rate of new connections per IP network (0 = unlimited)
+
+	// Limiter state is kept per IP network and pubkey. The least recently
+	// seen clients are forgotten beyond MaxTrackedClients, and any client
+	// after IdleTimeout; bans are kept regardless.
+	MaxTrackedClients int           // clients with limiter state (0 = 100000)
+	IdleTimeout       time.Duration // limiter state of idle clients is dropped (0 = 10m)
+}
+
+// MessageRates are sustained per-second rates by message type.
+type MessageRates struct {
+	Events float64 // EVENT and AUTH
+	Reqs   float64 // REQ
+	Counts float64 // COUNT
+}
+
+// Escalation turns repeated rate limit violations into bans: Violations
+// within Window lead to a temporary ban, and a temporary ban after
+// LongBanAfter earlier ones to a long ban. Zero values take the defaults noted.
+type Escalation struct {
+	Violations      int           // violations that lead to a temporary ban (0 = 10)
+	Window          time.Duration // violations further apart than this start over (0 = 1m)
+	BanDuration     time.Duration // temporary ban (0 = 10m)
+	LongBanAfter    int           // temporary bans before a long ban (0 = 3)
+	LongBanDuration time.Duration // long ban (0 = 24h)
+}
+
+// Rate limit defaults
+const (
+	defaultMessageRate     = 10
+	defaultRateBurst       = 2
+	defaultIPv6Prefix      = 64
+	defaultBanViolations   = 10
+	defaultViolationWindow = time.Minute
+	defaultBanDuration     = 10 * time.Minute
+	defaultLongBanAfter    = 3
+	defaultLongBanDuration = 24 * time.Hour
+	defaultMaxTracked      = 100000
+	defaultLimiterIdle     = 10 * time.Minute
+	connectionRetryAfter   = 10 * time.Second // Retry-After for connections over a cap
+)
+
+func defaultRateLimits(enabled bool) RateLimits {
+	return RateLimits{Enabled: enabled}.withDefaults()
+}
+
+// withDefaults fills in zero values
+func (l RateLimits) withDefaults() RateLimits {
+	if l.EventsPerSec <= 0 {
+		l.EventsPerSec = defaultMessageRate
+	}
+	if l.ReqPerSec <= 0 {
+		l.ReqPerSec = defaultMessageRate
+	}
+	if l.CountPerSec <= 0 {
+		l.CountPerSec = l.ReqPerSec
+	}
+	if l.Burst <= 0 {
+		l.Burst = defaultRateBurst
+	}
+	if l.Authenticated.Events <= 0 {
+		l.Authenticated.Events = l.EventsPerSec
+	}
+	if l.Authenticated.Reqs <= 0 {
+		l.Authenticated.Reqs = l.ReqPerSec
+	}
+	if l.Authenticated.Counts <= 0 {
+		l.Authenticated.Counts = l.CountPerSec
+	}
+	if l.IPv6Prefix <= 0 || l.IPv6Prefix > 128 {
+		l.IPv6Prefix = defaultIPv6Prefix
+	}
+	if l.MaxTrackedClients <= 0 {
+		l.MaxTrackedClients = defaultMaxTracked
+	}
+	if l.IdleTimeout <= 0 {
+		l.IdleTimeout = defaultLimiterIdle
+	}
+	esc := &l.Escalation
+	if esc.Violations <= 0 {
+		esc.Violations = defaultBanViolations
+	}
+	if esc.Window <= 0 {
+		esc.Window = defaultViolationWindow
+	}
+	if esc.BanDuration <= 0 {
+		esc.BanDuration = defaultBanDuration
+	}
+	if esc.LongBanAfter <= 0 {
+		esc.LongBanAfter = defaultLongBanAfter
+	}
+	if esc.LongBanDuration <= 0 {
+		esc.LongBanDuration = defaultLongBanDuration
+	}
+	return l
+}
+
+// SetRateLimits replaces the rate limits. It can be called while the relay is
+// serving: buckets refill at the new rates and connected clients get the new
+// event size limit, while existing connections over a lowered connection limit
+// are kept. Bans in effect keep their expiry.
+func (r *Relay) SetRateLimits(limits RateLimits) {
+	limits = limits.withDefaults()
+	trusted := make(map[string]bool, len(limits.TrustedPubKeys))
+	for _, pk := range limits.TrustedPubKeys {
+		if pk = strings.ToLower(strings.TrimSpace(pk)); pk != "" {
+			trusted[pk] = true
+		}
+	}
+
+	r.limiterMu.Lock()
+	if limits.IPv6Prefix != r.rateLimits.IPv6Prefix {
+		// Keys of the old prefix length would never match again
+		r.resetLimiters()
+	}
+	r.rateLimits = limits
+	r.trustedPubKeys = trusted
+	r.evictLimiters(time.Now())
+	r.limiterMu.Unlock()
+
+	r.clientsMu.RLock()
+	defer r.clientsMu.RUnlock()
+	for c := range r.clients {
+		c.SetMaxEventSize(limits.MaxEventSize)
+	}
+}
+
+// RateLimits returns the rate limits in effect.
+func (r *Relay) RateLimits() RateLimits {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+	return r.rateLimits
+}
+
+func (r *Relay) maxEventSize() int {
+	return r.RateLimits().MaxEventSize
+}
+
+// acquireConnection counts a new WebSocket connection or event stream from
+// ip. If the connection is over a connection limit it returns the reason and
+// how long the client should wait; otherwise it returns a func that uncounts
+// the connection.
+func (r *Relay) acquireConnection(ip string) (release func(), reason string, retryAfter time.Duration) {
+	if reason, retryAfter := r.checkConnectionRate(ip); reason != "" {
+		r.obs.connectionsRejected.With("rate").Inc()
+		return nil, reason, retryAfter
+	}
+	limits := r.RateLimits()
+	network := ipRateKey(ip, limits.IPv6Prefix)
+
+	r.clientsMu.Lock()
+	defer r.clientsMu.Unlock()
+	switch {
+	case limits.MaxTotalConnections > 0 && r.connsTotal >= limits.MaxTotalConnections:
+		r.obs.connectionsRejected.With("total").Inc()
+		return nil, "too many connections to the relay", connectionRetryAfter
+	case limits.MaxConnections > 0 && r.connsPerIP[ip] >= limits.MaxConnections:
+		r.obs.connectionsRejected.With("ip").Inc()
+		return nil, "too many connections", connectionRetryAfter
+	case limits.MaxConnectionsPerNetwork > 0 && r.connsPerNetwork[network] >= limits.MaxConnectionsPerNetwork:
+		r.obs.connectionsRejected.With("network").Inc()
+		return nil, "too many connections from your network", connectionRetryAfter
+	}
+	r.connsTotal++
+	r.connsPerIP[ip]++
+	r.connsPerNetwork[network]++
+	return func() { r.releaseConnection(ip, network) }, "", 0
+}
+
+// retryAfterSeconds formats a wait for the Retry-After header, rounded up to
+// whole seconds
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(int((d+time.Second-1)/time.Second), 1))
+}
+
+// releaseConnection uncounts a connection counted by acquireConnection
+func (r *Relay) releaseConnection(ip, network string) {
+	r.clientsMu.Lock()
+	defer r.clientsMu.Unlock()
+	r.connsTotal--
+	if r.connsPerIP[ip]--; r.connsPerIP[ip] <= 0 {
+		delete(r.connsPerIP, ip)
+	}
+	if r.connsPerNetwork[network]--; r.connsPerNetwork[network] <= 0 {
+		delete(r.connsPerNetwork, network)
+	}
+}
+
+// ConnectionCounts are the open WebSocket connections as seen by the
+// connection limits.
+type ConnectionCounts struct {
+	Total    int `json:"total"`      // open WebSocket connections
+	IPs      int `json:"ips"`        // distinct client IPs
+	Networks int `json:"networks"`   // distinct IPv4 addresses and IPv6 networks
+	MaxPerIP int `json:"max_per_ip"` // connections of the busiest IP
+}
+
+// ConnectionCounts returns the open WebSocket connections by client.
+func (r *Relay) ConnectionCounts() ConnectionCounts {
+	r.clientsMu.RLock()
+	defer r.clientsMu.RUnlock()
+	counts := ConnectionCounts{Total: r.connsTotal, IPs: len(r.connsPerIP), Networks: len(r.connsPerNetwork)}
+	for _, n := range r.connsPerIP {
+		counts.MaxPerIP = max(counts.MaxPerIP, n)
+	}
+	return counts
+}
@@ -0,0 +1,579 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/nips/nip56"
+	"github.com/paul/glienicke/pkg/nips/nip98"
+	"github.com/paul/glienicke/pkg/storage"
+)
+
+// NIP-86 management lists and settings as persisted in storage.ManagementStore
+const (
+	listBannedPubKeys   = "banned_pubkeys"
+	listBannedEvents    = "banned_events"
+	listBlockedIPs      = "blocked_ips"
+	listAllowedKinds    = "allowed_kinds"
+	listDisallowedKinds = "disallowed_kinds"
+	settingRelayName    = "relay_name"
+
+	// managementContentType is the content type of NIP-86 requests
+	managementContentType = "application/nostr+json+rpc"
+
+	maxManagementBodySize = 64 * 1024
+)
+
+// management holds the relay state controlled through the NIP-86 API. It is
+// cached in memory for enforcement and written through to the store.
+type management struct {
+	mu              sync.RWMutex
+	store           storage.ManagementStore // nil if the store cannot persist management state
+	bannedPubKeys   map[string]string       // pubkey -> reason
+	bannedEvents    map[string]string       // event ID -> reason
+	blockedIPs      map[string]string       // IP -> reason
+	allowedKinds    map[int]bool            // if non-empty, only these kinds are accepted
+	disallowedKinds map[int]bool
+	relayName       string
+}
+
+func newManagement(store storage.Store) *management {
+	m := &management{
+		bannedPubKeys:   make(map[string]string),
+		bannedEvents:    make(map[string]string),
+		blockedIPs:      make(map[string]string),
+		allowedKinds:    make(map[int]bool),
+		disallowedKinds: make(map[int]bool),
+	}
+	if ms, ok := store.(storage.ManagementStore); ok {
+		m.store = ms
+	}
+	return m
+}
+
+// load reads the persisted management state into memory.
+func (m *management) load(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for list, dst := range map[string]map[string]string{
+		listBannedPubKeys: m.bannedPubKeys,
+		listBannedEvents:  m.bannedEvents,
+		listBlockedIPs:    m.blockedIPs,
+	} {
+		entries, err := m.store.ListEntries(ctx, list)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			dst[entry.Value] = entry.Reason
+		}
+	}
+
+	for list, dst := range map[string]map[int]bool{
+		listAllowedKinds:    m.allowedKinds,
+		listDisallowedKinds: m.disallowedKinds,
+	} {
+		entries, err := m.store.ListEntries(ctx, list)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if kind, err := strconv.Atoi(entry.Value); err == nil {
+				dst[kind] = true
+			}
+		}
+	}
+
+	name, err := m.store.GetSetting(ctx, settingRelayName)
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	m.relayName = name
+	return nil
+}
+
+// restrictsKinds reports whether an allow or disallow list limits the kinds accepted.
+func (m *management) restrictsKinds() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.allowedKinds) > 0 || len(m.disallowedKinds) > 0
+}
+
+// rejectEvent returns a non-empty OK reason if the event may not be published.
+func (m *management) rejectEvent(evt *event.Event) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.bannedPubKeys[evt.PubKey]; ok {
+		return "blocked: pubkey is banned"
+	}
+	if _, ok := m.bannedEvents[evt.ID]; ok {
+		return "blocked: event is banned"
+	}
+	if m.disallowedKinds[evt.Kind] || (len(m.allowedKinds) > 0 && !m.allowedKinds[evt.Kind]) {
+		return fmt.Sprintf("blocked: kind %d is not allowed", evt.Kind)
+	}
+	return ""
+}
+
+// hidden reports whether a stored event must not be served to clients.
+func (m *management) hidden(evt *event.Event) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.bannedPubKeys[evt.PubKey]; ok {
+		return true
+	}
+	_, ok := m.bannedEvents[evt.ID]
+	return ok
+}
+
+func (m *management) isIPBlocked(ip string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.blockedIPs[ip]
+	return ok
+}
+
+func (m *management) name() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.relayName
+}
+
+// setEntry adds or removes a value on a list, in memory and in the store.
+func (m *management) setEntry(ctx context.Context, list string, cache map[string]string, value, reason string, add bool) error {
+	if m.store != nil {
+		var err error
+		if add {
+			err = m.store.AddListEntry(ctx, list, value, reason)
+		} else {
+			err = m.store.RemoveListEntry(ctx, list, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if add {
+		cache[value] = reason
+	} else {
+		delete(cache, value)
+	}
+	return nil
+}
+
+// setKind allows (allow=true) or disallows a kind, in memory and in the store.
+func (m *management) setKind(ctx context.Context, kind int, allow bool) error {
+	value := strconv.Itoa(kind)
+	add, remove := listAllowedKinds, listDisallowedKinds
+	if !allow {
+		add, remove = remove, add
+	}
+	if m.store != nil {
+		if err := m.store.RemoveListEntry(ctx, remove, value); err != nil {
+			return err
+		}
+		if err := m.store.AddListEntry(ctx, add, value, ""); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if allow {
+		delete(m.disallowedKinds, kind)
+		m.allowedKinds[kind] = true
+	} else {
+		delete(m.allowedKinds, kind)
+		m.disallowedKinds[kind] = true
+	}
+	return nil
+}
+
+func (m *management) setRelayName(ctx context.Context, name string) error {
+	if m.store != nil {
+		if err := m.store.SetSetting(ctx, settingRelayName, name); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.relayName = name
+	return nil
+}
+
+// managementRequest is a NIP-86 JSON-RPC request
+type managementRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// managementResponse is a NIP-86 JSON-RPC response
+type managementResponse struct {
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// pubkeyReason is an entry of listbannedpubkeys
+type pubkeyReason struct {
+	PubKey string `json:"pubkey"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// idReason is an entry of listbannedevents and listeventsneedingmoderation
+type idReason struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ipReason is an entry of listblockedips
+type ipReason struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// managementMethods lists the supported NIP-86 methods
+var managementMethods = []string{
+	"supportedmethods",
+	"banpubkey",
+	"allowpubkey",
+	"listbannedpubkeys",
+	"banevent",
+	"allowevent",
+	"listbannedevents",
+	"blockip",
+	"unblockip",
+	"listblockedips",
+	"allowkind",
+	"disallowkind",
+	"listallowedkinds",
+	"changerelayname",
+	"acladd",
+	"aclremove",
+	"acllist",
+	"listbans",
+	"liftban",
+	"importbans",
+	"listeventsneedingmoderation",
+	"listreports",
+	"resolvereports",
+	"listreporters",
+}
+
+// SetAdminPubKeys sets the pubkeys allowed to use the NIP-86 management API.
+// The API is disabled while no admin is configured.
+func (r *Relay) SetAdminPubKeys(pubkeys []string) {
+	admins := make(map[string]bool, len(pubkeys))
+	for _, pk := range pubkeys {
+		if pk = strings.ToLower(strings.TrimSpace(pk)); pk != "" {
+			admins[pk] = true
+		}
+	}
+	r.adminMu.Lock()
+	defer r.adminMu.Unlock()
+	r.adminPubKeys = admins
+}
+
+// hasAdmins reports whether the NIP-86 management API is enabled
+func (r *Relay) hasAdmins() bool {
+	r.adminMu.RLock()
+	defer r.adminMu.RUnlock()
+	return len(r.adminPubKeys) > 0
+}
+
+// isAdmin reports whether pubkey may use the NIP-86 management API
+func (r *Relay) isAdmin(pubkey string) bool {
+	r.adminMu.RLock()
+	defer r.adminMu.RUnlock()
+	return r.adminPubKeys[pubkey]
+}
+
+// isManagementRequest reports whether an HTTP request is a NIP-86 call
+func isManagementRequest(req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+	mediaType := strings.TrimSpace(strings.Split(req.Header.Get("Content-Type"), ";")[0])
+	return strings.EqualFold(mediaType, managementContentType)
+}
+
+// mgmtLogger logs NIP-86 management calls
+var mgmtLogger = logging.For("nip86")
+
+// managementAuth returns the authenticator of NIP-86 requests, answering
+// failures in the NIP-86 response format
+func (r *Relay) managementAuth() *nip98.Authenticator {
+	return &nip98.Authenticator{
+		MaxBodySize:  maxManagementBodySize,
+		TrustedProxy: r.isTrustedProxy,
+		OnError: func(w http.ResponseWriter, req *http.Request, status int, err error) {
+			writeManagementResponse(w, status, managementResponse{Error: fmt.Sprintf("unauthorized: %v", err)})
+		},
+	}
+}
+
+// handleManagement serves NIP-86 JSON-RPC requests authenticated with NIP-98
+func (r *Relay) handleManagement(w http.ResponseWriter, req *http.Request) {
+	if !r.hasAdmins() {
+		writeManagementResponse(w, http.StatusForbidden, managementResponse{Error: "management API is not enabled"})
+		return
+	}
+	r.managementAuth().Middleware(http.HandlerFunc(r.serveManagementRPC)).ServeHTTP(w, req)
+}
+
+// serveManagementRPC executes a NIP-86 call from an authenticated caller
+func (r *Relay) serveManagementRPC(w http.ResponseWriter, req *http.Request) {
+	pubkey, _ := nip98.PubKeyFromContext(req.Context())
+	if !r.isAdmin(pubkey) {
+		writeManagementResponse(w, http.StatusUnauthorized, managementResponse{Error: "unauthorized: pubkey is not an admin"})
+		return
+	}
+
+	var rpc managementRequest
+	if err := json.NewDecoder(req.Body).Decode(&rpc); err != nil {
+		writeManagementResponse(w, http.StatusBadRequest, managementResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	result, err := r.callManagement(req.Context(), rpc)
+	if err != nil {
+		writeManagementResponse(w, http.StatusOK, managementResponse{Error: err.Error()})
+		return
+	}
+	mgmtLogger.Info("management call", logging.KeyPubKey, pubkey, "method", rpc.Method)
+	writeManagementResponse(w, http.StatusOK, managementResponse{Result: result})
+}
+
+// callManagement executes a single NIP-86 method
+func (r *Relay) callManagement(ctx context.Context, rpc managementRequest) (interface{}, error) {
+	m := r.mgmt
+
+	switch rpc.Method {
+	case "supportedmethods":
+		return managementMethods, nil
+
+	case "banpubkey", "allowpubkey":
+		pubkey, reason, err := hexParamWithReason(rpc.Params)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.setEntry(ctx, listBannedPubKeys, m.bannedPubKeys, pubkey, reason, rpc.Method == "banpubkey"); err != nil {
+			return nil, fmt.Errorf("failed to update banned pubkeys: %w", err)
+		}
+		if err := r.resolveQueued(ctx, reportTarget{nip56.TargetPubKey, pubkey}, rpc.Method == "banpubkey"); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	case "listbannedpubkeys":
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		list := make([]pubkeyReason, 0, len(m.bannedPubKeys))
+		for pk, reason := range m.bannedPubKeys {
+			list = append(list, pubkeyReason{PubKey: pk, Reason: reason})
+		}
+		return list, nil
+
+	case "banevent", "allowevent":
+		id, reason, err := hexParamWithReason(rpc.Params)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.setEntry(ctx, listBannedEvents, m.bannedEvents, id, reason, rpc.Method == "banevent"); err != nil {
+			return nil, fmt.Errorf("failed to update banned events: %w", err)
+		}
+		if err := r.resolveQueued(ctx, reportTarget{nip56.TargetEvent, id}, rpc.Method == "banevent"); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	case "listbannedevents":
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		list := make([]idReason, 0, len(m.bannedEvents))
+		for id, reason := range m.bannedEvents {
+			list = append(list, idReason{ID: id, Reason: reason})
+		}
+		return list, nil
+
+	case "blockip", "unblockip":
+		var ip, reason string
+		if err := decodeParams(rpc.Params, &ip, &reason); err != nil {
+			return nil, err
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid IP address: %q", ip)
+		}
+		if err := m.setEntry(ctx, listBlockedIPs, m.blockedIPs, ip, reason, rpc.Method == "blockip"); err != nil {
+			return nil, fmt.Errorf("failed to update blocked IPs: %w", err)
+		}
+		if rpc.Method == "unblockip" {
+			if err := r.LiftBan(ctx, ip); err != nil {
+				return nil, err
+			}
+		}
+		return true, nil
+
+	case "listblockedips":
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		list := make([]ipReason, 0, len(m.blockedIPs))
+		for ip, reason := range m.blockedIPs {
+			list = append(list, ipReason{IP: ip, Reason: reason})
+		}
+		return list, nil
+
+	case "allowkind", "disallowkind":
+		var kind int
+		if err := decodeParams(rpc.Params, &kind); err != nil {
+			return nil, err
+		}
+		if kind < 0 {
+			return nil, fmt.Errorf("invalid kind: %d", kind)
+		}
+		if err := m.setKind(ctx, kind, rpc.Method == "allowkind"); err != nil {
+			return nil, fmt.Errorf("failed to update kinds: %w", err)
+		}
+		return true, nil
+
+	case "listallowedkinds":
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		kinds := make([]int, 0, len(m.allowedKinds))
+		for kind := range m.allowedKinds {
+			kinds = append(kinds, kind)
+		}
+		return kinds, nil
+
+	case "changerelayname":
+		var name string
+		if err := decodeParams(rpc.Params, &name); err != nil {
+			return nil, err
+		}
+		if err := m.setRelayName(ctx, name); err != nil {
+			return nil, fmt.Errorf("failed to change relay name: %w", err)
+		}
+		return true, nil
+
+	case "acladd", "aclremove":
+		var e ACLEntry
+		if err := decodeParams(rpc.Params, &e.Direction, &e.Action, &e.Type, &e.Value, &e.Reason); err != nil {
+			return nil, err
+		}
+		if rpc.Method == "acladd" {
+			if err := r.AddACLEntry(ctx, e); err != nil {
+				return nil, err
+			}
+		} else if err := r.RemoveACLEntry(ctx, e); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	case "acllist":
+		return r.ACLEntries(), nil
+
+	case "listbans":
+		return r.Bans(), nil
+
+	case "liftban":
+		var target string
+		if err := decodeParams(rpc.Params, &target); err != nil {
+			return nil, err
+		}
+		if err := r.LiftBan(ctx, target); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	case "importbans":
+		var bans []Ban
+		if err := decodeParams(rpc.Params, &bans); err != nil {
+			return nil, err
+		}
+		return r.AddBans(ctx, bans)
+
+	case "listeventsneedingmoderation":
+		list := []idReason{}
+		for _, item := range r.ModerationQueue() {
+			if item.Type == nip56.TargetEvent {
+				list = append(list, idReason{ID: item.Target, Reason: item.summary()})
+			}
+		}
+		return list, nil
+
+	case "listreports":
+		return r.ModerationQueue(), nil
+
+	case "resolvereports":
+		var targetType, target, action, reason string
+		if err := decodeParams(rpc.Params, &targetType, &target, &action, &reason); err != nil {
+			return nil, err
+		}
+		if action != "uphold" && action != "dismiss" {
+			return nil, fmt.Errorf("invalid action %q (want uphold or dismiss)", action)
+		}
+		if err := r.ResolveReports(ctx, targetType, target, action == "uphold", reason); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	case "listreporters":
+		return r.ReporterReputations(), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported method: %q", rpc.Method)
+	}
+}
+
+// decodeParams decodes positional params into dst. The first param is
+// required; later ones are optional.
+func decodeParams(params []json.RawMessage, dst ...interface{}) error {
+	if len(params) == 0 {
+		return fmt.Errorf("missing params")
+	}
+	for i, d := range dst {
+		if i >= len(params) {
+			break
+		}
+		if err := json.Unmarshal(params[i], d); err != nil {
+			return fmt.Errorf("invalid param %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// hexParamWithReason decodes a [<64-char hex>, <optional reason>] param list
+func hexParamWithReason(params []json.RawMessage) (string, string, error) {
+	var value, reason string
+	if err := decodeParams(params, &value, &reason); err != nil {
+		return "", "", err
+	}
+	value = strings.ToLower(value)
+	if len(value) != 64 || strings.Trim(value, "0123456789abcdef") != "" {
+		return "", "", fmt.Errorf("invalid hex value: %q", value)
+	}
+	return value, reason, nil
+}
+
+func writeManagementResponse(w http.ResponseWriter, status int, resp managementResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
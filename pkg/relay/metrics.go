@@ -0,0 +1,229 @@
+package relay
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/metrics"
+	"github.com/paul/glienicke/pkg/protocol"
+)
+
+// metricsNamespace prefixes every exported series
+const metricsNamespace = "glienicke"
+
+// fanoutBuckets bound the number of clients an event is broadcast to
+var fanoutBuckets = []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// knownReasons are the OK/CLOSED machine-readable prefixes used as reason labels;
+// anything else is reported as "other" to keep label cardinality bounded
+var knownReasons = map[string]bool{
+	"duplicate":     true,
+	"pow":           true,
+	"blocked":       true,
+	"rate-limited":  true,
+	"invalid":       true,
+	"restricted":    true,
+	"error":         true,
+	"auth-required": true,
+	"mute":          true,
+	"banned":        true,
+}
+
+// instrumentation holds the relay's Prometheus series
+type instrumentation struct {
+	registry            *metrics.Registry
+	store               *metrics.StoreMetrics
+	connections         *metrics.Counter
+	connectionsRejected *metrics.CounterVec   // reason
+	messages            *metrics.CounterVec   // type
+	events              *metrics.CounterVec   // result, reason, kind
+	queryDuration       *metrics.HistogramVec // type
+	fanout              *metrics.Histogram
+	rateLimited         *metrics.Counter
+	bans                *metrics.Counter
+	retentionDeleted    *metrics.Counter
+	writePolicy         *metrics.CounterVec // action
+}
+
+func newInstrumentation() *instrumentation {
+	reg := metrics.NewRegistry()
+	return &instrumentation{
+		registry: reg,
+		store:    metrics.NewStoreMetrics(reg, metricsNamespace),
+		connections: reg.NewCounter(metricsNamespace+"_connections_total",
+			"WebSocket connections accepted since start."),
+		connectionsRejected: reg.NewCounterVec(metricsNamespace+"_connections_rejected_total",
+			"WebSocket connections rejected by the connection limits, by limit: ip, network, total or rate.", "reason"),
+		messages: reg.NewCounterVec(metricsNamespace+"_messages_total",
+			"Client messages received by type.", "type"),
+		events: reg.NewCounterVec(metricsNamespace+"_events_total",
+			"EVENT results by outcome, OK reason prefix and kind.", "result", "reason", "kind"),
+		queryDuration: reg.NewHistogramVec(metricsNamespace+"_query_duration_seconds",
+			"Time spent answering REQ and COUNT messages.", metrics.DefBuckets, "type"),
+		fanout: reg.NewHistogram(metricsNamespace+"_broadcast_fanout",
+			"Number of clients a broadcast event matched.", fanoutBuckets),
+		rateLimited: reg.NewCounter(metricsNamespace+"_rate_limited_total",
+			"Messages rejected by the per-IP rate limiter."),
+		bans: reg.NewCounter(metricsNamespace+"_bans_total",
+			"IP bans issued for repeated rate limit violations."),
+		retentionDeleted: reg.NewCounter(metricsNamespace+"_retention_deleted_total",
+			"Events deleted by the retention policy."),
+		writePolicy: reg.NewCounterVec(metricsNamespace+"_write_policy_total",
+			"Write-policy plugin decisions by action; error when the plugin failed.", "action"),
+	}
+}
+
+// connectionLimits are the reason labels of connectionsRejected
+var connectionLimits = []string{"ip", "network", "total", "rate"}
+
+// connectionsRejectedTotal sums rejected connections over all limits
+func (o *instrumentation) connectionsRejectedTotal() float64 {
+	total := 0.0
+	for _, reason := range connectionLimits {
+		total += o.connectionsRejected.With(reason).Value()
+	}
+	return total
+}
+
+// registerGauges adds the series read from relay state on every scrape
+func (r *Relay) registerGauges() {
+	reg := r.obs.registry
+	reg.NewGaugeFunc(metricsNamespace+"_connections_active",
+		"Currently connected clients, including HTTP API streams.", func() float64 {
+			r.clientsMu.RLock()
+			defer r.clientsMu.RUnlock()
+			return float64(len(r.clients))
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_websocket_connections",
+		"Open WebSocket connections counted by the connection limits.", func() float64 {
+			return float64(r.ConnectionCounts().Total)
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_connected_ips",
+		"Distinct IPs with open WebSocket connections.", func() float64 {
+			return float64(r.ConnectionCounts().IPs)
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_connected_networks",
+		"Distinct IPv4 addresses and IPv6 networks with open WebSocket connections.", func() float64 {
+			return float64(r.ConnectionCounts().Networks)
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_connections_per_ip_max",
+		"Open WebSocket connections of the busiest IP.", func() float64 {
+			return float64(r.ConnectionCounts().MaxPerIP)
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_outbound_queue_depth",
+		"Broadcast events waiting in client delivery queues, summed over clients.", func() float64 {
+			total, _ := r.queueDepths()
+			return float64(total)
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_outbound_queue_depth_max",
+		"Longest client delivery queue.", func() float64 {
+			_, max := r.queueDepths()
+			return float64(max)
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_banned_ips",
+		"IPs currently banned by the rate limiter.", func() float64 {
+			return float64(r.bannedIPCount())
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_rate_limit_tracked_clients",
+		"IP networks and pubkeys with rate limiter state.", func() float64 {
+			return float64(r.trackedClients())
+		})
+	reg.NewGaugeFunc(metricsNamespace+"_uptime_seconds",
+		"Seconds since the relay started.", func() float64 {
+			return time.Since(r.metrics.startTime).Seconds()
+		})
+}
+
+// MetricsHandler serves the relay's metrics in the Prometheus text format.
+func (r *Relay) MetricsHandler() http.Handler {
+	return r.obs.registry.Handler()
+}
+
+// observeMessage counts a client message by type
+func (r *Relay) observeMessage(msgType protocol.MessageType) {
+	switch msgType {
+	case protocol.MessageTypeEvent, protocol.MessageTypeReq, protocol.MessageTypeClose,
+		protocol.MessageTypeCount, protocol.MessageTypeAuth:
+		r.obs.messages.With(string(msgType)).Inc()
+	default:
+		r.obs.messages.With("unknown").Inc()
+	}
+}
+
+// sendOK answers an EVENT and records its outcome
+func (r *Relay) sendOK(c *protocol.Client, evt *event.Event, accepted bool, message string) {
+	r.recordEvent(evt, accepted, message)
+	c.SendOK(evt.ID, accepted, message)
+}
+
+// recordEvent counts an EVENT outcome by result, reason prefix and kind
+func (r *Relay) recordEvent(evt *event.Event, accepted bool, message string) {
+	result := "rejected"
+	if accepted {
+		result = "accepted"
+	}
+	r.obs.events.With(result, reasonLabel(message), kindLabel(evt.Kind)).Inc()
+}
+
+// reasonLabel reduces an OK message to its machine-readable prefix
+func reasonLabel(message string) string {
+	if message == "" {
+		return ""
+	}
+	prefix := message
+	if i := strings.IndexAny(prefix, ": "); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if knownReasons[prefix] {
+		return prefix
+	}
+	return "other"
+}
+
+// knownKinds are the regular kinds reported exactly as kind labels; kinds
+// are chosen by clients, so any other is reported as "other" to keep label
+// cardinality bounded
+var knownKinds = map[int]bool{
+	0: true, 1: true, 2: true, 3: true, 4: true, 5: true, 6: true, 7: true,
+	8: true, 9: true, 10: true, 11: true, 12: true, 13: true, 14: true,
+	16: true, 40: true, 41: true, 42: true, 43: true, 44: true, 62: true,
+	1059: true, 1063: true, 1111: true, 1984: true, 1985: true,
+	9000: true, 9001: true, 9002: true, 9005: true, 9007: true, 9008: true,
+	9009: true, 9021: true, 9022: true, 9734: true, 9735: true,
+}
+
+// kindLabel reports known regular kinds exactly and the larger NIP-01 ranges by name
+func kindLabel(kind int) string {
+	switch {
+	case kind < 10000:
+		if knownKinds[kind] {
+			return strconv.Itoa(kind)
+		}
+		return "other"
+	case kind < 20000:
+		return "replaceable"
+	case kind < 30000:
+		return "ephemeral"
+	case kind < 40000:
+		return "addressable"
+	default:
+		return "other"
+	}
+}
+
+// queueDepths returns the total and largest number of queued broadcast events
+func (r *Relay) queueDepths() (total, max int) {
+	r.clientsMu.RLock()
+	defer r.clientsMu.RUnlock()
+	for c := range r.clients {
+		n := c.PendingDeliveries()
+		total += n
+		if n > max {
+			max = n
+		}
+	}
+	return total, max
+}
@@ -0,0 +1,20 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKindLabel(t *testing.T) {
+	assert.Equal(t, "1", kindLabel(1))
+	assert.Equal(t, "9735", kindLabel(9735))
+	assert.Equal(t, "replaceable", kindLabel(10002))
+	assert.Equal(t, "ephemeral", kindLabel(22242))
+	assert.Equal(t, "addressable", kindLabel(30023))
+
+	// Arbitrary client-chosen kinds share one label
+	assert.Equal(t, "other", kindLabel(4242))
+	assert.Equal(t, "other", kindLabel(9999))
+	assert.Equal(t, "other", kindLabel(40000))
+}
@@ -0,0 +1,616 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/nips/nip56"
+	"github.com/paul/glienicke/pkg/storage"
+)
+
+// Moderation lists persisted in storage.ManagementStore
+const (
+	listHiddenEvents  = "moderation_hidden"  // events hidden until a moderator reviews them
+	listAllowedEvents = "moderation_allowed" // events a moderator cleared, never hidden again
+)
+
+// ModerationPolicy configures the automatic actions taken on NIP-56 reports.
+// Admins of the NIP-86 API count as moderators.
+type ModerationPolicy struct {
+	Moderators       []string // pubkeys whose reports are trusted and may delete events
+	TrustedReporters []string // pubkeys whose reports are trusted
+	// HideAfter hides a reported event once this many distinct trusted
+	// reporters reported it (0 = never)
+	HideAfter int
+	// DeleteTypes are the report types with which a moderator's report of an
+	// event or blob deletes it right away
+	DeleteTypes []string
+	// TrustedReputation makes reporters trusted once this many more of their
+	// reports were upheld than dismissed (0 = never)
+	TrustedReputation int
+	// IgnoreReputation ignores the reports of reporters once this many more
+	// of their reports were dismissed than upheld (0 = never)
+	IgnoreReputation int
+	// Reports from untrusted reporters are not queued once their target has
+	// MaxReportsPerTarget reports, the reporter has MaxReportsPerReporter
+	// reports awaiting review, or the queue holds MaxQueuedReports reports,
+	// so that throwaway keys cannot flood the queue (0 = unlimited)
+	MaxReportsPerTarget   int
+	MaxReportsPerReporter int
+	MaxQueuedReports      int
+}
+
+// ModerationItem is a reported pubkey, event or blob awaiting review
+type ModerationItem struct {
+	Type          string         `json:"type"`   // pubkey, event or blob
+	Target        string         `json:"target"` // pubkey, event ID or blob hash
+	Reports       int            `json:"reports"`
+	Trusted       int            `json:"trusted"` // reports from trusted reporters
+	Types         map[string]int `json:"types"`   // reports per report type
+	Reporters     []string       `json:"reporters"`
+	Hidden        bool           `json:"hidden"`
+	FirstReported int64          `json:"first_reported"`
+	LastReported  int64          `json:"last_reported"`
+}
+
+// ReporterReputation is how a reporter's reports were resolved
+type ReporterReputation struct {
+	PubKey    string `json:"pubkey"`
+	Upheld    int    `json:"upheld"`
+	Dismissed int    `json:"dismissed"`
+	Trusted   bool   `json:"trusted"`
+	Ignored   bool   `json:"ignored"`
+}
+
+// reportTarget identifies what a report is about
+type reportTarget struct {
+	Type  string // nip56.TargetPubKey, TargetEvent or TargetBlob
+	Value string
+}
+
+// moderation is the queue of reported pubkeys, events and blobs. Like
+// management it is cached in memory and written through to the store.
+type moderation struct {
+	mu           sync.RWMutex
+	store        storage.ManagementStore // nil if the store cannot persist the queue
+	isAdmin      func(pubkey string) bool
+	policy       ModerationPolicy
+	moderators   map[string]bool
+	trusted      map[string]bool
+	deleteTypes  map[string]bool
+	queue        map[reportTarget][]storage.Report // one report per reporter, oldest first
+	size         int                               // reports in the queue
+	pending      map[string]int                    // reports in the queue by reporter
+	reputations  map[string]storage.Reputation
+	hiddenEvents map[string]string // event ID -> reason
+	allowed      map[string]bool   // event IDs cleared by a moderator
+}
+
+func newModeration(store storage.Store, isAdmin func(string) bool) *moderation {
+	m := &moderation{
+		isAdmin:      isAdmin,
+		moderators:   make(map[string]bool),
+		trusted:      make(map[string]bool),
+		deleteTypes:  make(map[string]bool),
+		queue:        make(map[reportTarget][]storage.Report),
+		pending:      make(map[string]int),
+		reputations:  make(map[string]storage.Reputation),
+		hiddenEvents: make(map[string]string),
+		allowed:      make(map[string]bool),
+	}
+	if ms, ok := store.(storage.ManagementStore); ok {
+		m.store = ms
+	}
+	return m
+}
+
+// load reads the persisted queue, reputations and hidden events into memory.
+func (m *moderation) load(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+	reports, err := m.store.ListReports(ctx)
+	if err != nil {
+		return err
+	}
+	reps, err := m.store.ListReputations(ctx)
+	if err != nil {
+		return err
+	}
+	hidden, err := m.store.ListEntries(ctx, listHiddenEvents)
+	if err != nil {
+		return err
+	}
+	allowed, err := m.store.ListEntries(ctx, listAllowedEvents)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, report := range reports {
+		key := reportTarget{report.TargetType, report.Target}
+		m.queue[key] = append(m.queue[key], report)
+		m.pending[report.Reporter]++
+		m.size++
+	}
+	for _, rep := range reps {
+		m.reputations[rep.PubKey] = rep
+	}
+	for _, entry := range hidden {
+		m.hiddenEvents[entry.Value] = entry.Reason
+	}
+	for _, entry := range allowed {
+		m.allowed[entry.Value] = true
+	}
+	return nil
+}
+
+// SetModeration sets the automatic actions taken on NIP-56 reports. Reports
+// are validated and queued for review regardless.
+func (r *Relay) SetModeration(policy ModerationPolicy) {
+	toSet := func(values []string) map[string]bool {
+		set := make(map[string]bool, len(values))
+		for _, v := range values {
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				set[v] = true
+			}
+		}
+		return set
+	}
+	m := r.moderation
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policy = policy
+	m.moderators = toSet(policy.Moderators)
+	m.trusted = toSet(policy.TrustedReporters)
+	m.deleteTypes = toSet(policy.DeleteTypes)
+}
+
+// isModerator reports whether pubkey is a moderator or admin
+func (m *moderation) isModerator(pubkey string) bool {
+	m.mu.RLock()
+	moderator := m.moderators[pubkey]
+	m.mu.RUnlock()
+	return moderator || m.isAdmin(pubkey)
+}
+
+// score is the number of a reporter's reports upheld minus those dismissed.
+// m.mu must be held.
+func (m *moderation) score(pubkey string) int {
+	rep := m.reputations[pubkey]
+	return rep.Upheld - rep.Dismissed
+}
+
+// isTrusted reports whether pubkey's reports count towards hiding events.
+// m.mu must be held.
+func (m *moderation) isTrusted(pubkey string) bool {
+	if m.moderators[pubkey] || m.trusted[pubkey] || m.isAdmin(pubkey) {
+		return true
+	}
+	return m.policy.TrustedReputation > 0 && m.score(pubkey) >= m.policy.TrustedReputation
+}
+
+// isIgnored reports whether pubkey's reports are dropped for having been
+// dismissed too often. m.mu must be held.
+func (m *moderation) isIgnored(pubkey string) bool {
+	if m.moderators[pubkey] || m.trusted[pubkey] || m.isAdmin(pubkey) {
+		return false
+	}
+	return m.policy.IgnoreReputation > 0 && -m.score(pubkey) >= m.policy.IgnoreReputation
+}
+
+// admits reports whether a report may be queued: replacements and reports
+// from trusted reporters always are, other reports only within the limits of
+// the policy. m.mu must be held.
+func (m *moderation) admits(report storage.Report) bool {
+	reports := m.queue[reportTarget{report.TargetType, report.Target}]
+	for _, existing := range reports {
+		if existing.Reporter == report.Reporter {
+			return true
+		}
+	}
+	if m.isTrusted(report.Reporter) {
+		return true
+	}
+	p := m.policy
+	switch {
+	case p.MaxReportsPerTarget > 0 && len(reports) >= p.MaxReportsPerTarget:
+	case p.MaxReportsPerReporter > 0 && m.pending[report.Reporter] >= p.MaxReportsPerReporter:
+	case p.MaxQueuedReports > 0 && m.size >= p.MaxQueuedReports:
+	default:
+		return true
+	}
+	return false
+}
+
+// add queues a report, replacing the reporter's earlier report of the
+// target, and returns how many distinct trusted reporters reported it.
+// Reports the policy does not admit are dropped, reported by ok.
+func (m *moderation) add(ctx context.Context, report storage.Report) (trusted int, ok bool, err error) {
+	m.mu.RLock()
+	ok = m.admits(report)
+	m.mu.RUnlock()
+	if !ok {
+		return 0, false, nil
+	}
+	if m.store != nil {
+		if err := m.store.SaveReport(ctx, report); err != nil {
+			return 0, false, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := reportTarget{report.TargetType, report.Target}
+	reports := m.queue[key]
+	replaced := false
+	for i, existing := range reports {
+		if existing.Reporter == report.Reporter {
+			reports = append(reports[:i:i], reports[i+1:]...)
+			replaced = true
+			break
+		}
+	}
+	reports = append(reports, report)
+	m.queue[key] = reports
+	if !replaced {
+		m.pending[report.Reporter]++
+		m.size++
+	}
+
+	for _, r := range reports {
+		if m.isTrusted(r.Reporter) {
+			trusted++
+		}
+	}
+	return trusted, true, nil
+}
+
+// hide hides an event until a moderator reviews it, unless one already cleared it
+func (m *moderation) hide(ctx context.Context, eventID, reason string) (bool, error) {
+	m.mu.RLock()
+	_, hidden := m.hiddenEvents[eventID]
+	skip := hidden || m.allowed[eventID]
+	m.mu.RUnlock()
+	if skip {
+		return false, nil
+	}
+	if m.store != nil {
+		if err := m.store.AddListEntry(ctx, listHiddenEvents, eventID, reason); err != nil {
+			return false, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hiddenEvents[eventID] = reason
+	return true, nil
+}
+
+// hidden reports whether an event is hidden pending review
+func (m *moderation) hidden(eventID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.hiddenEvents[eventID]
+	return ok
+}
+
+// queued reports whether a target has reports awaiting review
+func (m *moderation) queued(target reportTarget) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.queue[target]) > 0
+}
+
+// resolve closes the reports of a target: each reporter's reputation records
+// the outcome, the reports are dropped from the queue and a hidden event is
+// shown again (an upheld one is banned by then). Dismissed events are never
+// hidden again.
+func (m *moderation) resolve(ctx context.Context, target reportTarget, upheld bool) error {
+	m.mu.RLock()
+	reports := m.queue[target]
+	reps := make([]storage.Reputation, 0, len(reports))
+	for _, report := range reports {
+		rep := m.reputations[report.Reporter]
+		rep.PubKey = report.Reporter
+		if upheld {
+			rep.Upheld++
+		} else {
+			rep.Dismissed++
+		}
+		reps = append(reps, rep)
+	}
+	m.mu.RUnlock()
+
+	isEvent := target.Type == nip56.TargetEvent
+	if m.store != nil {
+		for _, rep := range reps {
+			if err := m.store.SaveReputation(ctx, rep); err != nil {
+				return err
+			}
+		}
+		if err := m.store.DeleteReports(ctx, target.Type, target.Value); err != nil {
+			return err
+		}
+		if isEvent {
+			if err := m.store.RemoveListEntry(ctx, listHiddenEvents, target.Value); err != nil {
+				return err
+			}
+			if !upheld {
+				if err := m.store.AddListEntry(ctx, listAllowedEvents, target.Value, ""); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rep := range reps {
+		m.reputations[rep.PubKey] = rep
+	}
+	for _, report := range m.queue[target] {
+		if m.pending[report.Reporter]--; m.pending[report.Reporter] <= 0 {
+			delete(m.pending, report.Reporter)
+		}
+		m.size--
+	}
+	delete(m.queue, target)
+	if isEvent {
+		delete(m.hiddenEvents, target.Value)
+		if !upheld {
+			m.allowed[target.Value] = true
+		}
+	}
+	return nil
+}
+
+// observeReport queues a stored NIP-56 report for review and takes the
+// automatic actions of the moderation policy
+func (r *Relay) observeReport(ctx context.Context, evt *event.Event) {
+	if !nip56.IsReportEvent(evt) {
+		return
+	}
+	m := r.moderation
+	moderator := m.isModerator(evt.PubKey)
+	m.mu.RLock()
+	ignored := m.isIgnored(evt.PubKey)
+	hideAfter := m.policy.HideAfter
+	deleteTypes := m.deleteTypes
+	m.mu.RUnlock()
+	if ignored {
+		logger.Debug("ignoring report from reporter with poor reputation", logging.KeyEventID, evt.ID, "reporter", evt.PubKey)
+		return
+	}
+
+	for _, t := range nip56.GetReportTargets(evt) {
+		target := reportTarget{t.Type, t.Value}
+		report := storage.Report{
+			TargetType: t.Type,
+			Target:     t.Value,
+			Reporter:   evt.PubKey,
+			Type:       t.ReportType,
+			EventID:    evt.ID,
+			CreatedAt:  evt.CreatedAt,
+		}
+		trusted, ok, err := m.add(ctx, report)
+		if err != nil {
+			logger.Error("failed to queue report", logging.KeyEventID, evt.ID, "target", t.Value, logging.KeyError, err)
+			continue
+		}
+		if !ok {
+			logger.Debug("dropping report over the moderation queue limits", logging.KeyEventID, evt.ID, "target", t.Value, "reporter", evt.PubKey)
+			continue
+		}
+
+		// A moderator's report of illegal content or malware removes it right away
+		if moderator && t.Type != nip56.TargetPubKey && deleteTypes[t.ReportType] {
+			reason := fmt.Sprintf("reported as %s by a moderator", t.ReportType)
+			if err := r.resolveReports(ctx, target, true, reason, true); err != nil {
+				logger.Error("failed to delete reported content", "target", t.Value, logging.KeyError, err)
+			} else {
+				logger.Info("deleted content reported by a moderator", "type", t.Type, "target", t.Value, "report_type", t.ReportType, "moderator", evt.PubKey)
+			}
+			continue
+		}
+
+		if t.Type == nip56.TargetEvent && hideAfter > 0 && trusted >= hideAfter {
+			hid, err := m.hide(ctx, t.Value, fmt.Sprintf("reported by %d trusted reporters", trusted))
+			if err != nil {
+				logger.Error("failed to hide reported event", logging.KeyEventID, t.Value, logging.KeyError, err)
+			} else if hid {
+				logger.Info("hid reported event pending review", logging.KeyEventID, t.Value, "trusted_reports", trusted)
+			}
+		}
+	}
+}
+
+// ResolveReports closes the reports of a pubkey, event or blob. Upholding
+// bans the pubkey, the event or the events carrying the blob; dismissing
+// leaves them be. Either way the reporters' reputations record the outcome.
+func (r *Relay) ResolveReports(ctx context.Context, targetType, target string, uphold bool, reason string) error {
+	switch targetType {
+	case nip56.TargetPubKey, nip56.TargetEvent, nip56.TargetBlob:
+	default:
+		return fmt.Errorf("invalid report target type %q (want pubkey, event or blob)", targetType)
+	}
+	key := reportTarget{targetType, strings.ToLower(target)}
+	if !r.moderation.queued(key) {
+		return fmt.Errorf("no reports of %s %s", targetType, target)
+	}
+	return r.resolveReports(ctx, key, uphold, reason, false)
+}
+
+// resolveReports bans an upheld target, deleting the reported events if del
+// is set, and closes its reports
+func (r *Relay) resolveReports(ctx context.Context, target reportTarget, uphold bool, reason string, del bool) error {
+	if uphold {
+		mgmt := r.mgmt
+		switch target.Type {
+		case nip56.TargetPubKey:
+			if err := mgmt.setEntry(ctx, listBannedPubKeys, mgmt.bannedPubKeys, target.Value, reason, true); err != nil {
+				return fmt.Errorf("failed to ban pubkey: %w", err)
+			}
+		default:
+			ids, err := r.reportedEventIDs(ctx, target)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if err := mgmt.setEntry(ctx, listBannedEvents, mgmt.bannedEvents, id, reason, true); err != nil {
+					return fmt.Errorf("failed to ban event: %w", err)
+				}
+				if del {
+					if err := r.deleteReportedEvent(ctx, id); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	if err := r.moderation.resolve(ctx, target, uphold); err != nil {
+		return fmt.Errorf("failed to resolve reports: %w", err)
+	}
+	return nil
+}
+
+// resolveQueued closes the reports of a target a NIP-86 ban or allow call
+// decided, if it has any
+func (r *Relay) resolveQueued(ctx context.Context, target reportTarget, upheld bool) error {
+	if !r.moderation.queued(target) {
+		return nil
+	}
+	if err := r.moderation.resolve(ctx, target, upheld); err != nil {
+		return fmt.Errorf("failed to resolve reports: %w", err)
+	}
+	return nil
+}
+
+// reportedEventIDs returns the reported event, or the stored events carrying a reported blob
+func (r *Relay) reportedEventIDs(ctx context.Context, target reportTarget) ([]string, error) {
+	if target.Type == nip56.TargetEvent {
+		return []string{target.Value}, nil
+	}
+	events, err := r.store.QueryEvents(ctx, []*event.Filter{{Tags: map[string][]string{"x": {target.Value}}}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up events carrying blob: %w", err)
+	}
+	ids := make([]string, 0, len(events))
+	for _, evt := range events {
+		ids = append(ids, evt.ID)
+	}
+	return ids, nil
+}
+
+// deleteReportedEvent deletes a stored event on behalf of its author
+func (r *Relay) deleteReportedEvent(ctx context.Context, id string) error {
+	evt, err := r.store.GetEvent(ctx, id)
+	if err != nil && err != storage.ErrNotFound {
+		return fmt.Errorf("failed to look up reported event: %w", err)
+	}
+	if evt == nil {
+		return nil
+	}
+	if err := r.store.DeleteEvent(ctx, id, evt.PubKey); err != nil {
+		return fmt.Errorf("failed to delete reported event: %w", err)
+	}
+	return nil
+}
+
+// ModerationQueue returns the reported pubkeys, events and blobs awaiting
+// review, most trusted reports first
+func (r *Relay) ModerationQueue() []ModerationItem {
+	m := r.moderation
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make([]ModerationItem, 0, len(m.queue))
+	for target, reports := range m.queue {
+		item := ModerationItem{
+			Type:    target.Type,
+			Target:  target.Value,
+			Reports: len(reports),
+			Types:   make(map[string]int),
+		}
+		if target.Type == nip56.TargetEvent {
+			_, item.Hidden = m.hiddenEvents[target.Value]
+		}
+		for _, report := range reports {
+			if m.isTrusted(report.Reporter) {
+				item.Trusted++
+			}
+			reportType := report.Type
+			if reportType == "" {
+				reportType = nip56.ReportTypeOther
+			}
+			item.Types[reportType]++
+			item.Reporters = append(item.Reporters, report.Reporter)
+			if item.FirstReported == 0 || report.CreatedAt < item.FirstReported {
+				item.FirstReported = report.CreatedAt
+			}
+			if report.CreatedAt > item.LastReported {
+				item.LastReported = report.CreatedAt
+			}
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Trusted != items[j].Trusted {
+			return items[i].Trusted > items[j].Trusted
+		}
+		if items[i].Reports != items[j].Reports {
+			return items[i].Reports > items[j].Reports
+		}
+		return items[i].FirstReported < items[j].FirstReported
+	})
+	return items
+}
+
+// ReporterReputations returns the reputation of every reporter with resolved reports
+func (r *Relay) ReporterReputations() []ReporterReputation {
+	m := r.moderation
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]ReporterReputation, 0, len(m.reputations))
+	for pubkey, rep := range m.reputations {
+		list = append(list, ReporterReputation{
+			PubKey:    pubkey,
+			Upheld:    rep.Upheld,
+			Dismissed: rep.Dismissed,
+			Trusted:   m.isTrusted(pubkey),
+			Ignored:   m.isIgnored(pubkey),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].PubKey < list[j].PubKey })
+	return list
+}
+
+// summary describes the report types of a queue item, e.g. "3 reports: spam (2), illegal (1)"
+func (item ModerationItem) summary() string {
+	types := make([]string, 0, len(item.Types))
+	for t := range item.Types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if item.Types[types[i]] != item.Types[types[j]] {
+			return item.Types[types[i]] > item.Types[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	parts := make([]string, len(types))
+	for i, t := range types {
+		parts[i] = fmt.Sprintf("%s (%d)", t, item.Types[t])
+	}
+	noun := "reports"
+	if item.Reports == 1 {
+		noun = "report"
+	}
+	return fmt.Sprintf("%d %s: %s", item.Reports, noun, strings.Join(parts, ", "))
+}
@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/paul/glienicke/pkg/nips/nip11"
+	"github.com/paul/glienicke/pkg/nips/nip59"
+	"github.com/paul/glienicke/pkg/protocol"
+)
+
+const (
+	defaultRelayName        = "Glienicke Nostr Relay"
+	defaultRelayDescription = "Glienicke - a Nostr relay written in Go"
+	defaultRelayIcon        = "https://www.paulstephenborile.com/wp-content/uploads/2026/02/cropped-logo-only.png"
+	relaySoftware           = "https://github.com/paul/glienicke"
+)
+
+// baseSupportedNIPs are the NIPs handled regardless of configuration
+var baseSupportedNIPs = []int{1, 2, 4, 9, 11, 17, 22, 25, 40, 44, 45, 50, 59, 62, 65, 98}
+
+// SetInfo sets the operator-provided fields of the NIP-11 relay information
+// document (name, description, contact, retention, fees, ...). Supported NIPs,
+// software, version and the enforced limits are always filled in by the relay.
+func (r *Relay) SetInfo(info *nip11.RelayInformationDocument) {
+	r.infoMu.Lock()
+	defer r.infoMu.Unlock()
+	r.info = info
+}
+
+// relayInfo builds the NIP-11 document from the configured fields and the
+// limits and modules actually in effect
+func (r *Relay) relayInfo() *nip11.RelayInformationDocument {
+	r.infoMu.RLock()
+	var info nip11.RelayInformationDocument
+	if r.info != nil {
+		info = *r.info
+	}
+	r.infoMu.RUnlock()
+
+	info.Name = r.relayName()
+	if info.Description == "" {
+		info.Description = defaultRelayDescription
+	}
+	if info.Icon == "" {
+		info.Icon = defaultRelayIcon
+	}
+	info.Software = relaySoftware
+	info.Version = r.version
+	info.SupportedNIPs = r.supportedNIPs()
+	if info.Self == "" {
+		// NIP-29 clients verify group state against the relay's own pubkey
+		info.Self = r.GroupsPubKey()
+	}
+
+	// Advertise the limits the relay enforces; configured values only fill in
+	// what the relay cannot know itself, such as payment_required
+	limitation := &nip11.RelayLimitation{}
+	if info.Limitation != nil {
+		limitation.PaymentRequired = info.Limitation.PaymentRequired
+		limitation.RestrictedWrites = info.Limitation.RestrictedWrites
+	}
+	limitation.MaxSubscriptions = protocol.MaxSubscriptionsPerClient
+	limitation.MaxLimit = r.maxEventsPerREQ
+	// The event size limit bounds both the EVENT message and its content
+	limitation.MaxMessageLength = r.maxEventSize()
+	limitation.MaxContentLength = r.maxEventSize()
+	limitation.AuthRequired = r.requireAuth
+	if policy := r.powPolicy.Load(); policy != nil {
+		limitation.MinPowDifficulty = policy.MaxDifficulty()
+	}
+	if r.requireAuth || limitation.PaymentRequired || limitation.MinPowDifficulty > 0 || r.nip36Policy.Load() != nil || r.mgmt.restrictsKinds() || r.acl.restrictsWrites() || r.inboxMode {
+		limitation.RestrictedWrites = true
+	}
+	info.Limitation = limitation
+
+	// Retention enforced by the relay replaces the configured description
+	var retention []nip11.Retention
+	retentionDays := int(r.retentionDays.Load())
+	if retentionDays > 0 {
+		exempt := make([]interface{}, len(retentionExemptKinds))
+		for i, kind := range retentionExemptKinds {
+			exempt[i] = kind
+		}
+		retention = append(retention, nip11.Retention{Kinds: exempt})
+	}
+	if days := r.giftWrapRetention(); days > 0 && days != retentionDays {
+		seconds := int64(days) * 24 * 60 * 60
+		retention = append(retention, nip11.Retention{Kinds: []interface{}{nip59.GiftWrapKind}, Time: &seconds})
+	}
+	if retentionDays > 0 {
+		seconds := int64(retentionDays) * 24 * 60 * 60
+		retention = append(retention, nip11.Retention{Time: &seconds})
+	}
+	if retention != nil {
+		info.Retention = retention
+	}
+
+	return &info
+}
+
+// supportedNIPs lists the NIPs handled with the current configuration
+func (r *Relay) supportedNIPs() []int {
+	nips := append([]int(nil), baseSupportedNIPs...)
+	if r.features.NIP28 {
+		nips = append(nips, 28)
+	}
+	if r.features.NIP42 {
+		// NIP-70 protected events are accepted from authenticated authors
+		nips = append(nips, 42, 70)
+	}
+	if r.powPolicy.Load() != nil {
+		nips = append(nips, 13)
+	}
+	if r.nip36Policy.Load() != nil {
+		nips = append(nips, 36)
+	}
+	if r.hasAdmins() {
+		nips = append(nips, 86)
+	}
+	if r.groups != nil {
+		nips = append(nips, 29)
+	}
+	sort.Ints(nips)
+	return nips
+}
+
+// relayName returns the NIP-11 name, as changed through NIP-86, configured, or the default
+func (r *Relay) relayName() string {
+	if name := r.mgmt.name(); name != "" {
+		return name
+	}
+	r.infoMu.RLock()
+	defer r.infoMu.RUnlock()
+	if r.info != nil && r.info.Name != "" {
+		return r.info.Name
+	}
+	return defaultRelayName
+}
+
+// serveRelayInfo writes the NIP-11 relay information document
+func (r *Relay) serveRelayInfo(w http.ResponseWriter) {
+	writeCORSHeaders(w)
+	w.Header().Set("Content-Type", nip11.MediaType)
+	json.NewEncoder(w).Encode(r.relayInfo())
+}
+
+// writeCORSHeaders allows browsers to fetch the relay URL from any origin (NIP-11)
+func writeCORSHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+}
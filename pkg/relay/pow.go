@@ -0,0 +1,48 @@
+package relay
+
+import "sync"
+
+// maxKnownAuthors bounds the NIP-13 known-author cache. When it is full the
+// cache is reset and authors are looked up in the store again.
+const maxKnownAuthors = 100000
+
+// knownAuthors caches the pubkeys the store holds events from, so that the
+// NIP-13 ExemptKnown check does not cost a query for every event a regular
+// author publishes. Only positive lookups are cached; authors are added as
+// their events are stored and removed when they vanish (NIP-62).
+type knownAuthors struct {
+	mu      sync.RWMutex
+	pubkeys map[string]struct{}
+}
+
+func newKnownAuthors() *knownAuthors {
+	return &knownAuthors{pubkeys: make(map[string]struct{})}
+}
+
+// has reports whether pubkey is cached as known.
+func (k *knownAuthors) has(pubkey string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, ok := k.pubkeys[pubkey]
+	return ok
+}
+
+// add caches pubkey as known, resetting the cache when it is full.
+func (k *knownAuthors) add(pubkey string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.pubkeys[pubkey]; ok {
+		return
+	}
+	if len(k.pubkeys) >= maxKnownAuthors {
+		k.pubkeys = make(map[string]struct{})
+	}
+	k.pubkeys[pubkey] = struct{}{}
+}
+
+// remove forgets pubkey, e.g. after its events were deleted.
+func (k *knownAuthors) remove(pubkey string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.pubkeys, pubkey)
+}
@@ -0,0 +1,36 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsKnownPubKey_Cached(t *testing.T) {
+	store := memory.New()
+	r := New(store)
+	t.Cleanup(func() { r.Close() })
+
+	ctx := context.Background()
+	kp := testutil.MustGenerateKeyPair()
+	assert.False(t, r.isKnownPubKey(kp.PubKeyHex))
+
+	// Unknown authors are not cached, so their first event makes them known
+	evt := &event.Event{Kind: 1, CreatedAt: time.Now().Unix(), Content: "hello"}
+	require.NoError(t, kp.SignEvent(evt))
+	require.NoError(t, store.SaveEvent(ctx, evt))
+	assert.True(t, r.isKnownPubKey(kp.PubKeyHex))
+
+	// Known authors are answered from the cache
+	require.NoError(t, store.DeleteAllEventsByPubKey(ctx, kp.PubKeyHex))
+	assert.True(t, r.isKnownPubKey(kp.PubKeyHex))
+
+	r.knownAuthors.remove(kp.PubKeyHex)
+	assert.False(t, r.isKnownPubKey(kp.PubKeyHex))
+}
@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/paul/glienicke/pkg/proxyproto"
+)
+
+// defaultTrustedProxies are trusted until SetTrustedProxies is called: a
+// reverse proxy on the same host
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// SetTrustedProxies sets the addresses or CIDR networks of the reverse
+// proxies whose X-Forwarded-For, Forwarded and X-Real-IP headers and PROXY
+// protocol headers are believed. Requests from other peers are attributed to
+// the peer's address. It can be called while the relay is serving.
+func (r *Relay) SetTrustedProxies(proxies []string) error {
+	networks, err := parseNetworks(proxies)
+	if err != nil {
+		return err
+	}
+	r.trustedProxies.Store(&networks)
+	return nil
+}
+
+// SetProxyProtocol makes Start and StartTLS read PROXY protocol (v1 and v2)
+// headers from trusted proxies. Call it before the relay starts serving.
+func (r *Relay) SetProxyProtocol(enabled bool) {
+	r.proxyProtocol = enabled
+}
+
+// parseNetworks parses IP addresses and CIDR networks
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: want an IP address or CIDR network", v)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy
+func (r *Relay) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	networks := r.trustedProxies.Load()
+	if networks == nil {
+		return false
+	}
+	for _, network := range *networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listen opens the relay's listener, reading PROXY protocol headers if enabled
+func (r *Relay) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.proxyProtocol {
+		ln = &proxyproto.Listener{Listener: ln, Trusted: r.isTrustedProxy}
+	}
+	return ln, nil
+}
+
+// requestIP returns the client IP of an HTTP request. Proxy headers are only
+// believed from trusted proxies: the forwarding chain is walked from the
+// right, and the first address that is not a trusted proxy is the client.
+func (r *Relay) requestIP(req *http.Request) string {
+	peer := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	ip := net.ParseIP(peer)
+	if !r.isTrustedProxy(ip) {
+		return peer
+	}
+
+	hops := forwardedFor(req)
+	if len(hops) == 0 {
+		if realIP := parseHop(req.Header.Get("X-Real-IP")); realIP != nil {
+			return realIP.String()
+		}
+		return ip.String()
+	}
+	for i := len(hops) - 1; i >= 0 && r.isTrustedProxy(ip); i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// Unknown or obfuscated hops end the chain at the last proxy
+			break
+		}
+		ip = hop
+	}
+	return ip.String()
+}
+
+// forwardedFor returns the forwarding chain of a request, client first, from
+// the Forwarded header (RFC 7239) or else X-Forwarded-For
+func forwardedFor(req *http.Request) []string {
+	var hops []string
+	if values := req.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hop = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHop parses a forwarding chain entry: an IP address, optionally quoted,
+// bracketed or with a port. It returns nil for anything else, such as the
+// "unknown" and obfuscated identifiers of RFC 7239.
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIP(t *testing.T) {
+	r := New(memory.New())
+	t.Cleanup(func() { r.Close() })
+	require.NoError(t, r.SetTrustedProxies([]string{"10.0.0.0/8", "2001:db8:ffff::1"}))
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "direct", remote: "203.0.113.7:4000", want: "203.0.113.7"},
+		{name: "untrusted peer cannot spoof", remote: "203.0.113.7:4000", headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, want: "203.0.113.7"},
+		{name: "untrusted peer X-Real-IP", remote: "203.0.113.7:4000", headers: map[string]string{"X-Real-IP": "198.51.100.1"}, want: "203.0.113.7"},
+		{name: "trusted proxy", remote: "10.0.0.1:4000", headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed leftmost entry", remote: "10.0.0.1:4000", headers: map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "proxy chain", remote: "10.0.0.1:4000", headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "all hops trusted", remote: "10.0.0.1:4000", headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "garbage hop", remote: "10.0.0.1:4000", headers: map[string]string{"X-Forwarded-For": "198.51.100.1, garbage"}, want: "10.0.0.1"},
+		{name: "X-Real-IP", remote: "10.0.0.1:4000", headers: map[string]string{"X-Real-IP": "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "Forwarded", remote: "10.0.0.1:4000", headers: map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:db8:cafe::17]:4711";proto=https`}, want: "2001:db8:cafe::17"},
+		{name: "Forwarded over X-Forwarded-For", remote: "10.0.0.1:4000", headers: map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "1.2.3.4"}, want: "198.51.100.1"},
+		{name: "Forwarded obfuscated", remote: "10.0.0.1:4000", headers: map[string]string{"Forwarded": "for=_hidden"}, want: "10.0.0.1"},
+		{name: "trusted IPv6 proxy", remote: "[2001:db8:ffff::1]:443", headers: map[string]string{"X-Forwarded-For": "198.51.100.1:5555"}, want: "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, r.requestIP(req))
+		})
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	r := New(memory.New())
+	t.Cleanup(func() { r.Close() })
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:4000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "198.51.100.1", r.requestIP(req), "loopback proxies are trusted by default")
+
+	require.NoError(t, r.SetTrustedProxies(nil))
+	assert.Equal(t, "127.0.0.1", r.requestIP(req))
+
+	assert.Error(t, r.SetTrustedProxies([]string{"10.0.0.0/33"}))
+}
@@ -0,0 +1,315 @@
+package relay
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/protocol"
+)
+
+// Rate limit keys: anonymous clients are limited per IP network, authenticated
+// clients per pubkey and, together, per IP network
+const (
+	rateKeyIP     = "ip:"
+	rateKeyPubKey = "pubkey:"
+)
+
+// rateLimiter holds the token buckets and violations of one key. Limiters
+// are kept in LRU order and evicted when idle or over the tracking cap; ban
+// state lives in Relay.bans so that eviction does not forget it.
+type rateLimiter struct {
+	key           string
+	buckets       map[string]*tokenBucket // by message type or "kind:<n>"
+	violations    int                     // within the escalation window
+	lastViolation time.Time
+	lastSeen      time.Time
+	pubkeys       map[string]bool // IP keys: authenticated pubkeys seen from the network
+	elem          *list.Element   // position in Relay.limiterLRU
+}
+
+// maxObservedPubKeys bounds the pubkeys remembered per IP network
+const maxObservedPubKeys = 32
+
+func newRateLimiter(key string) *rateLimiter {
+	return &rateLimiter{
+		key:     key,
+		buckets: make(map[string]*tokenBucket),
+		pubkeys: make(map[string]bool),
+	}
+}
+
+// observePubKey remembers an authenticated pubkey seen from an IP network
+func (lim *rateLimiter) observePubKey(pubkey string) {
+	if len(lim.pubkeys) < maxObservedPubKeys {
+		lim.pubkeys[pubkey] = true
+	}
+}
+
+// tokenBucket allows rate tokens per second with bursts of burst seconds' worth
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token, reporting false if none is left. A rate of 0 is unlimited.
+func (b *tokenBucket) take(rate, burst float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	size := math.Max(rate*burst, 1)
+	if b.last.IsZero() {
+		b.tokens = size
+	} else {
+		b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*rate, size)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait returns the time until the next token
+func (b *tokenBucket) wait(rate float64) time.Duration {
+	if b.tokens >= 1 || rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// ipRateKey returns the limiter key of an IP: the address for IPv4, the
+// network of the configured prefix length for IPv6
+func ipRateKey(ip string, ipv6Prefix int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil || ipv6Prefix >= 128 {
+		return rateKeyIP + ip
+	}
+	network := parsed.Mask(net.CIDRMask(ipv6Prefix, 128))
+	return rateKeyIP + network.String() + "/" + strconv.Itoa(ipv6Prefix)
+}
+
+// limiter returns the limiter of a key, creating it and evicting idle and
+// least recently used limiters over the cap. Callers hold limiterMu.
+func (r *Relay) limiter(key string, now time.Time) *rateLimiter {
+	if lim, ok := r.limiters[key]; ok {
+		lim.lastSeen = now
+		r.limiterLRU.MoveToFront(lim.elem)
+		return lim
+	}
+	lim := newRateLimiter(key)
+	lim.lastSeen = now
+	lim.elem = r.limiterLRU.PushFront(lim)
+	r.limiters[key] = lim
+	r.evictLimiters(now)
+	return lim
+}
+
+// evictLimiters drops limiters idle for longer than the idle timeout and the
+// least recently used ones over MaxTrackedClients. Callers hold limiterMu.
+func (r *Relay) evictLimiters(now time.Time) {
+	limits := r.rateLimits
+	for back := r.limiterLRU.Back(); back != nil; back = r.limiterLRU.Back() {
+		lim := back.Value.(*rateLimiter)
+		if r.limiterLRU.Len() <= limits.MaxTrackedClients && now.Sub(lim.lastSeen) < limits.IdleTimeout {
+			return
+		}
+		r.limiterLRU.Remove(back)
+		delete(r.limiters, lim.key)
+	}
+}
+
+// resetLimiters forgets all limiter state. Callers hold limiterMu.
+func (r *Relay) resetLimiters() {
+	r.limiters = make(map[string]*rateLimiter)
+	r.limiterLRU = list.New()
+}
+
+// trackedClients returns the number of keys with limiter state
+func (r *Relay) trackedClients() int {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+	return len(r.limiters)
+}
+
+// clientRates picks the limiter key and rates of a client: trusted and
+// authenticated pubkeys are limited per pubkey, anonymous clients per IP
+// network. Callers hold limiterMu.
+func (r *Relay) clientRates(ipKey, pubkey string) (key string, rates MessageRates, trusted bool) {
+	limits := r.rateLimits
+	switch {
+	case pubkey != "" && r.trustedPubKeys[pubkey]:
+		return rateKeyPubKey + pubkey, limits.Trusted, true
+	case pubkey != "":
+		return rateKeyPubKey + pubkey, limits.Authenticated, false
+	default:
+		return ipKey, MessageRates{Events: limits.EventsPerSec, Reqs: limits.ReqPerSec, Counts: limits.CountPerSec}, false
+	}
+}
+
+// checkRate limits client messages with token buckets per message type,
+// keyed by IP network or authenticated pubkey.
+// Returns empty string if allowed, or a reason string if rejected.
+func (r *Relay) checkRate(clientIP string, pubkey string, msgType protocol.MessageType) string {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+
+	limits := r.rateLimits
+	if !limits.Enabled {
+		return ""
+	}
+	now := time.Now()
+
+	ipKey := ipRateKey(clientIP, limits.IPv6Prefix)
+	if r.banned(ipKey, now) {
+		return banReason
+	}
+	if pubkey != "" {
+		r.limiter(ipKey, now).observePubKey(pubkey)
+	}
+
+	key, rates, trusted := r.clientRates(ipKey, pubkey)
+	if key != ipKey && r.banned(key, now) {
+		return banReason
+	}
+	lim := r.limiter(key, now)
+
+	var rate float64
+	bucket := string(msgType)
+	switch msgType {
+	case protocol.MessageTypeEvent, protocol.MessageTypeAuth:
+		rate, bucket = rates.Events, string(protocol.MessageTypeEvent)
+	case protocol.MessageTypeCount:
+		rate = rates.Counts
+	default:
+		rate, bucket = rates.Reqs, string(protocol.MessageTypeReq)
+	}
+	const reason = "rate-limited: too many messages, slow down"
+	if !r.bucket(lim, bucket).take(rate, limits.Burst, now) {
+		return r.clientViolation(ipKey, key, lim, trusted, now, reason)
+	}
+
+	// Authenticated clients of a network also share one bucket at the
+	// authenticated rates, so that authenticating every connection with a
+	// fresh key does not multiply the network's rate
+	if key != ipKey && !trusted {
+		ipLim := r.limiter(ipKey, now)
+		if !r.bucket(ipLim, rateKeyPubKey+bucket).take(rate, limits.Burst, now) {
+			return r.violation(ipKey, ipLim, now, reason)
+		}
+	}
+	return ""
+}
+
+// checkKindRate applies the per-kind EVENT rates to an event; trusted pubkeys
+// are exempt
+func (r *Relay) checkKindRate(c *protocol.Client, evt *event.Event) string {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+
+	limits := r.rateLimits
+	rate := limits.KindsPerSec[evt.Kind]
+	if !limits.Enabled || rate <= 0 {
+		return ""
+	}
+	ipKey := ipRateKey(c.RemoteAddr(), limits.IPv6Prefix)
+	key, _, trusted := r.clientRates(ipKey, c.AuthPubKey())
+	if trusted {
+		return ""
+	}
+	now := time.Now()
+	lim := r.limiter(key, now)
+	if r.bucket(lim, "kind:"+strconv.Itoa(evt.Kind)).take(rate, limits.Burst, now) {
+		return ""
+	}
+	return r.clientViolation(ipKey, key, lim, false, now, fmt.Sprintf("rate-limited: too many kind %d events, slow down", evt.Kind))
+}
+
+// checkConnectionRate limits new WebSocket connections per IP network, so
+// that reconnect storms count as violations and end in a ban. It returns the
+// reason and how long to wait if the connection is rejected.
+func (r *Relay) checkConnectionRate(ip string) (string, time.Duration) {
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+
+	limits := r.rateLimits
+	if !limits.Enabled || limits.ConnectionsPerSec <= 0 {
+		return "", 0
+	}
+	now := time.Now()
+	key := ipRateKey(ip, limits.IPv6Prefix)
+	lim := r.limiter(key, now)
+	b := r.bucket(lim, "connect")
+	if b.take(limits.ConnectionsPerSec, limits.Burst, now) {
+		return "", 0
+	}
+	reason := r.violation(key, lim, now, "rate-limited: too many connections, slow down")
+	if reason == banReason {
+		return reason, r.bans[key].until.Sub(now)
+	}
+	return reason, b.wait(limits.ConnectionsPerSec)
+}
+
+func (r *Relay) bucket(lim *rateLimiter, name string) *tokenBucket {
+	b, ok := lim.buckets[name]
+	if !ok {
+		b = &tokenBucket{}
+		lim.buckets[name] = b
+	}
+	return b
+}
+
+// violation records a rate limit violation and escalates repeated ones to a
+// ban (see ban). Callers hold limiterMu.
+func (r *Relay) violation(key string, lim *rateLimiter, now time.Time, reason string) string {
+	r.obs.rateLimited.Inc()
+	if r.escalate(key, lim, now) {
+		return banReason
+	}
+	return reason
+}
+
+// clientViolation records a violation of a client's limiter. Violations of
+// authenticated, untrusted clients also count against their IP network, so
+// that rotating keys still ends in an IP ban. Callers hold limiterMu.
+func (r *Relay) clientViolation(ipKey, key string, lim *rateLimiter, trusted bool, now time.Time, reason string) string {
+	r.obs.rateLimited.Inc()
+	banned := r.escalate(key, lim, now)
+	if key != ipKey && !trusted && r.escalate(ipKey, r.limiter(ipKey, now), now) {
+		banned = true
+	}
+	if banned {
+		return banReason
+	}
+	return reason
+}
+
+// escalate counts a violation of a key and bans it once there are
+// Escalation.Violations within the window. Callers hold limiterMu.
+func (r *Relay) escalate(key string, lim *rateLimiter, now time.Time) bool {
+	esc := r.rateLimits.Escalation
+	if now.Sub(lim.lastViolation) > esc.Window {
+		lim.violations = 0
+	}
+	lim.violations++
+	lim.lastViolation = now
+	if lim.violations < esc.Violations {
+		rateLogger.Warn("rate limited", "key", key, "violations", lim.violations, "ban_after", esc.Violations)
+		return false
+	}
+	lim.violations = 0
+
+	pubkeys := make([]string, 0, len(lim.pubkeys))
+	for pk := range lim.pubkeys {
+		pubkeys = append(pubkeys, pk)
+	}
+	sort.Strings(pubkeys)
+	r.ban(key, now, pubkeys)
+	return true
+}
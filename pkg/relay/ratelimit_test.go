@@ -0,0 +1,268 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRateLimitedRelay(t *testing.T, limits RateLimits) *Relay {
+	t.Helper()
+	r := New(memory.New())
+	t.Cleanup(func() { r.Close() })
+	limits.Enabled = true
+	r.SetRateLimits(limits)
+	return r
+}
+
+// spend sends n messages and returns how many were allowed
+func spend(r *Relay, ip, pubkey string, msgType protocol.MessageType, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if r.checkRate(ip, pubkey, msgType) == "" {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestCheckRate_SeparateBuckets(t *testing.T) {
+	r := newRateLimitedRelay(t, RateLimits{EventsPerSec: 5, ReqPerSec: 5, CountPerSec: 1, Escalation: Escalation{Violations: 1000}})
+
+	assert.Equal(t, 10, spend(r, "10.0.0.1", "", protocol.MessageTypeEvent, 20))
+	// An EVENT flood leaves the REQ and COUNT buckets alone
+	assert.Equal(t, 10, spend(r, "10.0.0.1", "", protocol.MessageTypeReq, 20))
+	assert.Equal(t, 2, spend(r, "10.0.0.1", "", protocol.MessageTypeCount, 20))
+	// Other IPs have their own buckets
+	assert.Equal(t, 10, spend(r, "10.0.0.2", "", protocol.MessageTypeEvent, 20))
+}
+
+func TestCheckRate_IPv6Aggregation(t *testing.T) {
+	r := newRateLimitedRelay(t, RateLimits{EventsPerSec: 5, Escalation: Escalation{Violations: 1000}})
+
+	assert.Equal(t, 5, spend(r, "2001:db8:1:2::1", "", protocol.MessageTypeEvent, 5))
+	assert.Equal(t, 5, spend(r, "2001:db8:1:2::ffff", "", protocol.MessageTypeEvent, 10), "same /64 shares the bucket")
+	assert.Equal(t, 10, spend(r, "2001:db8:1:3::1", "", protocol.MessageTypeEvent, 20), "another /64 has its own")
+
+	r.SetRateLimits(RateLimits{Enabled: true, EventsPerSec: 5, IPv6Prefix: 128, Escalation: Escalation{Violations: 1000}})
+	assert.Equal(t, 10, spend(r, "2001:db8:1:2::1", "", protocol.MessageTypeEvent, 20))
+	assert.Equal(t, 10, spend(r, "2001:db8:1:2::2", "", protocol.MessageTypeEvent, 20))
+}
+
+func TestCheckRate_Tiers(t *testing.T) {
+	alice, bob, trusted := hexID(1), hexID(2), hexID(3)
+	r := newRateLimitedRelay(t, RateLimits{
+		EventsPerSec:   1,
+		Authenticated:  MessageRates{Events: 5},
+		TrustedPubKeys: []string{trusted},
+		Escalation:     Escalation{Violations: 1000},
+	})
+
+	assert.Equal(t, 2, spend(r, "10.0.0.1", "", protocol.MessageTypeEvent, 20))
+	// Authenticated clients are limited per pubkey, not by the IP's exhausted bucket
+	assert.Equal(t, 10, spend(r, "10.0.0.1", alice, protocol.MessageTypeEvent, 20))
+	assert.Equal(t, 10, spend(r, "10.0.0.2", bob, protocol.MessageTypeEvent, 20))
+	// Unset authenticated rates fall back to the per-IP rates
+	assert.Equal(t, 20, spend(r, "10.0.0.1", alice, protocol.MessageTypeReq, 20))
+	// Trusted pubkeys without rates are unlimited
+	assert.Equal(t, 100, spend(r, "10.0.0.1", trusted, protocol.MessageTypeEvent, 100))
+}
+
+func TestCheckRate_RotatingPubKeys(t *testing.T) {
+	r := newRateLimitedRelay(t, RateLimits{
+		EventsPerSec:  1,
+		Authenticated: MessageRates{Events: 5},
+		Escalation:    Escalation{Violations: 3, BanDuration: time.Hour, LongBanAfter: 1, LongBanDuration: time.Hour},
+	})
+
+	// Fresh keys from one network share the network's authenticated bucket
+	assert.Equal(t, 10, spend(r, "10.0.0.1", hexID(1), protocol.MessageTypeEvent, 10))
+	reason := r.checkRate("10.0.0.1", hexID(2), protocol.MessageTypeEvent)
+	assert.True(t, strings.HasPrefix(reason, "rate-limited:"), reason)
+	assert.Equal(t, 10, spend(r, "10.0.0.2", hexID(3), protocol.MessageTypeEvent, 10), "other networks are unaffected")
+
+	// Their violations escalate to a ban of the network
+	r.checkRate("10.0.0.1", hexID(4), protocol.MessageTypeEvent)
+	r.checkRate("10.0.0.1", hexID(5), protocol.MessageTypeEvent)
+	assert.True(t, r.IsIPBanned("10.0.0.1"))
+	assert.Equal(t, banReason, r.checkRate("10.0.0.1", hexID(6), protocol.MessageTypeEvent))
+}
+
+func TestCheckKindRate(t *testing.T) {
+	r := newRateLimitedRelay(t, RateLimits{KindsPerSec: map[int]float64{7: 1}, Escalation: Escalation{Violations: 1000}})
+	c := protocol.NewDetachedClient(r, "10.0.0.1")
+
+	reaction := &event.Event{Kind: 7}
+	assert.Empty(t, r.checkKindRate(c, reaction))
+	assert.Empty(t, r.checkKindRate(c, reaction))
+	reason := r.checkKindRate(c, reaction)
+	assert.True(t, strings.HasPrefix(reason, "rate-limited:"), reason)
+	assert.Contains(t, reason, "kind 7")
+
+	assert.Empty(t, r.checkKindRate(c, &event.Event{Kind: 1}), "unlisted kinds are not limited")
+}
+
+func TestCheckRate_Escalation(t *testing.T) {
+	r := newRateLimitedRelay(t, RateLimits{
+		EventsPerSec: 1,
+		Escalation: Escalation{
+			Violations:      2,
+			BanDuration:     50 * time.Millisecond,
+			LongBanAfter:    1,
+			LongBanDuration: time.Hour,
+		},
+	})
+	ip := "10.0.0.1"
+
+	spend(r, ip, "", protocol.MessageTypeEvent, 2)
+	assert.True(t, strings.HasPrefix(r.checkRate(ip, "", protocol.MessageTypeEvent), "rate-limited:"))
+	assert.True(t, strings.HasPrefix(r.checkRate(ip, "", protocol.MessageTypeEvent), "banned:"))
+	assert.True(t, r.IsIPBanned(ip))
+	assert.True(t, strings.HasPrefix(r.checkRate(ip, "", protocol.MessageTypeReq), "banned:"), "bans cover every message type")
+
+	// The temporary ban expires; the next one is long
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, r.IsIPBanned(ip))
+	spend(r, ip, "", protocol.MessageTypeEvent, 2)
+	r.checkRate(ip, "", protocol.MessageTypeEvent)
+	require.True(t, r.IsIPBanned(ip))
+	bans := r.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, ip, bans[0].Target)
+	assert.Greater(t, time.Until(bans[0].Until), 30*time.Minute)
+
+	require.NoError(t, r.LiftBan(context.Background(), ip))
+	assert.False(t, r.IsIPBanned(ip))
+}
+
+func TestLimiterEviction(t *testing.T) {
+	r := newRateLimitedRelay(t, RateLimits{MaxTrackedClients: 3, IdleTimeout: time.Hour})
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		spend(r, ip, "", protocol.MessageTypeEvent, 1)
+	}
+	spend(r, "10.0.0.1", "", protocol.MessageTypeEvent, 1)
+	spend(r, "10.0.0.4", "", protocol.MessageTypeEvent, 1)
+	assert.Equal(t, 3, r.trackedClients())
+	r.limiterMu.Lock()
+	assert.NotContains(t, r.limiters, ipRateKey("10.0.0.2", defaultIPv6Prefix), "least recently seen is evicted")
+	assert.Contains(t, r.limiters, ipRateKey("10.0.0.1", defaultIPv6Prefix))
+	r.limiterMu.Unlock()
+
+	r.SetRateLimits(RateLimits{Enabled: true, IdleTimeout: 50 * time.Millisecond})
+	time.Sleep(100 * time.Millisecond)
+	spend(r, "10.0.0.5", "", protocol.MessageTypeEvent, 1)
+	assert.Equal(t, 1, r.trackedClients(), "idle clients are evicted")
+}
+
+func TestBans_SurviveEvictionAndRestart(t *testing.T) {
+	store := memory.New()
+	limits := RateLimits{Enabled: true, EventsPerSec: 1, MaxTrackedClients: 2, Escalation: Escalation{Violations: 1}}
+	alice := hexID(1)
+
+	r := New(store)
+	r.SetRateLimits(limits)
+	spend(r, "10.0.0.1", alice, protocol.MessageTypeReq, 1)
+	spend(r, "10.0.0.1", "", protocol.MessageTypeEvent, 3)
+	require.True(t, r.IsIPBanned("10.0.0.1"))
+	// Tracking other clients evicts the banned one's limiter, not its ban
+	spend(r, "10.0.0.2", "", protocol.MessageTypeEvent, 1)
+	spend(r, "10.0.0.3", "", protocol.MessageTypeEvent, 1)
+	r.limiterMu.Lock()
+	assert.NotContains(t, r.limiters, ipRateKey("10.0.0.1", defaultIPv6Prefix))
+	r.limiterMu.Unlock()
+	assert.True(t, r.IsIPBanned("10.0.0.1"))
+	require.NoError(t, r.Close())
+
+	r = New(store)
+	defer r.Close()
+	r.SetRateLimits(limits)
+	assert.True(t, r.IsIPBanned("10.0.0.1"), "bans are restored at startup")
+	bans := r.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, []string{alice}, bans[0].PubKeys)
+	assert.Contains(t, bans[0].Reason, "rate limit violations")
+
+	require.NoError(t, r.LiftBan(context.Background(), "10.0.0.1"))
+	r.banWrites.Wait()
+	stored, err := store.ListBans(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, stored, "lifted bans are removed from the store")
+}
+
+func TestPruneExpiredBans(t *testing.T) {
+	r := newRateLimitedRelay(t, RateLimits{
+		EventsPerSec: 1,
+		Escalation:   Escalation{Violations: 1, BanDuration: 10 * time.Millisecond, LongBanAfter: 5, LongBanDuration: 20 * time.Millisecond},
+	})
+	for i := 1; i <= 3; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		spend(r, ip, "", protocol.MessageTypeEvent, 10)
+		require.True(t, r.IsIPBanned(ip))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	r.pruneExpiredBans()
+	r.limiterMu.Lock()
+	defer r.limiterMu.Unlock()
+	assert.Empty(t, r.bans)
+}
+
+func TestBans_ExportImport(t *testing.T) {
+	src := newRateLimitedRelay(t, RateLimits{})
+	dst := newRateLimitedRelay(t, RateLimits{})
+	ctx := context.Background()
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	added, err := src.AddBans(ctx, []Ban{
+		{Target: "203.0.113.7", Reason: "abuse", Until: until},
+		{Target: "2001:db8:1:2::/64", Until: until},
+		{Target: hexID(9), Until: until},
+		{Target: "203.0.113.8", Until: time.Now().Add(-time.Minute)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, added, "expired bans are skipped")
+	assert.True(t, src.IsIPBanned("2001:db8:1:2::99"))
+	assert.True(t, strings.HasPrefix(src.checkRate("10.0.0.1", hexID(9), protocol.MessageTypeReq), "banned:"))
+
+	var blocklist, exported bytes.Buffer
+	require.NoError(t, src.ExportBans(&blocklist))
+	want := blocklist.String()
+	imported, err := dst.ImportBans(ctx, &blocklist)
+	require.NoError(t, err)
+	assert.Equal(t, 3, imported)
+	require.NoError(t, dst.ExportBans(&exported))
+	assert.JSONEq(t, want, exported.String())
+
+	_, err = dst.AddBans(ctx, []Ban{{Target: "10.0.0.0/8", Until: until}})
+	assert.Error(t, err, "IPv4 networks are not rate limit keys")
+}
+
+func TestBans_IPv6Networks(t *testing.T) {
+	r := newRateLimitedRelay(t, RateLimits{})
+	ctx := context.Background()
+	until := time.Now().Add(time.Hour)
+
+	// Networks wider than the /64 aggregation could never match a client
+	_, err := r.AddBans(ctx, []Ban{{Target: "2001:db8:1::/48", Until: until}})
+	assert.Error(t, err)
+	assert.Empty(t, r.Bans())
+
+	// Narrower networks ban the client network they belong to
+	added, err := r.AddBans(ctx, []Ban{{Target: "2001:db8:1:2:3::/80", Until: until}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, added)
+	assert.True(t, r.IsIPBanned("2001:db8:1:2::99"))
+	assert.False(t, r.IsIPBanned("2001:db8:1:3::1"))
+	require.Len(t, r.Bans(), 1)
+	assert.Equal(t, "2001:db8:1:2::/64", r.Bans()[0].Target)
+}
@@ -1,40 +1,48 @@
 package relay
 
 import (
+	"container/list"
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/json"
 
 	"github.com/gorilla/websocket"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/paul/glienicke/internal/store/memory"
-	"github.com/paul/glienicke/internal/store/sqlite"
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/metrics"
 	"github.com/paul/glienicke/pkg/nips/nip02"
 	"github.com/paul/glienicke/pkg/nips/nip09"
 	"github.com/paul/glienicke/pkg/nips/nip11"
+	"github.com/paul/glienicke/pkg/nips/nip13"
 	"github.com/paul/glienicke/pkg/nips/nip22"
 	"github.com/paul/glienicke/pkg/nips/nip25"
 	"github.com/paul/glienicke/pkg/nips/nip28"
+	"github.com/paul/glienicke/pkg/nips/nip29"
 	"github.com/paul/glienicke/pkg/nips/nip36"
 	"github.com/paul/glienicke/pkg/nips/nip40"
 	"github.com/paul/glienicke/pkg/nips/nip42"
-	"github.com/paul/glienicke/pkg/nips/nip44"
+	"github.com/paul/glienicke/pkg/nips/nip45"
 	"github.com/paul/glienicke/pkg/nips/nip50"
+	"github.com/paul/glienicke/pkg/nips/nip56"
 	"github.com/paul/glienicke/pkg/nips/nip59"
 	"github.com/paul/glienicke/pkg/nips/nip62"
 	"github.com/paul/glienicke/pkg/nips/nip65"
+	"github.com/paul/glienicke/pkg/nips/nip70"
+	"github.com/paul/glienicke/pkg/nips/nip98"
 	"github.com/paul/glienicke/pkg/protocol"
 	"github.com/paul/glienicke/pkg/storage"
+	"github.com/paul/glienicke/pkg/writepolicy"
 )
 
 // ChannelStore defines the interface for storing channel events
@@ -43,8 +51,14 @@ type ChannelStore interface {
 	QueryChannelEvents(ctx context.Context, channelID string, since, until *int64, limit *int) ([]*event.Event, error)
 }
 
+// Subsystem loggers; levels are set per subsystem with logging.Configure
+var (
+	logger     = logging.For("relay")
+	rateLogger = logging.For("ratelimit")
+)
+
 // Version of the relay
-const Version = "0.19.8"
+const Version = "0.41.1"
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
@@ -56,41 +70,30 @@ var upgrader = websocket.Upgrader{
 type Metrics struct {
 	mu               sync.RWMutex
 	startTime        time.Time
-	totalConnections int64
-	totalEvents      int64
-	totalRequests    int64
 	packetsPerSecond float64
 	lastPacketTime   time.Time
 	packetCount      int64
 	lastPacketReset  time.Time
-	rateLimitedCount int64
 	memoryUsage      uint64
 	dbStatus         string
 }
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status            string  `json:"status"`
-	UptimeSeconds     float64 `json:"uptime_seconds"`
-	Version           string  `json:"version"`
-	ActiveConnections int     `json:"active_connections"`
-	TotalConnections  int64   `json:"total_connections"`
-	TotalEvents       int64   `json:"total_events"`
-	TotalRequests     int64   `json:"total_requests"`
-	PacketsPerSecond  float64 `json:"packets_per_second"`
-	RateLimitedCount  int64   `json:"rate_limited_count"`
-	MemoryUsageMB     float64 `json:"memory_usage_mb"`
-	DatabaseStatus    string  `json:"database_status"`
-	Timestamp         string  `json:"timestamp"`
-}
-
-// ipRateLimiter tracks per-IP REQ rate using a token bucket and ban state
-type ipRateLimiter struct {
-	tokens     float64
-	lastRefill time.Time
-	violations int
-	bannedAt   time.Time
-	pubkeys    map[string]bool // authenticated pubkeys seen from this IP
+	Status              string           `json:"status"`
+	UptimeSeconds       float64          `json:"uptime_seconds"`
+	Version             string           `json:"version"`
+	ActiveConnections   int              `json:"active_connections"`
+	TotalConnections    int64            `json:"total_connections"`
+	TotalEvents         int64            `json:"total_events"`
+	TotalRequests       int64            `json:"total_requests"`
+	PacketsPerSecond    float64          `json:"packets_per_second"`
+	RateLimitedCount    int64            `json:"rate_limited_count"`
+	Connections         ConnectionCounts `json:"connections"`          // WebSocket connections by client
+	RejectedConnections int64            `json:"rejected_connections"` // over a connection limit
+	MemoryUsageMB       float64          `json:"memory_usage_mb"`
+	DatabaseStatus      string           `json:"database_status"`
+	Timestamp           string           `json:"timestamp"`
 }
 
 // Relay is the main relay orchestrator
@@ -98,18 +101,57 @@ type Relay struct {
 	store           storage.Store
 	clients         map[*protocol.Client]bool
 	clientsMu       sync.RWMutex
+	subs            *subscriptionIndex // live subscriptions indexed for broadcast matching
+	broadcastMu     sync.Mutex         // orders broadcasts across client delivery queues
 	version         string
 	metrics         *Metrics
+	obs             *instrumentation // Prometheus series (see metrics.go)
 	mux             *http.ServeMux
-	ipLimiters      map[string]*ipRateLimiter
-	ipLimiterMu     sync.Mutex
+	limiters        map[string]*rateLimiter // rate limit state by IP network or pubkey (see ratelimit.go)
+	limiterLRU      *list.List              // limiters, most recently used first
+	limiterMu       sync.Mutex
+	bans            map[string]*banRecord // rate limit bans by limiter key (see bans.go), guarded by limiterMu
+	banStoreMu      sync.Mutex            // serializes ban writes to the store
+	banWrites       sync.WaitGroup        // background ban writes, waited for before the store closes
 	maxEventsPerREQ  int
-	rateLimitEnabled bool
+	rateLimits       RateLimits     // guarded by limiterMu
+	trustedPubKeys   map[string]bool // RateLimits.TrustedPubKeys, guarded by limiterMu
+	connsPerIP       map[string]int // open WebSocket connections per IP, guarded by clientsMu
+	connsPerNetwork  map[string]int // open WebSocket connections per limiter IP network, guarded by clientsMu
+	connsTotal       int            // open WebSocket connections, guarded by clientsMu
 	requireAuth      bool // NIP-42: require authentication before allowing REQ/EVENT
 	closeAfterEOSE   bool // Auto-close subscriptions after sending stored events
-	retentionDays    int  // Event retention period in days (0 = no retention)
+	retentionDays    atomic.Int64 // Event retention period in days (0 = no retention)
+	giftWrapRetentionDays atomic.Int64 // Gift wrap retention period in days (0 = retentionDays, see inbox.go)
+	inboxMode        bool // NIP-17 DM inbox: only gift wraps for users and their metadata
 	stopRetention    chan struct{}
-	nip36Policy      *nip36.Policy // NIP-36 content-warning enforcement (nil = disabled)
+	retentionDone    chan struct{} // closed when the retention loop has returned
+	stopOnce         sync.Once
+	shuttingDown     bool // set by Shutdown, guarded by clientsMu
+	server           *http.Server // started by Start or StartTLS, guarded by serverMu
+	serverMu         sync.Mutex
+	nip36Policy      atomic.Pointer[nip36.Policy] // NIP-36 content-warning enforcement (nil = disabled)
+	powPolicy        atomic.Pointer[nip13.Policy] // NIP-13 proof-of-work enforcement (nil = disabled)
+	knownAuthors     *knownAuthors // authors exempt under NIP-13 ExemptKnown (see pow.go)
+	writePolicy      atomic.Pointer[writepolicy.Plugin] // external write-policy plugin (nil = disabled)
+	queryTimeout     time.Duration // per-query timeout for REQ/COUNT (0 = no timeout)
+	costBudget       *event.CostBudget // filter cost budgets for REQ/COUNT (nil = unlimited)
+	queryCosts       map[*protocol.Client]float64 // cost of the queries running per connection
+	queryCostMu      sync.Mutex
+	mgmt             *management     // NIP-86 management state (bans, blocked IPs, kinds, relay name)
+	acl              *acl            // read/write access-control lists (see acl.go)
+	moderation       *moderation     // NIP-56 report queue (see moderation.go)
+	groups           *groupState     // NIP-29 relay-based groups (nil = disabled, see groups.go)
+	adminPubKeys     map[string]bool // pubkeys allowed to use the NIP-86 management API
+	adminMu          sync.RWMutex
+	tlsCert          atomic.Pointer[tls.Certificate] // served certificate, swapped by ReloadTLS
+	trustedProxies   atomic.Pointer[[]*net.IPNet] // peers whose proxy headers are believed (see proxy.go)
+	proxyProtocol    bool                         // read PROXY protocol headers from trusted proxies
+	features         Features
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	info             *nip11.RelayInformationDocument // operator-provided NIP-11 fields (nil = defaults)
+	infoMu           sync.RWMutex
 }
 
 // New creates a new relay instance
@@ -118,26 +160,61 @@ func New(store storage.Store) *Relay {
 	rlEnabled := true
 	if v := os.Getenv("GLIENICKE_RATE_LIMIT_ENABLED"); v == "false" || v == "0" {
 		rlEnabled = false
-		log.Println("Rate limiting DISABLED via GLIENICKE_RATE_LIMIT_ENABLED")
+		logger.Warn("rate limiting disabled via GLIENICKE_RATE_LIMIT_ENABLED")
+	}
+
+	obs := newInstrumentation()
+	if store != nil {
+		store = metrics.InstrumentStore(store, obs.store)
 	}
 
 	r := &Relay{
 		store:            store,
 		clients:          make(map[*protocol.Client]bool),
+		subs:             newSubscriptionIndex(),
 		version:          Version,
-		ipLimiters:       make(map[string]*ipRateLimiter),
+		limiters:         make(map[string]*rateLimiter),
+		limiterLRU:       list.New(),
+		bans:             make(map[string]*banRecord),
 		maxEventsPerREQ:  defaultMaxEventsPerREQ,
-		rateLimitEnabled: rlEnabled,
+		rateLimits:       defaultRateLimits(rlEnabled),
+		connsPerIP:       make(map[string]int),
+		connsPerNetwork:  make(map[string]int),
+		features:         Features{NIP11: true, NIP28: true, NIP42: true},
 		requireAuth:      false,
-		retentionDays:    defaultRetentionDays,
+		queryTimeout:     protocol.DefaultQueryTimeout,
+		queryCosts:       make(map[*protocol.Client]float64),
+		mgmt:             newManagement(store),
+		acl:              newACL(store),
+		knownAuthors:     newKnownAuthors(),
 		stopRetention:    make(chan struct{}),
+		retentionDone:    make(chan struct{}),
 		metrics: &Metrics{
 			startTime:       time.Now(),
 			dbStatus:        "unknown",
 			lastPacketReset: time.Now(),
 		},
+		obs: obs,
 		mux: http.NewServeMux(),
 	}
+	r.retentionDays.Store(defaultRetentionDays)
+	r.moderation = newModeration(store, r.isAdmin)
+	r.registerGauges()
+	r.SetTrustedProxies(defaultTrustedProxies)
+
+	// Load persisted NIP-86 management state
+	if err := r.mgmt.load(context.Background()); err != nil {
+		logger.Error("failed to load management state", logging.KeyError, err)
+	}
+	if err := r.acl.load(context.Background()); err != nil {
+		logger.Error("failed to load ACL entries", logging.KeyError, err)
+	}
+	if err := r.moderation.load(context.Background()); err != nil {
+		logger.Error("failed to load moderation queue", logging.KeyError, err)
+	}
+	if err := r.loadBans(context.Background()); err != nil {
+		logger.Error("failed to load rate limit bans", logging.KeyError, err)
+	}
 
 	// Setup HTTP routes
 	r.setupRoutes()
@@ -160,26 +237,52 @@ func (r *Relay) SetRequireAuth(enabled bool) {
 
 // SetRetentionDays sets the event retention period in days. 0 disables retention.
 func (r *Relay) SetRetentionDays(days int) {
-	r.retentionDays = days
+	r.retentionDays.Store(int64(days))
 }
 
 // SetNIP36Policy enables NIP-36 content-warning enforcement using the given vocabulary file.
 // The file is reloaded automatically when its mtime changes.
 // Pass an empty path to disable.
 func (r *Relay) SetNIP36Policy(vocabFile string) {
-	if vocabFile == "" {
-		if r.nip36Policy != nil {
-			r.nip36Policy.Close()
-			r.nip36Policy = nil
-		}
+	if current := r.nip36Policy.Load(); current != nil && current.Path() == vocabFile {
+		current.Reload()
 		return
 	}
-	r.nip36Policy = nip36.New(vocabFile)
-	r.nip36Policy.StartWatcher(30 * time.Second)
+	var policy *nip36.Policy
+	if vocabFile != "" {
+		policy = nip36.New(vocabFile)
+		policy.StartWatcher(30 * time.Second)
+	}
+	if old := r.nip36Policy.Swap(policy); old != nil {
+		old.Close()
+	}
+}
+
+// SetPoWPolicy enables NIP-13 proof-of-work enforcement. Pass nil to disable.
+func (r *Relay) SetPoWPolicy(policy *nip13.Policy) {
+	r.powPolicy.Store(policy)
+}
+
+// SetQueryTimeout sets how long a REQ/COUNT may run before it is ended with
+// CLOSED "error: timeout" (0 disables the timeout).
+func (r *Relay) SetQueryTimeout(d time.Duration) {
+	r.queryTimeout = d
+}
+
+// SetCostBudget sets the filter cost budgets for REQ/COUNT (nil disables them).
+func (r *Relay) SetCostBudget(budget *event.CostBudget) {
+	r.costBudget = budget
+}
+
+// clientLog returns the relay logger with the client's IP and authenticated pubkey
+func clientLog(c *protocol.Client) *slog.Logger {
+	return logging.WithClient(logger, c.RemoteAddr(), c.AuthPubKey())
 }
 
 // retentionLoop periodically deletes old events and expired NIP-40 events.
 func (r *Relay) retentionLoop() {
+	defer close(r.retentionDone)
+
 	// Run once at startup
 	r.runRetention()
 
@@ -192,26 +295,41 @@ func (r *Relay) retentionLoop() {
 			return
 		case <-ticker.C:
 			r.runRetention()
+			r.pruneExpiredBans()
 		}
 	}
 }
 
 func (r *Relay) runRetention() {
-	if r.retentionDays <= 0 || r.store == nil {
+	if r.store == nil {
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	cutoff := time.Now().Unix() - int64(r.retentionDays*86400)
-	deleted, err := r.store.DeleteEventsOlderThan(ctx, cutoff, retentionExemptKinds)
+	if days := r.retentionDays.Load(); days > 0 {
+		// Gift wraps are expired separately, as their created_at is randomized
+		cutoff := time.Now().Unix() - days*86400
+		deleted, err := r.store.DeleteEventsOlderThan(ctx, cutoff, retentionSweepExemptKinds)
+		if err != nil {
+			logger.Error("retention cleanup failed", logging.KeyError, err)
+			return
+		}
+		r.obs.retentionDeleted.Add(float64(deleted))
+		if deleted > 0 {
+			logger.Info("retention cleanup", "deleted", deleted, "retention_days", days)
+		}
+	}
+
+	deleted, err := r.expireGiftWraps(ctx)
 	if err != nil {
-		log.Printf("Retention cleanup error: %v", err)
+		logger.Error("gift wrap retention cleanup failed", logging.KeyError, err)
 		return
 	}
+	r.obs.retentionDeleted.Add(float64(deleted))
 	if deleted > 0 {
-		log.Printf("Retention cleanup: deleted %d events older than %d days", deleted, r.retentionDays)
+		logger.Info("gift wrap retention cleanup", "deleted", deleted, "retention_days", r.giftWrapRetention())
 	}
 }
 
@@ -225,79 +343,103 @@ func (r *Relay) SetCloseAfterEOSE(enabled bool) {
 func (r *Relay) setupRoutes() {
 	r.mux.HandleFunc("/", r.ServeHTTP)
 	r.mux.HandleFunc("/health", r.HealthHandler)
+	r.mux.Handle("/metrics", r.MetricsHandler())
+	apiAuth := r.apiAuth()
+	r.mux.Handle("/api/event", apiAuth.Middleware(http.HandlerFunc(r.handleAPIEvent)))
+	r.mux.Handle("/api/query", apiAuth.Middleware(http.HandlerFunc(r.handleAPIQuery)))
+	r.mux.Handle("/api/count", apiAuth.Middleware(http.HandlerFunc(r.handleAPICount)))
+	r.mux.Handle("/api/stream", apiAuth.Middleware(http.HandlerFunc(r.handleAPIStream)))
 }
 
 // ServeHTTP handles WebSocket upgrade requests
 func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Header.Get("Accept") == "application/nostr+json" {
-		info := &nip11.RelayInformationDocument{
-			Name:          "Glienicke Nostr Relay",
-			Description:   "Glienicke - a Nostr relay written in Go",
-			Software:      "https://github.com/paul/glienicke",
-			Version:       r.version,
-			SupportedNIPs: []int{1, 2, 4, 9, 11, 17, 22, 25, 40, 42, 44, 45, 50, 59, 62, 65},
-			Icon:          "https://www.paulstephenborile.com/wp-content/uploads/2026/02/cropped-logo-only.png",
-		}
-
-		w.Header().Set("Content-Type", "application/nostr+json")
-		json.NewEncoder(w).Encode(info)
+	// NIP-86: Management API shares the relay URL
+	if isManagementRequest(req) {
+		r.handleManagement(w, req)
+		return
+	}
+
+	// NIP-11: Relay information document, also when other media types are acceptable
+	if r.features.NIP11 && nip11.Accepts(req.Header.Get("Accept")) {
+		r.serveRelayInfo(w)
+		return
+	}
+
+	// CORS preflight for browser fetches of the relay URL
+	if req.Method == http.MethodOptions {
+		writeCORSHeaders(w)
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
 	// Extract real client IP from proxy headers (before upgrade, so we can reject banned IPs)
-	realIP := req.Header.Get("X-Forwarded-For")
-	if realIP != "" {
-		// X-Forwarded-For can contain multiple IPs; first one is the original client
-		if idx := strings.Index(realIP, ","); idx != -1 {
-			realIP = strings.TrimSpace(realIP[:idx])
-		}
-	} else if realIP = req.Header.Get("X-Real-IP"); realIP == "" {
-		// No proxy headers — use the direct connection IP (strip port)
-		realIP = req.RemoteAddr
-		if host, _, err := net.SplitHostPort(realIP); err == nil {
-			realIP = host
-		}
+	realIP := r.requestIP(req)
+
+	// NIP-86: Reject blocked IPs before WebSocket upgrade
+	if r.mgmt.isIPBlocked(realIP) {
+		http.Error(w, "blocked", http.StatusForbidden)
+		return
+	}
+
+	if r.isShuttingDown() {
+		http.Error(w, protocol.ShutdownNotice, http.StatusServiceUnavailable)
+		return
+	}
+
+	// Reject IPs that may neither read nor write
+	if reason := r.acl.checkConnection(realIP); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
 	}
 
 	// Reject banned IPs before WebSocket upgrade
-	if r.rateLimitEnabled && r.IsIPBanned(realIP) {
+	if r.IsIPBanned(realIP) {
 		http.Error(w, "banned", http.StatusForbidden)
 		return
 	}
 
+	// Reject connections over the connection limits
+	release, reason, retryAfter := r.acquireConnection(realIP)
+	if release == nil {
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		http.Error(w, reason, http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logger.Warn("websocket upgrade failed", logging.KeyClientIP, realIP, logging.KeyError, err)
 		return
 	}
 
 	client := protocol.NewClient(conn, r, realIP)
 	ua := req.Header.Get("User-Agent")
 	origin := req.Header.Get("Origin")
-	log.Printf("New WebSocket connection from %s (UA: %s, Origin: %s)", client.RemoteAddr(), ua, origin)
-	if r.rateLimitEnabled {
-		client.SetRateLimit(r.checkRate)
-	}
+	clientLog(client).Info("websocket connection", "user_agent", ua, "origin", origin)
+	client.SetMessageObserver(r.observeMessage)
+	client.SetRateLimit(r.checkRate)
+	client.SetMaxEventSize(r.maxEventSize())
+	client.SetQueryTimeout(r.queryTimeout)
 	if r.requireAuth {
 		client.SetRequireAuth()
 		client.SendAuth()
 	}
 
 	// Update metrics
+	r.obs.connections.Inc()
 	r.metrics.mu.Lock()
-	r.metrics.totalConnections++
 	r.metrics.lastPacketTime = time.Now()
 	r.metrics.packetCount++
 	r.metrics.mu.Unlock()
 
-	r.clientsMu.Lock()
-	r.clients[client] = true
-	r.clientsMu.Unlock()
-
+	if !r.addClient(client) {
+		client.Close()
+		return
+	}
 	defer func() {
-		r.clientsMu.Lock()
-		delete(r.clients, client)
-		r.clientsMu.Unlock()
+		r.removeClient(client)
+		r.subs.RemoveClient(client)
 		client.Close()
 	}()
 
@@ -330,18 +472,20 @@ func (r *Relay) HealthHandler(w http.ResponseWriter, req *http.Request) {
 
 	// Create response
 	response := HealthResponse{
-		Status:            status,
-		UptimeSeconds:     time.Since(r.metrics.startTime).Seconds(),
-		Version:           r.version,
-		ActiveConnections: activeConnections,
-		TotalConnections:  r.metrics.totalConnections,
-		TotalEvents:       r.metrics.totalEvents,
-		TotalRequests:     r.metrics.totalRequests,
-		PacketsPerSecond:  r.metrics.packetsPerSecond,
-		RateLimitedCount:  r.metrics.rateLimitedCount,
-		MemoryUsageMB:     memoryUsageMB,
-		DatabaseStatus:    r.metrics.dbStatus,
-		Timestamp:         time.Now().UTC().Format(time.RFC3339),
+		Status:              status,
+		UptimeSeconds:       time.Since(r.metrics.startTime).Seconds(),
+		Version:             r.version,
+		ActiveConnections:   activeConnections,
+		TotalConnections:    int64(r.obs.connections.Value()),
+		TotalEvents:         int64(r.obs.messages.With(string(protocol.MessageTypeEvent)).Value()),
+		TotalRequests:       int64(r.obs.messages.With(string(protocol.MessageTypeReq)).Value()),
+		PacketsPerSecond:    r.metrics.packetsPerSecond,
+		RateLimitedCount:    int64(r.obs.rateLimited.Value()),
+		Connections:         r.ConnectionCounts(),
+		RejectedConnections: int64(r.obs.connectionsRejectedTotal()),
+		MemoryUsageMB:       memoryUsageMB,
+		DatabaseStatus:      r.metrics.dbStatus,
+		Timestamp:           time.Now().UTC().Format(time.RFC3339),
 	}
 
 	// Set headers and send response
@@ -386,147 +530,110 @@ func (r *Relay) updateMetrics() {
 }
 
 const (
-	reqRatePerSec          = 10             // max sustained REQ rate per IP per second
-	reqBurstLimit          = 20             // max burst of REQs per IP
-	banViolationLimit      = 10             // number of rate limit violations before banning
-	banDuration            = 24 * time.Hour // how long an IP stays banned
-	defaultMaxEventsPerREQ = 100            // max events returned per REQ response
-	defaultRetentionDays   = 30             // default event retention period in days
-	retentionCheckInterval = 1 * time.Hour  // how often to run retention cleanup
+	defaultMaxEventsPerREQ = 100           // max events returned per REQ response
+	defaultRetentionDays   = 30            // default event retention period in days
+	retentionCheckInterval = 1 * time.Hour // how often to run retention cleanup
 )
 
 // retentionExemptKinds are event kinds that should never be deleted by retention.
 // These are long-lived identity/config events that clients expect to persist.
-var retentionExemptKinds = []int{
+var retentionExemptKinds = append([]int{
 	0,     // profile metadata
 	3,     // contact list
 	10002, // relay list (NIP-65)
 	10050, // DM relay list
-}
-
-// isIPBanned checks if an IP is currently banned. Must be called with ipLimiterMu held.
-func (r *Relay) isIPBanned(ip string) bool {
-	lim, ok := r.ipLimiters[ip]
-	if !ok {
-		return false
-	}
-	if lim.bannedAt.IsZero() {
-		return false
-	}
-	if time.Since(lim.bannedAt) > banDuration {
-		// Ban expired — reset
-		lim.bannedAt = time.Time{}
-		lim.violations = 0
-		return false
-	}
-	return true
-}
-
-// IsIPBanned checks if an IP is currently banned (thread-safe, for use in ServeHTTP).
-func (r *Relay) IsIPBanned(ip string) bool {
-	r.ipLimiterMu.Lock()
-	defer r.ipLimiterMu.Unlock()
-	return r.isIPBanned(ip)
-}
-
-// checkRate implements per-IP rate limiting using a shared token bucket.
-// Returns empty string if allowed, or a reason string if rejected.
-func (r *Relay) checkRate(clientIP string, pubkey string) string {
-	r.ipLimiterMu.Lock()
-	defer r.ipLimiterMu.Unlock()
-
-	// Check ban first
-	if r.isIPBanned(clientIP) {
-		return "banned: too many rate limit violations"
-	}
-
-	lim, ok := r.ipLimiters[clientIP]
-	if !ok {
-		lim = &ipRateLimiter{
-			tokens:     reqBurstLimit,
-			lastRefill: time.Now(),
-			pubkeys:    make(map[string]bool),
-		}
-		r.ipLimiters[clientIP] = lim
-	}
-	if pubkey != "" {
-		lim.pubkeys[pubkey] = true
-	}
-
-	// Refill tokens
-	now := time.Now()
-	elapsed := now.Sub(lim.lastRefill).Seconds()
-	lim.tokens += elapsed * reqRatePerSec
-	if lim.tokens > reqBurstLimit {
-		lim.tokens = reqBurstLimit
-	}
-	lim.lastRefill = now
-
-	if lim.tokens < 1 {
-		lim.violations++
-		r.metrics.mu.Lock()
-		r.metrics.rateLimitedCount++
-		r.metrics.mu.Unlock()
-
-		if lim.violations >= banViolationLimit {
-			lim.bannedAt = now
-			pubkeyList := make([]string, 0, len(lim.pubkeys))
-			for pk := range lim.pubkeys {
-				pubkeyList = append(pubkeyList, pk)
-			}
-			if len(pubkeyList) > 0 {
-				log.Printf("BANNED IP %s for %v after %d violations (pubkeys: %s)", clientIP, banDuration, lim.violations, strings.Join(pubkeyList, ", "))
-			} else {
-				log.Printf("BANNED IP %s for %v after %d violations (no authenticated pubkeys)", clientIP, banDuration, lim.violations)
-			}
-			return "banned: too many rate limit violations"
-		}
-
-		log.Printf("Rate limited %s (violations %d/%d)", clientIP, lim.violations, banViolationLimit)
-		return "rate-limited: too many messages, slow down"
-	}
-
-	lim.tokens--
-	return ""
-}
+}, nip29.StateKinds...) // NIP-29 group state is rebuilt from these
 
 // HandleEvent processes an EVENT message from a client
 func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.Event) error {
 	// Update metrics
 	r.metrics.mu.Lock()
-	r.metrics.totalEvents++
 	r.metrics.packetCount++
 	r.metrics.lastPacketTime = time.Now()
 	r.metrics.mu.Unlock()
 
 	// NIP-42: Handle AUTH events
 	if nip42.IsAuthEvent(evt) {
+		if !r.features.NIP42 {
+			r.sendOK(c, evt, false, "restricted: NIP-42 authentication is disabled")
+			return nil
+		}
 		if err := nip42.ValidateAuthEvent(evt); err != nil {
-			c.SendOK(evt.ID, false, fmt.Sprintf("invalid AUTH: %v", err))
+			r.sendOK(c, evt, false, fmt.Sprintf("invalid AUTH: %v", err))
 			return fmt.Errorf("invalid AUTH event: %w", err)
 		}
 		// Verify challenge matches what we sent
 		if c.AuthChallenge() != "" && evt.Content != c.AuthChallenge() {
-			c.SendOK(evt.ID, false, "invalid: challenge mismatch")
+			r.sendOK(c, evt, false, "invalid: challenge mismatch")
 			return fmt.Errorf("AUTH challenge mismatch")
 		}
 		c.Authenticate(evt.PubKey)
-		c.SendOK(evt.ID, true, "authenticated")
-		log.Printf("Client %s authenticated as %s", c.RemoteAddr(), evt.PubKey)
+		r.sendOK(c, evt, true, "authenticated")
+		clientLog(c).Info("client authenticated")
 		return nil
 	}
 
 	// NIP-42: Reject non-AUTH events from unauthenticated clients when auth is required
 	if r.requireAuth && !c.IsAuthenticated() {
-		c.SendOK(evt.ID, false, "auth-required: this relay requires NIP-42 authentication")
+		r.sendOK(c, evt, false, "auth-required: this relay requires NIP-42 authentication")
+		return nil
+	}
+
+	// NIP-70: Protected events are only accepted from their authenticated author
+	if nip70.IsProtected(evt) {
+		if !r.features.NIP42 {
+			r.sendOK(c, evt, false, "blocked: protected events need NIP-42 authentication, which is disabled")
+			return nil
+		}
+		if reason := nip70.Check(evt, c.AuthPubKey()); reason != "" {
+			r.sendOK(c, evt, false, reason)
+			if !c.IsAuthenticated() {
+				c.RequestAuth()
+			}
+			return nil
+		}
+	}
+
+	// NIP-17 inbox mode: only gift wraps for users and their metadata
+	if reason := r.checkInboxWrite(ctx, c, evt); reason != "" {
+		r.sendOK(c, evt, false, reason)
+		if reason == inboxAuthRequired {
+			c.RequestAuth()
+		}
+		return nil
+	}
+
+	// Per-kind write rate limits
+	if reason := r.checkKindRate(c, evt); reason != "" {
+		r.sendOK(c, evt, false, reason)
 		return nil
 	}
 
+	// NIP-86: Reject banned pubkeys, banned events and disallowed kinds
+	if reason := r.mgmt.rejectEvent(evt); reason != "" {
+		r.sendOK(c, evt, false, reason)
+		return nil
+	}
+
+	// Reject writes denied by the IP, pubkey and kind ACLs
+	if reason := r.acl.checkWrite(c.RemoteAddr(), evt); reason != "" {
+		r.sendOK(c, evt, false, reason)
+		return nil
+	}
+
+	// NIP-13: Reject events without the required proof of work
+	if policy := r.powPolicy.Load(); policy != nil {
+		if reason := policy.ShouldReject(evt, c.AuthPubKey(), r.isKnownPubKey); reason != "" {
+			r.sendOK(c, evt, false, reason)
+			return nil
+		}
+	}
+
 	// NIP-36: Reject NSFW content lacking content-warning tag
-	if r.nip36Policy != nil {
-		if reason := r.nip36Policy.ShouldReject(evt); reason != "" {
-			c.SendOK(evt.ID, false, reason)
-			log.Printf("NIP-36: rejected event %s from %s (no content-warning tag)", evt.ID, evt.PubKey)
+	if policy := r.nip36Policy.Load(); policy != nil {
+		if reason := policy.ShouldReject(evt); reason != "" {
+			r.sendOK(c, evt, false, reason)
+			clientLog(c).Info("NIP-36: rejected event without content-warning tag", logging.KeyEventID, evt.ID, logging.KeyKind, evt.Kind, "author", evt.PubKey)
 			return nil
 		}
 	}
@@ -534,7 +641,7 @@ func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.
 	// NIP-02: Validate follow list events
 	if nip02.IsFollowListEvent(evt) {
 		if err := nip02.ValidateFollowList(evt); err != nil {
-			c.SendOK(evt.ID, false, fmt.Sprintf("invalid follow list: %v", err))
+			r.sendOK(c, evt, false, fmt.Sprintf("invalid follow list: %v", err))
 			return fmt.Errorf("invalid follow list event: %w", err)
 		}
 	}
@@ -542,7 +649,7 @@ func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.
 	// NIP-22: Validate comment events
 	if nip22.IsCommentEvent(evt) {
 		if err := nip22.ValidateComment(evt); err != nil {
-			c.SendOK(evt.ID, false, fmt.Sprintf("invalid comment: %v", err))
+			r.sendOK(c, evt, false, fmt.Sprintf("invalid comment: %v", err))
 			return fmt.Errorf("invalid comment event: %w", err)
 		}
 	}
@@ -550,23 +657,35 @@ func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.
 	// NIP-25: Validate reaction events
 	if nip25.IsReactionEvent(evt) {
 		if err := nip25.ValidateReaction(evt); err != nil {
-			c.SendOK(evt.ID, false, fmt.Sprintf("invalid reaction: %v", err))
+			r.sendOK(c, evt, false, fmt.Sprintf("invalid reaction: %v", err))
 			return fmt.Errorf("invalid reaction event: %w", err)
 		}
 	}
 
+	// NIP-56: Validate report events
+	if nip56.IsReportEvent(evt) {
+		if err := nip56.ValidateReportEvent(evt); err != nil {
+			r.sendOK(c, evt, false, fmt.Sprintf("invalid: %v", err))
+			return fmt.Errorf("invalid report event: %w", err)
+		}
+	}
+
 	// NIP-65: Validate relay list events
 	if nip65.IsRelayListEvent(evt) {
 		if err := nip65.ValidateRelayList(evt); err != nil {
-			c.SendOK(evt.ID, false, fmt.Sprintf("invalid relay list: %v", err))
+			r.sendOK(c, evt, false, fmt.Sprintf("invalid relay list: %v", err))
 			return fmt.Errorf("invalid relay list event: %w", err)
 		}
 	}
 
 	// NIP-28: Validate channel events
 	if nip28.IsNIP28Event(evt) {
+		if !r.features.NIP28 {
+			r.sendOK(c, evt, false, "blocked: NIP-28 public chat is disabled")
+			return nil
+		}
 		if err := nip28.New().Process(evt, r.store); err != nil {
-			c.SendOK(evt.ID, false, fmt.Sprintf("invalid channel event: %v", err))
+			r.sendOK(c, evt, false, fmt.Sprintf("invalid channel event: %v", err))
 			return fmt.Errorf("invalid channel event: %w", err)
 		}
 	}
@@ -574,29 +693,44 @@ func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.
 	// NIP-62: Validate Request to Vanish events
 	if nip62.IsRequestToVanishEvent(evt) {
 		if err := nip62.ValidateRequestToVanish(evt); err != nil {
-			c.SendOK(evt.ID, false, fmt.Sprintf("invalid Request to Vanish: %v", err))
+			r.sendOK(c, evt, false, fmt.Sprintf("invalid Request to Vanish: %v", err))
 			return fmt.Errorf("invalid Request to Vanish event: %w", err)
 		}
 	}
 
+	// External write-policy plugin: accept, reject or shadow-reject
+	if plugin := r.writePolicy.Load(); plugin != nil {
+		if r.applyWritePolicy(ctx, plugin, c, evt) {
+			return nil
+		}
+	}
+
+	// NIP-29: Enforce group membership; moderation events, join and leave requests are handled here
+	if r.groups != nil && r.handleGroupEvent(ctx, c, evt) {
+		return nil
+	}
+
 	// NIP-16: Ephemeral events (kinds 20000-29999) — relay to subscribers but don't store
 	if evt.Kind >= 20000 && evt.Kind < 30000 {
 		r.broadcastEvent(evt)
-		c.SendOK(evt.ID, true, "")
+		r.sendOK(c, evt, true, "")
 		return nil
 	}
 
 	// NIP-40: Check for expired events
 	if nip40.ShouldRejectEvent(evt) {
-		c.SendOK(evt.ID, false, "event has expired")
+		r.sendOK(c, evt, false, "event has expired")
 		return fmt.Errorf("event has expired")
 	}
 
 	// NIP-09: Handle event deletion
 	if evt.Kind == 5 {
 		if err := nip09.HandleDeletion(ctx, r.store, evt); err != nil {
-			log.Printf("NIP-09 deletion handling failed: %v", err)
+			clientLog(c).Warn("NIP-09 deletion handling failed", logging.KeyEventID, evt.ID, logging.KeyError, err)
+			r.sendOK(c, evt, false, fmt.Sprintf("error: failed to process deletion: %v", err))
+			return fmt.Errorf("failed to process deletion: %w", err)
 		}
+		r.sendOK(c, evt, true, "")
 		return nil
 	}
 
@@ -605,11 +739,12 @@ func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.
 		// Get the relay URL from the request or use default
 		relayURL := "ws://localhost:8080" // This should be configurable in production
 		if err := nip62.HandleRequestToVanish(ctx, r.store, evt, relayURL); err != nil {
-			log.Printf("NIP-62 Request to Vanish handling failed: %v", err)
-			c.SendOK(evt.ID, false, fmt.Sprintf("error: failed to process Request to Vanish: %v", err))
+			clientLog(c).Error("NIP-62 request to vanish failed", logging.KeyEventID, evt.ID, logging.KeyError, err)
+			r.sendOK(c, evt, false, fmt.Sprintf("error: failed to process Request to Vanish: %v", err))
 			return fmt.Errorf("failed to process Request to Vanish: %w", err)
 		}
-		c.SendOK(evt.ID, true, "Request to Vanish processed")
+		r.knownAuthors.remove(evt.PubKey)
+		r.sendOK(c, evt, true, "Request to Vanish processed")
 		return nil
 	}
 
@@ -619,10 +754,10 @@ func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.
 		// For gift wrap events, we don't unwrap or validate the inner event.
 		// We just store it and broadcast it to the recipient.
 		if err := r.store.SaveEvent(ctx, evt); err != nil {
-			c.SendOK(evt.ID, false, fmt.Sprintf("error: failed to save event: %v", err))
+			r.sendOK(c, evt, false, fmt.Sprintf("error: failed to save event: %v", err))
 			return fmt.Errorf("failed to save gift wrap event: %w", err)
 		}
-		c.SendOK(evt.ID, true, "")
+		r.sendOK(c, evt, true, "")
 		r.broadcastEvent(evt)
 		return nil
 	}
@@ -630,38 +765,41 @@ func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.
 	// Check for duplicate event
 	existingEvent, err := r.store.GetEvent(ctx, evt.ID)
 	if err != nil && err != storage.ErrNotFound {
+		r.recordEvent(evt, false, "error")
 		return fmt.Errorf("failed to check for existing event: %w", err)
 	}
 	if existingEvent != nil {
 		// Event already exists, send OK with duplicate status
-		c.SendOK(evt.ID, true, "duplicate: event already exists")
+		r.sendOK(c, evt, true, "duplicate: event already exists")
 		return nil
 	}
 
 	// Save to storage
 	if err := r.store.SaveEvent(ctx, evt); err != nil {
-		c.SendOK(evt.ID, false, fmt.Sprintf("error: failed to save event: %v", err))
+		r.sendOK(c, evt, false, fmt.Sprintf("error: failed to save event: %v", err))
 		return fmt.Errorf("failed to save event: %w", err)
 	}
+	r.knownAuthors.add(evt.PubKey)
 
 	// NIP-28: Save channel events to channel table
 	if nip28.IsNIP28Event(evt) {
-		var channelStore ChannelStore
-		if sqliteStore, ok := r.store.(*sqlite.Store); ok {
-			channelStore = sqliteStore
-		} else if memStore, ok := r.store.(*memory.Store); ok {
-			channelStore = memStore
-		}
+		channelStore, _ := r.store.(ChannelStore)
 
 		if channelStore != nil {
 			if err := channelStore.SaveChannelEvent(ctx, evt); err != nil {
-				log.Printf("NIP-28: failed to save channel event: %v", err)
+				clientLog(c).Error("NIP-28: failed to save channel event", logging.KeyEventID, evt.ID, logging.KeyKind, evt.Kind, logging.KeyError, err)
 			}
 		}
 	}
 
+	// NIP-29: Add group events to the group timeline
+	r.observeGroupEvent(evt)
+
+	// NIP-56: Queue reports for review
+	r.observeReport(ctx, evt)
+
 	// Send OK message
-	c.SendOK(evt.ID, true, "")
+	r.sendOK(c, evt, true, "")
 
 	// Broadcast to subscribed clients
 	r.broadcastEvent(evt)
@@ -669,14 +807,74 @@ func (r *Relay) HandleEvent(ctx context.Context, c *protocol.Client, evt *event.
 	return nil
 }
 
+// isKnownPubKey reports whether the store already holds an event from the given pubkey.
+// Known authors are cached so that their events do not each cost a query.
+func (r *Relay) isKnownPubKey(pubkey string) bool {
+	if r.knownAuthors.has(pubkey) {
+		return true
+	}
+	limit := 1
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, err := r.store.QueryEvents(ctx, []*event.Filter{{Authors: []string{pubkey}, Limit: &limit}})
+	if err != nil {
+		logger.Error("NIP-13: failed to look up pubkey", logging.KeyPubKey, pubkey, logging.KeyError, err)
+		return false
+	}
+	if len(events) == 0 {
+		return false
+	}
+	r.knownAuthors.add(pubkey)
+	return true
+}
+
 // HandleReq processes a REQ message from a client
 func (r *Relay) HandleReq(ctx context.Context, c *protocol.Client, subID string, filters []*event.Filter) error {
 	// Update metrics
 	r.metrics.mu.Lock()
-	r.metrics.totalRequests++
 	r.metrics.packetCount++
 	r.metrics.lastPacketTime = time.Now()
 	r.metrics.mu.Unlock()
+	defer r.obs.queryDuration.With(string(protocol.MessageTypeReq)).ObserveSince(time.Now())
+
+	// Reject readers denied by the IP and pubkey ACLs
+	if reason := r.acl.checkRead(c.RemoteAddr(), c.AuthPubKey()); reason != "" {
+		c.RemoveSubscription(subID)
+		r.subs.Remove(c, subID)
+		c.SendClosed(subID, reason)
+		return nil
+	}
+
+	// NIP-29: Private groups are only readable by authenticated members
+	if reason := r.checkGroupRead(c, filters); reason != "" {
+		c.RemoveSubscription(subID)
+		r.subs.Remove(c, subID)
+		c.SendClosed(subID, reason)
+		return nil
+	}
+
+	// Direct messages are only served to authenticated recipients
+	if reason := checkDMRead(c, filters); reason != "" {
+		c.RemoveSubscription(subID)
+		r.subs.Remove(c, subID)
+		c.SendClosed(subID, reason)
+		c.RequestAuth()
+		return nil
+	}
+
+	// Reject filters that are too expensive to run
+	release, reason := r.reserveQueryCost(c, subID, filters)
+	if reason != "" {
+		c.RemoveSubscription(subID)
+		r.subs.Remove(c, subID)
+		c.SendClosed(subID, reason)
+		return nil
+	}
+	defer release()
+
+	// Register the subscription for live events before querying stored ones
+	r.subs.Add(c, subID, filters)
 
 	var events []*event.Event
 	var err error
@@ -684,13 +882,8 @@ func (r *Relay) HandleReq(ctx context.Context, c *protocol.Client, subID string,
 	// Check for channel_id in filters (NIP-28)
 	channelID, isChannelQuery := getChannelIDFromFilters(filters)
 
-	if isChannelQuery {
-		var channelStore ChannelStore
-		if sqliteStore, ok := r.store.(*sqlite.Store); ok {
-			channelStore = sqliteStore
-		} else if memStore, ok := r.store.(*memory.Store); ok {
-			channelStore = memStore
-		}
+	if isChannelQuery && r.features.NIP28 {
+		channelStore, _ := r.store.(ChannelStore)
 
 		if channelStore == nil {
 			return fmt.Errorf("channel events require storage with channel support")
@@ -714,6 +907,11 @@ func (r *Relay) HandleReq(ctx context.Context, c *protocol.Client, subID string,
 		}
 	}
 
+	// Don't send stored events for a subscription that was closed, replaced or timed out meanwhile
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Send stored events to the client, filtering out expired events
 	sent := 0
 	for _, evt := range events {
@@ -721,42 +919,96 @@ func (r *Relay) HandleReq(ctx context.Context, c *protocol.Client, subID string,
 		if nip40.ShouldFilterEvent(evt) {
 			continue
 		}
+		// NIP-86: Don't serve banned events or events of banned pubkeys,
+		// NIP-56: nor events hidden pending review of their reports
+		if r.mgmt.hidden(evt) || r.moderation.hidden(evt.ID) {
+			continue
+		}
+		if !r.acl.readableKind(evt.Kind) {
+			continue
+		}
+		if !r.groupReadable(c, evt) {
+			continue
+		}
+		if !dmReadable(c.AuthPubKey(), evt) {
+			continue
+		}
 		if sent >= r.maxEventsPerREQ {
 			break
 		}
 		if err := c.SendEvent(subID, evt); err != nil {
-			log.Printf("Failed to send stored event to client: %v", err)
+			clientLog(c).Debug("failed to send stored event", logging.KeySubID, subID, logging.KeyError, err)
 		}
 		sent++
 	}
 
 	// Send EOSE to indicate end of stored events
 	if err := c.SendEOSE(subID); err != nil {
-		log.Printf("Failed to send EOSE to client: %v", err)
+		clientLog(c).Debug("failed to send EOSE", logging.KeySubID, subID, logging.KeyError, err)
 	}
 
 	if sent < len(events) {
-		log.Printf("Sent %d stored events (capped from %d) for subscription %s", sent, len(events), subID)
+		clientLog(c).Debug("stored events capped", logging.KeySubID, subID, "sent", sent, "matched", len(events))
 	}
 
 	// Auto-close subscription after EOSE to free the slot
 	if r.closeAfterEOSE {
 		c.RemoveSubscription(subID)
+		r.subs.Remove(c, subID)
 	}
 
 	return nil
 }
 
+// reserveQueryCost scores the filters of a REQ/COUNT against the cost budget,
+// clamping unbounded time ranges in place if that brings them under budget. It
+// returns a CLOSED reason if the query must be rejected; otherwise release must
+// be called when the query has finished.
+func (r *Relay) reserveQueryCost(c *protocol.Client, id string, filters []*event.Filter) (release func(), reason string) {
+	budget := r.costBudget
+	if budget == nil {
+		return func() {}, ""
+	}
+
+	costs, total, ok := budget.Apply(filters, time.Now().Unix())
+	log := clientLog(c).With(logging.KeySubID, id)
+	for i, cost := range costs {
+		log.Debug("query cost", "filter", i, "cost", cost.String())
+	}
+	if !ok {
+		log.Debug("query rejected: request cost exceeds budget", "cost", total, "budget", budget.MaxRequestCost)
+		return nil, "blocked: filter too broad"
+	}
+
+	r.queryCostMu.Lock()
+	defer r.queryCostMu.Unlock()
+	if budget.MaxConnectionCost > 0 && r.queryCosts[c]+total > budget.MaxConnectionCost {
+		log.Debug("query rejected: connection cost exceeds budget", "running", r.queryCosts[c], "cost", total, "budget", budget.MaxConnectionCost)
+		return nil, "blocked: filter too broad"
+	}
+	r.queryCosts[c] += total
+
+	return func() {
+		r.queryCostMu.Lock()
+		defer r.queryCostMu.Unlock()
+		if r.queryCosts[c] -= total; r.queryCosts[c] <= 0 {
+			delete(r.queryCosts, c)
+		}
+	}, ""
+}
+
 // HandleClose processes a CLOSE message from a client
 func (r *Relay) HandleClose(ctx context.Context, c *protocol.Client, subID string) error {
 	// Subscription close is routine — don't log
 	c.RemoveSubscription(subID)
+	r.subs.Remove(c, subID)
 	return nil
 }
 
 // HandleCount processes a COUNT message from a client (NIP-45)
 func (r *Relay) HandleCount(ctx context.Context, c *protocol.Client, countID string, filters []*event.Filter) error {
-	log.Printf("Received COUNT request %s from client %s", countID, c.RemoteAddr())
+	clientLog(c).Debug("COUNT request", logging.KeySubID, countID)
+	defer r.obs.queryDuration.With(string(protocol.MessageTypeCount)).ObserveSince(time.Now())
 
 	// Validate filters
 	if len(filters) == 0 {
@@ -764,57 +1016,122 @@ func (r *Relay) HandleCount(ctx context.Context, c *protocol.Client, countID str
 		return fmt.Errorf("COUNT request requires at least one filter")
 	}
 
-	// Get count from storage
+	// Reject readers denied by the ACLs, and counts that could include unreadable kinds
+	reason := r.acl.checkRead(c.RemoteAddr(), c.AuthPubKey())
+	if reason == "" {
+		reason = r.acl.checkCountKinds(filters)
+	}
+	if reason == "" {
+		reason = r.checkGroupRead(c, filters)
+	}
+	if reason == "" {
+		reason = checkDMCount(c, filters)
+	}
+	if reason != "" {
+		c.SendClosed(countID, reason)
+		if reason == dmAuthRequired {
+			c.RequestAuth()
+		}
+		return nil
+	}
+
+	// Reject filters that are too expensive to count
+	release, reason := r.reserveQueryCost(c, countID, filters)
+	if reason != "" {
+		c.SendClosed(countID, reason)
+		return nil
+	}
+	defer release()
+
+	// NIP-45: Answer follower/reaction/comment counts from HyperLogLog sketches
+	if len(filters) == 1 {
+		if ref, ok := nip45.ParseRef(filters[0]); ok {
+			if hllStore, ok := r.store.(storage.HLLCounter); ok {
+				result, err := hllStore.CountEventsHLL(ctx, filters[0], ref)
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
+				if err != nil {
+					c.SendClosed(countID, fmt.Sprintf("error: failed to count events: %v", err))
+					return fmt.Errorf("failed to count events: %w", err)
+				}
+				if err := c.SendCount(countID, result.Count, result.Approximate, nip45.EncodeRegisters(result.Registers)); err != nil {
+					return fmt.Errorf("failed to send COUNT response: %w", err)
+				}
+				clientLog(c).Debug("COUNT answered", logging.KeySubID, countID, "count", result.Count, "approximate", result.Approximate)
+				return nil
+			}
+		}
+	}
+
+	// Get count from storage, without the direct messages kindless filters match
 	count, err := r.store.CountEvents(ctx, filters)
+	if exclusions := dmCountExclusions(c.AuthPubKey(), filters); err == nil && len(exclusions) > 0 {
+		var dms int
+		dms, err = r.store.CountEvents(ctx, exclusions)
+		count -= dms
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
 	if err != nil {
 		c.SendClosed(countID, fmt.Sprintf("error: failed to count events: %v", err))
 		return fmt.Errorf("failed to count events: %w", err)
 	}
 
 	// Send count response
-	// For now, we don't implement approximate counting, but could be added later for performance
-	err = c.SendCount(countID, count, false)
+	err = c.SendCount(countID, count, false, "")
 	if err != nil {
 		return fmt.Errorf("failed to send COUNT response: %w", err)
 	}
 
-	log.Printf("COUNT request %s returned %d events", countID, count)
+	clientLog(c).Debug("COUNT answered", logging.KeySubID, countID, "count", count)
 	return nil
 }
 
-// broadcastEvent sends an event to all clients with matching subscriptions
+// broadcastEvent sends an event to every matching subscription of every client
 func (r *Relay) broadcastEvent(evt *event.Event) {
-	r.clientsMu.RLock()
-	defer r.clientsMu.RUnlock()
+	// NIP-40: Filter out expired events
+	if nip40.ShouldFilterEvent(evt) {
+		return
+	}
 
-	for client := range r.clients {
-		go func(c *protocol.Client) {
-			// NIP-40: Filter out expired events
-			if nip40.ShouldFilterEvent(evt) {
-				return
-			}
+	// Serialize broadcasts so every client's queue sees events in acceptance order
+	r.broadcastMu.Lock()
+	defer r.broadcastMu.Unlock()
 
-			// NIP-44: Encrypted Direct Messages (kind 4)
-			if nip44.IsEncryptedDirectMessage(evt) {
-				recipientPubKey, found := nip44.GetRecipientPubKey(evt)
-				if !found || !c.HasSubscriptionToPubKey(recipientPubKey) {
-					return // Don't broadcast if not the recipient or not subscribed to recipient
-				}
-			}
+	matches := r.subs.Match(evt)
+	r.obs.fanout.Observe(float64(len(matches)))
+	if len(matches) == 0 {
+		return
+	}
 
-			subs := c.GetSubscriptions()
-			for subID, filters := range subs {
-				// Check if event matches any filter
-				for _, filter := range filters {
-					if evt.Matches(filter) {
-						if err := c.SendEvent(subID, evt); err != nil {
-							log.Printf("Failed to send event to client: %v", err)
-						}
-						return // Only send once per subscription
-					}
-				}
-			}
-		}(client)
+	// Encode the event once; only the subscription envelope differs per recipient
+	encoded, err := protocol.EncodeEvent(evt)
+	if err != nil {
+		logger.Error("failed to encode event for broadcast", logging.KeyEventID, evt.ID, logging.KeyError, err)
+		return
+	}
+
+	for client, subIDs := range matches {
+		// Skip clients the read ACLs no longer admit, and unreadable kinds
+		if !r.acl.mayReceive(client.RemoteAddr(), client.AuthPubKey(), evt.Kind) {
+			continue
+		}
+
+		// NIP-29: Events of private groups only reach members
+		if !r.groupReadable(client, evt) {
+			continue
+		}
+
+		// Direct messages only reach their authenticated recipients
+		if !dmReadable(client.AuthPubKey(), evt) {
+			continue
+		}
+
+		if err := client.Deliver(subIDs, encoded); err != nil {
+			clientLog(client).Debug("failed to deliver event", logging.KeyEventID, evt.ID, logging.KeyError, err)
+		}
 	}
 }
 
@@ -823,42 +1140,91 @@ func (r *Relay) GetMux() *http.ServeMux {
 	return r.mux
 }
 
-// Close shuts down the relay
-func (r *Relay) Close() error {
-	// Stop retention goroutine
-	close(r.stopRetention)
+// HandleAuthenticated registers handler on the relay's multiplexer behind
+// NIP-98 authentication. The handler only sees authenticated requests and can
+// get the caller's pubkey with nip98.PubKeyFromContext. X-Forwarded-Proto is
+// only believed from trusted proxies (see SetTrustedProxies).
+func (r *Relay) HandleAuthenticated(pattern string, handler http.Handler) {
+	auth := &nip98.Authenticator{TrustedProxy: r.isTrustedProxy}
+	r.mux.Handle(pattern, auth.Middleware(handler))
+}
 
+// Close shuts down the relay immediately, disconnecting all clients. Use
+// Shutdown to let them finish first.
+func (r *Relay) Close() error {
 	r.clientsMu.Lock()
-	defer r.clientsMu.Unlock()
-
 	// Close all clients
 	for client := range r.clients {
 		client.Close()
 	}
+	r.clientsMu.Unlock()
 
-	return r.store.Close()
+	return r.stop()
+}
+
+// SetServerTimeouts sets the HTTP read and write timeouts used by Start and
+// StartTLS (0 = no timeout). WebSocket connections and event streams are not
+// affected once established.
+func (r *Relay) SetServerTimeouts(read, write time.Duration) {
+	r.readTimeout = read
+	r.writeTimeout = write
+}
+
+// newServer returns the HTTP server for the relay's routes and keeps it for Shutdown
+func (r *Relay) newServer(addr string) *http.Server {
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      r.mux,
+		ReadTimeout:  r.readTimeout,
+		WriteTimeout: r.writeTimeout,
+	}
+	r.serverMu.Lock()
+	r.server = server
+	r.serverMu.Unlock()
+	return server
 }
 
 // Start starts the relay HTTP server
 func (r *Relay) Start(addr string) error {
-	log.Printf("Relay starting on %s", addr)
-	log.Printf("Health endpoint available at http://%s/health", addr)
-	return http.ListenAndServe(addr, r.mux)
+	logger.Info("relay starting", "addr", addr, "health", "http://"+addr+"/health")
+	ln, err := r.listen(addr)
+	if err != nil {
+		return err
+	}
+	return r.newServer(addr).Serve(ln)
 }
 
-// StartTLS starts the relay HTTPS server with TLS certificates
+// StartTLS starts the relay HTTPS server with TLS certificates. The
+// certificate can be replaced while running with ReloadTLS.
 func (r *Relay) StartTLS(addr, certFile, keyFile string) error {
-	log.Printf("Relay starting with TLS on %s", addr)
-	log.Printf("Certificate file: %s", certFile)
-	log.Printf("Private key file: %s", keyFile)
-	log.Printf("Health endpoint available at https://%s/health", addr)
+	logger.Info("relay starting with TLS", "addr", addr, "cert", certFile, "key", keyFile, "health", "https://"+addr+"/health")
 
-	server := &http.Server{
-		Addr:    addr,
-		Handler: r.mux,
+	if err := r.ReloadTLS(certFile, keyFile); err != nil {
+		return err
+	}
+	server := r.newServer(addr)
+	server.TLSConfig = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.tlsCert.Load(), nil
+		},
 	}
 
-	return server.ListenAndServeTLS(certFile, keyFile)
+	ln, err := r.listen(addr)
+	if err != nil {
+		return err
+	}
+	return server.ServeTLS(ln, "", "")
+}
+
+// ReloadTLS loads a certificate and key pair and serves it for new TLS
+// handshakes; established connections are kept.
+func (r *Relay) ReloadTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.tlsCert.Store(&cert)
+	return nil
 }
 
 // convertLocalEventToNostrEvent converts a local_event.Event to a nostr.Event
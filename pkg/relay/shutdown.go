@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"context"
+	"sync"
+
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/protocol"
+)
+
+// Shutdown stops the relay gracefully. The server started by Start or
+// StartTLS stops accepting connections and waits for in-flight HTTP requests;
+// every client finishes the message it is handling, receives its queued
+// events, CLOSED for its open subscriptions and a NOTICE, and is disconnected.
+// The background loops then stop and the store is closed. Clients still
+// connected when ctx ends are closed immediately and ctx's error is returned.
+func (r *Relay) Shutdown(ctx context.Context) error {
+	r.clientsMu.Lock()
+	r.shuttingDown = true
+	clients := make([]*protocol.Client, 0, len(r.clients))
+	for c := range r.clients {
+		clients = append(clients, c)
+	}
+	r.clientsMu.Unlock()
+	logger.Info("relay shutting down", "clients", len(clients))
+
+	r.serverMu.Lock()
+	server := r.server
+	r.serverMu.Unlock()
+	serverDone := make(chan error, 1)
+	go func() {
+		if server == nil {
+			serverDone <- nil
+			return
+		}
+		// Hijacked WebSocket connections are not tracked by the server;
+		// they are drained below
+		serverDone <- server.Shutdown(ctx)
+	}()
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Shutdown(ctx); err != nil {
+				clientLog(c).Debug("client did not drain before the shutdown deadline", logging.KeyError, err)
+			}
+		}()
+	}
+	wg.Wait()
+	err := <-serverDone
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if stopErr := r.stop(); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// isShuttingDown reports whether Shutdown has been called
+func (r *Relay) isShuttingDown() bool {
+	r.clientsMu.RLock()
+	defer r.clientsMu.RUnlock()
+	return r.shuttingDown
+}
+
+// addClient registers a connected client, or reports false during shutdown
+func (r *Relay) addClient(c *protocol.Client) bool {
+	r.clientsMu.Lock()
+	defer r.clientsMu.Unlock()
+	if r.shuttingDown {
+		return false
+	}
+	r.clients[c] = true
+	return true
+}
+
+// removeClient unregisters a client registered by addClient
+func (r *Relay) removeClient(c *protocol.Client) {
+	r.clientsMu.Lock()
+	defer r.clientsMu.Unlock()
+	delete(r.clients, c)
+}
+
+// stop ends the background loops and closes the store, once
+func (r *Relay) stop() error {
+	var err error
+	r.stopOnce.Do(func() {
+		close(r.stopRetention)
+		<-r.retentionDone
+		if policy := r.nip36Policy.Swap(nil); policy != nil {
+			policy.Close()
+		}
+		if plugin := r.writePolicy.Swap(nil); plugin != nil {
+			plugin.Close()
+		}
+		r.banWrites.Wait()
+		err = r.store.Close()
+	})
+	return err
+}
@@ -0,0 +1,310 @@
+package relay
+
+import (
+	"sync"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/protocol"
+)
+
+// subKey identifies one subscription of one client.
+type subKey struct {
+	client *protocol.Client
+	subID  string
+}
+
+// indexedSub is a subscription registered in the index together with the
+// index postings created for it, so it can be removed without rescanning.
+type indexedSub struct {
+	filters  []*event.Filter
+	postings []posting
+}
+
+// posting records where a subscription was inserted in the index.
+type posting struct {
+	dim   dimension
+	name  string // tag name for dimTag
+	value string // id, author or tag value (unused for dimKind and dimAll)
+	kind  int
+}
+
+type dimension int
+
+const (
+	dimID dimension = iota
+	dimAuthor
+	dimTag
+	dimKind
+	dimAll
+)
+
+// prefixBucket maps values (or value prefixes, as NIP-01 allows prefix
+// matching) to the subscriptions indexed under them. lengths counts the
+// indexed value lengths so that lookups only probe prefixes that can exist.
+type prefixBucket struct {
+	subs    map[string]map[subKey]struct{}
+	lengths map[int]int
+}
+
+func newPrefixBucket() *prefixBucket {
+	return &prefixBucket{
+		subs:    make(map[string]map[subKey]struct{}),
+		lengths: make(map[int]int),
+	}
+}
+
+func (b *prefixBucket) add(value string, key subKey) {
+	set, ok := b.subs[value]
+	if !ok {
+		set = make(map[subKey]struct{})
+		b.subs[value] = set
+	}
+	if _, exists := set[key]; !exists {
+		set[key] = struct{}{}
+		b.lengths[len(value)]++
+	}
+}
+
+func (b *prefixBucket) remove(value string, key subKey) {
+	set, ok := b.subs[value]
+	if !ok {
+		return
+	}
+	if _, exists := set[key]; !exists {
+		return
+	}
+	delete(set, key)
+	if len(set) == 0 {
+		delete(b.subs, value)
+	}
+	if b.lengths[len(value)]--; b.lengths[len(value)] == 0 {
+		delete(b.lengths, len(value))
+	}
+}
+
+// collect adds every subscription indexed under a prefix of value to out.
+func (b *prefixBucket) collect(value string, out map[subKey]struct{}) {
+	for l := range b.lengths {
+		if l > len(value) {
+			continue
+		}
+		for key := range b.subs[value[:l]] {
+			out[key] = struct{}{}
+		}
+	}
+}
+
+// subscriptionIndex narrows the subscriptions a new event has to be matched
+// against. Each filter is posted under its most selective field (ids, then
+// authors, then one tag, then kinds); filters without any of those go to a
+// catch-all bucket. Candidates are then verified with event.Matches.
+type subscriptionIndex struct {
+	mu       sync.RWMutex
+	subs     map[subKey]*indexedSub
+	byClient map[*protocol.Client]map[string]struct{}
+	ids      *prefixBucket
+	authors  *prefixBucket
+	tags     map[string]*prefixBucket
+	kinds    map[int]map[subKey]struct{}
+	all      map[subKey]struct{}
+}
+
+func newSubscriptionIndex() *subscriptionIndex {
+	return &subscriptionIndex{
+		subs:     make(map[subKey]*indexedSub),
+		byClient: make(map[*protocol.Client]map[string]struct{}),
+		ids:      newPrefixBucket(),
+		authors:  newPrefixBucket(),
+		tags:     make(map[string]*prefixBucket),
+		kinds:    make(map[int]map[subKey]struct{}),
+		all:      make(map[subKey]struct{}),
+	}
+}
+
+// Add registers a subscription, replacing any previous subscription with the same ID.
+func (idx *subscriptionIndex) Add(c *protocol.Client, subID string, filters []*event.Filter) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	key := subKey{client: c, subID: subID}
+	idx.removeLocked(key)
+
+	sub := &indexedSub{filters: filters}
+	for _, f := range filters {
+		for _, p := range postingsFor(f) {
+			idx.insertLocked(p, key)
+			sub.postings = append(sub.postings, p)
+		}
+	}
+	idx.subs[key] = sub
+
+	ids, ok := idx.byClient[c]
+	if !ok {
+		ids = make(map[string]struct{})
+		idx.byClient[c] = ids
+	}
+	ids[subID] = struct{}{}
+}
+
+// Remove unregisters a single subscription.
+func (idx *subscriptionIndex) Remove(c *protocol.Client, subID string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(subKey{client: c, subID: subID})
+}
+
+// RemoveClient unregisters every subscription of a client.
+func (idx *subscriptionIndex) RemoveClient(c *protocol.Client) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for subID := range idx.byClient[c] {
+		idx.removeLocked(subKey{client: c, subID: subID})
+	}
+	delete(idx.byClient, c)
+}
+
+// Len returns the number of indexed subscriptions.
+func (idx *subscriptionIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.subs)
+}
+
+// Match returns, per client, the IDs of every subscription with at least one
+// filter matching the event.
+func (idx *subscriptionIndex) Match(evt *event.Event) map[*protocol.Client][]string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	candidates := make(map[subKey]struct{})
+	idx.ids.collect(evt.ID, candidates)
+	idx.authors.collect(evt.PubKey, candidates)
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		if bucket, ok := idx.tags[tag[0]]; ok {
+			bucket.collect(tag[1], candidates)
+		}
+	}
+	for key := range idx.kinds[evt.Kind] {
+		candidates[key] = struct{}{}
+	}
+	for key := range idx.all {
+		candidates[key] = struct{}{}
+	}
+
+	matches := make(map[*protocol.Client][]string)
+	for key := range candidates {
+		for _, f := range idx.subs[key].filters {
+			if evt.Matches(f) {
+				matches[key.client] = append(matches[key.client], key.subID)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+func (idx *subscriptionIndex) removeLocked(key subKey) {
+	sub, ok := idx.subs[key]
+	if !ok {
+		return
+	}
+	for _, p := range sub.postings {
+		idx.deleteLocked(p, key)
+	}
+	delete(idx.subs, key)
+
+	if ids, ok := idx.byClient[key.client]; ok {
+		delete(ids, key.subID)
+		if len(ids) == 0 {
+			delete(idx.byClient, key.client)
+		}
+	}
+}
+
+func (idx *subscriptionIndex) insertLocked(p posting, key subKey) {
+	switch p.dim {
+	case dimID:
+		idx.ids.add(p.value, key)
+	case dimAuthor:
+		idx.authors.add(p.value, key)
+	case dimTag:
+		bucket, ok := idx.tags[p.name]
+		if !ok {
+			bucket = newPrefixBucket()
+			idx.tags[p.name] = bucket
+		}
+		bucket.add(p.value, key)
+	case dimKind:
+		set, ok := idx.kinds[p.kind]
+		if !ok {
+			set = make(map[subKey]struct{})
+			idx.kinds[p.kind] = set
+		}
+		set[key] = struct{}{}
+	case dimAll:
+		idx.all[key] = struct{}{}
+	}
+}
+
+func (idx *subscriptionIndex) deleteLocked(p posting, key subKey) {
+	switch p.dim {
+	case dimID:
+		idx.ids.remove(p.value, key)
+	case dimAuthor:
+		idx.authors.remove(p.value, key)
+	case dimTag:
+		if bucket, ok := idx.tags[p.name]; ok {
+			bucket.remove(p.value, key)
+			if len(bucket.subs) == 0 {
+				delete(idx.tags, p.name)
+			}
+		}
+	case dimKind:
+		if set, ok := idx.kinds[p.kind]; ok {
+			delete(set, key)
+			if len(set) == 0 {
+				delete(idx.kinds, p.kind)
+			}
+		}
+	case dimAll:
+		delete(idx.all, key)
+	}
+}
+
+// postingsFor picks the most selective field of a filter and returns one
+// posting per value of that field.
+func postingsFor(f *event.Filter) []posting {
+	var postings []posting
+	switch {
+	case len(f.IDs) > 0:
+		for _, id := range f.IDs {
+			postings = append(postings, posting{dim: dimID, value: id})
+		}
+	case len(f.Authors) > 0:
+		for _, author := range f.Authors {
+			postings = append(postings, posting{dim: dimAuthor, value: author})
+		}
+	case len(f.Tags) > 0:
+		// Use the tag with the fewest values; ties broken by name for determinism
+		var name string
+		for n, values := range f.Tags {
+			if name == "" || len(values) < len(f.Tags[name]) || (len(values) == len(f.Tags[name]) && n < name) {
+				name = n
+			}
+		}
+		for _, value := range f.Tags[name] {
+			postings = append(postings, posting{dim: dimTag, name: name, value: value})
+		}
+	case len(f.Kinds) > 0:
+		for _, kind := range f.Kinds {
+			postings = append(postings, posting{dim: dimKind, kind: kind})
+		}
+	}
+	if len(postings) == 0 {
+		postings = append(postings, posting{dim: dimAll})
+	}
+	return postings
+}
@@ -0,0 +1,126 @@
+package relay
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func hexID(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+func matchedSubs(matches map[*protocol.Client][]string, c *protocol.Client) []string {
+	subIDs := append([]string(nil), matches[c]...)
+	sort.Strings(subIDs)
+	return subIDs
+}
+
+func TestSubscriptionIndex_Match(t *testing.T) {
+	idx := newSubscriptionIndex()
+	c1 := protocol.NewClient(nil, nil, "10.0.0.1")
+	c2 := protocol.NewClient(nil, nil, "10.0.0.2")
+
+	author := hexID(1)
+	note := hexID(2)
+
+	idx.Add(c1, "by-kind", []*event.Filter{{Kinds: []int{1}}})
+	idx.Add(c1, "by-author", []*event.Filter{{Authors: []string{author}}})
+	idx.Add(c1, "by-author-prefix", []*event.Filter{{Authors: []string{author[:8]}}})
+	idx.Add(c1, "by-tag", []*event.Filter{{Tags: map[string][]string{"e": {note}}}})
+	idx.Add(c1, "other-kind", []*event.Filter{{Kinds: []int{7}}})
+	idx.Add(c2, "everything", []*event.Filter{{}})
+	idx.Add(c2, "by-id", []*event.Filter{{IDs: []string{hexID(3)}}})
+
+	evt := &event.Event{ID: hexID(3), PubKey: author, Kind: 1, Tags: [][]string{{"e", note}}}
+	matches := idx.Match(evt)
+
+	assert.Equal(t, []string{"by-author", "by-author-prefix", "by-kind", "by-tag"}, matchedSubs(matches, c1))
+	assert.Equal(t, []string{"by-id", "everything"}, matchedSubs(matches, c2))
+
+	t.Run("candidates are verified against all filter fields", func(t *testing.T) {
+		idx.Add(c1, "author-and-kind", []*event.Filter{{Authors: []string{author}, Kinds: []int{7}}})
+		assert.NotContains(t, idx.Match(evt)[c1], "author-and-kind")
+	})
+
+	t.Run("replacing a subscription drops its old postings", func(t *testing.T) {
+		idx.Add(c1, "by-kind", []*event.Filter{{Kinds: []int{30023}}})
+		assert.NotContains(t, idx.Match(evt)[c1], "by-kind")
+	})
+
+	t.Run("remove and remove client", func(t *testing.T) {
+		idx.Remove(c2, "everything")
+		assert.Equal(t, []string{"by-id"}, matchedSubs(idx.Match(evt), c2))
+
+		idx.RemoveClient(c1)
+		matches := idx.Match(evt)
+		assert.Empty(t, matches[c1])
+		assert.Equal(t, 1, idx.Len())
+		assert.Empty(t, idx.kinds)
+		assert.Empty(t, idx.tags)
+	})
+}
+
+// benchmarkClients registers n clients with subsPerClient subscriptions each,
+// mixing the filter shapes seen in practice.
+func benchmarkClients(n, subsPerClient int) (*subscriptionIndex, map[*protocol.Client]map[string][]*event.Filter) {
+	idx := newSubscriptionIndex()
+	linear := make(map[*protocol.Client]map[string][]*event.Filter, n)
+	for i := 0; i < n; i++ {
+		c := protocol.NewClient(nil, nil, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		linear[c] = make(map[string][]*event.Filter, subsPerClient)
+		for j := 0; j < subsPerClient; j++ {
+			var f *event.Filter
+			switch j % 4 {
+			case 0:
+				f = &event.Filter{Authors: []string{hexID(i*subsPerClient + j)}}
+			case 1:
+				f = &event.Filter{Kinds: []int{7}, Tags: map[string][]string{"e": {hexID(i + j)}}}
+			case 2:
+				f = &event.Filter{Kinds: []int{4}, Tags: map[string][]string{"p": {hexID(i)}}}
+			case 3:
+				f = &event.Filter{IDs: []string{hexID(i*subsPerClient + j)}}
+			}
+			subID := fmt.Sprintf("sub-%d", j)
+			idx.Add(c, subID, []*event.Filter{f})
+			linear[c][subID] = []*event.Filter{f}
+		}
+	}
+	return idx, linear
+}
+
+func BenchmarkBroadcastMatch_Indexed(b *testing.B) {
+	idx, _ := benchmarkClients(10000, 20)
+	evt := &event.Event{ID: hexID(-1), PubKey: hexID(42), Kind: 1, Tags: [][]string{{"e", hexID(7)}, {"p", hexID(9)}}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.Match(evt)
+	}
+}
+
+func BenchmarkBroadcastMatch_Linear(b *testing.B) {
+	_, linear := benchmarkClients(10000, 20)
+	evt := &event.Event{ID: hexID(-1), PubKey: hexID(42), Kind: 1, Tags: [][]string{{"e", hexID(7)}, {"p", hexID(9)}}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matches := make(map[*protocol.Client][]string)
+		for c, subs := range linear {
+			for subID, filters := range subs {
+				for _, f := range filters {
+					if evt.Matches(f) {
+						matches[c] = append(matches[c], subID)
+						break
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"context"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+	"github.com/paul/glienicke/pkg/protocol"
+	"github.com/paul/glienicke/pkg/writepolicy"
+)
+
+// SetWritePolicy runs an external write-policy plugin (see package
+// writepolicy) for every event that passes the relay's own checks. An empty
+// command disables the plugin. Setting the running command again only
+// updates the options, so the plugin keeps its state across reloads.
+func (r *Relay) SetWritePolicy(command string, opts writepolicy.Options) error {
+	if current := r.writePolicy.Load(); current != nil && current.Command() == command {
+		current.SetOptions(opts)
+		return nil
+	}
+	var plugin *writepolicy.Plugin
+	if command != "" {
+		var err error
+		if plugin, err = writepolicy.New(command, opts); err != nil {
+			return err
+		}
+	}
+	if old := r.writePolicy.Swap(plugin); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// applyWritePolicy asks the plugin about evt and answers the client if the
+// event is rejected or shadow-rejected. It reports whether it did.
+func (r *Relay) applyWritePolicy(ctx context.Context, plugin *writepolicy.Plugin, c *protocol.Client, evt *event.Event) bool {
+	d := plugin.Check(ctx, evt, writepolicy.Source{
+		IP:         c.RemoteAddr(),
+		AuthPubKey: c.AuthPubKey(),
+		ReceivedAt: time.Now(),
+	})
+	if d.Err != nil {
+		r.obs.writePolicy.With("error").Inc()
+	} else {
+		r.obs.writePolicy.With(string(d.Action)).Inc()
+	}
+
+	switch d.Action {
+	case writepolicy.Reject:
+		clientLog(c).Debug("write policy rejected event", logging.KeyEventID, evt.ID, "message", d.Message)
+		r.sendOK(c, evt, false, d.Message)
+		return true
+	case writepolicy.ShadowReject:
+		clientLog(c).Debug("write policy shadow-rejected event", logging.KeyEventID, evt.ID)
+		r.sendOK(c, evt, true, "")
+		return true
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip45"
 )
 
 var ErrNotFound = errors.New("event not found")
@@ -43,4 +44,101 @@ type Store interface {
 	// Events with kinds in exemptKinds are not deleted (e.g., profile metadata, relay lists).
 	// Returns the number of deleted events.
 	DeleteEventsOlderThan(ctx context.Context, before int64, exemptKinds []int) (int, error)
+
+	// DeleteKindsOlderThan deletes events of the given kinds with created_at before
+	// the given Unix timestamp (e.g., expired gift wraps).
+	// Returns the number of deleted events.
+	DeleteKindsOlderThan(ctx context.Context, kinds []int, before int64) (int, error)
+}
+
+// HLLCounter is implemented by stores that maintain NIP-45 HyperLogLog sketches
+// for common aggregates (followers, reactions, comments).
+type HLLCounter interface {
+	// CountEventsHLL counts the events matching a filter eligible for HyperLogLog
+	// counting (see nip45.ParseRef) and returns the registers for the counted authors.
+	// Small sets are counted exactly; large sets are estimated from the sketch
+	// and reported as approximate. Authors cannot be removed from a sketch, so
+	// estimates still include the authors of deleted or replaced events.
+	CountEventsHLL(ctx context.Context, filter *event.Filter, ref nip45.SketchRef) (*nip45.Result, error)
+}
+
+// ListEntry is one value on a management list together with the reason it was added.
+type ListEntry struct {
+	Value     string
+	Reason    string
+	CreatedAt int64
+}
+
+// Ban is a rate-limit ban of an IP network or pubkey, persisted so that it
+// survives restarts.
+type Ban struct {
+	Key       string // banned rate limit key, e.g. "ip:203.0.113.7" or "pubkey:<hex>"
+	Reason    string
+	Until     int64    // Unix time the ban expires
+	PubKeys   []string // authenticated pubkeys seen from a banned IP network
+	Strikes   int      // temporary bans since the last long ban, for escalation
+	CreatedAt int64
+}
+
+// Report is one reporter's NIP-56 report of a pubkey, event or blob. A
+// reporter has at most one report per target.
+type Report struct {
+	TargetType string // "pubkey", "event" or "blob"
+	Target     string // pubkey, event ID or blob hash
+	Reporter   string
+	Type       string // NIP-56 report type, e.g. "spam"; may be empty
+	EventID    string // the kind 1984 report event
+	CreatedAt  int64
+}
+
+// Reputation counts how moderators resolved a reporter's reports
+type Reputation struct {
+	PubKey    string
+	Upheld    int
+	Dismissed int
+}
+
+// ManagementStore is implemented by stores that persist relay management
+// state: named lists (banned pubkeys, banned events, blocked IPs, allowed
+// kinds, ...), key/value settings such as the relay name, rate-limit bans,
+// and the NIP-56 moderation queue with its reporter reputations.
+type ManagementStore interface {
+	// AddListEntry adds a value to a list, replacing the reason if it is already present
+	AddListEntry(ctx context.Context, list, value, reason string) error
+
+	// RemoveListEntry removes a value from a list; removing a missing value is not an error
+	RemoveListEntry(ctx context.Context, list, value string) error
+
+	// ListEntries returns every entry of a list, oldest first
+	ListEntries(ctx context.Context, list string) ([]ListEntry, error)
+
+	// SetSetting stores a setting
+	SetSetting(ctx context.Context, key, value string) error
+
+	// GetSetting returns a setting, or ErrNotFound if it was never set
+	GetSetting(ctx context.Context, key string) (string, error)
+
+	// SaveBan stores a ban, replacing any ban with the same key
+	SaveBan(ctx context.Context, ban Ban) error
+
+	// DeleteBan removes a ban; removing a missing ban is not an error
+	DeleteBan(ctx context.Context, key string) error
+
+	// ListBans returns every stored ban, expired ones included
+	ListBans(ctx context.Context) ([]Ban, error)
+
+	// SaveReport stores a report, replacing the reporter's earlier report of the same target
+	SaveReport(ctx context.Context, report Report) error
+
+	// DeleteReports removes every report of a target
+	DeleteReports(ctx context.Context, targetType, target string) error
+
+	// ListReports returns every stored report, oldest first
+	ListReports(ctx context.Context) ([]Report, error)
+
+	// SaveReputation stores a reporter's reputation, replacing the previous one
+	SaveReputation(ctx context.Context, rep Reputation) error
+
+	// ListReputations returns the stored reporter reputations ordered by pubkey
+	ListReputations(ctx context.Context) ([]Reputation, error)
 }
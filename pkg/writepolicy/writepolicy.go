@@ -0,0 +1,432 @@
+// Package writepolicy runs external write-policy plugins.
+//
+// A plugin is a long-running process that reads one JSON request per line on
+// stdin and answers each with one JSON line on stdout, using the strfry
+// write-policy protocol so that existing strfry plugins work unchanged:
+//
+//	{"type":"new","event":{...},"receivedAt":1700000000,"sourceType":"IP4","sourceInfo":"203.0.113.7","authed":"<pubkey>"}
+//	{"id":"<event id>","action":"accept|reject|shadowReject","msg":"..."}
+//
+// Requests are pipelined; responses are matched to requests by event ID.
+// Anything the plugin writes to stderr is logged. A plugin that exits, or
+// that stops reading requests for longer than Timeout and is killed, is
+// restarted on the next request, no sooner than RestartDelay after it was
+// last started.
+package writepolicy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/logging"
+)
+
+// Action is a plugin's verdict on an event
+type Action string
+
+const (
+	Accept Action = "accept"
+	Reject Action = "reject"
+	// ShadowReject tells the client the event was accepted without storing
+	// or broadcasting it
+	ShadowReject Action = "shadowReject"
+)
+
+// Default option values
+const (
+	DefaultTimeout      = 5 * time.Second
+	DefaultRestartDelay = time.Second
+)
+
+// maxLineSize bounds a single response line
+const maxLineSize = 1 << 20
+
+// ErrUnavailable is returned when the plugin is not running and cannot be
+// started yet
+var ErrUnavailable = errors.New("write policy plugin unavailable")
+
+var logger = logging.For("writepolicy")
+
+// Options tune a Plugin.
+type Options struct {
+	// Timeout bounds the wait for a response (0 = DefaultTimeout)
+	Timeout time.Duration
+	// FailOpen accepts events when the plugin fails or times out; by
+	// default they are rejected
+	FailOpen bool
+	// RestartDelay is the minimum time between plugin starts (0 = DefaultRestartDelay)
+	RestartDelay time.Duration
+}
+
+// Source describes where an event came from.
+type Source struct {
+	IP         string    // client IP; empty for events not received from a client
+	AuthPubKey string    // NIP-42 or NIP-98 authenticated pubkey, if any
+	ReceivedAt time.Time // when the relay received the event
+}
+
+// Request is a line sent to the plugin.
+type Request struct {
+	Type       string       `json:"type"`
+	Event      *event.Event `json:"event"`
+	ReceivedAt int64        `json:"receivedAt"`
+	SourceType string       `json:"sourceType"` // IP4, IP6 or Import
+	SourceInfo string       `json:"sourceInfo"`
+	Authed     string       `json:"authed,omitempty"`
+}
+
+// Response is a line received from the plugin.
+type Response struct {
+	ID     string `json:"id"`
+	Action Action `json:"action"`
+	Msg    string `json:"msg"`
+}
+
+// Decision is the outcome of Check.
+type Decision struct {
+	Action Action
+	// Message is the OK message for rejected events
+	Message string
+	// Err is set when the plugin could not decide and Action comes from the
+	// fail-open/fail-closed setting
+	Err error
+}
+
+// Plugin manages a write-policy process.
+type Plugin struct {
+	command string
+	args    []string
+	opts    Options
+
+	mu        sync.Mutex
+	proc      *process
+	lastStart time.Time
+	closed    bool
+}
+
+// process is one run of the plugin command
+type process struct {
+	cmd   *exec.Cmd
+	stdin *os.File      // pipe to the plugin, supporting write deadlines
+	done  chan struct{} // closed when the process has exited
+
+	writing chan struct{} // held while a request is written to stdin
+	mu      sync.Mutex
+	pending map[string][]chan Response
+}
+
+// New returns a Plugin for a command line; arguments are separated by
+// spaces. The process is started by the first Check.
+func New(command string, opts Options) (*Plugin, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("empty write policy command")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.RestartDelay <= 0 {
+		opts.RestartDelay = DefaultRestartDelay
+	}
+	return &Plugin{command: command, args: fields, opts: opts}, nil
+}
+
+// Command returns the command line the plugin runs.
+func (p *Plugin) Command() string {
+	return p.command
+}
+
+// SetOptions changes the options of a running plugin.
+func (p *Plugin) SetOptions(opts Options) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.RestartDelay <= 0 {
+		opts.RestartDelay = DefaultRestartDelay
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.opts = opts
+}
+
+// Check asks the plugin whether to accept evt. If the plugin fails, times
+// out or returns an unknown action, the decision follows FailOpen and Err
+// says why.
+func (p *Plugin) Check(ctx context.Context, evt *event.Event, src Source) Decision {
+	p.mu.Lock()
+	opts := p.opts
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	resp, err := p.call(ctx, newRequest(evt, src))
+	if err == nil {
+		switch resp.Action {
+		case Accept, ShadowReject:
+			return Decision{Action: resp.Action}
+		case Reject:
+			msg := resp.Msg
+			if msg == "" {
+				msg = "blocked: rejected by write policy"
+			}
+			return Decision{Action: Reject, Message: msg}
+		default:
+			err = fmt.Errorf("unknown action %q", resp.Action)
+		}
+	}
+
+	logger.Warn("write policy plugin failed", logging.KeyEventID, evt.ID, logging.KeyError, err, "fail_open", opts.FailOpen)
+	if opts.FailOpen {
+		return Decision{Action: Accept, Err: err}
+	}
+	return Decision{Action: Reject, Message: "error: write policy unavailable", Err: err}
+}
+
+// Close stops the plugin process.
+func (p *Plugin) Close() {
+	p.mu.Lock()
+	p.closed = true
+	proc := p.proc
+	p.proc = nil
+	p.mu.Unlock()
+	if proc != nil {
+		proc.stop()
+	}
+}
+
+func newRequest(evt *event.Event, src Source) Request {
+	req := Request{
+		Type:       "new",
+		Event:      evt,
+		ReceivedAt: src.ReceivedAt.Unix(),
+		SourceType: "Import",
+		SourceInfo: src.IP,
+		Authed:     src.AuthPubKey,
+	}
+	if ip := net.ParseIP(src.IP); ip != nil {
+		req.SourceType = "IP6"
+		if ip.To4() != nil {
+			req.SourceType = "IP4"
+		}
+	}
+	return req
+}
+
+// call sends a request and waits for the response with the same event ID
+func (p *Plugin) call(ctx context.Context, req Request) (Response, error) {
+	proc, err := p.running()
+	if err != nil {
+		return Response{}, err
+	}
+
+	ch := proc.register(req.Event.ID)
+	if err := proc.send(ctx, req); err != nil {
+		proc.unregister(req.Event.ID, ch)
+		return Response{}, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-proc.done:
+		proc.unregister(req.Event.ID, ch)
+		return Response{}, errors.New("write policy plugin exited")
+	case <-ctx.Done():
+		proc.unregister(req.Event.ID, ch)
+		return Response{}, fmt.Errorf("write policy plugin did not answer: %w", ctx.Err())
+	}
+}
+
+// running returns the current process, starting one if needed
+func (p *Plugin) running() (*process, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrUnavailable
+	}
+	if p.proc != nil {
+		select {
+		case <-p.proc.done:
+			p.proc = nil
+		default:
+			return p.proc, nil
+		}
+	}
+	if time.Since(p.lastStart) < p.opts.RestartDelay {
+		return nil, ErrUnavailable
+	}
+
+	p.lastStart = time.Now()
+	proc, err := start(p.args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start write policy plugin: %w", err)
+	}
+	logger.Info("write policy plugin started", "command", p.command, "pid", proc.cmd.Process.Pid)
+	p.proc = proc
+	return proc, nil
+}
+
+func start(args []string) (*process, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	// An os.Pipe rather than cmd.StdinPipe, so that writes can time out
+	stdinRead, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = stdinRead
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdinRead.Close()
+		stdin.Close()
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdinRead.Close()
+		stdin.Close()
+		return nil, err
+	}
+	err = cmd.Start()
+	stdinRead.Close()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+
+	proc := &process{
+		cmd:     cmd,
+		stdin:   stdin,
+		done:    make(chan struct{}),
+		writing: make(chan struct{}, 1),
+		pending: make(map[string][]chan Response),
+	}
+	go logStderr(stderr)
+	go proc.readResponses(stdout)
+	return proc, nil
+}
+
+// readResponses dispatches response lines until stdout closes, then reaps the process
+func (proc *process) readResponses(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		var resp Response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			logger.Warn("invalid write policy response", "line", scanner.Text(), logging.KeyError, err)
+			continue
+		}
+		if ch := proc.take(resp.ID); ch != nil {
+			ch <- resp
+		} else {
+			logger.Warn("write policy response for unknown event", logging.KeyEventID, resp.ID)
+		}
+	}
+
+	err := proc.cmd.Wait()
+	logger.Warn("write policy plugin exited", logging.KeyError, err)
+	close(proc.done)
+}
+
+func logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		logger.Info("write policy plugin", "stderr", scanner.Text())
+	}
+}
+
+// send writes a request line to the plugin. Waiting for other writers and
+// the write itself are bounded by ctx: a plugin that stops reading would
+// otherwise block every request once the pipe buffer is full. It is killed
+// when a write times out, since a partial line has corrupted its input.
+func (proc *process) send(ctx context.Context, req Request) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	select {
+	case proc.writing <- struct{}{}:
+	case <-proc.done:
+		return errors.New("write policy plugin exited")
+	case <-ctx.Done():
+		return fmt.Errorf("write policy plugin is not reading: %w", ctx.Err())
+	}
+	defer func() { <-proc.writing }()
+
+	deadline, _ := ctx.Deadline()
+	proc.stdin.SetWriteDeadline(deadline)
+	if _, err := proc.stdin.Write(append(data, '\n')); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Warn("write policy plugin is not reading requests, killing it", "pid", proc.cmd.Process.Pid)
+			proc.cmd.Process.Kill()
+			return fmt.Errorf("write policy plugin is not reading: %w", context.DeadlineExceeded)
+		}
+		return fmt.Errorf("failed to write to write policy plugin: %w", err)
+	}
+	return nil
+}
+
+// register queues a waiter for id; concurrent requests for the same event
+// are answered in order
+func (proc *process) register(id string) chan Response {
+	ch := make(chan Response, 1)
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	proc.pending[id] = append(proc.pending[id], ch)
+	return ch
+}
+
+func (proc *process) unregister(id string, ch chan Response) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	waiters := proc.pending[id]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(proc.pending, id)
+	} else {
+		proc.pending[id] = waiters
+	}
+}
+
+// take removes and returns the oldest waiter for id
+func (proc *process) take(id string) chan Response {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	waiters := proc.pending[id]
+	if len(waiters) == 0 {
+		return nil
+	}
+	if len(waiters) == 1 {
+		delete(proc.pending, id)
+	} else {
+		proc.pending[id] = waiters[1:]
+	}
+	return waiters[0]
+}
+
+// stop closes stdin so the plugin can exit, and kills it if it does not
+func (proc *process) stop() {
+	proc.stdin.Close()
+	select {
+	case <-proc.done:
+	case <-time.After(2 * time.Second):
+		proc.cmd.Process.Kill()
+		<-proc.done
+	}
+}
@@ -0,0 +1,197 @@
+package writepolicy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/pkg/event"
+)
+
+// helperEnv selects the plugin behaviour when the test binary runs as a plugin
+const helperEnv = "WRITEPOLICY_TEST_PLUGIN"
+
+// TestHelperPlugin is not a real test: it is the plugin process started by
+// the other tests. Its behaviour depends on the content of each event:
+// "spam" is rejected, "shadow" shadow-rejected, "slow" never answered,
+// "stall" never answered and stdin no longer read, "crash" exits, "whoami"
+// is rejected with the request's source, and anything else accepted.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv(helperEnv) == "" {
+		t.Skip("only runs as a plugin process")
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintln(os.Stderr, "bad request:", err)
+			continue
+		}
+		resp := Response{ID: req.Event.ID, Action: Accept}
+		switch req.Event.Content {
+		case "spam":
+			resp.Action, resp.Msg = Reject, "blocked: spam"
+		case "shadow":
+			resp.Action = ShadowReject
+		case "slow":
+			continue
+		case "stall":
+			time.Sleep(time.Hour)
+		case "crash":
+			os.Exit(1)
+		case "whoami":
+			resp.Action = Reject
+			resp.Msg = strings.Join([]string{req.Type, req.SourceType, req.SourceInfo, req.Authed}, " ")
+		}
+		data, _ := json.Marshal(resp)
+		fmt.Println(string(data))
+	}
+	os.Exit(0)
+}
+
+func newHelperPlugin(t *testing.T, opts Options) *Plugin {
+	t.Helper()
+	t.Setenv(helperEnv, "1")
+	p, err := New(os.Args[0]+" -test.run=^TestHelperPlugin$", opts)
+	require.NoError(t, err)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func testEvent(content string) *event.Event {
+	return &event.Event{
+		ID:        fmt.Sprintf("%064x", time.Now().UnixNano()),
+		PubKey:    strings.Repeat("a", 64),
+		CreatedAt: time.Now().Unix(),
+		Kind:      1,
+		Tags:      [][]string{},
+		Content:   content,
+	}
+}
+
+func TestCheck_Actions(t *testing.T) {
+	p := newHelperPlugin(t, Options{})
+	ctx := context.Background()
+	src := Source{IP: "203.0.113.7", ReceivedAt: time.Now()}
+
+	assert.Equal(t, Decision{Action: Accept}, p.Check(ctx, testEvent("hello"), src))
+	assert.Equal(t, Decision{Action: Reject, Message: "blocked: spam"}, p.Check(ctx, testEvent("spam"), src))
+	assert.Equal(t, Decision{Action: ShadowReject}, p.Check(ctx, testEvent("shadow"), src))
+}
+
+func TestCheck_SendsSource(t *testing.T) {
+	p := newHelperPlugin(t, Options{})
+	pubkey := strings.Repeat("b", 64)
+
+	d := p.Check(context.Background(), testEvent("whoami"), Source{IP: "2001:db8::1", AuthPubKey: pubkey, ReceivedAt: time.Now()})
+	assert.Equal(t, "new IP6 2001:db8::1 "+pubkey, d.Message)
+
+	d = p.Check(context.Background(), testEvent("whoami"), Source{IP: "203.0.113.7", ReceivedAt: time.Now()})
+	assert.Equal(t, "new IP4 203.0.113.7 ", d.Message)
+}
+
+func TestCheck_ConcurrentRequests(t *testing.T) {
+	p := newHelperPlugin(t, Options{})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		content := "hello"
+		if i%2 == 0 {
+			content = "spam"
+		}
+		evt := testEvent(content)
+		evt.ID = fmt.Sprintf("%064x", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := p.Check(context.Background(), evt, Source{})
+			if content == "spam" {
+				assert.Equal(t, Reject, d.Action)
+			} else {
+				assert.Equal(t, Accept, d.Action)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCheck_TimeoutFailsClosed(t *testing.T) {
+	p := newHelperPlugin(t, Options{Timeout: 100 * time.Millisecond})
+
+	d := p.Check(context.Background(), testEvent("slow"), Source{})
+	assert.Equal(t, Reject, d.Action)
+	assert.Equal(t, "error: write policy unavailable", d.Message)
+	assert.ErrorIs(t, d.Err, context.DeadlineExceeded)
+
+	// The plugin keeps serving other events
+	assert.Equal(t, Accept, p.Check(context.Background(), testEvent("hello"), Source{}).Action)
+}
+
+func TestCheck_TimeoutFailsOpen(t *testing.T) {
+	p := newHelperPlugin(t, Options{Timeout: 100 * time.Millisecond, FailOpen: true})
+
+	d := p.Check(context.Background(), testEvent("slow"), Source{})
+	assert.Equal(t, Accept, d.Action)
+	assert.Error(t, d.Err)
+}
+
+func TestCheck_PluginNotReading(t *testing.T) {
+	p := newHelperPlugin(t, Options{Timeout: 200 * time.Millisecond, RestartDelay: time.Hour})
+
+	d := p.Check(context.Background(), testEvent("stall"), Source{})
+	assert.ErrorIs(t, d.Err, context.DeadlineExceeded)
+
+	// Requests larger than the pipe buffer time out instead of blocking
+	// the writer, and the requests queued behind it time out as well
+	big := strings.Repeat("x", 256*1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		evt := testEvent(big)
+		evt.ID = fmt.Sprintf("%064x", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			d := p.Check(context.Background(), evt, Source{})
+			assert.Equal(t, Reject, d.Action)
+			assert.Error(t, d.Err)
+			assert.Less(t, time.Since(start), 2*time.Second)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCheck_RestartsAfterCrash(t *testing.T) {
+	p := newHelperPlugin(t, Options{RestartDelay: 50 * time.Millisecond})
+
+	d := p.Check(context.Background(), testEvent("crash"), Source{})
+	assert.Equal(t, Reject, d.Action)
+	assert.Error(t, d.Err)
+
+	// Within the restart delay the plugin stays down
+	assert.ErrorIs(t, p.Check(context.Background(), testEvent("hello"), Source{}).Err, ErrUnavailable)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, Decision{Action: Accept}, p.Check(context.Background(), testEvent("hello"), Source{}))
+}
+
+func TestCheck_MissingCommand(t *testing.T) {
+	p, err := New("/nonexistent/write-policy", Options{FailOpen: true})
+	require.NoError(t, err)
+	defer p.Close()
+
+	d := p.Check(context.Background(), testEvent("hello"), Source{})
+	assert.Equal(t, Accept, d.Action)
+	assert.Error(t, d.Err)
+
+	_, err = New("  ", Options{})
+	assert.Error(t, err)
+}
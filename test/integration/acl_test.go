@@ -0,0 +1,198 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip19"
+	"github.com/paul/glienicke/pkg/relay"
+)
+
+func TestACL_WriteRules(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	t.Run("denied pubkey given as npub", func(t *testing.T) {
+		spammer := testutil.MustGenerateKeyPair()
+		npub, err := nip19.EncodeNpub(spammer.PubKeyHex)
+		require.NoError(t, err)
+		require.NoError(t, r.AddACLEntry(ctx, relay.ACLEntry{
+			Direction: relay.ACLWrite, Action: relay.ACLDeny, Type: relay.ACLPubKey, Value: npub, Reason: "spam",
+		}))
+
+		evt, err := testutil.NewTestEventWithKey(spammer, 1, "buy now", nil)
+		require.NoError(t, err)
+		accepted, msg := publish(t, client, evt)
+		assert.False(t, accepted)
+		assert.True(t, strings.HasPrefix(msg, "blocked:"), msg)
+		assert.Contains(t, msg, "spam")
+
+		// Other authors are unaffected
+		evt, _ = testutil.MustNewTestEvent(1, "hello", nil)
+		accepted, msg = publish(t, client, evt)
+		assert.True(t, accepted, msg)
+	})
+
+	t.Run("kind allowlist", func(t *testing.T) {
+		require.NoError(t, r.AddACLEntry(ctx, relay.ACLEntry{
+			Direction: relay.ACLWrite, Action: relay.ACLAllow, Type: relay.ACLKind, Value: "0-1",
+		}))
+		defer r.RemoveACLEntry(ctx, relay.ACLEntry{
+			Direction: relay.ACLWrite, Action: relay.ACLAllow, Type: relay.ACLKind, Value: "0-1",
+		})
+
+		evt, _ := testutil.MustNewTestEvent(1, "note", nil)
+		accepted, msg := publish(t, client, evt)
+		assert.True(t, accepted, msg)
+
+		evt, _ = testutil.MustNewTestEvent(7, "+", nil)
+		accepted, msg = publish(t, client, evt)
+		assert.False(t, accepted)
+		assert.True(t, strings.HasPrefix(msg, "restricted:"), msg)
+	})
+}
+
+func TestACL_ReadRules(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	t.Run("denied kinds are not served", func(t *testing.T) {
+		require.NoError(t, r.AddACLEntry(ctx, relay.ACLEntry{
+			Direction: relay.ACLRead, Action: relay.ACLDeny, Type: relay.ACLKind, Value: "1",
+		}))
+		defer r.RemoveACLEntry(ctx, relay.ACLEntry{
+			Direction: relay.ACLRead, Action: relay.ACLDeny, Type: relay.ACLKind, Value: "1",
+		})
+
+		note, _ := testutil.MustNewTestEvent(1, "secret", nil)
+		accepted, msg := publish(t, client, note)
+		require.True(t, accepted, msg)
+
+		require.NoError(t, client.SendReq("notes", &event.Filter{Kinds: []int{1}}))
+		events, err := client.CollectEvents("notes", 2*time.Second)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+	})
+
+	t.Run("pubkey allowlist requires authentication", func(t *testing.T) {
+		require.NoError(t, r.AddACLEntry(ctx, relay.ACLEntry{
+			Direction: relay.ACLRead, Action: relay.ACLAllow, Type: relay.ACLPubKey, Value: testutil.MustGenerateKeyPair().PubKeyHex,
+		}))
+
+		require.NoError(t, client.SendReq("feed", &event.Filter{Kinds: []int{1}}))
+		reason, err := client.ExpectClosed("feed", 2*time.Second)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(reason, "auth-required:"), reason)
+	})
+}
+
+func TestACL_DeniedIPCannotConnect(t *testing.T) {
+	url, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Denying only writes keeps the connection open for reading
+	require.NoError(t, r.AddACLEntry(ctx, relay.ACLEntry{
+		Direction: relay.ACLWrite, Action: relay.ACLDeny, Type: relay.ACLIP, Value: "127.0.0.0/8",
+	}))
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	evt, _ := testutil.MustNewTestEvent(1, "hello", nil)
+	accepted, msg := publish(t, client, evt)
+	assert.False(t, accepted)
+	assert.True(t, strings.HasPrefix(msg, "blocked:"), msg)
+	client.Close()
+
+	require.NoError(t, r.AddACLEntry(ctx, relay.ACLEntry{
+		Direction: relay.ACLRead, Action: relay.ACLDeny, Type: relay.ACLIP, Value: "127.0.0.1",
+	}))
+	_, err = testutil.NewWSClient(url)
+	assert.Error(t, err)
+
+	resp, body := postJSON(t, httpURL+"/api/query", []byte(`{"kinds":[1]}`), nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, string(body), "blocked:")
+}
+
+func TestACL_FilesAndPersistence(t *testing.T) {
+	store := memory.New()
+	r := relay.New(store)
+	ctx := context.Background()
+
+	blocked := testutil.MustGenerateKeyPair()
+	path := filepath.Join(t.TempDir(), "relay.acl")
+	content := "# blocked authors\nboth deny pubkey " + blocked.PubKeyHex + " impersonation\nwrite allow kind 0-9999\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	require.NoError(t, r.SetACLFiles([]string{path}))
+	require.NoError(t, r.AddACLEntry(ctx, relay.ACLEntry{
+		Direction: relay.ACLWrite, Action: relay.ACLDeny, Type: relay.ACLIP, Value: "2001:db8::/32",
+	}))
+	assert.Len(t, r.ACLEntries(), 4)
+
+	// Invalid files are rejected and the loaded entries stay in effect
+	bad := filepath.Join(t.TempDir(), "bad.acl")
+	require.NoError(t, os.WriteFile(bad, []byte("write allow kind nine\n"), 0644))
+	assert.Error(t, r.SetACLFiles([]string{bad}))
+	assert.Len(t, r.ACLEntries(), 4)
+	r.Close()
+
+	// Runtime entries survive a restart on the same store; file entries
+	// come back when the files are loaded again
+	r = relay.New(store)
+	defer r.Close()
+	entries := r.ACLEntries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, relay.ACLEntry{
+		Direction: relay.ACLWrite, Action: relay.ACLDeny, Type: relay.ACLIP, Value: "2001:db8::/32",
+	}, entries[0])
+}
+
+func TestACL_ManagementAPI(t *testing.T) {
+	_, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	admin := testutil.MustGenerateKeyPair()
+	r.SetAdminPubKeys([]string{admin.PubKeyHex})
+	target := testutil.MustGenerateKeyPair()
+
+	status, resp := callNIP86(t, httpURL, admin, "acladd", "write", "deny", "pubkey", target.PubKeyHex, "spam")
+	require.Equal(t, http.StatusOK, status)
+	require.Empty(t, resp.Error)
+
+	status, resp = callNIP86(t, httpURL, admin, "acladd", "write", "deny", "planet", "mars")
+	require.Equal(t, http.StatusOK, status)
+	assert.Contains(t, resp.Error, "invalid ACL type")
+
+	_, resp = callNIP86(t, httpURL, admin, "acllist")
+	var entries []relay.ACLEntry
+	require.NoError(t, json.Unmarshal(resp.Result, &entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, target.PubKeyHex, entries[0].Value)
+	assert.Equal(t, "spam", entries[0].Reason)
+
+	_, resp = callNIP86(t, httpURL, admin, "aclremove", "write", "deny", "pubkey", target.PubKeyHex)
+	require.Empty(t, resp.Error)
+	assert.Empty(t, r.ACLEntries())
+}
@@ -0,0 +1,172 @@
+package integration
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+)
+
+func TestDMReadAccess(t *testing.T) {
+	url, _, cleanup, _ := setupRelay(t)
+	defer cleanup()
+
+	alice := testutil.MustGenerateKeyPair()
+	bob := testutil.MustGenerateKeyPair()
+	eve := testutil.MustGenerateKeyPair()
+	aliceClient := authedClient(t, url, alice)
+	bobClient := authedClient(t, url, bob)
+	eveClient := authedClient(t, url, eve)
+
+	dm, err := testutil.NewTestEventWithKey(alice, 4, "ciphertext", [][]string{{"p", bob.PubKeyHex}})
+	require.NoError(t, err)
+	wrap, _ := testutil.MustNewTestEvent(1059, "ciphertext", [][]string{{"p", bob.PubKeyHex}})
+	for _, evt := range []*event.Event{dm, wrap} {
+		accepted, msg := publish(t, aliceClient, evt)
+		require.True(t, accepted, msg)
+	}
+	toBob := &event.Filter{Kinds: []int{4, 1059}, Tags: map[string][]string{"p": {bob.PubKeyHex}}}
+
+	t.Run("unauthenticated clients are asked to authenticate", func(t *testing.T) {
+		client, err := testutil.NewWSClient(url)
+		require.NoError(t, err)
+		defer client.Close()
+
+		require.NoError(t, client.SendReq("dms", toBob))
+		reason, err := client.ExpectClosed("dms", 2*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "auth-required: direct messages are only served to their recipients", reason)
+		msg, err := client.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "AUTH", msg[0])
+
+		// Filters without kinds still work, without the direct messages
+		require.NoError(t, client.SendReq("mentions", &event.Filter{Tags: map[string][]string{"p": {bob.PubKeyHex}}}))
+		events, err := client.CollectEvents("mentions", 2*time.Second)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+	})
+
+	t.Run("stored messages are only served to participants", func(t *testing.T) {
+		require.NoError(t, eveClient.SendReq("dms", toBob))
+		events, err := eveClient.CollectEvents("dms", 2*time.Second)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+
+		require.NoError(t, bobClient.SendReq("dms", toBob))
+		events, err = bobClient.CollectEvents("dms", 2*time.Second)
+		require.NoError(t, err)
+		assert.Len(t, events, 2)
+
+		// Kind 4 is also readable by its author
+		require.NoError(t, aliceClient.SendReq("sent", &event.Filter{Kinds: []int{4, 1059}, Authors: []string{alice.PubKeyHex}}))
+		events, err = aliceClient.CollectEvents("sent", 2*time.Second)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, dm.ID, events[0].ID)
+	})
+
+	t.Run("counts are limited to the client's own messages", func(t *testing.T) {
+		require.NoError(t, eveClient.SendCountMessage("count", toBob))
+		reason, err := eveClient.ExpectClosed("count", 2*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "restricted: direct messages can only be counted by their recipients", reason)
+
+		require.NoError(t, bobClient.SendCountMessage("count", toBob))
+		msg, err := bobClient.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, "COUNT", msg[0])
+		assert.Equal(t, float64(2), msg[2].(map[string]interface{})["count"])
+
+		// Filters without kinds leave out other people's direct messages
+		note, err := testutil.NewTestEventWithKey(alice, 1, "hi bob", [][]string{{"p", bob.PubKeyHex}})
+		require.NoError(t, err)
+		accepted, reason := publish(t, aliceClient, note)
+		require.True(t, accepted, reason)
+		for name, f := range map[string]*event.Filter{
+			"mentions": {Tags: map[string][]string{"p": {bob.PubKeyHex}}},
+			"author":   {Authors: []string{alice.PubKeyHex}},
+		} {
+			require.NoError(t, eveClient.SendCountMessage(name, f))
+			msg, err = eveClient.ReadMessage()
+			require.NoError(t, err)
+			require.Equal(t, "COUNT", msg[0])
+			assert.Equal(t, float64(1), msg[2].(map[string]interface{})["count"], name)
+		}
+
+		// Recipients still count their own
+		require.NoError(t, bobClient.SendCountMessage("mentions", &event.Filter{Tags: map[string][]string{"p": {bob.PubKeyHex}}}))
+		msg, err = bobClient.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, "COUNT", msg[0])
+		assert.Equal(t, float64(3), msg[2].(map[string]interface{})["count"])
+	})
+
+	t.Run("live messages only reach the recipient", func(t *testing.T) {
+		require.NoError(t, eveClient.SendReq("spy", &event.Filter{Tags: map[string][]string{"p": {bob.PubKeyHex}}}))
+		require.NoError(t, eveClient.ExpectEOSE("spy", 2*time.Second))
+		require.NoError(t, bobClient.SendReq("inbox", &event.Filter{Tags: map[string][]string{"p": {bob.PubKeyHex}}}))
+		_, err := bobClient.CollectEvents("inbox", 2*time.Second)
+		require.NoError(t, err)
+
+		live, _ := testutil.MustNewTestEvent(1059, "ciphertext", [][]string{{"p", bob.PubKeyHex}})
+		accepted, msg := publish(t, aliceClient, live)
+		require.True(t, accepted, msg)
+
+		received, err := bobClient.ExpectEvent("inbox", 2*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, live.ID, received.ID)
+		_, err = eveClient.ExpectEvent("spy", 500*time.Millisecond)
+		assert.Error(t, err)
+	})
+}
+
+func TestDMReadAccess_ConcurrentAuthRequests(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	url, _, cleanup, _ := setupRelay(t)
+	defer cleanup()
+
+	bob := testutil.MustGenerateKeyPair()
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Both queries run at once and need the client to authenticate
+	toBob := &event.Filter{Kinds: []int{4}, Tags: map[string][]string{"p": {bob.PubKeyHex}}}
+	require.NoError(t, client.SendReq("dms1", toBob))
+	require.NoError(t, client.SendReq("dms2", toBob))
+
+	// Read both CLOSED and the AUTH challenge, then authenticate with it
+	var challenges []string
+	closed := 0
+	for closed < 2 || len(challenges) == 0 {
+		msg, err := client.ReadMessage()
+		require.NoError(t, err)
+		switch msg[0] {
+		case "AUTH":
+			challenges = append(challenges, msg[1].(string))
+		case "CLOSED":
+			closed++
+		}
+	}
+	auth, err := testutil.NewTestEventWithKey(bob, 22242, challenges[0], nil)
+	require.NoError(t, err)
+	require.NoError(t, client.SendEvent(auth))
+	for {
+		msg, err := client.ReadMessage()
+		require.NoError(t, err)
+		if msg[0] == "AUTH" {
+			challenges = append(challenges, msg[1].(string))
+		}
+		if msg[0] == "OK" && msg[1] == auth.ID {
+			assert.Equal(t, true, msg[2], msg[3])
+			break
+		}
+	}
+	assert.Len(t, challenges, 1, "expected a single AUTH challenge")
+}
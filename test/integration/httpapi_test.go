@@ -0,0 +1,255 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type apiOK struct {
+	ID       string `json:"id"`
+	Accepted bool   `json:"accepted"`
+	Message  string `json:"message"`
+}
+
+func postJSON(t *testing.T, url string, body []byte, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, data
+}
+
+func publishHTTP(t *testing.T, httpURL string, evt *event.Event) (int, apiOK) {
+	t.Helper()
+	body, err := json.Marshal(evt)
+	require.NoError(t, err)
+	resp, data := postJSON(t, httpURL+"/api/event", body, nil)
+	var ok apiOK
+	require.NoError(t, json.Unmarshal(data, &ok), string(data))
+	return resp.StatusCode, ok
+}
+
+func TestHTTPAPI_PublishQueryCount(t *testing.T) {
+	_, _, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	kp := testutil.MustGenerateKeyPair()
+	var published []*event.Event
+	for _, content := range []string{"one", "two", "three"} {
+		evt, err := testutil.NewTestEventWithKey(kp, 1, content, nil)
+		require.NoError(t, err)
+		status, ok := publishHTTP(t, httpURL, evt)
+		require.Equal(t, http.StatusOK, status)
+		require.True(t, ok.Accepted, ok.Message)
+		assert.Equal(t, evt.ID, ok.ID)
+		published = append(published, evt)
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		status, ok := publishHTTP(t, httpURL, published[0])
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, ok.Accepted)
+		assert.Contains(t, ok.Message, "duplicate:")
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		evt, err := testutil.NewTestEventWithKey(kp, 1, "tampered", nil)
+		require.NoError(t, err)
+		evt.Content = "changed"
+		status, ok := publishHTTP(t, httpURL, evt)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.False(t, ok.Accepted)
+		assert.True(t, strings.HasPrefix(ok.Message, "invalid:"), ok.Message)
+	})
+
+	filter := []byte(`{"authors":["` + kp.PubKeyHex + `"]}`)
+
+	t.Run("query as JSON array", func(t *testing.T) {
+		resp, data := postJSON(t, httpURL+"/api/query", filter, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(data))
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		var events []*event.Event
+		require.NoError(t, json.Unmarshal(data, &events))
+		assert.Len(t, events, 3)
+	})
+
+	t.Run("query as NDJSON", func(t *testing.T) {
+		header := http.Header{"Accept": []string{"application/x-ndjson"}}
+		resp, data := postJSON(t, httpURL+"/api/query", []byte(`[`+string(filter)+`]`), header)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(data))
+		assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		require.Len(t, lines, 3)
+		for _, line := range lines {
+			var evt event.Event
+			require.NoError(t, json.Unmarshal([]byte(line), &evt))
+			assert.Equal(t, kp.PubKeyHex, evt.PubKey)
+		}
+	})
+
+	t.Run("query without matches", func(t *testing.T) {
+		resp, data := postJSON(t, httpURL+"/api/query", []byte(`{"kinds":[30023]}`), nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "[]", strings.TrimSpace(string(data)))
+	})
+
+	t.Run("malformed filter", func(t *testing.T) {
+		resp, _ := postJSON(t, httpURL+"/api/query", []byte(`"nope"`), nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("count", func(t *testing.T) {
+		resp, data := postJSON(t, httpURL+"/api/count", filter, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(data))
+		var count struct {
+			Count int `json:"count"`
+		}
+		require.NoError(t, json.Unmarshal(data, &count))
+		assert.Equal(t, 3, count.Count)
+	})
+
+	t.Run("deletion", func(t *testing.T) {
+		deletion, err := testutil.NewTestEventWithKey(kp, 5, "", [][]string{{"e", published[2].ID}})
+		require.NoError(t, err)
+		status, ok := publishHTTP(t, httpURL, deletion)
+		require.Equal(t, http.StatusOK, status)
+		assert.True(t, ok.Accepted, ok.Message)
+		assert.Equal(t, deletion.ID, ok.ID)
+
+		resp, data := postJSON(t, httpURL+"/api/query", filter, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(data))
+		var events []*event.Event
+		require.NoError(t, json.Unmarshal(data, &events))
+		assert.Len(t, events, 2)
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		resp, err := http.Get(httpURL + "/api/query")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+// readSSE reads the next Server-Sent Event from the stream
+func readSSE(t *testing.T, reader *bufio.Reader) (name, data string) {
+	t.Helper()
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if data != "" || name != "" {
+				return name, data
+			}
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestHTTPAPI_Stream(t *testing.T) {
+	wsURL, _, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	kp := testutil.MustGenerateKeyPair()
+	stored, err := testutil.NewTestEventWithKey(kp, 1, "stored", nil)
+	require.NoError(t, err)
+	status, ok := publishHTTP(t, httpURL, stored)
+	require.Equal(t, http.StatusOK, status, ok.Message)
+
+	filter := url.QueryEscape(`{"authors":["` + kp.PubKeyHex + `"]}`)
+	resp, err := http.Get(httpURL + "/api/stream?filter=" + filter)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	name, data := readSSE(t, reader)
+	assert.Empty(t, name)
+	var evt event.Event
+	require.NoError(t, json.Unmarshal([]byte(data), &evt))
+	assert.Equal(t, stored.ID, evt.ID)
+
+	name, _ = readSSE(t, reader)
+	assert.Equal(t, "eose", name)
+
+	// A live event published over WebSocket reaches the stream through the broadcast path
+	client, err := testutil.NewWSClient(wsURL)
+	require.NoError(t, err)
+	defer client.Close()
+	live := &event.Event{Kind: 1, Content: "live", Tags: [][]string{}, CreatedAt: time.Now().Unix()}
+	require.NoError(t, kp.SignEvent(live))
+	require.NoError(t, client.SendEvent(live))
+	_, _, err = client.ExpectOK(live.ID, 2*time.Second)
+	require.NoError(t, err)
+
+	_, data = readSSE(t, reader)
+	require.NoError(t, json.Unmarshal([]byte(data), &evt))
+	assert.Equal(t, live.ID, evt.ID)
+}
+
+func TestHTTPAPI_AuthPolicy(t *testing.T) {
+	_, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+	r.SetRequireAuth(true)
+
+	kp := testutil.MustGenerateKeyPair()
+	evt, err := testutil.NewTestEventWithKey(kp, 1, "authenticated", nil)
+	require.NoError(t, err)
+	body, err := json.Marshal(evt)
+	require.NoError(t, err)
+
+	resp, data := postJSON(t, httpURL+"/api/event", body, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, string(data), "auth-required:")
+
+	auth, err := testutil.NIP98Header(kp, httpURL+"/api/event", "POST", body)
+	require.NoError(t, err)
+	resp, data = postJSON(t, httpURL+"/api/event", body, http.Header{"Authorization": []string{auth}})
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(data))
+	var ok apiOK
+	require.NoError(t, json.Unmarshal(data, &ok))
+	assert.True(t, ok.Accepted, ok.Message)
+}
+
+func TestHTTPAPI_BlockedKind(t *testing.T) {
+	_, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	admin := testutil.MustGenerateKeyPair()
+	r.SetAdminPubKeys([]string{admin.PubKeyHex})
+	_, rpc := callNIP86(t, httpURL, admin, "disallowkind", 1)
+	require.Empty(t, rpc.Error)
+
+	evt, err := testutil.NewTestEventWithKey(testutil.MustGenerateKeyPair(), 1, "blocked", nil)
+	require.NoError(t, err)
+	status, ok := publishHTTP(t, httpURL, evt)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.False(t, ok.Accepted)
+	assert.Equal(t, "blocked: kind 1 is not allowed", ok.Message)
+}
@@ -0,0 +1,118 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip11"
+	"github.com/paul/glienicke/pkg/relay"
+)
+
+func TestInboxMode(t *testing.T) {
+	forEachStore(t, func(t *testing.T, r *relay.Relay) {
+		r.SetRequireAuth(false)
+		r.SetInboxMode(true)
+		url := serveRelay(t, r)
+
+		alice := testutil.MustGenerateKeyPair()
+		bob := testutil.MustGenerateKeyPair()
+		stranger := testutil.MustGenerateKeyPair()
+		sender, err := testutil.NewWSClient(url)
+		require.NoError(t, err)
+		defer sender.Close()
+
+		// Other events are rejected
+		note, _ := testutil.MustNewTestEvent(1, "hello", nil)
+		accepted, msg := publish(t, sender, note)
+		assert.False(t, accepted)
+		assert.Equal(t, "blocked: this relay only accepts direct messages for its users", msg)
+
+		unaddressed, _ := testutil.MustNewTestEvent(1059, "ciphertext", nil)
+		accepted, msg = publish(t, sender, unaddressed)
+		assert.False(t, accepted)
+		assert.Equal(t, "invalid: gift wraps must be addressed with a p tag", msg)
+
+		toAlice, _ := testutil.MustNewTestEvent(1059, "ciphertext", [][]string{{"p", alice.PubKeyHex}})
+		accepted, msg = publish(t, sender, toAlice)
+		assert.False(t, accepted)
+		assert.Equal(t, "restricted: recipient is not a user of this relay", msg)
+
+		// Registering needs authentication as the author
+		inbox, err := testutil.NewTestEventWithKey(alice, 10050, "", [][]string{{"relay", url}})
+		require.NoError(t, err)
+		accepted, msg = publish(t, sender, inbox)
+		assert.False(t, accepted)
+		assert.Equal(t, "auth-required: authenticate as the author to register with this relay", msg)
+		challenge, err := sender.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "AUTH", challenge[0])
+
+		aliceClient := authedClient(t, url, alice)
+		strangerClient := authedClient(t, url, stranger)
+		profile, err := testutil.NewTestEventWithKey(bob, 0, "{}", nil)
+		require.NoError(t, err)
+		accepted, msg = publish(t, strangerClient, profile)
+		assert.False(t, accepted)
+		assert.Equal(t, "restricted: only users of this relay may publish their metadata", msg)
+
+		accepted, msg = publish(t, aliceClient, inbox)
+		require.True(t, accepted, msg)
+		aliceClient.Close()
+
+		// Registered users receive gift wraps after disconnecting
+		accepted, msg = publish(t, sender, toAlice)
+		assert.True(t, accepted, msg)
+		aliceProfile, err := testutil.NewTestEventWithKey(alice, 0, "{}", nil)
+		require.NoError(t, err)
+		accepted, msg = publish(t, sender, aliceProfile)
+		assert.True(t, accepted, msg)
+
+		// Authenticated connections count as users
+		authedClient(t, url, bob)
+		toBob, _ := testutil.MustNewTestEvent(1059, "ciphertext", [][]string{{"p", bob.PubKeyHex}})
+		accepted, msg = publish(t, sender, toBob)
+		assert.True(t, accepted, msg)
+
+		// Gift wraps are still only served to their recipients
+		require.NoError(t, strangerClient.SendReq("wraps", &event.Filter{Kinds: []int{1059}}))
+		events, err := strangerClient.CollectEvents("wraps", 2*time.Second)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+	})
+}
+
+func TestInboxMode_RelayInformation(t *testing.T) {
+	r := relay.New(memory.New())
+	r.SetRequireAuth(false)
+	r.SetInboxMode(true)
+	r.SetRetentionDays(30)
+	r.SetGiftWrapRetentionDays(7)
+	url := serveRelay(t, r)
+
+	req, err := http.NewRequest("GET", "http"+strings.TrimPrefix(url, "ws"), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/nostr+json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var info nip11.RelayInformationDocument
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	require.NotNil(t, info.Limitation)
+	assert.True(t, info.Limitation.RestrictedWrites)
+
+	// Exempt kinds, gift wraps and everything else
+	require.Len(t, info.Retention, 3)
+	assert.Equal(t, []interface{}{float64(1059)}, info.Retention[1].Kinds)
+	assert.Equal(t, int64(7*24*60*60), *info.Retention[1].Time)
+	assert.Equal(t, int64(30*24*60*60), *info.Retention[2].Time)
+}
@@ -0,0 +1,178 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/relay"
+)
+
+func TestMaxEventSize(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Lowering the limit applies to connected clients too
+	r.SetRateLimits(relay.RateLimits{Enabled: true, MaxEventSize: 1024})
+
+	small, _ := testutil.MustNewTestEvent(1, "fits", nil)
+	require.NoError(t, client.SendEvent(small))
+	accepted, msg, err := client.ExpectOK(small.ID, 2*time.Second)
+	require.NoError(t, err)
+	assert.True(t, accepted, msg)
+
+	large, _ := testutil.MustNewTestEvent(1, strings.Repeat("x", 2048), nil)
+	require.NoError(t, client.SendEvent(large))
+	accepted, msg, err = client.ExpectOK(large.ID, 2*time.Second)
+	require.NoError(t, err)
+	assert.False(t, accepted)
+	assert.Contains(t, msg, "invalid: event too large")
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+
+	r.SetRateLimits(relay.RateLimits{Enabled: true, MaxConnections: 2})
+
+	for i := 0; i < 2; i++ {
+		client, err := testutil.NewWSClient(url)
+		require.NoError(t, err)
+		defer client.Close()
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// Raising the limit at runtime admits the connection
+	r.SetRateLimits(relay.RateLimits{Enabled: true, MaxConnections: 3})
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	client.Close()
+}
+
+func TestConnectionLimits(t *testing.T) {
+	url, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	// The test client connects from loopback, a trusted proxy, so that
+	// X-Forwarded-For picks the client address
+	dial := func(ip string) (*websocket.Conn, *http.Response) {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {ip}})
+		if err != nil {
+			require.NotNil(t, resp, err)
+			return nil, resp
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp
+	}
+	rejected := func(ip string) *http.Response {
+		t.Helper()
+		conn, resp := dial(ip)
+		require.Nil(t, conn, "connection from %s should be rejected", ip)
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+		return resp
+	}
+	accepted := func(ip string) *websocket.Conn {
+		t.Helper()
+		conn, _ := dial(ip)
+		require.NotNil(t, conn, "connection from %s should be accepted", ip)
+		return conn
+	}
+
+	// IPv6 clients share the per-network cap within a /64
+	r.SetRateLimits(relay.RateLimits{MaxConnectionsPerNetwork: 2})
+	accepted("2001:db8::1")
+	accepted("2001:db8::2")
+	rejected("2001:db8::3")
+	accepted("2001:db8:0:1::1")
+
+	var health relay.HealthResponse
+	resp, err := http.Get(httpURL + "/health")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	resp.Body.Close()
+	assert.Equal(t, relay.ConnectionCounts{Total: 3, IPs: 3, Networks: 2, MaxPerIP: 1}, health.Connections)
+	assert.EqualValues(t, 1, health.RejectedConnections)
+
+	// The global cap counts all clients
+	r.SetRateLimits(relay.RateLimits{MaxTotalConnections: 3})
+	rejected("198.51.100.1")
+
+	// Reconnect storms are rate limited per network
+	r.SetRateLimits(relay.RateLimits{Enabled: true, ConnectionsPerSec: 1, Burst: 1})
+	conn := accepted("203.0.113.7")
+	conn.Close()
+	resp = rejected("203.0.113.7")
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	accepted("203.0.113.8")
+}
+
+func TestConnectionLimits_Streams(t *testing.T) {
+	url, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+	r.SetRateLimits(relay.RateLimits{MaxConnections: 1})
+
+	stream := func() *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, httpURL+"/api/stream?filter=%7B%22kinds%22%3A%5B1%5D%7D", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// An open stream takes the IP's only connection slot
+	resp := stream()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = stream()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {"198.51.100.7"}})
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 1, r.ConnectionCounts().Total)
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	url, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	r.SetFeatures(relay.Features{NIP11: false, NIP28: false, NIP42: true})
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	channel, _ := testutil.MustNewTestEvent(KindChannelCreate, `{"name":"chat"}`, nil)
+	require.NoError(t, client.SendEvent(channel))
+	accepted, msg, err := client.ExpectOK(channel.ID, 2*time.Second)
+	require.NoError(t, err)
+	assert.False(t, accepted)
+	assert.Contains(t, msg, "blocked:")
+
+	req, err := http.NewRequest(http.MethodGet, httpURL+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/nostr+json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.NotEqual(t, "application/nostr+json", resp.Header.Get("Content-Type"))
+}
@@ -0,0 +1,75 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scrapeMetrics(t *testing.T, httpURL string) string {
+	t.Helper()
+	resp, err := http.Get(httpURL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestMetrics_Endpoint(t *testing.T) {
+	wsURL, _, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	subscriber, err := testutil.NewWSClient(wsURL)
+	require.NoError(t, err)
+	defer subscriber.Close()
+	require.NoError(t, subscriber.SendReq("live", &event.Filter{Kinds: []int{1}}))
+	require.NoError(t, subscriber.ExpectEOSE("live", 2*time.Second))
+
+	publisher, err := testutil.NewWSClient(wsURL)
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	evt, _ := testutil.MustNewTestEvent(1, "counted", nil)
+	accepted, _ := publish(t, publisher, evt)
+	require.True(t, accepted)
+	_, _, err = publisher.ExpectOK(evt.ID, 2*time.Second) // trailing OK from the protocol layer
+	require.NoError(t, err)
+	accepted, msg := publish(t, publisher, evt)
+	require.True(t, accepted)
+	require.True(t, strings.HasPrefix(msg, "duplicate:"), msg)
+	_, err = subscriber.ExpectEvent("live", 2*time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, publisher.SendCountMessage("c1", &event.Filter{Kinds: []int{1}}))
+	_, err = publisher.ReadMessage()
+	require.NoError(t, err)
+
+	out := scrapeMetrics(t, httpURL)
+	for _, want := range []string{
+		"glienicke_connections_active 2\n",
+		"glienicke_connections_total 2\n",
+		`glienicke_messages_total{type="EVENT"} 2`,
+		`glienicke_messages_total{type="REQ"} 1`,
+		`glienicke_messages_total{type="COUNT"} 1`,
+		`glienicke_events_total{result="accepted",reason="",kind="1"} 1`,
+		`glienicke_events_total{result="accepted",reason="duplicate",kind="1"} 1`,
+		`glienicke_query_duration_seconds_count{type="REQ"} 1`,
+		`glienicke_query_duration_seconds_count{type="COUNT"} 1`,
+		`glienicke_store_operation_duration_seconds_count{op="save_event"} 1`,
+		`glienicke_broadcast_fanout_bucket{le="1"} 1`,
+		"glienicke_outbound_queue_depth 0\n",
+		"glienicke_rate_limited_total 0\n",
+	} {
+		assert.Contains(t, out, want)
+	}
+}
@@ -0,0 +1,240 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/relay"
+)
+
+// report publishes a NIP-56 report of an event by reporter
+func report(t *testing.T, client *testutil.WSClient, reporter *testutil.KeyPair, evt *event.Event, reportType string) {
+	t.Helper()
+	rpt, err := testutil.NewTestEventWithKey(reporter, 1984, "", [][]string{{"e", evt.ID, reportType}, {"p", evt.PubKey}})
+	require.NoError(t, err)
+	accepted, msg := publish(t, client, rpt)
+	require.True(t, accepted, msg)
+}
+
+// visible reports whether an event is served to clients
+func visible(t *testing.T, client *testutil.WSClient, evt *event.Event) bool {
+	t.Helper()
+	require.NoError(t, client.SendReq("visible", &event.Filter{IDs: []string{evt.ID}}))
+	events, err := client.CollectEvents("visible", 2*time.Second)
+	require.NoError(t, err)
+	return len(events) == 1
+}
+
+func TestModeration(t *testing.T) {
+	url, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	admin := testutil.MustGenerateKeyPair()
+	moderator := testutil.MustGenerateKeyPair()
+	trusted1 := testutil.MustGenerateKeyPair()
+	trusted2 := testutil.MustGenerateKeyPair()
+	brigader := testutil.MustGenerateKeyPair()
+	author := testutil.MustGenerateKeyPair()
+	r.SetAdminPubKeys([]string{admin.PubKeyHex})
+	r.SetModeration(relay.ModerationPolicy{
+		Moderators:        []string{moderator.PubKeyHex},
+		TrustedReporters:  []string{trusted1.PubKeyHex, trusted2.PubKeyHex},
+		HideAfter:         2,
+		DeleteTypes:       []string{"illegal", "malware"},
+		TrustedReputation: 1,
+		IgnoreReputation:  1,
+	})
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	t.Run("invalid reports are rejected", func(t *testing.T) {
+		rpt, _ := testutil.MustNewTestEvent(1984, "", [][]string{{"e", "event1", "spam"}})
+		accepted, msg := publish(t, client, rpt)
+		assert.False(t, accepted)
+		assert.Equal(t, "invalid: missing required 'p' tag for reported pubkey", msg)
+
+		rpt, _ = testutil.MustNewTestEvent(1984, "", [][]string{{"p", author.PubKeyHex, "rude"}})
+		accepted, msg = publish(t, client, rpt)
+		assert.False(t, accepted)
+		assert.Equal(t, "invalid: invalid report type: rude", msg)
+	})
+
+	t.Run("events are hidden after reports from trusted reporters", func(t *testing.T) {
+		note, err := testutil.NewTestEventWithKey(author, 1, "controversial", nil)
+		require.NoError(t, err)
+		accepted, msg := publish(t, client, note)
+		require.True(t, accepted, msg)
+
+		// Untrusted reports are queued but do not count
+		report(t, client, brigader, note, "spam")
+		report(t, client, trusted1, note, "spam")
+		assert.True(t, visible(t, client, note))
+		report(t, client, trusted2, note, "profanity")
+		assert.False(t, visible(t, client, note))
+
+		_, resp := callNIP86(t, httpURL, admin, "listeventsneedingmoderation")
+		require.Empty(t, resp.Error)
+		var pending []struct {
+			ID     string `json:"id"`
+			Reason string `json:"reason"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Result, &pending))
+		require.Len(t, pending, 1)
+		assert.Equal(t, note.ID, pending[0].ID)
+		assert.Equal(t, "3 reports: spam (2), profanity (1)", pending[0].Reason)
+
+		_, resp = callNIP86(t, httpURL, admin, "listreports")
+		require.Empty(t, resp.Error)
+		var queue []relay.ModerationItem
+		require.NoError(t, json.Unmarshal(resp.Result, &queue))
+		require.Len(t, queue, 1)
+		assert.Equal(t, "event", queue[0].Type)
+		assert.Equal(t, 3, queue[0].Reports)
+		assert.Equal(t, 2, queue[0].Trusted)
+		assert.True(t, queue[0].Hidden)
+
+		// Clearing the event shows it again and counts against the reporters
+		_, resp = callNIP86(t, httpURL, admin, "allowevent", note.ID)
+		require.Empty(t, resp.Error)
+		assert.True(t, visible(t, client, note))
+		assert.Empty(t, r.ModerationQueue())
+
+		// Cleared events are not hidden again
+		report(t, client, trusted1, note, "spam")
+		report(t, client, trusted2, note, "spam")
+		assert.True(t, visible(t, client, note))
+		require.NoError(t, r.ResolveReports(context.Background(), "event", note.ID, false, ""))
+	})
+
+	t.Run("reporters with dismissed reports are ignored", func(t *testing.T) {
+		note, err := testutil.NewTestEventWithKey(author, 1, "another note", nil)
+		require.NoError(t, err)
+		accepted, msg := publish(t, client, note)
+		require.True(t, accepted, msg)
+
+		report(t, client, brigader, note, "spam")
+		assert.Empty(t, r.ModerationQueue())
+
+		_, resp := callNIP86(t, httpURL, admin, "listreporters")
+		require.Empty(t, resp.Error)
+		var reporters []relay.ReporterReputation
+		require.NoError(t, json.Unmarshal(resp.Result, &reporters))
+		for _, rep := range reporters {
+			if rep.PubKey == brigader.PubKeyHex {
+				assert.Equal(t, 1, rep.Dismissed)
+				assert.True(t, rep.Ignored)
+			}
+		}
+	})
+
+	t.Run("upheld reports earn trust", func(t *testing.T) {
+		reporter := testutil.MustGenerateKeyPair()
+		spammer := testutil.MustGenerateKeyPair()
+		rpt, err := testutil.NewTestEventWithKey(reporter, 1984, "", [][]string{{"p", spammer.PubKeyHex, "spam"}})
+		require.NoError(t, err)
+		accepted, msg := publish(t, client, rpt)
+		require.True(t, accepted, msg)
+
+		_, resp := callNIP86(t, httpURL, admin, "resolvereports", "pubkey", spammer.PubKeyHex, "uphold", "spam")
+		require.Empty(t, resp.Error)
+		evt, _ := testutil.NewTestEventWithKey(spammer, 1, "buy now", nil)
+		accepted, msg = publish(t, client, evt)
+		assert.False(t, accepted)
+		assert.Equal(t, "blocked: pubkey is banned", msg)
+
+		for _, rep := range r.ReporterReputations() {
+			if rep.PubKey == reporter.PubKeyHex {
+				assert.Equal(t, 1, rep.Upheld)
+				assert.True(t, rep.Trusted)
+			}
+		}
+
+		_, resp = callNIP86(t, httpURL, admin, "resolvereports", "pubkey", spammer.PubKeyHex, "uphold")
+		assert.Contains(t, resp.Error, "no reports")
+	})
+
+	t.Run("moderator reports of illegal content delete it", func(t *testing.T) {
+		note, err := testutil.NewTestEventWithKey(author, 1, "illegal content", nil)
+		require.NoError(t, err)
+		accepted, msg := publish(t, client, note)
+		require.True(t, accepted, msg)
+
+		report(t, client, moderator, note, "illegal")
+		assert.False(t, visible(t, client, note))
+		assert.Empty(t, r.ModerationQueue())
+
+		accepted, msg = publish(t, client, note)
+		assert.False(t, accepted)
+		assert.Equal(t, "blocked: event is banned", msg)
+
+		// Other report types from moderators are queued for review
+		other, err := testutil.NewTestEventWithKey(author, 1, "rude content", nil)
+		require.NoError(t, err)
+		accepted, msg = publish(t, client, other)
+		require.True(t, accepted, msg)
+		report(t, client, moderator, other, "profanity")
+		assert.True(t, visible(t, client, other))
+		assert.Len(t, r.ModerationQueue(), 1)
+	})
+
+	t.Run("reports from untrusted reporters are capped", func(t *testing.T) {
+		r.SetRateLimits(relay.RateLimits{})
+		r.SetModeration(relay.ModerationPolicy{
+			TrustedReporters:      []string{trusted1.PubKeyHex},
+			MaxReportsPerTarget:   2,
+			MaxReportsPerReporter: 2,
+			MaxQueuedReports:      6,
+		})
+		reports := func(evt *event.Event) int {
+			for _, item := range r.ModerationQueue() {
+				if item.Target == evt.ID {
+					return item.Reports
+				}
+			}
+			return 0
+		}
+		notes := 0
+		newNote := func() *event.Event {
+			notes++
+			note, err := testutil.NewTestEventWithKey(author, 1, fmt.Sprintf("popular target %d", notes), nil)
+			require.NoError(t, err)
+			accepted, msg := publish(t, client, note)
+			require.True(t, accepted, msg)
+			return note
+		}
+
+		// Per target, trusted reporters are still heard
+		note := newNote()
+		for i := 0; i < 3; i++ {
+			report(t, client, testutil.MustGenerateKeyPair(), note, "spam")
+		}
+		assert.Equal(t, 2, reports(note))
+		report(t, client, trusted1, note, "spam")
+		assert.Equal(t, 3, reports(note))
+
+		// Per reporter
+		spammer := testutil.MustGenerateKeyPair()
+		targets := []*event.Event{newNote(), newNote(), newNote()}
+		for _, target := range targets {
+			report(t, client, spammer, target, "spam")
+		}
+		assert.Equal(t, 1, reports(targets[0]))
+		assert.Equal(t, 1, reports(targets[1]))
+		assert.Equal(t, 0, reports(targets[2]))
+
+		// In the whole queue, which now holds 6 reports
+		last := newNote()
+		report(t, client, testutil.MustGenerateKeyPair(), last, "spam")
+		assert.Equal(t, 0, reports(last))
+	})
+}
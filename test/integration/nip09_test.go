@@ -42,9 +42,9 @@ func TestNIP09_EventDeletion(t *testing.T) {
 	// Send the deletion event
 	err = client.SendEvent(delEvt)
 	assert.NoError(t, err)
-
-	// Give the relay a moment to process the deletion
-	time.Sleep(50 * time.Millisecond)
+	accepted, msg, err = client.ExpectOK(delEvt.ID, 2*time.Second)
+	assert.NoError(t, err)
+	assert.True(t, accepted, msg)
 
 	// Now, try to subscribe to the original event
 	filter := &event.Filter{
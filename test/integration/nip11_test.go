@@ -7,13 +7,17 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/paul/glienicke/pkg/nips/nip11"
+	"github.com/paul/glienicke/pkg/protocol"
 	"github.com/paul/glienicke/pkg/relay"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNIP11_RelayInformationDocument(t *testing.T) {
-	wsURL, _, cleanup, _ := setupRelay(t)
+	wsURL, r, cleanup, _ := setupRelay(t)
 	defer cleanup()
+	r.SetRateLimits(relay.RateLimits{MaxEventSize: 4096})
 
 	httpURL := strings.Replace(wsURL, "ws://", "http://", 1)
 
@@ -45,6 +49,107 @@ func TestNIP11_RelayInformationDocument(t *testing.T) {
 	supportedNIPs, ok := infoDoc["supported_nips"].([]interface{})
 	assert.True(t, ok)
 
-	expectedNIPs := []float64{1, 2, 4, 9, 11, 17, 22, 25, 40, 42, 44, 45, 50, 59, 62, 65}
+	expectedNIPs := []float64{1, 2, 4, 9, 11, 17, 22, 25, 28, 40, 42, 44, 45, 50, 59, 62, 65, 70, 98}
 	assert.ElementsMatch(t, expectedNIPs, supportedNIPs)
+
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	limitation, ok := infoDoc["limitation"].(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, float64(protocol.MaxSubscriptionsPerClient), limitation["max_subscriptions"])
+	assert.Equal(t, false, limitation["auth_required"])
+	assert.Equal(t, float64(4096), limitation["max_message_length"])
+	assert.Equal(t, float64(4096), limitation["max_content_length"])
+
+	// Default 30-day retention, with replaceable lists kept indefinitely
+	retention, ok := infoDoc["retention"].([]interface{})
+	require.True(t, ok)
+	require.Len(t, retention, 2)
+	assert.Nil(t, retention[0].(map[string]interface{})["time"])
+	assert.Equal(t, float64(30*24*60*60), retention[1].(map[string]interface{})["time"])
+}
+
+func TestNIP11_AcceptHeaderWithOtherTypes(t *testing.T) {
+	_, _, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	for _, accept := range []string{
+		"application/nostr+json, application/json",
+		"text/html;q=0.9, application/nostr+json;q=0.8",
+		"Application/Nostr+JSON",
+	} {
+		req, err := http.NewRequest("GET", httpURL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "application/nostr+json", resp.Header.Get("Content-Type"), accept)
+	}
+}
+
+func TestNIP11_CORSPreflight(t *testing.T) {
+	_, _, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	req, err := http.NewRequest("OPTIONS", httpURL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://client.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Accept")
+}
+
+func TestNIP11_ConfiguredDocument(t *testing.T) {
+	_, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	day := int64(86400)
+	r.SetInfo(&nip11.RelayInformationDocument{
+		Name:           "Configured Relay",
+		Banner:         "https://relay.example.com/banner.png",
+		Self:           "0000000000000000000000000000000000000000000000000000000000000001",
+		TermsOfService: "https://relay.example.com/tos",
+		PostingPolicy:  "https://relay.example.com/policy",
+		RelayCountries: []string{"DE"},
+		LanguageTags:   []string{"de", "en"},
+		Retention:      []nip11.Retention{{Kinds: []interface{}{1}, Time: &day}},
+		Fees:           &nip11.Fees{Admission: []nip11.Fee{{Amount: 1000, Unit: "sats"}}},
+		Limitation:     &nip11.RelayLimitation{PaymentRequired: true},
+	})
+	r.SetRequireAuth(true)
+	r.SetMaxEventsPerREQ(250)
+	r.SetRetentionDays(0) // the configured retention is only advertised without enforced retention
+
+	req, err := http.NewRequest("GET", httpURL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/nostr+json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var info nip11.RelayInformationDocument
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, "Configured Relay", info.Name)
+	assert.Equal(t, "Glienicke - a Nostr relay written in Go", info.Description)
+	assert.Equal(t, "https://relay.example.com/banner.png", info.Banner)
+	assert.Equal(t, "https://relay.example.com/tos", info.TermsOfService)
+	assert.Equal(t, "https://relay.example.com/policy", info.PostingPolicy)
+	assert.Equal(t, []string{"DE"}, info.RelayCountries)
+	assert.Equal(t, []string{"de", "en"}, info.LanguageTags)
+	require.Len(t, info.Retention, 1)
+	assert.Equal(t, day, *info.Retention[0].Time)
+	require.NotNil(t, info.Fees)
+	assert.Equal(t, 1000, info.Fees.Admission[0].Amount)
+
+	require.NotNil(t, info.Limitation)
+	assert.True(t, info.Limitation.PaymentRequired)
+	assert.True(t, info.Limitation.AuthRequired)
+	assert.True(t, info.Limitation.RestrictedWrites)
+	assert.Equal(t, 250, info.Limitation.MaxLimit)
 }
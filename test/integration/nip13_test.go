@@ -0,0 +1,87 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip13"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// minePoW returns a signed kind 1 event whose ID has at least the given difficulty.
+func minePoW(t *testing.T, kp *testutil.KeyPair, difficulty int) *event.Event {
+	t.Helper()
+	evt := &event.Event{Kind: 1, Content: "mined note", CreatedAt: time.Now().Unix(), PubKey: kp.PubKeyHex}
+	for nonce := 0; ; nonce++ {
+		evt.Tags = [][]string{{"nonce", strconv.Itoa(nonce), strconv.Itoa(difficulty)}}
+		id, err := evt.ComputeID()
+		require.NoError(t, err)
+		if d, _ := nip13.Difficulty(id); d >= difficulty {
+			break
+		}
+	}
+	require.NoError(t, kp.SignEvent(evt))
+	return evt
+}
+
+func TestNIP13_ProofOfWork(t *testing.T) {
+	url, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+	r.SetPoWPolicy(&nip13.Policy{MinDifficulty: 8})
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	kp := testutil.MustGenerateKeyPair()
+
+	t.Run("event without work is rejected", func(t *testing.T) {
+		evt, err := testutil.NewTestEventWithKey(kp, 1, "cheap spam", nil)
+		require.NoError(t, err)
+		for d, _ := nip13.Difficulty(evt.ID); d >= 8; d, _ = nip13.Difficulty(evt.ID) {
+			evt.Content += "."
+			require.NoError(t, kp.SignEvent(evt))
+		}
+
+		require.NoError(t, client.SendEvent(evt))
+		accepted, msg, err := client.ExpectOK(evt.ID, 2*time.Second)
+		require.NoError(t, err)
+		assert.False(t, accepted)
+		assert.True(t, strings.HasPrefix(msg, "pow:"), "unexpected reason: %s", msg)
+	})
+
+	t.Run("mined event is accepted", func(t *testing.T) {
+		evt := minePoW(t, kp, 8)
+
+		require.NoError(t, client.SendEvent(evt))
+		accepted, msg, err := client.ExpectOK(evt.ID, 2*time.Second)
+		require.NoError(t, err)
+		assert.True(t, accepted, msg)
+	})
+
+	t.Run("NIP-11 advertises min_pow_difficulty", func(t *testing.T) {
+		req, err := http.NewRequest("GET", httpURL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/nostr+json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var info struct {
+			SupportedNIPs []int `json:"supported_nips"`
+			Limitation    struct {
+				MinPowDifficulty int `json:"min_pow_difficulty"`
+			} `json:"limitation"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+		assert.Equal(t, 8, info.Limitation.MinPowDifficulty)
+		assert.Contains(t, info.SupportedNIPs, 13)
+	})
+}
@@ -0,0 +1,136 @@
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip29"
+	"github.com/paul/glienicke/pkg/relay"
+)
+
+// serveGroups starts a relay with NIP-29 groups on the given store
+func serveGroups(t *testing.T, store *memory.Store) (string, *relay.Relay) {
+	t.Helper()
+	r := relay.New(store)
+	r.SetRequireAuth(false)
+	require.NoError(t, r.EnableGroups(context.Background(), ""))
+	return serveRelay(t, r), r
+}
+
+// publishGroup sends a group event and returns the OK result
+func publishGroup(t *testing.T, client *testutil.WSClient, kp *testutil.KeyPair, kind int, group string, tags ...[]string) (*event.Event, bool, string) {
+	t.Helper()
+	evt := &event.Event{
+		Kind:      kind,
+		CreatedAt: time.Now().Unix(),
+		Tags:      append([][]string{{"h", group}}, tags...),
+	}
+	require.NoError(t, kp.SignEvent(evt))
+	require.NoError(t, client.SendEvent(evt))
+	accepted, msg, err := client.ExpectOK(evt.ID, 2*time.Second)
+	require.NoError(t, err)
+	return evt, accepted, msg
+}
+
+func TestNIP29_GroupLifecycle(t *testing.T) {
+	store := memory.New()
+	url, r := serveGroups(t, store)
+	admin := testutil.MustGenerateKeyPair()
+	user := testutil.MustGenerateKeyPair()
+	adminClient := authedClient(t, url, admin)
+	userClient := authedClient(t, url, user)
+
+	_, accepted, msg := publishGroup(t, adminClient, admin, nip29.KindCreateGroup, "dev", []string{"name", "Developers"})
+	require.True(t, accepted, msg)
+
+	// The relay publishes the group metadata under its own key
+	require.NoError(t, userClient.SendReq("meta", &event.Filter{
+		Kinds: []int{nip29.KindGroupMetadata},
+		Tags:  map[string][]string{"d": {"dev"}},
+	}))
+	events, err := userClient.CollectEvents("meta", 2*time.Second)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, r.GroupsPubKey(), events[0].PubKey)
+	assert.Contains(t, events[0].Tags, []string{"name", "Developers"})
+
+	// Nobody else may publish group state
+	forged, _ := testutil.MustNewTestEvent(nip29.KindGroupMetadata, "", [][]string{{"d", "dev"}})
+	require.NoError(t, userClient.SendEvent(forged))
+	accepted, msg, err = userClient.ExpectOK(forged.ID, 2*time.Second)
+	require.NoError(t, err)
+	assert.False(t, accepted)
+	assert.Contains(t, msg, "restricted:")
+
+	// Non-members cannot post until they join the open group
+	_, accepted, msg = publishGroup(t, userClient, user, 9, "dev")
+	assert.False(t, accepted)
+	assert.Equal(t, "restricted: not a member of this group", msg)
+
+	_, accepted, msg = publishGroup(t, userClient, user, nip29.KindJoinRequest, "dev")
+	require.True(t, accepted, msg)
+	post, accepted, msg := publishGroup(t, userClient, user, 9, "dev")
+	require.True(t, accepted, msg)
+
+	// Admins delete messages with kind 9005
+	_, accepted, msg = publishGroup(t, adminClient, admin, nip29.KindDeleteEvent, "dev", []string{"e", post.ID})
+	require.True(t, accepted, msg)
+	_, err = store.GetEvent(context.Background(), post.ID)
+	assert.Error(t, err)
+
+	// Private groups need authenticated members to read
+	_, accepted, msg = publishGroup(t, adminClient, admin, nip29.KindEditMetadata, "dev", []string{"private"})
+	require.True(t, accepted, msg)
+	anonymous, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer anonymous.Close()
+	require.NoError(t, anonymous.SendReq("private", &event.Filter{Tags: map[string][]string{"h": {"dev"}}}))
+	reason, err := anonymous.ExpectClosed("private", 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "auth-required: this group is private", reason)
+
+	require.NoError(t, userClient.SendReq("private", &event.Filter{Tags: map[string][]string{"h": {"dev"}}}))
+	events, err = userClient.CollectEvents("private", 2*time.Second)
+	require.NoError(t, err)
+	assert.NotEmpty(t, events)
+}
+
+func TestNIP29_StateRebuiltOnStartup(t *testing.T) {
+	store := memory.New()
+	url, r := serveGroups(t, store)
+	admin := testutil.MustGenerateKeyPair()
+	member := testutil.MustGenerateKeyPair()
+	client := authedClient(t, url, admin)
+
+	_, accepted, msg := publishGroup(t, client, admin, nip29.KindCreateGroup, "ops", []string{"closed"})
+	require.True(t, accepted, msg)
+	_, accepted, msg = publishGroup(t, client, admin, nip29.KindPutUser, "ops", []string{"p", member.PubKeyHex, nip29.RoleModerator})
+	require.True(t, accepted, msg)
+	pubKey := r.GroupsPubKey()
+
+	// A new relay on the same store keeps its key and the group roles
+	url, r = serveGroups(t, store)
+	assert.Equal(t, pubKey, r.GroupsPubKey())
+	client = authedClient(t, url, member)
+	_, accepted, msg = publishGroup(t, client, member, 9, "ops")
+	assert.True(t, accepted, msg)
+	_, accepted, msg = publishGroup(t, client, member, nip29.KindCreateGroup, "ops")
+	assert.False(t, accepted)
+	assert.Equal(t, "duplicate: group already exists", msg)
+
+	require.NoError(t, client.SendReq("admins", &event.Filter{
+		Kinds: []int{nip29.KindGroupAdmins},
+		Tags:  map[string][]string{"d": {"ops"}},
+	}))
+	events, err := client.CollectEvents("admins", 2*time.Second)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Contains(t, events[0].Tags, []string{"p", member.PubKeyHex, nip29.RoleModerator})
+}
@@ -63,6 +63,9 @@ func TestNIP44_EncryptedEvent(t *testing.T) {
 	assert.NoError(t, err, "Failed to create receiver WebSocket client")
 	defer receiverClient.Close()
 
+	// Direct messages are only served to their authenticated recipient
+	authenticate(t, receiverClient, receiverSecretKey)
+
 	nostrFilter := nostr.Filter{
 		Kinds: []int{nostr.KindEncryptedDirectMessage},
 		Tags:  nostr.TagMap{"p": []string{receiverPublicKey}},
@@ -7,6 +7,7 @@ import (
 	"github.com/paul/glienicke/internal/testutil"
 	"github.com/paul/glienicke/pkg/event"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -83,3 +84,57 @@ func TestNIP45_EventCounts_ReactionCounting(t *testing.T) {
 	// Wait a bit to allow the COUNT response to be processed
 	time.Sleep(50 * time.Millisecond)
 }
+
+// expectCount waits for a COUNT response with the given ID and returns its payload.
+func expectCount(t *testing.T, client *testutil.WSClient, countID string) map[string]interface{} {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer client.SetReadDeadline(time.Time{})
+
+	for {
+		msg, err := client.ReadMessage()
+		require.NoError(t, err)
+		if len(msg) >= 3 && msg[0] == "COUNT" && msg[1] == countID {
+			payload, ok := msg[2].(map[string]interface{})
+			require.True(t, ok, "COUNT payload must be an object")
+			return payload
+		}
+	}
+}
+
+func TestNIP45_EventCounts_HyperLogLog(t *testing.T) {
+	url, _, cleanup, _ := setupRelay(t)
+	defer cleanup()
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	target := testutil.MustGenerateKeyPair()
+
+	// Three different users follow the target
+	for i := 0; i < 3; i++ {
+		follow, _ := testutil.MustNewTestEvent(3, "", [][]string{{"p", target.PubKeyHex}})
+		require.NoError(t, client.SendEvent(follow))
+		accepted, msg, err := client.ExpectOK(follow.ID, 2*time.Second)
+		require.NoError(t, err)
+		require.True(t, accepted, msg)
+	}
+
+	require.NoError(t, client.SendCountMessage("followers", &event.Filter{
+		Kinds: []int{3},
+		Tags:  map[string][]string{"p": {target.PubKeyHex}},
+	}))
+	payload := expectCount(t, client, "followers")
+
+	assert.Equal(t, float64(3), payload["count"])
+	assert.Nil(t, payload["approximate"], "small sets are counted exactly")
+	hll, ok := payload["hll"].(string)
+	require.True(t, ok, "follower counts must carry hll registers")
+	assert.Len(t, hll, 512)
+
+	// Filters outside the NIP-45 HLL cases get a plain count
+	require.NoError(t, client.SendCountMessage("notes", &event.Filter{Kinds: []int{1}}))
+	payload = expectCount(t, client, "notes")
+	assert.Nil(t, payload["hll"])
+}
@@ -109,6 +109,9 @@ func TestNIP59_GiftWrapEvent(t *testing.T) {
 	assert.NoError(t, err, "Failed to create receiver WebSocket client")
 	defer receiverClient.Close()
 
+	// Gift wraps are only served to their authenticated recipient
+	authenticate(t, receiverClient, receiverSecretKey)
+
 	nostrFilter := nostr.Filter{
 		Kinds: []int{1059},
 		Tags:  nostr.TagMap{"p": []string{receiverPublicKey}},
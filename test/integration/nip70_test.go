@@ -0,0 +1,113 @@
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/relay"
+)
+
+func TestNIP70_ProtectedEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, r *relay.Relay) {
+		r.SetRequireAuth(false)
+		url := serveRelay(t, r)
+		author := testutil.MustGenerateKeyPair()
+		protected, err := testutil.NewTestEventWithKey(author, 1, "not for rebroadcast", [][]string{{"-"}})
+		require.NoError(t, err)
+
+		client, err := testutil.NewWSClient(url)
+		require.NoError(t, err)
+		defer client.Close()
+
+		// Unauthenticated clients are asked to authenticate
+		require.NoError(t, client.SendEvent(protected))
+		accepted, msg, err := client.ExpectOK(protected.ID, 2*time.Second)
+		require.NoError(t, err)
+		assert.False(t, accepted)
+		assert.Equal(t, "auth-required: this event may only be published by its author", msg)
+		challenge, err := client.ReadMessage()
+		require.NoError(t, err)
+		require.Len(t, challenge, 2)
+		require.Equal(t, "AUTH", challenge[0])
+
+		// Someone else authenticated cannot rebroadcast it
+		other := testutil.MustGenerateKeyPair()
+		auth, err := testutil.NewTestEventWithKey(other, 22242, challenge[1].(string), nil)
+		require.NoError(t, err)
+		require.NoError(t, client.SendEvent(auth))
+		accepted, msg, err = client.ExpectOK(auth.ID, 2*time.Second)
+		require.NoError(t, err)
+		require.True(t, accepted, msg)
+
+		require.NoError(t, client.SendEvent(protected))
+		accepted, msg, err = client.ExpectOK(protected.ID, 2*time.Second)
+		require.NoError(t, err)
+		assert.False(t, accepted)
+		assert.Equal(t, "restricted: this event may only be published by its author", msg)
+
+		// The author publishes it once authenticated against the challenge
+		authorClient, err := testutil.NewWSClient(url)
+		require.NoError(t, err)
+		defer authorClient.Close()
+		require.NoError(t, authorClient.SendEvent(protected))
+		_, _, err = authorClient.ExpectOK(protected.ID, 2*time.Second)
+		require.NoError(t, err)
+		challenge, err = authorClient.ReadMessage()
+		require.NoError(t, err)
+
+		replayed, err := testutil.NewTestEventWithKey(author, 22242, "another relay's challenge", nil)
+		require.NoError(t, err)
+		require.NoError(t, authorClient.SendEvent(replayed))
+		accepted, msg, err = authorClient.ExpectOK(replayed.ID, 2*time.Second)
+		require.NoError(t, err)
+		assert.False(t, accepted)
+		assert.Contains(t, msg, "challenge mismatch")
+
+		auth, err = testutil.NewTestEventWithKey(author, 22242, challenge[1].(string), nil)
+		require.NoError(t, err)
+		require.NoError(t, authorClient.SendEvent(auth))
+		accepted, msg, err = authorClient.ExpectOK(auth.ID, 2*time.Second)
+		require.NoError(t, err)
+		require.True(t, accepted, msg)
+
+		require.NoError(t, authorClient.SendEvent(protected))
+		accepted, msg, err = authorClient.ExpectOK(protected.ID, 2*time.Second)
+		require.NoError(t, err)
+		assert.True(t, accepted, msg)
+
+		require.NoError(t, client.SendReq("protected", &event.Filter{IDs: []string{protected.ID}}))
+		events, err := client.CollectEvents("protected", 2*time.Second)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Contains(t, events[0].Tags, []string{"-"})
+
+		// Events without the tag are unaffected
+		public, _ := testutil.MustNewTestEvent(1, "rebroadcast me", [][]string{{"t", "-"}})
+		require.NoError(t, client.SendEvent(public))
+		accepted, msg, err = client.ExpectOK(public.ID, 2*time.Second)
+		require.NoError(t, err)
+		assert.True(t, accepted, msg)
+	})
+}
+
+func TestNIP70_AuthDisabled(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+	r.SetFeatures(relay.Features{NIP11: true, NIP28: true, NIP42: false})
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	protected, _ := testutil.MustNewTestEvent(1, "protected", [][]string{{"-"}})
+	require.NoError(t, client.SendEvent(protected))
+	accepted, msg, err := client.ExpectOK(protected.ID, 2*time.Second)
+	require.NoError(t, err)
+	assert.False(t, accepted)
+	assert.Contains(t, msg, "blocked:")
+}
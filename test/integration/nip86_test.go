@@ -0,0 +1,251 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/nips/nip98"
+	"github.com/paul/glienicke/pkg/relay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nip86Response struct {
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// callNIP86 sends a NIP-86 request signed by kp and returns the HTTP status and response
+func callNIP86(t *testing.T, httpURL string, kp *testutil.KeyPair, method string, params ...interface{}) (int, nip86Response) {
+	t.Helper()
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"method": method, "params": params})
+	require.NoError(t, err)
+
+	url := httpURL + "/"
+	auth, err := testutil.NIP98Header(kp, url, "POST", body)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", auth)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var out nip86Response
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	return resp.StatusCode, out
+}
+
+func publish(t *testing.T, client *testutil.WSClient, evt *event.Event) (bool, string) {
+	t.Helper()
+	require.NoError(t, client.SendEvent(evt))
+	accepted, msg, err := client.ExpectOK(evt.ID, 2*time.Second)
+	require.NoError(t, err)
+	return accepted, msg
+}
+
+func TestNIP86_Management(t *testing.T) {
+	url, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	admin := testutil.MustGenerateKeyPair()
+	r.SetAdminPubKeys([]string{admin.PubKeyHex})
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	t.Run("non-admin is rejected", func(t *testing.T) {
+		status, resp := callNIP86(t, httpURL, testutil.MustGenerateKeyPair(), "supportedmethods")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.NotEmpty(t, resp.Error)
+	})
+
+	t.Run("supportedmethods", func(t *testing.T) {
+		status, resp := callNIP86(t, httpURL, admin, "supportedmethods")
+		require.Equal(t, http.StatusOK, status)
+		var methods []string
+		require.NoError(t, json.Unmarshal(resp.Result, &methods))
+		assert.Contains(t, methods, "banpubkey")
+		assert.Contains(t, methods, "changerelayname")
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		status, resp := callNIP86(t, httpURL, admin, "nosuchmethod")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, resp.Error, "unsupported method")
+	})
+
+	t.Run("banpubkey and allowpubkey", func(t *testing.T) {
+		spammer := testutil.MustGenerateKeyPair()
+		_, resp := callNIP86(t, httpURL, admin, "banpubkey", spammer.PubKeyHex, "spam")
+		require.Empty(t, resp.Error)
+
+		evt, _ := testutil.NewTestEventWithKey(spammer, 1, "buy now", nil)
+		accepted, msg := publish(t, client, evt)
+		assert.False(t, accepted)
+		assert.Equal(t, "blocked: pubkey is banned", msg)
+
+		_, resp = callNIP86(t, httpURL, admin, "listbannedpubkeys")
+		var banned []struct {
+			PubKey string `json:"pubkey"`
+			Reason string `json:"reason"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Result, &banned))
+		require.Len(t, banned, 1)
+		assert.Equal(t, spammer.PubKeyHex, banned[0].PubKey)
+		assert.Equal(t, "spam", banned[0].Reason)
+
+		_, resp = callNIP86(t, httpURL, admin, "allowpubkey", spammer.PubKeyHex)
+		require.Empty(t, resp.Error)
+		accepted, msg = publish(t, client, evt)
+		assert.True(t, accepted, msg)
+	})
+
+	t.Run("banevent hides stored event", func(t *testing.T) {
+		kp := testutil.MustGenerateKeyPair()
+		evt, _ := testutil.NewTestEventWithKey(kp, 1, "to be banned", nil)
+		accepted, msg := publish(t, client, evt)
+		require.True(t, accepted, msg)
+
+		_, resp := callNIP86(t, httpURL, admin, "banevent", evt.ID, "illegal")
+		require.Empty(t, resp.Error)
+
+		require.NoError(t, client.SendReq("banned", &event.Filter{Authors: []string{kp.PubKeyHex}}))
+		events, err := client.CollectEvents("banned", 2*time.Second)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+
+		_, resp = callNIP86(t, httpURL, admin, "allowevent", evt.ID)
+		require.Empty(t, resp.Error)
+		require.NoError(t, client.SendReq("allowed", &event.Filter{Authors: []string{kp.PubKeyHex}}))
+		events, err = client.CollectEvents("allowed", 2*time.Second)
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+	})
+
+	t.Run("allowkind and disallowkind", func(t *testing.T) {
+		kp := testutil.MustGenerateKeyPair()
+
+		_, resp := callNIP86(t, httpURL, admin, "disallowkind", 7)
+		require.Empty(t, resp.Error)
+		reaction, _ := testutil.NewTestEventWithKey(kp, 7, "+", [][]string{{"e", "0000000000000000000000000000000000000000000000000000000000000001"}})
+		accepted, msg := publish(t, client, reaction)
+		assert.False(t, accepted)
+		assert.Equal(t, "blocked: kind 7 is not allowed", msg)
+
+		// Allowing a kind switches to an allow list
+		_, resp = callNIP86(t, httpURL, admin, "allowkind", 1)
+		require.Empty(t, resp.Error)
+		note, _ := testutil.NewTestEventWithKey(kp, 1, "still allowed", nil)
+		accepted, msg = publish(t, client, note)
+		assert.True(t, accepted, msg)
+		metadata, _ := testutil.NewTestEventWithKey(kp, 0, "{}", nil)
+		accepted, _ = publish(t, client, metadata)
+		assert.False(t, accepted)
+
+		callNIP86(t, httpURL, admin, "disallowkind", 1)
+	})
+
+	t.Run("blockip", func(t *testing.T) {
+		_, resp := callNIP86(t, httpURL, admin, "blockip", "127.0.0.1", "abuse")
+		require.Empty(t, resp.Error)
+		_, err := testutil.NewWSClient(url)
+		assert.Error(t, err, "blocked IP should not be able to connect")
+
+		_, resp = callNIP86(t, httpURL, admin, "unblockip", "127.0.0.1")
+		require.Empty(t, resp.Error)
+		c, err := testutil.NewWSClient(url)
+		require.NoError(t, err)
+		c.Close()
+	})
+
+	t.Run("changerelayname", func(t *testing.T) {
+		_, resp := callNIP86(t, httpURL, admin, "changerelayname", "Renamed Relay")
+		require.Empty(t, resp.Error)
+
+		req, err := http.NewRequest("GET", httpURL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/nostr+json")
+		httpResp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer httpResp.Body.Close()
+
+		var info struct {
+			Name          string `json:"name"`
+			SupportedNIPs []int  `json:"supported_nips"`
+		}
+		require.NoError(t, json.NewDecoder(httpResp.Body).Decode(&info))
+		assert.Equal(t, "Renamed Relay", info.Name)
+		assert.Contains(t, info.SupportedNIPs, 86)
+	})
+}
+
+func TestNIP86_StatePersistsInStore(t *testing.T) {
+	store := memory.New()
+	r := relay.New(store)
+	defer r.Close()
+
+	admin := testutil.MustGenerateKeyPair()
+	r.SetAdminPubKeys([]string{admin.PubKeyHex})
+
+	spammer := testutil.MustGenerateKeyPair()
+	body, _ := json.Marshal(map[string]interface{}{"method": "banpubkey", "params": []string{spammer.PubKeyHex}})
+	auth, err := testutil.NIP98Header(admin, "http://relay.test/", "POST", body)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("POST", "http://relay.test/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", auth)
+	rec := httptest.NewRecorder()
+	r.GetMux().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	entries, err := store.ListEntries(req.Context(), "banned_pubkeys")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, spammer.PubKeyHex, entries[0].Value)
+}
+
+func TestNIP98_HandleAuthenticated(t *testing.T) {
+	_, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+
+	r.HandleAuthenticated("/whoami", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pubkey, _ := nip98.PubKeyFromContext(req.Context())
+		w.Write([]byte(pubkey))
+	}))
+
+	kp := testutil.MustGenerateKeyPair()
+	auth, err := testutil.NIP98Header(kp, httpURL+"/whoami", "GET", nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", httpURL+"/whoami", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", auth)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, kp.PubKeyHex, string(body))
+
+	resp, err = http.Get(httpURL + "/whoami")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,90 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/pkg/relay"
+)
+
+// denyIP makes ip unable to read or write
+func denyIP(t *testing.T, r *relay.Relay, ip string) {
+	t.Helper()
+	for _, dir := range []relay.ACLDirection{relay.ACLRead, relay.ACLWrite} {
+		require.NoError(t, r.AddACLEntry(context.Background(), relay.ACLEntry{
+			Direction: dir, Action: relay.ACLDeny, Type: relay.ACLIP, Value: ip,
+		}))
+	}
+}
+
+func TestProxy_ForwardedHeaders(t *testing.T) {
+	_, r, cleanup, httpURL := setupRelay(t)
+	defer cleanup()
+	denyIP(t, r, "203.0.113.7")
+
+	query := func(header http.Header) int {
+		resp, _ := postJSON(t, httpURL+"/api/query", []byte(`{"kinds":[1]}`), header)
+		return resp.StatusCode
+	}
+
+	// The test client connects from loopback, which is trusted by default
+	assert.Equal(t, http.StatusForbidden, query(http.Header{"X-Forwarded-For": {"203.0.113.7"}}))
+	assert.Equal(t, http.StatusForbidden, query(http.Header{"Forwarded": {"for=203.0.113.7;proto=https"}}))
+	// Entries left of the first untrusted hop are the client's own claims
+	assert.Equal(t, http.StatusOK, query(http.Header{"X-Forwarded-For": {"203.0.113.7, 198.51.100.1"}}))
+
+	// Headers from untrusted peers are ignored
+	require.NoError(t, r.SetTrustedProxies(nil))
+	assert.Equal(t, http.StatusOK, query(http.Header{"X-Forwarded-For": {"203.0.113.7"}}))
+}
+
+func TestProxy_ProxyProtocol(t *testing.T) {
+	r := relay.New(memory.New())
+	r.SetProxyProtocol(true)
+	denyIP(t, r, "203.0.113.7")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	go r.Start(addr)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		r.Shutdown(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+
+	query := func(proxyHeader string) int {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		body := `{"kinds":[1]}`
+		_, err = fmt.Fprintf(conn, "%sPOST /api/query HTTP/1.1\r\nHost: relay\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+			proxyHeader, len(body), body)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, query("PROXY TCP4 203.0.113.7 127.0.0.1 56324 80\r\n"))
+	assert.Equal(t, http.StatusOK, query("PROXY TCP4 198.51.100.1 127.0.0.1 56324 80\r\n"))
+	assert.Equal(t, http.StatusOK, query(""), "the header is optional")
+}
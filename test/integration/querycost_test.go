@@ -0,0 +1,71 @@
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryCost_Budget(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+	r.SetCostBudget(&event.CostBudget{
+		MaxRequestCost:    event.DefaultMaxRequestCost,
+		MaxConnectionCost: event.DefaultMaxConnectionCost,
+		ClampWindow:       event.DefaultClampWindow,
+	})
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// One event from 2009 and one from now
+	kp := testutil.MustGenerateKeyPair()
+	old, err := testutil.NewTestEventWithKey(kp, 1, "old", nil)
+	require.NoError(t, err)
+	recent := &event.Event{Kind: 1, Content: "recent", Tags: [][]string{}, CreatedAt: time.Now().Unix()}
+	require.NoError(t, kp.SignEvent(recent))
+
+	for _, evt := range []*event.Event{old, recent} {
+		require.NoError(t, client.SendEvent(evt))
+		accepted, msg, err := client.ExpectOK(evt.ID, 2*time.Second)
+		require.NoError(t, err)
+		require.True(t, accepted, msg)
+	}
+
+	t.Run("unbounded broad filter is clamped", func(t *testing.T) {
+		require.NoError(t, client.SendReq("broad", &event.Filter{}))
+		events, err := client.CollectEvents("broad", 2*time.Second)
+		require.NoError(t, err)
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, recent.ID, events[0].ID)
+		}
+	})
+
+	t.Run("selective filter is not clamped", func(t *testing.T) {
+		require.NoError(t, client.SendReq("author", &event.Filter{Authors: []string{kp.PubKeyHex}}))
+		events, err := client.CollectEvents("author", 2*time.Second)
+		require.NoError(t, err)
+		assert.Len(t, events, 2)
+	})
+
+	t.Run("bounded broad filter is blocked", func(t *testing.T) {
+		since := int64(0)
+		require.NoError(t, client.SendReq("too-broad", &event.Filter{Authors: []string{"a"}, Since: &since}))
+		reason, err := client.ExpectClosed("too-broad", 2*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "blocked: filter too broad", reason)
+	})
+
+	t.Run("COUNT is budgeted too", func(t *testing.T) {
+		since := int64(0)
+		require.NoError(t, client.SendCountMessage("count-broad", &event.Filter{Since: &since}))
+		reason, err := client.ExpectClosed("count-broad", 2*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "blocked: filter too broad", reason)
+	})
+}
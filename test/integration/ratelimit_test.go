@@ -8,8 +8,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/paul/glienicke/internal/testutil"
 	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/relay"
 )
 
 func TestReqRateLimiting(t *testing.T) {
@@ -77,6 +80,47 @@ func TestReqRateLimiting(t *testing.T) {
 	t.Logf("Results: %d succeeded, %d rate-limited", succeeded, rateLimited)
 }
 
+func TestRateLimit_RotatingAuthKeys(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+	r.SetRateLimits(relay.RateLimits{
+		Enabled:       true,
+		EventsPerSec:  10,
+		ReqPerSec:     10,
+		Burst:         1,
+		Authenticated: relay.MessageRates{Reqs: 2},
+		Escalation:    relay.Escalation{Violations: 1000},
+	})
+
+	// Every connection authenticates with a fresh key, but they share the
+	// authenticated rate of their address
+	var reasons []string
+	for i := 0; i < 5; i++ {
+		client := authedClient(t, url, testutil.MustGenerateKeyPair())
+		subID := fmt.Sprintf("rotating-%d", i)
+		if err := client.SendReq(subID, &event.Filter{Kinds: []int{1}}); err != nil {
+			t.Fatalf("Failed to send REQ: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			msg, err := client.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read response to REQ %d: %v", i, err)
+			}
+			if msg[0] == "EOSE" {
+				break
+			}
+			if msg[0] == "CLOSED" {
+				reasons = append(reasons, msg[2].(string))
+				break
+			}
+		}
+	}
+	if assert.NotEmpty(t, reasons, "expected REQs with rotating keys to be rate limited") {
+		assert.True(t, strings.HasPrefix(reasons[0], "rate-limited:"), reasons[0])
+	}
+}
+
 func TestRateLimitMetricsInHealth(t *testing.T) {
 	_, _, cleanup, baseURL := setupRelay(t)
 	defer cleanup()
@@ -5,10 +5,16 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
 	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/internal/store/sqlite"
 	"github.com/paul/glienicke/internal/testutil"
 	"github.com/paul/glienicke/pkg/event"
 	"github.com/paul/glienicke/pkg/relay"
@@ -57,6 +63,45 @@ func setupRelay(t *testing.T) (string, *relay.Relay, func(), string) {
 	return wsURL, r, cleanup, httpURL
 }
 
+// serveRelay serves r until the test ends and returns its WebSocket URL
+func serveRelay(t *testing.T, r *relay.Relay) string {
+	t.Helper()
+	srv := httptest.NewServer(r.GetMux())
+	t.Cleanup(func() {
+		srv.Close()
+		r.Close()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+}
+
+// authedClient connects and authenticates as kp
+func authedClient(t *testing.T, url string, kp *testutil.KeyPair) *testutil.WSClient {
+	t.Helper()
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	auth, err := testutil.NewTestEventWithKey(kp, 22242, "integration test", nil)
+	require.NoError(t, err)
+	require.NoError(t, client.SendEvent(auth))
+	accepted, msg, err := client.ExpectOK(auth.ID, 2*time.Second)
+	require.NoError(t, err)
+	require.True(t, accepted, msg)
+	return client
+}
+
+// forEachStore runs a test against a fresh relay on each store backend
+func forEachStore(t *testing.T, test func(t *testing.T, r *relay.Relay)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, relay.New(memory.New()))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := sqlite.New(filepath.Join(t.TempDir(), "relay.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		test(t, relay.New(store))
+	})
+}
+
 func TestEventMessage(t *testing.T) {
 	url, _, cleanup, _ := setupRelay(t)
 	defer cleanup()
@@ -306,6 +351,116 @@ func TestEventBroadcast(t *testing.T) {
 	t.Log("Event broadcast working correctly")
 }
 
+func TestEventBroadcast_AllMatchingSubscriptions(t *testing.T) {
+	url, _, cleanup, _ := setupRelay(t)
+	defer cleanup()
+
+	subscriber, err := testutil.NewWSClient(url)
+	if err != nil {
+		t.Fatalf("Failed to connect subscriber: %v", err)
+	}
+	defer subscriber.Close()
+
+	publisher, err := testutil.NewWSClient(url)
+	if err != nil {
+		t.Fatalf("Failed to connect publisher: %v", err)
+	}
+	defer publisher.Close()
+
+	kp := testutil.MustGenerateKeyPair()
+
+	// Two subscriptions on the same connection that both match the event
+	if err := subscriber.SendReq("by-kind", &event.Filter{Kinds: []int{1}}); err != nil {
+		t.Fatalf("Failed to send REQ: %v", err)
+	}
+	if err := subscriber.ExpectEOSE("by-kind", 2*time.Second); err != nil {
+		t.Fatalf("Failed to receive EOSE: %v", err)
+	}
+	if err := subscriber.SendReq("by-author", &event.Filter{Authors: []string{kp.PubKeyHex}}); err != nil {
+		t.Fatalf("Failed to send REQ: %v", err)
+	}
+	if err := subscriber.ExpectEOSE("by-author", 2*time.Second); err != nil {
+		t.Fatalf("Failed to receive EOSE: %v", err)
+	}
+
+	evt, err := testutil.NewTestEventWithKey(kp, 1, "Delivered twice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create event: %v", err)
+	}
+	if err := publisher.SendEvent(evt); err != nil {
+		t.Fatalf("Failed to send event: %v", err)
+	}
+
+	received := map[string]bool{}
+	subscriber.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(received) < 2 {
+		msg, err := subscriber.ReadMessage()
+		if err != nil {
+			t.Fatalf("Expected the event on both subscriptions, got %v: %v", received, err)
+		}
+		if len(msg) >= 3 && msg[0] == "EVENT" {
+			received[msg[1].(string)] = true
+		}
+	}
+
+	if !received["by-kind"] || !received["by-author"] {
+		t.Errorf("Expected delivery on by-kind and by-author, got %v", received)
+	}
+}
+
+func TestEventBroadcast_PreservesOrder(t *testing.T) {
+	url, _, cleanup, _ := setupRelay(t)
+	defer cleanup()
+
+	subscriber, err := testutil.NewWSClient(url)
+	if err != nil {
+		t.Fatalf("Failed to connect subscriber: %v", err)
+	}
+	defer subscriber.Close()
+
+	publisher, err := testutil.NewWSClient(url)
+	if err != nil {
+		t.Fatalf("Failed to connect publisher: %v", err)
+	}
+	defer publisher.Close()
+
+	if err := subscriber.SendReq("ordered", &event.Filter{Kinds: []int{1}}); err != nil {
+		t.Fatalf("Failed to send REQ: %v", err)
+	}
+	if err := subscriber.ExpectEOSE("ordered", 2*time.Second); err != nil {
+		t.Fatalf("Failed to receive EOSE: %v", err)
+	}
+
+	// Publish back to back without waiting for OK; stays under the rate limit burst
+	kp := testutil.MustGenerateKeyPair()
+	var sent []string
+	for i := 0; i < 15; i++ {
+		evt, err := testutil.NewTestEventWithKey(kp, 1, fmt.Sprintf("Message %d", i), nil)
+		if err != nil {
+			t.Fatalf("Failed to create event: %v", err)
+		}
+		if err := publisher.SendEvent(evt); err != nil {
+			t.Fatalf("Failed to send event: %v", err)
+		}
+		sent = append(sent, evt.ID)
+	}
+
+	subscriber.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for i, id := range sent {
+		msg, err := subscriber.ReadMessage()
+		if err != nil {
+			t.Fatalf("Expected event %d, got error: %v", i, err)
+		}
+		if len(msg) < 3 || msg[0] != "EVENT" {
+			t.Fatalf("Expected EVENT message, got %v", msg)
+		}
+		evtMap, _ := msg[2].(map[string]interface{})
+		if evtMap["id"] != id {
+			t.Fatalf("Event %d delivered out of order: got %v, want %s", i, evtMap["id"], id)
+		}
+	}
+}
+
 func TestMultipleFilters(t *testing.T) {
 	url, _, cleanup, _ := setupRelay(t)
 	defer cleanup()
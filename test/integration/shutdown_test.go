@@ -0,0 +1,81 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/store/memory"
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/relay"
+)
+
+// startRelay serves a relay with Relay.Start, so that Relay.Shutdown owns the server
+func startRelay(t *testing.T) (*relay.Relay, string, <-chan error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	r := relay.New(memory.New())
+	served := make(chan error, 1)
+	go func() { served <- r.Start(addr) }()
+	time.Sleep(100 * time.Millisecond)
+
+	return r, fmt.Sprintf("ws://%s/", addr), served
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	r, url, served := startRelay(t)
+
+	subscriber, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer subscriber.Close()
+	require.NoError(t, subscriber.SendReq("live", &event.Filter{Kinds: []int{1}}))
+	require.NoError(t, subscriber.ExpectEOSE("live", 2*time.Second))
+
+	publisher, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer publisher.Close()
+	evt, _ := testutil.MustNewTestEvent(1, "last words", nil)
+	require.NoError(t, publisher.SendEvent(evt))
+	accepted, msg, err := publisher.ExpectOK(evt.ID, 2*time.Second)
+	require.NoError(t, err)
+	require.True(t, accepted, msg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, r.Shutdown(ctx))
+	assert.ErrorIs(t, <-served, http.ErrServerClosed)
+
+	// The subscriber gets the event published before shutdown, then CLOSED,
+	// a NOTICE and a going-away close frame
+	got, err := subscriber.ExpectEvent("live", 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, evt.ID, got.ID)
+
+	reason, err := subscriber.ExpectClosed("live", 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "error: relay is shutting down", reason)
+
+	notice, err := subscriber.ExpectNotice(2 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "relay is shutting down", notice)
+
+	_, err = subscriber.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "expected going-away close, got %v", err)
+
+	// The listener is closed
+	_, err = testutil.NewWSClient(url)
+	assert.Error(t, err)
+}
@@ -3,9 +3,14 @@ package integration
 import (
 	"encoding/hex"
 	"fmt"
+	"testing"
+	"time"
+
 	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/paul/glienicke/internal/testutil"
 	local_event "github.com/paul/glienicke/pkg/event"
+	"github.com/stretchr/testify/require"
 )
 
 // convertNostrEventToLocalEvent converts a nostr.Event to a local_event.Event
@@ -83,3 +88,20 @@ func xOnlyToCompressed(pubkey string) (string, error) {
 	// Return the hex-encoded compressed public key.
 	return hex.EncodeToString(compressedPubKey), nil
 }
+
+// authenticate completes NIP-42 authentication of client as the owner of secretKey
+func authenticate(t *testing.T, client *testutil.WSClient, secretKey string) {
+	t.Helper()
+	authEvent := &nostr.Event{
+		Kind:      22242,
+		Content:   "integration test",
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{},
+	}
+	require.NoError(t, authEvent.Sign(secretKey))
+	localAuthEvent := convertNostrEventToLocalEvent(authEvent)
+	require.NoError(t, client.SendEvent(localAuthEvent))
+	accepted, msg, err := client.ExpectOK(localAuthEvent.ID, 2*time.Second)
+	require.NoError(t, err)
+	require.True(t, accepted, msg)
+}
@@ -0,0 +1,91 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paul/glienicke/internal/testutil"
+	"github.com/paul/glienicke/pkg/event"
+	"github.com/paul/glienicke/pkg/writepolicy"
+)
+
+// spamPlugin is a strfry-style write-policy plugin: it rejects events whose
+// content starts with "spam", shadow-rejects "shadow" and accepts the rest
+const spamPlugin = `#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed 's/.*"event":{"id":"\([0-9a-f]*\)".*/\1/')
+  case "$line" in
+    *'"content":"spam'*) echo "{\"id\":\"$id\",\"action\":\"reject\",\"msg\":\"blocked: spam detected\"}" ;;
+    *'"content":"shadow'*) echo "{\"id\":\"$id\",\"action\":\"shadowReject\",\"msg\":\"\"}" ;;
+    *) echo "{\"id\":\"$id\",\"action\":\"accept\",\"msg\":\"\"}" ;;
+  esac
+done
+`
+
+func writePlugin(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugin.sh")
+	require.NoError(t, os.WriteFile(path, []byte(script), 0755))
+	return path
+}
+
+func TestWritePolicy_Plugin(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+	require.NoError(t, r.SetWritePolicy(writePlugin(t, spamPlugin), writepolicy.Options{}))
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	kp := testutil.MustGenerateKeyPair()
+	publishContent := func(content string) (*event.Event, bool, string) {
+		evt, err := testutil.NewTestEventWithKey(kp, 1, content, nil)
+		require.NoError(t, err)
+		accepted, msg := publish(t, client, evt)
+		return evt, accepted, msg
+	}
+
+	kept, accepted, msg := publishContent("hello")
+	assert.True(t, accepted, msg)
+
+	_, accepted, msg = publishContent("spam spam spam")
+	assert.False(t, accepted)
+	assert.Equal(t, "blocked: spam detected", msg)
+
+	// Shadow-rejected events look accepted but are not stored
+	_, accepted, msg = publishContent("shadow")
+	assert.True(t, accepted, msg)
+
+	require.NoError(t, client.SendReq("mine", &event.Filter{Authors: []string{kp.PubKeyHex}}))
+	events, err := client.CollectEvents("mine", 2*time.Second)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, kept.ID, events[0].ID)
+}
+
+func TestWritePolicy_FailClosedAndOpen(t *testing.T) {
+	url, r, cleanup, _ := setupRelay(t)
+	defer cleanup()
+	broken := writePlugin(t, "#!/bin/sh\nexit 1\n")
+	require.NoError(t, r.SetWritePolicy(broken, writepolicy.Options{}))
+
+	client, err := testutil.NewWSClient(url)
+	require.NoError(t, err)
+	defer client.Close()
+
+	evt, _ := testutil.MustNewTestEvent(1, "hello", nil)
+	accepted, msg := publish(t, client, evt)
+	assert.False(t, accepted)
+	assert.Equal(t, "error: write policy unavailable", msg)
+
+	require.NoError(t, r.SetWritePolicy(broken, writepolicy.Options{FailOpen: true}))
+	evt, _ = testutil.MustNewTestEvent(1, "hello again", nil)
+	accepted, msg = publish(t, client, evt)
+	assert.True(t, accepted, msg)
+}